@@ -0,0 +1,183 @@
+// Package caskarchive reads and writes self-describing archives of blocks,
+// which carry trees between stores that share no network.
+//
+// An archive begins with a header, the magic line "cask archive", the number
+// of roots as a 32 bit big-endian integer, and the hash of each root.
+// Records of blocks follow, each a 32 byte hash, a 16 bit big-endian length,
+// and the content of the block with its trailing zeroes trimmed.
+//
+// Records follow the order of the bill of materials of each root, a depth
+// first traversal in which every block appears once, before the blocks it
+// links.
+// So, an importer can verify each block as it arrives, and reject a block
+// that no prior block links.
+package caskarchive
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"borkshop/cask"
+	"borkshop/cask/io"
+)
+
+const magic = "cask archive\n"
+
+var (
+	// ErrFormat indicates that a stream does not begin with the header of an
+	// archive.
+	ErrFormat = errors.New("not a cask archive")
+	// ErrUnexpected indicates a record of a block that neither a root nor a
+	// prior block links, or a block that appears twice.
+	ErrUnexpected = errors.New("archive has a block that no prior block links")
+	// ErrIncomplete indicates that an archive ends without some of the blocks
+	// that its roots reach.
+	ErrIncomplete = errors.New("archive lacks linked blocks")
+)
+
+// Export writes an archive of the given roots and every block they reach,
+// and returns the number of blocks it wrote.
+func Export(ctx context.Context, store cask.Store, w io.Writer, roots ...cask.Hash) (int, error) {
+	bw := bufio.NewWriter(w)
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(roots)))
+	bw.WriteString(magic)
+	bw.Write(header[:])
+	for _, root := range roots {
+		bw.Write(root[:])
+	}
+
+	e := &exporter{
+		store: store,
+		w:     bw,
+		seen:  make(map[cask.Hash]struct{}),
+	}
+	for _, root := range roots {
+		if err := e.export(ctx, root); err != nil {
+			return len(e.seen), err
+		}
+	}
+	return len(e.seen), bw.Flush()
+}
+
+type exporter struct {
+	store cask.Store
+	w     *bufio.Writer
+	seen  map[cask.Hash]struct{}
+}
+
+func (e *exporter) export(ctx context.Context, hash cask.Hash) error {
+	if _, ok := e.seen[hash]; ok {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	e.seen[hash] = struct{}{}
+
+	var block cask.Block
+	if err := e.store.Load(ctx, hash, &block); err != nil {
+		return fmt.Errorf("cannot export block %x: %v", hash, err)
+	}
+	content := bytes.TrimRight(block[:], "\x00")
+	var length [2]byte
+	binary.BigEndian.PutUint16(length[:], uint16(len(content)))
+	e.w.Write(hash[:])
+	e.w.Write(length[:])
+	if _, err := e.w.Write(content); err != nil {
+		return err
+	}
+
+	for _, link := range block.Links() {
+		if err := e.export(ctx, link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportReport summarizes an import.
+type ImportReport struct {
+	// Roots are the roots of the archive.
+	Roots []cask.Hash
+	// Blocks is the number of blocks the import stored.
+	Blocks int
+}
+
+// Import reads an archive and writes its blocks to a store.
+//
+// Import verifies that every block matches its hash, that a root or a prior
+// block links every block, and that the archive holds every block its roots
+// reach.
+// Import stores each block as soon as it verifies, so a store may retain
+// some blocks of an archive that fails, until a garbage collection.
+func Import(ctx context.Context, store cask.Store, r io.Reader) (*ImportReport, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(magic)+4)
+	if _, err := io.ReadFull(br, header); err != nil || string(header[:len(magic)]) != magic {
+		return nil, ErrFormat
+	}
+	count := binary.BigEndian.Uint32(header[len(magic):])
+
+	report := &ImportReport{}
+	expected := make(map[cask.Hash]struct{})
+	for i := uint32(0); i < count; i++ {
+		var root cask.Hash
+		if _, err := io.ReadFull(br, root[:]); err != nil {
+			return nil, ErrFormat
+		}
+		report.Roots = append(report.Roots, root)
+		expected[root] = struct{}{}
+	}
+
+	received := make(map[cask.Hash]struct{})
+	var record [cask.HashSize + 2]byte
+	for {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if _, err := io.ReadFull(br, record[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			return report, fmt.Errorf("%w: truncated record", ErrIncomplete)
+		}
+		var hash cask.Hash
+		copy(hash[:], record[:])
+		length := int(binary.BigEndian.Uint16(record[cask.HashSize:]))
+		if length > cask.BlockSize {
+			return report, fmt.Errorf("%w: record of %x exceeds block size", ErrFormat, hash)
+		}
+		var block cask.Block
+		if _, err := io.ReadFull(br, block[:length]); err != nil {
+			return report, fmt.Errorf("%w: truncated record", ErrIncomplete)
+		}
+
+		if _, ok := expected[hash]; !ok {
+			return report, fmt.Errorf("%w: %x", ErrUnexpected, hash)
+		}
+		if block.Hash() != hash {
+			return report, fmt.Errorf("%w: %x", caskio.ErrHashMismatch, hash)
+		}
+		delete(expected, hash)
+		received[hash] = struct{}{}
+		for _, link := range block.Links() {
+			if _, ok := received[link]; !ok {
+				expected[link] = struct{}{}
+			}
+		}
+		if err := store.Store(ctx, hash, &block); err != nil {
+			return report, err
+		}
+		report.Blocks++
+	}
+
+	if len(expected) > 0 {
+		return report, fmt.Errorf("%w: missing %d blocks", ErrIncomplete, len(expected))
+	}
+	return report, nil
+}
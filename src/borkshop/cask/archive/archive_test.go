@@ -0,0 +1,89 @@
+package caskarchive_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"borkshop/cask"
+	"borkshop/cask/archive"
+	"borkshop/cask/blob"
+	"borkshop/cask/dir"
+	"borkshop/cask/diskstore"
+	"borkshop/cask/io"
+	"borkshop/cask/memstore"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/osfs"
+)
+
+func export(t *testing.T) (*bytes.Buffer, cask.Store, []cask.Hash) {
+	ctx := context.Background()
+	store := caskmemstore.New()
+	tree, err := caskdir.Store(ctx, store, osfs.New(".."), "testdata")
+	require.NoError(t, err)
+	blob, err := caskblob.WriteString(ctx, store, "hello")
+	require.NoError(t, err)
+	roots := []cask.Hash{tree, blob}
+
+	var buf bytes.Buffer
+	blocks, err := caskarchive.Export(ctx, store, &buf, roots...)
+	require.NoError(t, err)
+	bom, err := caskio.BOM(ctx, store, tree)
+	require.NoError(t, err)
+	assert.Equal(t, len(bom)+1, blocks)
+	return &buf, store, roots
+}
+
+func TestRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	buf, _, roots := export(t)
+
+	target := &caskdiskstore.Store{Filesystem: memfs.New()}
+	report, err := caskarchive.Import(ctx, target, buf)
+	require.NoError(t, err)
+	assert.Equal(t, roots, report.Roots)
+
+	check, err := caskio.Check(ctx, target, roots...)
+	require.NoError(t, err)
+	assert.Empty(t, check.Damaged)
+	assert.Equal(t, check.Checked, report.Blocks)
+	str, err := caskblob.ReadString(ctx, target, roots[1])
+	require.NoError(t, err)
+	assert.Equal(t, "hello", str)
+}
+
+func TestImportVerifies(t *testing.T) {
+	ctx := context.Background()
+	buf, _, _ := export(t)
+	archive := buf.Bytes()
+	// The header has the magic, the count, and two roots.
+	first := len("cask archive\n") + 4 + 2*cask.HashSize
+
+	for _, test := range []struct {
+		name    string
+		archive []byte
+		err     error
+	}{
+		{"not an archive", []byte("tar"), caskarchive.ErrFormat},
+		{"truncated", archive[:len(archive)-10], caskarchive.ErrIncomplete},
+		{"missing blocks", archive[:first+cask.HashSize+2+100], caskarchive.ErrIncomplete},
+		{"corrupt block", func() []byte {
+			corrupt := append([]byte(nil), archive...)
+			corrupt[first+cask.HashSize+2+40] ^= 1
+			return corrupt
+		}(), caskio.ErrHashMismatch},
+		{"unexpected block", func() []byte {
+			unexpected := append([]byte(nil), archive...)
+			unexpected[first] ^= 1
+			return unexpected
+		}(), caskarchive.ErrUnexpected},
+	} {
+		store := &caskdiskstore.Store{Filesystem: memfs.New()}
+		_, err := caskarchive.Import(ctx, store, bytes.NewReader(test.archive))
+		assert.True(t, errors.Is(err, test.err), "%s: %v", test.name, err)
+	}
+}
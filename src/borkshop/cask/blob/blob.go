@@ -24,6 +24,7 @@ func WriteString(ctx context.Context, store cask.Store, str string) (cask.Hash,
 }
 
 // Read reads all of the bytes of the addressed blob.
+// Open provides access to parts of a blob without reading all of it.
 func Read(ctx context.Context, store cask.Store, hash cask.Hash) ([]byte, error) {
 	buf := bytes.NewBuffer(nil)
 	if err := Load(ctx, store, buf, hash); err != nil {
@@ -44,21 +45,57 @@ func ReadString(ctx context.Context, store cask.Store, hash cask.Hash) (string,
 // Store reads a stream and writes the corresponding B-tree of 1KB blocks to a
 // content address store, returning the hash of the root block.
 func Store(ctx context.Context, store cask.Store, reader io.Reader) (cask.Hash, error) {
-	writer := caskio.NewWriter(store)
+	return StoreConfig{}.Store(ctx, store, reader)
+}
+
+// StoreConfig captures the options for storing a blob.
+type StoreConfig struct {
+	// ContentDefined chooses the boundaries between blocks by their content
+	// rather than by their offset, so that inserting or removing bytes only
+	// changes the blocks near the edit, and edited versions of a blob share
+	// most of their blocks.
+	// The same content has a different hash with and without content defined
+	// chunking, unless the chunker leaves it in a single leaf, as it always
+	// does content shorter than the minimum leaf size of 256 bytes.
+	// Longer content may divide into several leaves even if it would fit in
+	// a single block.
+	ContentDefined bool
+}
+
+// Store reads a stream and writes the corresponding B-tree of 1KB blocks to a
+// content address store, returning the hash of the root block.
+func (c StoreConfig) Store(ctx context.Context, store cask.Store, reader io.Reader) (cask.Hash, error) {
+	var write func([]byte) error
+	var sum func() (cask.Hash, error)
+	if c.ContentDefined {
+		chunker := newChunker(ctx, store)
+		write, sum = chunker.write, chunker.sum
+	} else {
+		writer := caskio.NewWriter(store)
+		write = func(buf []byte) error {
+			return writer.Copy(ctx, buf)
+		}
+		sum = func() (cask.Hash, error) {
+			return writer.Sum(ctx)
+		}
+	}
+
+	var buf [storeBlobBufferSize]byte
 	for {
-		var buf [storeBlobBufferSize]byte
 		n, err := reader.Read(buf[:])
+		if n > 0 {
+			if err := write(buf[:n]); err != nil {
+				return cask.ZeroHash, err
+			}
+		}
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
 			return cask.ZeroHash, fmt.Errorf("read error: %s", err)
 		}
-		if err := writer.Copy(ctx, buf[:n]); err != nil {
-			return cask.ZeroHash, err
-		}
 	}
-	return writer.Sum(ctx)
+	return sum()
 }
 
 // Load reads the blocks of an object from the given content address store and
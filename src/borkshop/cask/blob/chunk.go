@@ -0,0 +1,155 @@
+package caskblob
+
+import (
+	"context"
+	"encoding/binary"
+	"math/bits"
+
+	"borkshop/cask"
+)
+
+// Content defined blobs divide content into leaves where a rolling hash of
+// the preceding window of bytes matches a pattern, within the bounds of a
+// minimum leaf size and the capacity of a block.
+// Interior blocks end after a child whose hash matches a pattern, or when
+// they are full, so the shape of the whole tree depends only on the content
+// and an edit only changes the blocks along the paths to the edited leaves.
+//
+// Interior blocks of content defined blobs record the cumulative size of
+// their children, for random access, as 8 bytes per link.
+//
+//	height:1 > 0
+//	links:32*n = children...
+//	bytes:8*n = end offset of each child
+const (
+	chunkWindow  = 64
+	minLeafSize  = 256
+	leafMask     = 1<<9 - 1
+	sizedFanout  = (cask.BlockSize - 4) / (cask.HashSize + 8)
+	interiorMask = 1<<4 - 1
+)
+
+// buzTable maps bytes to the random values the rolling hash combines.
+// The table determines the hashes of content defined blobs, so it must never
+// change.
+var buzTable = func() (table [256]uint32) {
+	// SplitMix64 from a fixed seed.
+	x := uint64(0x636173b)
+	for i := range table {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		table[i] = uint32(z ^ z>>31)
+	}
+	return table
+}()
+
+type chunk struct {
+	hash cask.Hash
+	size int64
+}
+
+// chunker writes a content defined blob, keeping the pending leaf and the
+// pending children of an interior block at each height.
+type chunker struct {
+	ctx    context.Context
+	store  cask.Store
+	window [chunkWindow]byte
+	total  int64
+	roll   uint32
+	leaf   []byte
+	levels [][]chunk
+}
+
+func newChunker(ctx context.Context, store cask.Store) *chunker {
+	return &chunker{
+		ctx:   ctx,
+		store: store,
+		leaf:  make([]byte, 0, leafSize),
+	}
+}
+
+func (c *chunker) write(buf []byte) error {
+	for _, b := range buf {
+		// Buzhash, a cyclic polynomial rolling hash.
+		i := c.total % chunkWindow
+		c.roll = bits.RotateLeft32(c.roll, 1) ^ buzTable[b]
+		if c.total >= chunkWindow {
+			c.roll ^= bits.RotateLeft32(buzTable[c.window[i]], chunkWindow%32)
+		}
+		c.window[i] = b
+		c.total++
+
+		c.leaf = append(c.leaf, b)
+		if len(c.leaf) == leafSize || (len(c.leaf) >= minLeafSize && c.roll&leafMask == 0) {
+			if err := c.flushLeaf(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *chunker) flushLeaf() error {
+	model := cask.Model{Bytes: c.leaf}
+	hash, err := model.Store(c.ctx, c.store)
+	if err != nil {
+		return err
+	}
+	size := int64(len(c.leaf))
+	c.leaf = c.leaf[:0]
+	return c.push(0, chunk{hash: hash, size: size})
+}
+
+// push adds a child to the pending interior block at the given level, where
+// level 0 holds the parents of leaves.
+func (c *chunker) push(level int, child chunk) error {
+	if level == len(c.levels) {
+		c.levels = append(c.levels, nil)
+	}
+	c.levels[level] = append(c.levels[level], child)
+	if len(c.levels[level]) == sizedFanout || binary.BigEndian.Uint32(child.hash[:4])&interiorMask == 0 {
+		return c.flushLevel(level)
+	}
+	return nil
+}
+
+func (c *chunker) flushLevel(level int) error {
+	model := cask.Model{Height: level + 1}
+	var end int64
+	for _, child := range c.levels[level] {
+		end += child.size
+		model.AppendLink(child.hash)
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], uint64(end))
+		model.AppendBytes(buf[:])
+	}
+	hash, err := model.Store(c.ctx, c.store)
+	if err != nil {
+		return err
+	}
+	c.levels[level] = c.levels[level][:0]
+	return c.push(level+1, chunk{hash: hash, size: end})
+}
+
+// sum flushes the pending blocks at every level and returns the hash of the
+// root, which is the only block remaining on the highest level.
+func (c *chunker) sum() (cask.Hash, error) {
+	if len(c.leaf) > 0 || c.total == 0 {
+		if err := c.flushLeaf(); err != nil {
+			return cask.ZeroHash, err
+		}
+	}
+	for level := 0; ; level++ {
+		pending := c.levels[level]
+		if level == len(c.levels)-1 && len(pending) == 1 {
+			return pending[0].hash, nil
+		}
+		if len(pending) > 0 {
+			if err := c.flushLevel(level); err != nil {
+				return cask.ZeroHash, err
+			}
+		}
+	}
+}
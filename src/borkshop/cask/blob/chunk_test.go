@@ -0,0 +1,106 @@
+package caskblob_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"borkshop/cask/blob"
+	"borkshop/cask/io"
+	"borkshop/cask/memstore"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var contentDefined = caskblob.StoreConfig{ContentDefined: true}
+
+func TestContentDefined(t *testing.T) {
+	ctx := context.Background()
+	expected, err := ioutil.ReadFile("../testdata/firstredfirstand.txt")
+	require.NoError(t, err)
+	store := caskmemstore.New()
+
+	hash, err := contentDefined.Store(ctx, store, bytes.NewReader(expected))
+	require.NoError(t, err)
+	fixed, err := caskblob.Write(ctx, store, expected)
+	require.NoError(t, err)
+	assert.NotEqual(t, fixed, hash)
+
+	actual, err := caskblob.Read(ctx, store, hash)
+	require.NoError(t, err)
+	assert.Equal(t, expected, actual, "round trip")
+
+	blob, err := caskblob.Open(ctx, store, hash)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(expected)), blob.Size())
+	random := rand.New(rand.NewSource(0))
+	for i := 0; i < 100; i++ {
+		off := random.Int63n(int64(len(expected)) - 3000)
+		buf := make([]byte, random.Intn(3000))
+		_, err := blob.ReadAt(buf, off)
+		require.NoError(t, err)
+		assert.Equal(t, expected[off:off+int64(len(buf))], buf, "read %d bytes at %d", len(buf), off)
+	}
+
+	// Storing the same content again produces the same tree.
+	again, err := contentDefined.Store(ctx, store, bytes.NewReader(expected))
+	require.NoError(t, err)
+	assert.Equal(t, hash, again)
+}
+
+func TestContentDefinedSmall(t *testing.T) {
+	ctx := context.Background()
+	store := caskmemstore.New()
+
+	for _, str := range []string{"", "Hello, World!\n"} {
+		hash, err := contentDefined.Store(ctx, store, bytes.NewReader([]byte(str)))
+		require.NoError(t, err)
+		fixed, err := caskblob.WriteString(ctx, store, str)
+		require.NoError(t, err)
+		assert.Equal(t, fixed, hash, "content shorter than a leaf is the same either way")
+	}
+}
+
+func TestContentDefinedEdits(t *testing.T) {
+	ctx := context.Background()
+	original, err := ioutil.ReadFile("../testdata/firstredfirstand.txt")
+	require.NoError(t, err)
+	store := caskmemstore.New()
+
+	for _, edit := range []struct {
+		name   string
+		config caskblob.StoreConfig
+		edited []byte
+		shared float64
+	}{
+		{"fixed insert", caskblob.StoreConfig{}, append([]byte{'!'}, original...), 0},
+		{"insert", contentDefined, append([]byte{'!'}, original...), 0.9},
+		{"delete", contentDefined, original[1000:], 0.9},
+		{"replace", contentDefined, append(append(append([]byte{}, original[:300000]...), "edit"...), original[300010:]...), 0.9},
+	} {
+		before, err := edit.config.Store(ctx, store, bytes.NewReader(original))
+		require.NoError(t, err)
+		after, err := edit.config.Store(ctx, store, bytes.NewReader(edit.edited))
+		require.NoError(t, err)
+
+		beforeBlocks, err := caskio.BOM(ctx, store, before)
+		require.NoError(t, err)
+		afterBlocks, err := caskio.BOM(ctx, store, after)
+		require.NoError(t, err)
+		shared := 0
+		for hash := range afterBlocks {
+			if _, ok := beforeBlocks[hash]; ok {
+				shared++
+			}
+		}
+		fraction := float64(shared) / float64(len(afterBlocks))
+		assert.True(t, fraction >= edit.shared, "%s shares %d of %d blocks", edit.name, shared, len(afterBlocks))
+
+		actual, err := caskblob.Read(ctx, store, after)
+		require.NoError(t, err)
+		assert.Equal(t, edit.edited, actual, edit.name)
+	}
+}
@@ -0,0 +1,306 @@
+package caskblob
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"borkshop/cask"
+)
+
+// The shape of a blob B-tree follows from how caskio.Writer fills blocks:
+// every leaf holds a full block of content except the last, and every
+// interior block holds as many links as fit except the last on each level.
+// Content defined blobs instead record the sizes of children in their
+// interior blocks.
+const (
+	leafSize = cask.BlockSize - 4
+	fanout   = (cask.BlockSize - 4) / cask.HashSize
+	// maxHeight bounds the height of a blob so that its capacity fits in an
+	// int64.
+	maxHeight = 10
+)
+
+// capacity returns the number of bytes in a full subtree of the given height.
+func capacity(height int) int64 {
+	n := int64(leafSize)
+	for ; height > 0; height-- {
+		n *= fanout
+	}
+	return n
+}
+
+// Blob provides random access to the content of a blob, loading only the
+// blocks along the path to each read.
+//
+// Blob implements io.ReaderAt, io.ReadSeeker, and io.WriterTo.
+// Since those interfaces do not accept a context, every read uses the
+// context given to Open.
+type Blob struct {
+	ctx   context.Context
+	store cask.Store
+	root  cask.Hash
+	size  int64
+
+	// offset is the position for Read and Seek.
+	offset int64
+
+	// mu guards the path of blocks loaded by the most recent read, which
+	// subsequent reads of nearby content reuse.
+	mu   sync.Mutex
+	path []pathBlock
+}
+
+type pathBlock struct {
+	hash  cask.Hash
+	model cask.Model
+}
+
+var (
+	_ io.ReaderAt   = (*Blob)(nil)
+	_ io.ReadSeeker = (*Blob)(nil)
+	_ io.WriterTo   = (*Blob)(nil)
+)
+
+// Open returns a blob for random access to the content addressed by the
+// given hash.
+//
+// Open loads the blocks along the right edge of the tree to find the size of
+// the blob, stopping at the first interior block that records the sizes of
+// its children.
+// Open and reads return an error if they encounter a block that does not fit
+// the shape caskio.Writer produces for blobs, or a size that disagrees with
+// the content.
+func Open(ctx context.Context, store cask.Store, hash cask.Hash) (*Blob, error) {
+	blob := &Blob{
+		ctx:   ctx,
+		store: store,
+		root:  hash,
+	}
+
+	var model cask.Model
+	if err := model.Load(ctx, store, hash); err != nil {
+		return nil, err
+	}
+	if model.Height > maxHeight {
+		return nil, blob.malformed(hash, "is too tall")
+	}
+	for model.Height > 0 {
+		if len(model.Links) == 0 {
+			return nil, blob.malformed(hash, "has an interior block without links")
+		}
+		if ends, ok := childEnds(&model); ok {
+			blob.size += ends[len(ends)-1]
+			return blob, nil
+		}
+		height := model.Height
+		blob.size += int64(len(model.Links)-1) * capacity(height-1)
+		hash = model.Links[len(model.Links)-1]
+		model = cask.Model{}
+		if err := model.Load(ctx, store, hash); err != nil {
+			return nil, err
+		}
+		if model.Height != height-1 {
+			return nil, blob.malformed(hash, "has a block at the wrong height")
+		}
+	}
+	if len(model.Links) > 0 {
+		return nil, blob.malformed(hash, "has a leaf with links")
+	}
+	blob.size += int64(len(model.Bytes))
+	return blob, nil
+}
+
+// Size returns the number of bytes in the blob.
+func (blob *Blob) Size() int64 {
+	return blob.size
+}
+
+// ReadAt reads bytes from the blob starting at the given offset.
+//
+// ReadAt is safe to call concurrently.
+func (blob *Blob) ReadAt(buf []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("caskblob: negative offset")
+	}
+	n := 0
+	for n < len(buf) {
+		if off >= blob.size {
+			return n, io.EOF
+		}
+		leaf, start, err := blob.locate(off)
+		if err != nil {
+			return n, err
+		}
+		copied := copy(buf[n:], leaf[off-start:])
+		n += copied
+		off += int64(copied)
+	}
+	return n, nil
+}
+
+// Read reads bytes from the current offset of the blob.
+func (blob *Blob) Read(buf []byte) (int, error) {
+	n, err := blob.ReadAt(buf, blob.offset)
+	blob.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek sets the offset for the next Read.
+func (blob *Blob) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += blob.offset
+	case io.SeekEnd:
+		offset += blob.size
+	default:
+		return blob.offset, errors.New("caskblob: invalid whence")
+	}
+	if offset < 0 {
+		return blob.offset, errors.New("caskblob: negative offset")
+	}
+	blob.offset = offset
+	return offset, nil
+}
+
+// WriteTo writes the remainder of the blob from the current offset.
+func (blob *Blob) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	for blob.offset < blob.size {
+		leaf, start, err := blob.locate(blob.offset)
+		if err != nil {
+			return total, err
+		}
+		n, err := w.Write(leaf[blob.offset-start:])
+		total += int64(n)
+		blob.offset += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// locate returns the content of the leaf containing the given offset, and the
+// offset of the start of the leaf.
+func (blob *Blob) locate(off int64) ([]byte, int64, error) {
+	blob.mu.Lock()
+	defer blob.mu.Unlock()
+
+	hash := blob.root
+	var start int64
+	// last indicates whether the block is the last on its level of the
+	// subtree that lacks recorded sizes, and want is the size of the block
+	// if known.
+	last := true
+	want := int64(-1)
+	for depth := 0; ; depth++ {
+		model, err := blob.load(depth, hash)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if depth > 0 && model.Height != blob.path[depth-1].model.Height-1 {
+			return nil, 0, blob.malformed(hash, "has a block at the wrong height")
+		}
+		// Every block before the last on its level must be full for the
+		// offsets of later blocks to hold.
+		full := len(model.Links) == fanout
+		if model.Height == 0 {
+			full = len(model.Bytes) == leafSize && len(model.Links) == 0
+		}
+		if !last && !full {
+			return nil, 0, blob.malformed(hash, "has a block that is not full")
+		}
+
+		if model.Height == 0 {
+			if want >= 0 && int64(len(model.Bytes)) != want {
+				return nil, 0, blob.malformed(hash, "has a leaf that disagrees with its size")
+			}
+			if off-start >= int64(len(model.Bytes)) {
+				return nil, 0, blob.malformed(hash, "is shorter than its size")
+			}
+			return model.Bytes, start, nil
+		}
+
+		if ends, ok := childEnds(model); ok {
+			if want >= 0 && ends[len(ends)-1] != want {
+				return nil, 0, blob.malformed(hash, "has a block that disagrees with its size")
+			}
+			i := sort.Search(len(ends), func(i int) bool {
+				return ends[i] > off-start
+			})
+			if i == len(ends) {
+				return nil, 0, blob.malformed(hash, "is shorter than its size")
+			}
+			var prior int64
+			if i > 0 {
+				prior = ends[i-1]
+			}
+			// The child has a known size, so it is the last block on its
+			// level of its own subtree.
+			start += prior
+			last, want = true, ends[i]-prior
+			hash = model.Links[i]
+			continue
+		}
+
+		span := capacity(model.Height - 1)
+		i := int((off - start) / span)
+		if i >= len(model.Links) {
+			return nil, 0, blob.malformed(hash, "is shorter than its size")
+		}
+		start += int64(i) * span
+		last = last && i == len(model.Links)-1
+		want = -1
+		if !last {
+			want = span
+		}
+		hash = model.Links[i]
+	}
+}
+
+// childEnds returns the end offsets of the children of an interior block
+// that records their sizes.
+func childEnds(model *cask.Model) ([]int64, bool) {
+	if len(model.Links) == 0 || len(model.Bytes) != 8*len(model.Links) {
+		return nil, false
+	}
+	ends := make([]int64, len(model.Links))
+	var prior int64
+	for i := range ends {
+		ends[i] = int64(binary.BigEndian.Uint64(model.Bytes[8*i:]))
+		if ends[i] <= prior {
+			return nil, false
+		}
+		prior = ends[i]
+	}
+	return ends, true
+}
+
+// load returns the block at the given depth of the path to the current read,
+// reusing the block from the prior read if it has the same hash.
+func (blob *Blob) load(depth int, hash cask.Hash) (*cask.Model, error) {
+	if depth < len(blob.path) && blob.path[depth].hash == hash {
+		return &blob.path[depth].model, nil
+	}
+	blob.path = blob.path[:depth]
+	var model cask.Model
+	if err := model.Load(blob.ctx, blob.store, hash); err != nil {
+		return nil, err
+	}
+	blob.path = append(blob.path, pathBlock{hash: hash, model: model})
+	return &blob.path[depth].model, nil
+}
+
+func (blob *Blob) malformed(hash cask.Hash, problem string) error {
+	return fmt.Errorf("blob %x %s: block %x", blob.root, problem, hash)
+}
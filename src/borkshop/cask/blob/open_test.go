@@ -0,0 +1,110 @@
+package caskblob_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"borkshop/cask"
+	"borkshop/cask/blob"
+	"borkshop/cask/memstore"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// loadCountingStore counts the blocks loaded from the underlying store.
+type loadCountingStore struct {
+	*caskmemstore.MemStore
+	loads int
+}
+
+func (s *loadCountingStore) Load(ctx context.Context, h cask.Hash, b *cask.Block) error {
+	s.loads++
+	return s.MemStore.Load(ctx, h, b)
+}
+
+func TestOpen(t *testing.T) {
+	ctx := context.Background()
+	expected, err := ioutil.ReadFile("../testdata/firstredfirstand.txt")
+	require.NoError(t, err)
+	store := &loadCountingStore{MemStore: caskmemstore.New()}
+	hash, err := caskblob.Write(ctx, store, expected)
+	require.NoError(t, err)
+
+	blob, err := caskblob.Open(ctx, store, hash)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(expected)), blob.Size())
+
+	// Reads load only the blocks along their path.
+	random := rand.New(rand.NewSource(0))
+	for i := 0; i < 100; i++ {
+		off := random.Int63n(int64(len(expected)))
+		buf := make([]byte, random.Intn(3000))
+		store.loads = 0
+		n, err := blob.ReadAt(buf, off)
+		if off+int64(len(buf)) > int64(len(expected)) {
+			assert.Equal(t, io.EOF, err)
+		} else {
+			require.NoError(t, err)
+		}
+		assert.Equal(t, expected[off:off+int64(n)], buf[:n], "read %d bytes at %d", len(buf), off)
+		assert.True(t, store.loads <= 3*5, "%d loads for %d bytes", store.loads, len(buf))
+	}
+
+	// Seeking and reading.
+	pos, err := blob.Seek(-100, io.SeekEnd)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(expected)-100), pos)
+	tail, err := ioutil.ReadAll(blob)
+	require.NoError(t, err)
+	assert.Equal(t, expected[len(expected)-100:], tail)
+
+	_, err = blob.Seek(1000, io.SeekStart)
+	require.NoError(t, err)
+	_, err = blob.Seek(1000, io.SeekCurrent)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	_, err = io.Copy(&buf, blob)
+	require.NoError(t, err)
+	assert.Equal(t, expected[2000:], buf.Bytes())
+}
+
+func TestOpenSmall(t *testing.T) {
+	ctx := context.Background()
+	store := caskmemstore.New()
+
+	for _, str := range []string{"", "Hello, World!\n"} {
+		hash, err := caskblob.WriteString(ctx, store, str)
+		require.NoError(t, err)
+		blob, err := caskblob.Open(ctx, store, hash)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(str)), blob.Size())
+		content, err := ioutil.ReadAll(blob)
+		require.NoError(t, err)
+		assert.Equal(t, str, string(content))
+	}
+}
+
+func TestOpenMalformed(t *testing.T) {
+	ctx := context.Background()
+	store := caskmemstore.New()
+
+	// A tree whose first leaf is not full does not have the shape of a
+	// blob.
+	short, err := caskblob.WriteString(ctx, store, "short")
+	require.NoError(t, err)
+	full, err := caskblob.Write(ctx, store, bytes.Repeat([]byte{'x'}, cask.BlockSize-4))
+	require.NoError(t, err)
+	root := cask.Model{Height: 1, Links: []cask.Hash{short, full}}
+	hash, err := root.Store(ctx, store)
+	require.NoError(t, err)
+
+	blob, err := caskblob.Open(ctx, store, hash)
+	require.NoError(t, err)
+	_, err = blob.ReadAt(make([]byte, 10), 0)
+	assert.Error(t, err)
+}
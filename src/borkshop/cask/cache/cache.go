@@ -0,0 +1,299 @@
+// Package caskcache provides a content address store that layers fast stores
+// over slow stores, such as memory over disk over a remote peer.
+//
+// The first tier of the store is a cache of recently used blocks, which the
+// store bounds with least-recently-used eviction.
+// Loads read through the tiers, from fastest to slowest, and copy the block
+// into every faster tier on the way back.
+// Stores write through to every tier, or write back to the slower tiers only
+// when the cache evicts a block or the store flushes.
+package caskcache
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+
+	"borkshop/cask"
+)
+
+// Policy determines when the store writes blocks to its slower tiers.
+type Policy int
+
+const (
+	// WriteThrough writes every block to every tier before Store returns.
+	WriteThrough Policy = iota
+	// WriteBack writes every block to the cache before Store returns, and to
+	// the slower tiers only when the cache evicts the block or the store
+	// flushes.
+	WriteBack
+)
+
+// ErrNoTiers indicates that a store has no tiers.
+var ErrNoTiers = errors.New("cache store has no tiers")
+
+// ErrNotRemover indicates that the cache of a bounded store cannot evict
+// blocks because it does not implement cask.Remover.
+var ErrNotRemover = errors.New("cache store with a capacity requires a cache tier that removes blocks")
+
+// Store is a CAS block store that reads through and writes to a cache tier
+// and slower tiers.
+//
+// The store serializes access to its cache tier, but loads from the slower
+// tiers proceed concurrently.
+type Store struct {
+	// Tiers are the underlying stores, fastest first.
+	// The first tier is the cache, which should be a store that fails to load
+	// or reports blocks it lacks, rather than one that waits for them, like
+	// caskmemstore, casktempstore, or caskdiskstore.
+	// The last tier should contain every block the store ever loads.
+	Tiers []cask.Store
+
+	// Policy determines when the store writes blocks to the slower tiers.
+	Policy Policy
+
+	// Capacity is the most blocks the cache tier retains for the store.
+	// A cache tier with a capacity must implement cask.Remover.
+	// Zero capacity retains every block.
+	Capacity int
+
+	lock sync.Mutex
+	// recent lists the cached blocks, most recently used first.
+	recent  list.List
+	entries map[cask.Hash]*list.Element
+}
+
+var _ cask.Store = (*Store)(nil)
+var _ cask.Checker = (*Store)(nil)
+
+// entry is a block in the cache tier.
+type entry struct {
+	hash cask.Hash
+	// dirty indicates that the store has not yet written the block to the
+	// slower tiers.
+	dirty bool
+}
+
+// Store writes a block to the cache, and to the slower tiers if the policy
+// writes through.
+func (s *Store) Store(ctx context.Context, h cask.Hash, b *cask.Block) error {
+	if len(s.Tiers) == 0 {
+		return ErrNoTiers
+	}
+	dirty := s.Policy == WriteBack
+	if !dirty {
+		if err := s.storeSlow(ctx, h, b, len(s.Tiers)); err != nil {
+			return err
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.admit(ctx, h, b, dirty)
+}
+
+// Load reads a block from the fastest tier that contains it, and writes the
+// block to every faster tier.
+func (s *Store) Load(ctx context.Context, h cask.Hash, b *cask.Block) error {
+	if len(s.Tiers) == 0 {
+		return ErrNoTiers
+	}
+	if ok, err := s.loadCache(ctx, h, b); err != nil || ok {
+		return err
+	}
+
+	var err error
+	for i := 1; i < len(s.Tiers); i++ {
+		tier := s.Tiers[i]
+		if checker, ok := tier.(cask.Checker); ok && i < len(s.Tiers)-1 {
+			if have, hasErr := checker.Has(ctx, []cask.Hash{h}); hasErr != nil || !have[0] {
+				continue
+			}
+		}
+		if err = tier.Load(ctx, h, b); err != nil {
+			continue
+		}
+
+		if err := s.storeSlow(ctx, h, b, i); err != nil {
+			return err
+		}
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		return s.admit(ctx, h, b, false)
+	}
+	if err == nil {
+		// Only the cache tier could have the block, and it does not.
+		err = s.Tiers[0].Load(ctx, h, b)
+	}
+	return err
+}
+
+// Has reports, for each hash, whether any tier contains the block.
+//
+// A block in the cache has its transitive links in the cache or in the slower
+// tiers, so the store as a whole contains the subtree of every block it
+// reports.
+// Tiers that are not checkers never report a block.
+func (s *Store) Has(ctx context.Context, hs []cask.Hash) ([]bool, error) {
+	have := make([]bool, len(hs))
+	s.lock.Lock()
+	for i, h := range hs {
+		_, have[i] = s.entries[h]
+	}
+	s.lock.Unlock()
+
+	for _, tier := range s.Tiers {
+		checker, ok := tier.(cask.Checker)
+		if !ok {
+			continue
+		}
+		var lacking []cask.Hash
+		var indexes []int
+		for i, h := range hs {
+			if !have[i] {
+				lacking = append(lacking, h)
+				indexes = append(indexes, i)
+			}
+		}
+		if len(lacking) == 0 {
+			break
+		}
+		found, err := checker.Has(ctx, lacking)
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range indexes {
+			have[i] = found[j]
+		}
+	}
+	return have, nil
+}
+
+// Flush writes every block that the store has not yet written back to the
+// slower tiers, least recently used first.
+func (s *Store) Flush(ctx context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for element := s.recent.Back(); element != nil; element = element.Prev() {
+		if err := s.writeBack(ctx, element.Value.(*entry)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadCache reads a block from the cache tier, if it contains the block, and
+// marks the block as recently used.
+func (s *Store) loadCache(ctx context.Context, h cask.Hash, b *cask.Block) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if element, ok := s.entries[h]; ok {
+		if err := s.Tiers[0].Load(ctx, h, b); err != nil {
+			// Something other than the store removed the block from the
+			// cache, so forget it, unless only the cache has it.
+			if element.Value.(*entry).dirty {
+				return false, err
+			}
+			s.forget(element)
+			return false, nil
+		}
+		s.recent.MoveToFront(element)
+		return true, nil
+	}
+
+	// The cache may contain blocks from before the store began to use it.
+	checker, ok := s.Tiers[0].(cask.Checker)
+	if !ok {
+		return false, nil
+	}
+	if have, err := checker.Has(ctx, []cask.Hash{h}); err != nil || !have[0] {
+		return false, nil
+	}
+	if err := s.Tiers[0].Load(ctx, h, b); err != nil {
+		return false, nil
+	}
+	return true, s.admit(ctx, h, b, false)
+}
+
+// storeSlow writes a block to the tiers between the cache and a tier.
+func (s *Store) storeSlow(ctx context.Context, h cask.Hash, b *cask.Block, until int) error {
+	for _, tier := range s.Tiers[1:until] {
+		if err := tier.Store(ctx, h, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// admit writes a block to the cache tier, marks it as recently used, and
+// evicts the least recently used blocks beyond the capacity.
+//
+// The caller must hold the lock.
+func (s *Store) admit(ctx context.Context, h cask.Hash, b *cask.Block, dirty bool) error {
+	if s.entries == nil {
+		s.entries = make(map[cask.Hash]*list.Element)
+	}
+	if element, ok := s.entries[h]; ok {
+		s.recent.MoveToFront(element)
+		return nil
+	}
+	if err := s.Tiers[0].Store(ctx, h, b); err != nil {
+		return err
+	}
+	s.entries[h] = s.recent.PushFront(&entry{hash: h, dirty: dirty})
+	return s.evict(ctx)
+}
+
+// evict removes the least recently used blocks from the cache tier until it
+// is within capacity, writing back the blocks that only the cache contains.
+//
+// The caller must hold the lock.
+func (s *Store) evict(ctx context.Context) error {
+	if s.Capacity <= 0 || s.recent.Len() <= s.Capacity {
+		return nil
+	}
+	remover, ok := s.Tiers[0].(cask.Remover)
+	if !ok {
+		return ErrNotRemover
+	}
+	for s.recent.Len() > s.Capacity {
+		element := s.recent.Back()
+		entry := element.Value.(*entry)
+		if err := s.writeBack(ctx, entry); err != nil {
+			return err
+		}
+		if err := remover.Remove(ctx, entry.hash); err != nil {
+			return err
+		}
+		s.forget(element)
+	}
+	return nil
+}
+
+// writeBack writes a dirty block from the cache tier to the slower tiers.
+//
+// The caller must hold the lock.
+func (s *Store) writeBack(ctx context.Context, entry *entry) error {
+	if !entry.dirty {
+		return nil
+	}
+	var block cask.Block
+	if err := s.Tiers[0].Load(ctx, entry.hash, &block); err != nil {
+		return err
+	}
+	if err := s.storeSlow(ctx, entry.hash, &block, len(s.Tiers)); err != nil {
+		return err
+	}
+	entry.dirty = false
+	return nil
+}
+
+// forget removes a block from the index of the cache tier.
+//
+// The caller must hold the lock.
+func (s *Store) forget(element *list.Element) {
+	delete(s.entries, element.Value.(*entry).hash)
+	s.recent.Remove(element)
+}
@@ -0,0 +1,164 @@
+package caskcache_test
+
+import (
+	"context"
+	"testing"
+
+	"borkshop/cask"
+	"borkshop/cask/cache"
+	"borkshop/cask/dir"
+	"borkshop/cask/memstore"
+	"borkshop/cask/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/osfs"
+)
+
+// blocks returns distinct blocks and their hashes.
+func blocks(n int) ([]cask.Block, []cask.Hash) {
+	bs := make([]cask.Block, n)
+	hs := make([]cask.Hash, n)
+	for i := range bs {
+		bs[i] = cask.Block{0, 0, 1, 0, byte(i), byte(i >> 8)}
+		hs[i] = bs[i].Hash()
+	}
+	return bs, hs
+}
+
+func TestReadThrough(t *testing.T) {
+	ctx := context.Background()
+	slow := casktest.NewCountingStore()
+	cache := caskmemstore.New()
+	store := &caskcache.Store{Tiers: []cask.Store{cache, slow}}
+
+	hash, err := caskdir.Store(ctx, slow, osfs.New(".."), "testdata/nominal")
+	require.NoError(t, err)
+
+	err = caskdir.Load(ctx, store, memfs.New(), ".", hash)
+	require.NoError(t, err)
+	loads := slow.Loads()
+	assert.NotZero(t, loads)
+
+	// The second load reads every block from the cache.
+	fs := memfs.New()
+	err = caskdir.Load(ctx, store, fs, ".", hash)
+	require.NoError(t, err)
+	assert.Equal(t, loads, slow.Loads())
+
+	again, err := caskdir.Store(ctx, caskmemstore.New(), fs, "")
+	require.NoError(t, err)
+	assert.Equal(t, hash, again)
+}
+
+func TestReadThroughFillsMiddleTiers(t *testing.T) {
+	ctx := context.Background()
+	bs, hs := blocks(1)
+	cache, middle, slow := caskmemstore.New(), caskmemstore.New(), caskmemstore.New()
+	require.NoError(t, slow.Store(ctx, hs[0], &bs[0]))
+	store := &caskcache.Store{Tiers: []cask.Store{cache, middle, slow}}
+
+	var b cask.Block
+	require.NoError(t, store.Load(ctx, hs[0], &b))
+	assert.Equal(t, bs[0], b)
+
+	for _, tier := range []*caskmemstore.MemStore{cache, middle} {
+		have, err := tier.Has(ctx, hs)
+		require.NoError(t, err)
+		assert.Equal(t, []bool{true}, have)
+	}
+}
+
+func TestEvictLeastRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+	bs, hs := blocks(4)
+	cache, slow := caskmemstore.New(), casktest.NewCountingStore()
+	store := &caskcache.Store{Tiers: []cask.Store{cache, slow}, Capacity: 2}
+
+	for i := range bs[:3] {
+		require.NoError(t, slow.MemStore.Store(ctx, hs[i], &bs[i]))
+	}
+	var b cask.Block
+	require.NoError(t, store.Load(ctx, hs[0], &b))
+	require.NoError(t, store.Load(ctx, hs[1], &b))
+	require.NoError(t, store.Load(ctx, hs[0], &b))
+	require.NoError(t, store.Load(ctx, hs[2], &b))
+	assert.Equal(t, int64(3), slow.Loads())
+
+	have, err := cache.Has(ctx, hs[:3])
+	require.NoError(t, err)
+	assert.Equal(t, []bool{true, false, true}, have, "evicts the least recently used block")
+
+	require.NoError(t, store.Load(ctx, hs[1], &b))
+	assert.Equal(t, bs[1], b)
+	assert.Equal(t, int64(4), slow.Loads())
+
+	have, err = store.Has(ctx, hs)
+	require.NoError(t, err)
+	assert.Equal(t, []bool{true, true, true, false}, have)
+}
+
+func TestWriteThrough(t *testing.T) {
+	ctx := context.Background()
+	bs, hs := blocks(3)
+	cache, slow := caskmemstore.New(), casktest.NewCountingStore()
+	store := &caskcache.Store{Tiers: []cask.Store{cache, slow}, Capacity: 2}
+
+	for i := range bs {
+		require.NoError(t, store.Store(ctx, hs[i], &bs[i]))
+	}
+	assert.Equal(t, int64(3), slow.Stores())
+	assert.NoError(t, store.Flush(ctx))
+	assert.Equal(t, int64(3), slow.Stores())
+	assert.Zero(t, slow.Loads())
+}
+
+func TestWriteBack(t *testing.T) {
+	ctx := context.Background()
+	bs, hs := blocks(3)
+	cache, slow := caskmemstore.New(), casktest.NewCountingStore()
+	store := &caskcache.Store{Tiers: []cask.Store{cache, slow}, Policy: caskcache.WriteBack, Capacity: 2}
+
+	require.NoError(t, store.Store(ctx, hs[0], &bs[0]))
+	require.NoError(t, store.Store(ctx, hs[1], &bs[1]))
+	assert.Zero(t, slow.Stores())
+
+	// Evicting the first block writes it back.
+	require.NoError(t, store.Store(ctx, hs[2], &bs[2]))
+	have, err := slow.Has(ctx, hs)
+	require.NoError(t, err)
+	assert.Equal(t, []bool{true, false, false}, have)
+
+	require.NoError(t, store.Flush(ctx))
+	have, err = slow.Has(ctx, hs)
+	require.NoError(t, err)
+	assert.Equal(t, []bool{true, true, true}, have)
+	assert.Equal(t, int64(3), slow.Stores())
+
+	// Flushing again writes nothing.
+	require.NoError(t, store.Flush(ctx))
+	assert.Equal(t, int64(3), slow.Stores())
+}
+
+// plainStore hides every method of a store but Store and Load.
+type plainStore struct {
+	store cask.Store
+}
+
+func (s plainStore) Store(ctx context.Context, h cask.Hash, b *cask.Block) error {
+	return s.store.Store(ctx, h, b)
+}
+
+func (s plainStore) Load(ctx context.Context, h cask.Hash, b *cask.Block) error {
+	return s.store.Load(ctx, h, b)
+}
+
+func TestCapacityRequiresRemover(t *testing.T) {
+	ctx := context.Background()
+	bs, hs := blocks(2)
+	cache := plainStore{caskmemstore.New()}
+	store := &caskcache.Store{Tiers: []cask.Store{cache, caskmemstore.New()}, Capacity: 1}
+
+	require.NoError(t, store.Store(ctx, hs[0], &bs[0]))
+	assert.Equal(t, caskcache.ErrNotRemover, store.Store(ctx, hs[1], &bs[1]))
+}
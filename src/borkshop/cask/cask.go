@@ -8,12 +8,18 @@
 // child blocks.
 //
 // Blobs are a B-tree where leaf blocks contain data without links.
+// Blobs stored with content defined chunking divide their data among leaves
+// by content rather than offset, and their interior blocks also record the
+// sizes of their children.
 //
 // Directories are a B-tree where leaf blocks contain entries, using both links
 // and data to capture the hash, type, and name of each child, ordered by name,
 // and divided among leaf blocks such that each leaf contains as many entries
 // as can fit.
 //
+// Maps are a B-tree of entries ordered by key, divided among blocks by the
+// hashes of their keys, so maps with equal entries have equal root hashes.
+//
 // Cask supports arbitrary block types beyond blobs and directories and only
 // imposes the basic block structure of height, links, and data on all types.
 // This allows us to independently evolve semantics, storage, and transport.
@@ -67,9 +73,10 @@ var ZeroHash = Hash{}
 // Block is a 1 kilobyte block of bytes.
 type Block [BlockSize]byte
 
-// Hash returns the SHA-256 hash of the occupied bytes in the block.
+// Hash returns the SHA-256 hash of the whole block, including the zeroes
+// beyond its occupied bytes, which is the address of the block.
 func (block *Block) Hash() Hash {
-	return Hash(sha256.Sum256(block[:block.Size()]))
+	return Hash(sha256.Sum256(block[:]))
 }
 
 // Size returns the size of the block's effective content.
@@ -117,6 +124,32 @@ type Store interface {
 	Load(context.Context, Hash, *Block) error
 }
 
+// Checker is an optional interface for stores that can report whether they
+// contain blocks without loading them.
+//
+// Has reports on the given blocks alone.
+// A store that contains a block need not contain its links, since stores
+// that expire, evict, or collect blocks one at a time, like casktempstore,
+// caskdiskstore, and any Remover, may drop a link before the block that links
+// it.
+// Transfers like caskio.Sync still skip the subtree of a block the target
+// has, so they complete a tree only in a target that keeps the links of every
+// block it keeps.
+type Checker interface {
+	// Has reports, for each hash, whether the store contains the block.
+	Has(context.Context, []Hash) ([]bool, error)
+}
+
+// Remover is an optional interface for stores that can discard individual
+// blocks, such as the stores that serve as caches.
+//
+// Removing a block may break the subtree of any block that links it, so only
+// a store that another store backs should discard blocks this way.
+type Remover interface {
+	// Remove discards a block, if the store contains it.
+	Remove(context.Context, Hash) error
+}
+
 // Model represents a block, suitable for building and marshalling.
 type Model struct {
 	// Height is the height of the modeled block in the B-tree.
@@ -167,7 +200,7 @@ func (model *Model) Store(ctx context.Context, store Store) (Hash, error) {
 	if err := model.Put(&b); err != nil {
 		return Hash{}, err
 	}
-	k := sha256.Sum256(b[:])
+	k := b.Hash()
 	return k, store.Store(ctx, k, &b)
 }
 
@@ -2,22 +2,35 @@ package main
 
 import (
 	"borkshop/cask"
+	"borkshop/cask/archive"
 	"borkshop/cask/blob"
+	"borkshop/cask/cache"
+	"borkshop/cask/commit"
+	"borkshop/cask/crypt"
 	"borkshop/cask/dir"
 	"borkshop/cask/diskstore"
+	"borkshop/cask/http"
+	"borkshop/cask/io"
 	"borkshop/cask/memstore"
 	"borkshop/cask/net"
+	"borkshop/cask/raft"
+	"borkshop/cask/shard"
+	"bufio"
 	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sort"
 	"strings"
 	"syscall"
+	"time"
 
 	"go.uber.org/multierr"
 	"gopkg.in/src-d/go-billy.v4"
@@ -25,32 +38,170 @@ import (
 )
 
 var usage = `Content Address Store of 1KB Blocks
-cask init [DIR]
+cask init [--pack] [DIR]
   Creates a .cask directory.
   Other commands find the .cask directory in the first parent dir.
-cask store [HOST:PORT] < FILE > HASH
+  With --pack, stores blocks in compressed pack files rather than one file
+  per block, which suits large trees.
+  Converts an existing .cask, whose blocks remain readable until gc moves
+  them into packs.
+Anywhere a HASH is accepted, the name of a pin (or tag) is also accepted.
+If the HASH addresses a commit, commands that expect a directory use the
+commit's tree.
+Commands sent to a peer at HOST:PORT keep up to 64MB of the blocks they use
+in memory, so they load each of those blocks from the peer only once.
+That memory lasts only as long as the command.
+With --cache, they also keep every block they use in the local .cask, so
+that later commands need not load the blocks again, until gc collects the
+blocks that no pin reaches.
+Anywhere a HOST:PORT is accepted, a directory (containing a /), or a comma
+separated list of peers and directories, is also accepted, which spreads
+blocks across them, with two replicas of each block.
+Every command must list the same peers the same way to find their blocks.
+cask store [--cdc] [HOST:PORT] < FILE > HASH
   Stores input to CASK.
+  With --cdc, divides content into blocks by content rather than offset, so
+  that edited versions of a file share most of their blocks.
   Writes the hash.
 cask load [HOST:PORT] HASH[:PATH] > FILE
   Writes out the file for the given hash.
-cask checkin [HOST:PORT] DIR > HASH
+cask checkin [--meta] [--cdc] [HOST:PORT] DIR > HASH
   Stores the given directory in CASK.
+  Only reads files that changed since they were last checked in locally.
+  With --meta, records permissions and modification times, which checkout
+  then restores.
   Writes the hash.
+cask commit [--meta] [--cdc] DIR NAME [MESSAGE] > HASH
+  Stores the given directory in CASK and records a commit with the commit
+  pinned as NAME as its parent, then pins the new commit as NAME.
+  Writes the hash of the commit.
+cask log [HOST:PORT] HASH
+  Writes the history of the given commit, newest first.
 cask checkout [HOST:PORT] DIR HASH[:PATH]
   Writes out the directory tree from CASK to the given path.
+cask watch [--meta] [--cdc] [HOST:PORT] DIR NAME
+  Checks in the given directory, then checks it in again whenever it
+  changes, and pins each new tree as NAME.
+  With HOST:PORT, also sends the blocks of each new tree that the peer
+  lacks, then pins the tree as NAME on the peer too, which must run
+  cask serve --pins.
+  Writes the hash of each new tree.
+cask follow [HOST:PORT] DIR NAME
+  Checks out the tree pinned as NAME to the given directory, then updates
+  the directory whenever the pin changes, writing only the entries that
+  changed.
+  With HOST:PORT, follows the pin on the peer, which must run
+  cask serve --pins, so that cask watch with the same peer replicates a
+  directory one way.
+  With - as NAME, reads a HASH from each line of input instead, so that
+  cask watch on another machine can drive it through a pipe.
+  Writes the hash of each tree it checks out.
 cask ls/list [HOST:PORT] HASH[:PATH]
   Writes the list of entries in the directory with the hash.
+  Each line has the hash, type (f, x, d, or l), permissions and modification
+  time if recorded, and name.
+cask diff [HOST:PORT] HASH[:PATH] HASH[:PATH]
+  Writes the paths of entries that were added (A), removed (D), or
+  modified (M) between two directories.
 cask hash [HOST:PORT] HASH:PATH
   Follows a path from the hash of a directory.
   Writes the hash of the addressed object.
-cask serve [HOST:PORT]
+cask push HOST:PORT HASH[:PATH]
+  Sends the blocks of the given hash that the peer lacks.
+  Writes the hash.
+cask pull HOST:PORT HASH[:PATH]
+  Fetches the blocks of the given hash that the local .cask lacks.
+  Writes the hash.
+cask export [--tar] [HOST:PORT] HASH[:PATH] > FILE
+  Writes an archive of the blocks of the given hash, which import verifies
+  and reads into another .cask without a network.
+  With --tar, writes the given directory as a tar stream instead.
+cask import [HOST:PORT] < FILE
+  Stores the blocks of an archive, verifying that every block matches its
+  hash and that the archive is complete.
+  Writes the hash of each root of the archive.
+cask rebalance [--prune] PEERS PEERS HASH[:PATH]...
+  Copies the blocks of the given hashes from the replicas where the first
+  comma separated list of peers places them to the replicas where the second
+  list places them, after adding or removing peers.
+  With --prune, removes the blocks from directories that no longer hold them.
+  Writes the number of blocks, copied replicas, and removed replicas.
+cask key [KEY]
+  Creates a random secret key in the local .cask, unless it already has one,
+  or records the given key in place of any other, and writes the key.
+  Blocks stored with a key that the local .cask no longer has become
+  unreadable.
+  While the local .cask has a key, commands sent to a peer encrypt the blocks
+  they store there and decrypt the blocks they load.
+  With --keyed, commands that write hashes of blocks sent to a peer write
+  keyed hashes, HASH+KEY, instead.
+  Commands sent to a peer accept a keyed hash anywhere they accept a HASH,
+  and use its key instead of the local key.
+  A keyed hash carries the key itself, which reads every block stored with
+  the key, not only the blocks of the hash, so share the key, and keyed
+  hashes, only with those who may read every block stored with the key.
+cask pin/tag NAME HASH[:PATH]
+  Names the given hash and protects its blocks from garbage collection.
+cask unpin NAME
+  Removes a pin.
+cask pins
+  Writes the hash and name of every pin.
+cask gc
+  Removes blocks that no pin reaches from the local .cask.
+  Spares blocks written within the last hour, and the blocks they link.
+  With packs, rewrites the packs last written more than an hour ago that
+  would shrink by a quarter or more, which also reclaims the space of
+  removed blocks, and defers the garbage in other packs to a later gc.
+  Writes the counts of retained, recent, collected, deferred, and partial
+  blocks.
+cask fsck [--repair PEERS] [HASH[:PATH]...]
+  Verifies the blocks of the given hashes in the local .cask, or every block
+  in the local .cask and the trees of every pin.
+  Writes each damaged block, and each partially written file, then counts.
+  With --repair, replaces missing and corrupt blocks with intact copies from
+  the given peers.
+cask serve [--pins] [HOST:PORT]
   Runs a CASK server.
   Commands sent with the server's address will use the server's .cask
   instead of the local .cask.
+  With --pins, also keeps the pins that cask watch sends, for cask follow
+  to read. The server does not authenticate its peers, so any host that
+  can reach it can then read every pin and create or replace any pin,
+  which unprotects the blocks of the replaced trees from gc. Only use
+  --pins where every host that can reach the server is trusted.
+cask http [--cdc] [HOST:PORT] [ADDR]
+  Runs an HTTP gateway on ADDR (localhost:8080 by default) to the local
+  .cask, or to the given peer.
+  GET /blob/HASH writes the content of a blob.
+  GET /tree/HASH/PATH writes a file, or lists a directory in HTML, or in
+  JSON with ?format=json.
+  PUT /blob/ stores the request body and responds with its hash.
+cask cluster [--join] HOST:PORT [MEMBER...]
+  Runs a CASK server that elects a leader among itself and the other member
+  servers, and replicates a log of hashes through the leader.
+  Every member must list the addresses of all of the others.
+  Reads a HASH from each line of input and proposes it, if this member leads.
+  A line "add MEMBER" or "remove MEMBER" changes the membership instead, one
+  member at a time.
+  With --join, waits for the leader to add this member to a running cluster
+  of the given members.
+  Pins each committed hash as "cluster" and writes its index and hash.
+  The log, term, and vote survive restarts in the local .cask.
 cask path
   Writes the location of the nearest .cask directory.
 `
 
+const (
+	stopTimeout = 5 * time.Second
+	gcGrace     = time.Hour
+	// cacheCapacity is the number of blocks that commands sent to a peer keep
+	// in memory.
+	cacheCapacity = 64 << 10
+	// defaultHTTPAddr is the address of the HTTP gateway unless the command
+	// gives another.
+	defaultHTTPAddr = "localhost:8080"
+)
+
 func main() {
 	ctx := context.Background()
 	ctx, cancel := context.WithCancel(ctx)
@@ -64,7 +215,7 @@ func main() {
 		cancel()
 	}()
 
-	fs := osfs.New("/")
+	fs := hostFS{Filesystem: osfs.New("/"), root: "/"}
 
 	if err := run(ctx, os.Args[1:], os.Stdout, os.Stderr, fs); err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err.Error())
@@ -74,20 +225,116 @@ func main() {
 
 func run(ctx context.Context, args []string, stdout, stderr io.Writer, fs billy.Filesystem) (err error) {
 	if len(args) < 1 {
-		fmt.Fprintf(stdout, usage)
+		fmt.Fprint(stdout, usage)
 		return
 	}
 
 	command := args[0]
 
+	// Options may appear anywhere after the command.
+	metaOpt := false
+	cdcOpt := false
+	joinOpt := false
+	pruneOpt := false
+	repairOpt := false
+	packOpt := false
+	tarOpt := false
+	keyedOpt := false
+	cacheOpt := false
+	pinsOpt := false
+	operands := args[:1]
+	for _, arg := range args[1:] {
+		switch arg {
+		case "--meta":
+			metaOpt = true
+		case "--cdc":
+			cdcOpt = true
+		case "--join":
+			joinOpt = true
+		case "--prune":
+			pruneOpt = true
+		case "--repair":
+			repairOpt = true
+		case "--pack":
+			packOpt = true
+		case "--tar":
+			tarOpt = true
+		case "--keyed":
+			keyedOpt = true
+		case "--cache":
+			cacheOpt = true
+		case "--pins":
+			pinsOpt = true
+		default:
+			operands = append(operands, arg)
+		}
+	}
+	args = operands
+	if metaOpt && command != "checkin" && command != "commit" && command != "watch" {
+		err = fmt.Errorf("usage error: cask %s does not accept --meta", command)
+		return
+	}
+	if cdcOpt && command != "store" && command != "checkin" && command != "commit" && command != "watch" && command != "http" {
+		err = fmt.Errorf("usage error: cask %s does not accept --cdc", command)
+		return
+	}
+	if joinOpt && command != "cluster" {
+		err = fmt.Errorf("usage error: cask %s does not accept --join", command)
+		return
+	}
+	if pruneOpt && command != "rebalance" {
+		err = fmt.Errorf("usage error: cask %s does not accept --prune", command)
+		return
+	}
+	if repairOpt && command != "fsck" {
+		err = fmt.Errorf("usage error: cask %s does not accept --repair", command)
+		return
+	}
+	if packOpt && command != "init" {
+		err = fmt.Errorf("usage error: cask %s does not accept --pack", command)
+		return
+	}
+	if tarOpt && command != "export" {
+		err = fmt.Errorf("usage error: cask %s does not accept --tar", command)
+		return
+	}
+	if keyedOpt && command != "store" && command != "checkin" && command != "hash" && command != "push" && command != "pull" && command != "import" && command != "watch" {
+		err = fmt.Errorf("usage error: cask %s does not accept --keyed", command)
+		return
+	}
+	if pinsOpt && command != "serve" {
+		err = fmt.Errorf("usage error: cask %s does not accept --pins", command)
+		return
+	}
+	switch command {
+	case "store", "load", "checkin", "checkout", "log", "list", "ls", "diff", "hash", "export", "import", "http", "follow":
+	default:
+		if cacheOpt {
+			err = fmt.Errorf("usage error: cask %s does not accept --cache", command)
+			return
+		}
+	}
+	storeConfig := caskdir.StoreConfig{
+		Meta: metaOpt,
+		Blob: caskblob.StoreConfig{ContentDefined: cdcOpt},
+	}
+
 	// Parse and validate arguments.
 	hashArg := ""
+	keyArg := ""
+	otherHashArg := ""
 	pathArg := ""
 	hostArg := ""
+	httpArg := ""
 	peerArg := ""
+	otherPeerArg := ""
+	nameArg := ""
+	messageArg := ""
+	var membersArg []string
+	var hashesArg []string
 	switch command {
 	case "help", "-h", "--help":
-		fmt.Fprintf(stdout, usage)
+		fmt.Fprint(stdout, usage)
 		return
 	case "init":
 		switch len(args) {
@@ -98,7 +345,7 @@ func run(ctx context.Context, args []string, stdout, stderr io.Writer, fs billy.
 			err = fmt.Errorf("usage error: cask %s [DIR]: 0 or 1 but got %d arguments", command, len(args)-1)
 			return
 		}
-	case "store":
+	case "store", "import":
 		switch len(args) {
 		case 1:
 		case 2:
@@ -108,7 +355,46 @@ func run(ctx context.Context, args []string, stdout, stderr io.Writer, fs billy.
 			err = fmt.Errorf("usage error: cask %s [HOST:PORT]: 0 or 1 but got %d arguments", command, len(args)-1)
 			return
 		}
-	case "load", "checkin", "list", "ls", "hash":
+	case "checkin":
+		switch len(args) {
+		case 2:
+			pathArg = args[1]
+		case 3:
+			hostArg = "0:0"
+			peerArg = args[1]
+			pathArg = args[2]
+		default:
+			err = fmt.Errorf("usage error: cask %s [HOST:PORT] DIR: 1 or 2 but got %d arguments", command, len(args)-1)
+			return
+		}
+	case "commit":
+		switch len(args) {
+		case 3:
+			pathArg = args[1]
+			nameArg = args[2]
+		case 4:
+			pathArg = args[1]
+			nameArg = args[2]
+			messageArg = args[3]
+		default:
+			err = fmt.Errorf("usage error: cask %s DIR NAME [MESSAGE]: 2 or 3 but got %d arguments", command, len(args)-1)
+			return
+		}
+	case "watch", "follow":
+		switch len(args) {
+		case 3:
+			pathArg = args[1]
+			nameArg = args[2]
+		case 4:
+			hostArg = "0:0"
+			peerArg = args[1]
+			pathArg = args[2]
+			nameArg = args[3]
+		default:
+			err = fmt.Errorf("usage error: cask %s [HOST:PORT] DIR NAME: 2 or 3 but got %d arguments", command, len(args)-1)
+			return
+		}
+	case "load", "list", "ls", "hash", "log", "export":
 		switch len(args) {
 		case 2:
 			hashArg = args[1]
@@ -120,6 +406,20 @@ func run(ctx context.Context, args []string, stdout, stderr io.Writer, fs billy.
 			err = fmt.Errorf("usage error: cask %s [HOST:PORT] HASH: 1 or 2 but got %d arguments", command, len(args)-1)
 			return
 		}
+	case "diff":
+		switch len(args) {
+		case 3:
+			hashArg = args[1]
+			otherHashArg = args[2]
+		case 4:
+			hostArg = "0:0"
+			peerArg = args[1]
+			hashArg = args[2]
+			otherHashArg = args[3]
+		default:
+			err = fmt.Errorf("usage error: cask %s [HOST:PORT] HASH HASH: 2 or 3 but got %d arguments", command, len(args)-1)
+			return
+		}
 	case "checkout":
 		switch len(args) {
 		case 3:
@@ -134,6 +434,76 @@ func run(ctx context.Context, args []string, stdout, stderr io.Writer, fs billy.
 			err = fmt.Errorf("usage error: cask %s [HOST:PORT] PATH HASH: 2 or 3 but got %d arguments", command, len(args)-1)
 			return
 		}
+	case "push", "pull":
+		switch len(args) {
+		case 3:
+			hostArg = "0:0"
+			peerArg = args[1]
+			hashArg = args[2]
+		default:
+			err = fmt.Errorf("usage error: cask %s HOST:PORT HASH: 2 but got %d arguments", command, len(args)-1)
+			return
+		}
+	case "rebalance":
+		switch len(args) {
+		case 1, 2, 3:
+			err = fmt.Errorf("usage error: cask %s PEERS PEERS HASH...: 3 or more but got %d arguments", command, len(args)-1)
+			return
+		default:
+			hostArg = "0:0"
+			peerArg = args[1]
+			otherPeerArg = args[2]
+			hashesArg = args[3:]
+		}
+	case "pin", "tag":
+		switch len(args) {
+		case 3:
+			nameArg = args[1]
+			hashArg = args[2]
+		default:
+			err = fmt.Errorf("usage error: cask %s NAME HASH: 2 but got %d arguments", command, len(args)-1)
+			return
+		}
+	case "unpin":
+		switch len(args) {
+		case 2:
+			nameArg = args[1]
+		default:
+			err = fmt.Errorf("usage error: cask %s NAME: 1 but got %d arguments", command, len(args)-1)
+			return
+		}
+	case "fsck":
+		if repairOpt {
+			if len(args) < 2 {
+				err = fmt.Errorf("usage error: cask %s --repair PEERS [HASH...]: 1 or more but got %d arguments", command, len(args)-1)
+				return
+			}
+			hostArg = "0:0"
+			peerArg = args[1]
+			args = args[1:]
+		}
+		hashesArg = args[1:]
+	case "pins", "gc":
+		switch len(args) {
+		case 1:
+		default:
+			err = fmt.Errorf("usage error: cask %s: 0 but got %d arguments", command, len(args)-1)
+			return
+		}
+	case "http":
+		switch len(args) {
+		case 1:
+			httpArg = defaultHTTPAddr
+		case 2:
+			httpArg = args[1]
+		case 3:
+			hostArg = "0:0"
+			peerArg = args[1]
+			httpArg = args[2]
+		default:
+			err = fmt.Errorf("usage error: cask %s [HOST:PORT] [ADDR]: 0 to 2 but got %d arguments", command, len(args)-1)
+			return
+		}
 	case "serve":
 		switch len(args) {
 		case 1:
@@ -144,6 +514,24 @@ func run(ctx context.Context, args []string, stdout, stderr io.Writer, fs billy.
 			err = fmt.Errorf("usage error: cask %s [HOST:PORT]: 0 or 1 but got %d arguments", command, len(args)-1)
 			return
 		}
+	case "cluster":
+		switch len(args) {
+		case 1:
+			err = fmt.Errorf("usage error: cask %s HOST:PORT [MEMBER...]: 1 or more but got %d arguments", command, len(args)-1)
+			return
+		default:
+			hostArg = args[1]
+			membersArg = args[2:]
+		}
+	case "key":
+		switch len(args) {
+		case 1:
+		case 2:
+			keyArg = args[1]
+		default:
+			err = fmt.Errorf("usage error: cask %s [KEY]: 0 or 1 but got %d arguments", command, len(args)-1)
+			return
+		}
 	case "path":
 		switch len(args) {
 		case 1:
@@ -160,7 +548,7 @@ func run(ctx context.Context, args []string, stdout, stderr io.Writer, fs billy.
 
 	var path string
 	switch command {
-	case "checkin", "checkout":
+	case "checkin", "checkout", "commit", "watch", "follow":
 		if p, absErr := filepath.Abs(pathArg); absErr != nil {
 			err = absErr
 			return
@@ -169,56 +557,203 @@ func run(ctx context.Context, args []string, stdout, stderr io.Writer, fs billy.
 		}
 	}
 
-	var store cask.Store
+	// The local store is the store that the server exposes.
+	// Commands that transfer blocks between peers use the local .cask, and
+	// all other commands sent to a peer use memory to cache the peer's blocks.
+	transfer := command == "push" || command == "pull" || command == "fsck" || command == "watch"
+	var local cask.Store
+	var disk *caskdiskstore.Store
 	switch command {
-	case "store", "load", "checkin", "checkout", "list", "ls", "hash", "serve":
-		if peerArg != "" {
-			store = caskmemstore.New()
+	case "store", "load", "checkin", "commit", "watch", "follow", "log", "checkout", "list", "ls", "diff", "hash", "export", "import", "serve", "http", "cluster", "push", "pull", "rebalance", "pin", "tag", "unpin", "pins", "gc", "fsck", "key":
+		if peerArg != "" && !transfer {
+			local = caskmemstore.New()
 		} else {
 			if caskPath, findErr := findCask(fs); findErr != nil {
 				err = findErr
 				return
 			} else {
 				fs := osfs.New(caskPath)
-				store = &caskdiskstore.Store{Filesystem: fs}
+				disk = &caskdiskstore.Store{Filesystem: fs}
+				local = disk
+			}
+		}
+	}
+	store := local
+
+	// Names resolve to pins in the local .cask, if there is one, even for
+	// commands sent to a peer.
+	refs := disk
+	if refs == nil {
+		if caskPath, findErr := findCask(fs); findErr == nil {
+			refs = &caskdiskstore.Store{Filesystem: osfs.New(caskPath)}
+		}
+	}
+
+	// Keyed hashes carry their own key, and otherwise the key of the local
+	// .cask, if any, encrypts the blocks sent to a peer.
+	var key *caskcrypt.Key
+	for _, arg := range []*string{&hashArg, &otherHashArg} {
+		if h, k, keyedErr := parseKeyedHash(*arg); keyedErr != nil {
+			err = keyedErr
+			return
+		} else if k != nil {
+			if key != nil && *key != *k {
+				err = fmt.Errorf("usage error: keyed hashes with different keys")
+				return
 			}
+			*arg = h
+			key = k
+		}
+	}
+	if key == nil && refs != nil && command != "key" {
+		if k, keyErr := readKey(refs); keyErr != nil {
+			err = keyErr
+			return
+		} else {
+			key = k
 		}
 	}
 
 	var server *casknet.Server
 	if hostArg != "" {
 		server = &casknet.Server{
-			Addr:  hostArg,
-			Store: store,
+			Addr:   hostArg,
+			Store:  local,
+			Logger: &serverLogger{stderr: stderr},
+		}
+		if pinsOpt && disk != nil {
+			server.Pins = disk
 		}
 		if startErr := server.Start(ctx); startErr != nil {
 			err = startErr
 			return
 		}
 		defer func() {
-			if stopErr := server.Stop(ctx); err != nil {
+			// The command context may already be canceled, so give in-flight
+			// handlers a moment of their own to drain.
+			stopCtx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+			defer cancel()
+			if stopErr := server.Stop(stopCtx); stopErr != nil {
 				err = multierr.Append(err, stopErr)
 			}
 		}()
 	}
 
+	var prior, next *caskshard.Store
+	if command == "rebalance" {
+		if s, shardErr := shards(server, peerArg, key != nil); shardErr != nil {
+			err = shardErr
+			return
+		} else {
+			prior = s
+		}
+		if s, shardErr := shards(server, otherPeerArg, key != nil); shardErr != nil {
+			err = shardErr
+			return
+		} else {
+			next = s
+		}
+	}
+
+	// A single remote peer that serves with --pins also keeps the pins that
+	// watch publishes and follow polls.
+	var remote *casknet.Peer
 	if peerArg != "" {
-		if udpAddr, resolveErr := net.ResolveUDPAddr("udp", peerArg); resolveErr != nil {
+		var peer cask.Store
+		if isShards(peerArg) {
+			if s, shardErr := shards(server, peerArg, key != nil); shardErr != nil {
+				err = shardErr
+				return
+			} else {
+				peer = s
+			}
+		} else if udpAddr, resolveErr := net.ResolveUDPAddr("udp", peerArg); resolveErr != nil {
 			err = resolveErr
+			return
+		} else if key != nil {
+			remote = server.Peer(udpAddr)
+			peer = remote.Opaque()
 		} else {
-			store = server.Peer(udpAddr)
+			remote = server.Peer(udpAddr)
+			peer = remote
+		}
+		if key != nil {
+			peer = &caskcrypt.Store{Backing: peer, Key: *key}
 		}
+		store = peer
+		if !transfer {
+			tiers := []cask.Store{local, peer}
+			if cacheOpt {
+				if refs == nil {
+					err = fmt.Errorf("cannot cache blocks without a local .cask")
+					return
+				}
+				tiers = []cask.Store{local, refs, peer}
+			}
+			store = &caskcache.Store{
+				Tiers:    tiers,
+				Capacity: cacheCapacity,
+			}
+		}
+	} else if cacheOpt {
+		err = fmt.Errorf("usage error: cask %s accepts --cache only with HOST:PORT", command)
+		return
 	}
 
-	var hash cask.Hash
+	var hash, otherHash cask.Hash
+	var hashes []cask.Hash
 	switch command {
+	case "diff":
+		if h, resolveErr := resolve(ctx, store, refs, otherHashArg, true); resolveErr != nil {
+			err = resolveErr
+			return
+		} else {
+			otherHash = h
+		}
+		fallthrough
 	case "load", "checkout", "list", "ls", "hash":
-		if h, resolveErr := resolve(ctx, store, hashArg); resolveErr != nil {
+		if h, resolveErr := resolve(ctx, store, refs, hashArg, true); resolveErr != nil {
+			err = resolveErr
+			return
+		} else {
+			hash = h
+		}
+	case "export":
+		// Archives carry commits and their history, but tar streams carry
+		// only a tree.
+		if h, resolveErr := resolve(ctx, store, refs, hashArg, tarOpt); resolveErr != nil {
+			err = resolveErr
+			return
+		} else {
+			hash = h
+		}
+	case "log", "pull", "pin", "tag":
+		if h, resolveErr := resolve(ctx, store, refs, hashArg, false); resolveErr != nil {
+			err = resolveErr
+			return
+		} else {
+			hash = h
+		}
+	case "push":
+		if h, resolveErr := resolve(ctx, local, refs, hashArg, false); resolveErr != nil {
 			err = resolveErr
 			return
 		} else {
 			hash = h
 		}
+	case "rebalance", "fsck":
+		resolveStore := local
+		if command == "rebalance" {
+			resolveStore = prior
+		}
+		for _, arg := range hashesArg {
+			if h, resolveErr := resolve(ctx, resolveStore, refs, arg, false); resolveErr != nil {
+				err = resolveErr
+				return
+			} else {
+				hashes = append(hashes, h)
+			}
+		}
 	}
 
 	// Execute.
@@ -230,9 +765,14 @@ func run(ctx context.Context, args []string, stdout, stderr io.Writer, fs billy.
 		} else if mkdirErr := fs.MkdirAll(caskPath, 755); mkdirErr != nil {
 			err = mkdirErr
 			return
+		} else if packOpt {
+			if packErr := (&caskdiskstore.Store{Filesystem: osfs.New(caskPath)}).InitPacks(); packErr != nil {
+				err = packErr
+				return
+			}
 		}
 	case "store":
-		if h, storeErr := caskblob.Store(ctx, store, os.Stdin); storeErr != nil {
+		if h, storeErr := storeConfig.Blob.Store(ctx, store, os.Stdin); storeErr != nil {
 			err = storeErr
 			return
 		} else {
@@ -243,8 +783,25 @@ func run(ctx context.Context, args []string, stdout, stderr io.Writer, fs billy.
 			err = loadErr
 			return
 		}
+	case "export":
+		if tarOpt {
+			if tarErr := caskdir.WriteTar(ctx, store, stdout, hash); tarErr != nil {
+				err = tarErr
+				return
+			}
+		} else if _, exportErr := caskarchive.Export(ctx, store, stdout, hash); exportErr != nil {
+			err = exportErr
+			return
+		}
+	case "import":
+		if report, importErr := caskarchive.Import(ctx, store, os.Stdin); importErr != nil {
+			err = importErr
+			return
+		} else {
+			hashes = report.Roots
+		}
 	case "checkin":
-		if h, storeErr := caskdir.Store(ctx, store, fs, path); storeErr != nil {
+		if h, storeErr := checkin(ctx, stderr, store, disk, fs, path, storeConfig); storeErr != nil {
 			err = storeErr
 			return
 		} else {
@@ -269,21 +826,141 @@ func run(ctx context.Context, args []string, stdout, stderr io.Writer, fs billy.
 					mode = "x"
 				case caskdir.DirMode:
 					mode = "d"
+				case caskdir.SymlinkMode:
+					mode = "l"
+				}
+				if entry.Meta != nil {
+					fmt.Fprintf(stdout, "%x %s %s %s %s\n", entry.Hash, mode, entry.Meta.Perm, entry.Meta.ModTime.Format(time.RFC3339), string(entry.Name))
+				} else {
+					fmt.Fprintf(stdout, "%x %s %s\n", entry.Hash, mode, string(entry.Name))
 				}
-				fmt.Fprintf(stdout, "%x %s %s\n", entry.Hash, mode, string(entry.Name))
 			}
 		}
-	case "hash":
-		if entry, resolveErr := caskdir.Resolve(ctx, store, hash, pathArg); resolveErr != nil {
-			err = resolveErr
+	case "diff":
+		if changes, diffErr := caskdir.Diff(ctx, store, hash, otherHash); diffErr != nil {
+			err = diffErr
 			return
 		} else {
-			hash = entry.Hash
+			for _, change := range changes {
+				fmt.Fprintf(stdout, "%s %s\n", change.Type, change.Path)
+			}
+		}
+	case "commit":
+		if h, commitErr := commit(ctx, stderr, disk, fs, path, nameArg, messageArg, storeConfig); commitErr != nil {
+			err = commitErr
+			return
+		} else {
+			hash = h
+		}
+	case "watch":
+		var peer cask.Store
+		if peerArg != "" {
+			peer = store
+		}
+		var printKey *caskcrypt.Key
+		if keyedOpt {
+			printKey = key
+		}
+		if watchErr := watch(ctx, stdout, stderr, disk, peer, remote, printKey, fs, path, nameArg, storeConfig); watchErr != nil {
+			err = watchErr
+			return
+		}
+	case "follow":
+		if followErr := follow(ctx, os.Stdin, stdout, stderr, store, refs, remote, fs, path, nameArg); followErr != nil {
+			err = followErr
+			return
+		}
+	case "log":
+		if logErr := log(ctx, stdout, store, hash); logErr != nil {
+			err = logErr
+			return
+		}
+	case "push":
+		if syncErr := caskio.Sync(ctx, store, local, hash); syncErr != nil {
+			err = syncErr
+			return
+		}
+	case "pull":
+		if syncErr := caskio.Sync(ctx, local, store, hash); syncErr != nil {
+			err = syncErr
+			return
+		}
+	case "rebalance":
+		config := caskshard.RebalanceConfig{Roots: hashes, Prune: pruneOpt}
+		if report, rebalanceErr := config.Rebalance(ctx, prior, next); rebalanceErr != nil {
+			err = rebalanceErr
+			return
+		} else {
+			fmt.Fprintf(stdout, "%d blocks\n%d copied\n%d pruned\n", report.Blocks, report.Copied, report.Pruned)
+		}
+	case "pin", "tag":
+		if pinErr := disk.Pin(nameArg, hash); pinErr != nil {
+			err = pinErr
+			return
+		}
+	case "unpin":
+		if unpinErr := disk.Unpin(nameArg); unpinErr != nil {
+			err = unpinErr
+			return
+		}
+	case "pins":
+		if pins, pinsErr := disk.Pins(); pinsErr != nil {
+			err = pinsErr
+			return
+		} else {
+			names := make([]string, 0, len(pins))
+			for name := range pins {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				fmt.Fprintf(stdout, "%x %s\n", pins[name], name)
+			}
+		}
+	case "gc":
+		if report, gcErr := (caskdiskstore.CollectConfig{Grace: gcGrace}).Collect(ctx, disk); gcErr != nil {
+			err = gcErr
+			return
+		} else {
+			fmt.Fprintf(stdout, "%d retained\n%d recent\n%d collected\n%d deferred\n%d partial\n", report.Retained, report.Recent, report.Collected, report.Deferred, report.Partial)
+		}
+	case "fsck":
+		var repair cask.Store
+		if peerArg != "" {
+			repair = store
+		}
+		if fsckErr := fsck(ctx, stdout, disk, repair, hashes); fsckErr != nil {
+			err = fsckErr
+			return
 		}
 	case "serve":
 		fmt.Fprintf(stderr, "Serving on %s\n", server.LocalAddr().String())
 		<-ctx.Done()
 		err = ctx.Err()
+	case "http":
+		handler := &caskhttp.Handler{
+			Store: store,
+			Blob:  storeConfig.Blob,
+			Names: func(name string) (cask.Hash, error) {
+				return parseRef(refs, name)
+			},
+		}
+		if httpErr := serveHTTP(ctx, stderr, httpArg, handler); httpErr != nil {
+			err = httpErr
+			return
+		}
+	case "cluster":
+		if clusterErr := cluster(ctx, os.Stdin, stdout, stderr, server, disk, hostArg, membersArg, joinOpt); clusterErr != nil {
+			err = clusterErr
+			return
+		}
+	case "key":
+		if k, keyErr := writeKey(disk, keyArg); keyErr != nil {
+			err = keyErr
+			return
+		} else {
+			fmt.Fprintf(stdout, "%x\n", k)
+		}
 	case "path":
 		if caskPath, findErr := findCask(fs); findErr != nil {
 			err = findErr
@@ -295,8 +972,20 @@ func run(ctx context.Context, args []string, stdout, stderr io.Writer, fs billy.
 
 	// Report.
 	switch command {
-	case "store", "checkin", "hash":
-		fmt.Fprintf(stdout, "%x\n", hash)
+	case "store", "checkin", "commit", "hash", "push", "pull":
+		if keyedOpt && key != nil && peerArg != "" {
+			fmt.Fprintf(stdout, "%s\n", caskcrypt.KeyedHash{Hash: hash, Key: *key})
+		} else {
+			fmt.Fprintf(stdout, "%x\n", hash)
+		}
+	case "import":
+		for _, h := range hashes {
+			if keyedOpt && key != nil && peerArg != "" {
+				fmt.Fprintf(stdout, "%s\n", caskcrypt.KeyedHash{Hash: h, Key: *key})
+			} else {
+				fmt.Fprintf(stdout, "%x\n", h)
+			}
+		}
 	}
 
 	return nil
@@ -322,7 +1011,195 @@ func findCask(fs billy.Filesystem) (string, error) {
 	}
 }
 
-func resolve(ctx context.Context, store cask.Store, hashArg string) (cask.Hash, error) {
+// serveHTTP runs an HTTP server until the context is canceled.
+func serveHTTP(ctx context.Context, stderr io.Writer, addr string, handler http.Handler) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: handler}
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(listener)
+	}()
+	fmt.Fprintf(stderr, "Serving HTTP on %s\n", listener.Addr().String())
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+	stopCtx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+	return multierr.Append(ctx.Err(), server.Shutdown(stopCtx))
+}
+
+// fsck verifies the blocks of the given hashes, or the whole local .cask, and
+// fails if any damage remains.
+func fsck(ctx context.Context, stdout io.Writer, disk *caskdiskstore.Store, repair cask.Store, hashes []cask.Hash) error {
+	var damaged []caskio.Damage
+	if len(hashes) > 0 {
+		report, err := caskio.CheckConfig{Repair: repair}.Check(ctx, disk, hashes...)
+		if err != nil {
+			return err
+		}
+		damaged = report.Damaged
+		for _, damage := range damaged {
+			fmt.Fprintf(stdout, "%s\n", damage)
+		}
+		fmt.Fprintf(stdout, "%d checked\n", report.Checked)
+	} else {
+		report, err := caskdiskstore.CheckConfig{Repair: repair}.Check(ctx, disk)
+		if err != nil {
+			return err
+		}
+		damaged = report.Damaged
+		for _, partial := range report.Partial {
+			fmt.Fprintf(stdout, "partial %s\n", partial)
+		}
+		for _, damage := range damaged {
+			fmt.Fprintf(stdout, "%s\n", damage)
+		}
+		fmt.Fprintf(stdout, "%d blocks\n%d reachable\n%d partial\n", report.Blocks, report.Reachable, len(report.Partial))
+	}
+
+	repaired := 0
+	for _, damage := range damaged {
+		if damage.Repaired {
+			repaired++
+		}
+	}
+	fmt.Fprintf(stdout, "%d damaged\n%d repaired\n", len(damaged), repaired)
+	if repaired < len(damaged) {
+		return fmt.Errorf("damage remains in %d blocks", len(damaged)-repaired)
+	}
+	return nil
+}
+
+// keyFile is the name of the secret key in the local .cask.
+const keyFile = "key"
+
+// readKey reads the secret key from the local .cask, if it has one.
+func readKey(disk *caskdiskstore.Store) (*caskcrypt.Key, error) {
+	file, err := disk.Filesystem.Open(keyFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	buf, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	key, err := caskcrypt.ParseKey(strings.TrimSpace(string(buf)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key in %s: %v", keyFile, err)
+	}
+	return &key, nil
+}
+
+// writeKey records a secret key in the local .cask, or creates a random key
+// if none is given and the local .cask has none, and returns the key.
+//
+// Without a given key, writeKey returns the existing key rather than
+// replacing it, since blocks stored with the existing key become unreadable
+// without it.
+func writeKey(disk *caskdiskstore.Store, keyArg string) (caskcrypt.Key, error) {
+	var key caskcrypt.Key
+	var err error
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if keyArg == "" {
+		if existing, err := readKey(disk); err != nil {
+			return key, err
+		} else if existing != nil {
+			return *existing, nil
+		}
+		key, err = caskcrypt.NewKey()
+		// Another command may create a key at the same time.
+		flags = os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	} else {
+		key, err = caskcrypt.ParseKey(keyArg)
+	}
+	if err != nil {
+		return key, err
+	}
+	file, err := disk.Filesystem.OpenFile(keyFile, flags, 0600)
+	if err != nil {
+		return key, err
+	}
+	_, err = fmt.Fprintf(file, "%x\n", key)
+	return key, multierr.Append(err, file.Close())
+}
+
+// parseKeyedHash splits the key from a HASH+KEY[:PATH] argument, returning
+// the argument as HASH[:PATH], or returns the argument unchanged and no key if
+// it is not a keyed hash.
+func parseKeyedHash(arg string) (string, *caskcrypt.Key, error) {
+	parts := strings.SplitN(arg, ":", 2)
+	if !caskcrypt.IsKeyedHash(parts[0]) {
+		return arg, nil, nil
+	}
+	k, err := caskcrypt.ParseKeyedHash(parts[0])
+	if err != nil {
+		return arg, nil, err
+	}
+	parts[0] = hex.EncodeToString(k.Hash[:])
+	return strings.Join(parts, ":"), &k.Key, nil
+}
+
+// shardReplicas is the number of peers and directories that hold each block
+// in a sharded store.
+const shardReplicas = 2
+
+// isShards reports whether a peer argument names directories or several
+// peers, rather than a single peer, which shards handles.
+// Directories contain a slash, so even a single directory counts.
+func isShards(arg string) bool {
+	return strings.Contains(arg, ",") || strings.Contains(arg, "/")
+}
+
+// shards returns a store that spreads blocks across a comma separated list of
+// peers and directories.
+//
+// Directories take their absolute paths as their names, so that their
+// blocks stay in place wherever the command runs.
+// Peers are opaque if the blocks are encrypted, since encrypted blocks do not
+// match the hashes they are stored under.
+func shards(server *casknet.Server, arg string, opaque bool) (*caskshard.Store, error) {
+	var nodes []caskshard.Node
+	for _, member := range strings.Split(arg, ",") {
+		if strings.Contains(member, "/") {
+			path, err := filepath.Abs(member)
+			if err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, caskshard.Node{
+				Name:  path,
+				Store: &caskdiskstore.Store{Filesystem: osfs.New(path)},
+			})
+		} else if udpAddr, err := net.ResolveUDPAddr("udp", member); err != nil {
+			return nil, err
+		} else {
+			peer := server.Peer(udpAddr)
+			if opaque {
+				peer = peer.Opaque()
+			}
+			nodes = append(nodes, caskshard.Node{
+				Name:  member,
+				Store: peer,
+			})
+		}
+	}
+	return caskshard.New(nodes, shardReplicas)
+}
+
+// resolve parses a HASH[:PATH] argument.
+//
+// The hash may be hex or the name of a pin.
+// If the hash addresses a commit, resolve follows the commit to its tree if
+// the caller asks to peel the commit or the argument has a path.
+func resolve(ctx context.Context, store cask.Store, refs *caskdiskstore.Store, hashArg string, peel bool) (cask.Hash, error) {
 	parts := strings.SplitN(hashArg, ":", 2)
 	hashArg = parts[0]
 	var path string
@@ -330,13 +1207,17 @@ func resolve(ctx context.Context, store cask.Store, hashArg string) (cask.Hash,
 		path = parts[1]
 	}
 
-	var hash cask.Hash
-	if h, err := hex.DecodeString(hashArg); err != nil {
+	hash, err := parseRef(refs, hashArg)
+	if err != nil {
 		return hash, err
-	} else if len(h) != len(hash) {
-		return hash, errors.New("invalid hash")
-	} else {
-		copy(hash[:], h)
+	}
+
+	if peel || path != "" {
+		if h, err := caskcommit.Peel(ctx, store, hash); err != nil {
+			return hash, err
+		} else {
+			hash = h
+		}
 	}
 
 	if path != "" {
@@ -349,3 +1230,469 @@ func resolve(ctx context.Context, store cask.Store, hashArg string) (cask.Hash,
 
 	return hash, nil
 }
+
+// parseRef parses a hash from hex or looks up a pin by name.
+func parseRef(refs *caskdiskstore.Store, ref string) (cask.Hash, error) {
+	var hash cask.Hash
+	if h, err := hex.DecodeString(ref); err == nil && len(h) == len(hash) {
+		copy(hash[:], h)
+		return hash, nil
+	}
+	if refs == nil {
+		return hash, fmt.Errorf("invalid hash: %s", ref)
+	}
+	if h, err := refs.Pinned(ref); os.IsNotExist(err) {
+		return hash, fmt.Errorf("invalid hash or unknown name: %s", ref)
+	} else if err != nil {
+		return hash, err
+	} else {
+		return h, nil
+	}
+}
+
+// indexFile is the name of the stat cache in the local .cask, which cannot
+// collide with the two hex digit prefixes of block files.
+const indexFile = "index"
+
+// checkin stores a directory, consulting and updating the stat cache in the
+// local .cask, if there is one, so that only changed files are read.
+// checkin warns of a stat cache it cannot read, and replaces it.
+func checkin(ctx context.Context, stderr io.Writer, store cask.Store, disk *caskdiskstore.Store, fs billy.Filesystem, path string, config caskdir.StoreConfig) (cask.Hash, error) {
+	if disk == nil {
+		return config.Store(ctx, store, fs, path)
+	}
+	index, err := caskdir.ReadIndexFile(disk.Filesystem, indexFile)
+	if err != nil {
+		// The index is only a cache, so an unreadable index, perhaps from an
+		// older version, only costs reading every file again.
+		fmt.Fprintf(stderr, "warning: reading every file again, since the stat cache is unreadable: %v\n", err)
+		index = caskdir.NewIndex()
+	}
+	config.Index = index
+	hash, err := config.Store(ctx, store, fs, path)
+	if err != nil {
+		return cask.ZeroHash, err
+	}
+	return hash, index.WriteFile(disk.Filesystem, indexFile)
+}
+
+// commit checks in a directory and records a commit whose parent is the
+// commit pinned with the given name, if any, then pins the new commit in its
+// stead.
+func commit(ctx context.Context, stderr io.Writer, disk *caskdiskstore.Store, fs billy.Filesystem, path, name, message string, config caskdir.StoreConfig) (cask.Hash, error) {
+	tree, err := checkin(ctx, stderr, disk, disk, fs, path, config)
+	if err != nil {
+		return cask.ZeroHash, err
+	}
+
+	var parents []cask.Hash
+	if parent, err := disk.Pinned(name); err == nil {
+		if prior, err := caskcommit.Load(ctx, disk, parent); err != nil {
+			return cask.ZeroHash, fmt.Errorf("%s does not name a commit: %v", name, err)
+		} else if prior.Tree == tree {
+			// Nothing changed.
+			return parent, nil
+		}
+		parents = append(parents, parent)
+	} else if !os.IsNotExist(err) {
+		return cask.ZeroHash, err
+	}
+
+	hash, err := caskcommit.Store(ctx, disk, caskcommit.Commit{
+		Tree:    tree,
+		Parents: parents,
+		Time:    time.Now(),
+		Message: message,
+	})
+	if err != nil {
+		return cask.ZeroHash, err
+	}
+	return hash, disk.Pin(name, hash)
+}
+
+// watchSettle is how long a watched directory must go without changing
+// before watch checks it in, so that a burst of changes yields one tree.
+const watchSettle = 200 * time.Millisecond
+
+// watch checks in a directory, then checks it in again whenever it changes,
+// pinning each new tree with the given name and sending its blocks to the
+// peer, if any, until the context is canceled.
+// Given a remote peer, watch also pins each tree on the remote peer, once it
+// has all of the tree's blocks, so that follow can poll the remote pin.
+//
+// Given a key, watch writes each hash with the key.
+func watch(ctx context.Context, stdout, stderr io.Writer, disk *caskdiskstore.Store, peer cask.Store, remote *casknet.Peer, key *caskcrypt.Key, fs billy.Filesystem, path, name string, config caskdir.StoreConfig) error {
+	notifier, err := newNotifier(path)
+	if err != nil {
+		return err
+	}
+	defer notifier.Close()
+
+	var last cask.Hash
+	publish := func() error {
+		hash, err := checkin(ctx, stderr, disk, disk, fs, path, config)
+		if err != nil {
+			return err
+		}
+		if hash == last {
+			return nil
+		}
+		if peer != nil {
+			if err := caskio.Sync(ctx, peer, disk, hash); err != nil {
+				return err
+			}
+		}
+		if remote != nil {
+			if err := remote.Pin(ctx, name, hash); err != nil {
+				return err
+			}
+		}
+		if err := disk.Pin(name, hash); err != nil {
+			return err
+		}
+		last = hash
+		if key != nil && peer != nil {
+			fmt.Fprintf(stdout, "%s\n", caskcrypt.KeyedHash{Hash: hash, Key: *key})
+		} else {
+			fmt.Fprintf(stdout, "%x\n", hash)
+		}
+		return nil
+	}
+	if err := publish(); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case _, ok := <-notifier.Changes():
+			if !ok {
+				return notifier.Err()
+			}
+		}
+		for settled := false; !settled; {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case _, ok := <-notifier.Changes():
+				if !ok {
+					return notifier.Err()
+				}
+			case <-time.After(watchSettle):
+				settled = true
+			}
+		}
+		// A file may vanish while checkin reads it, or the peer may be
+		// unreachable for a while, and the next change tries again.
+		if err := publish(); err != nil {
+			fmt.Fprintf(stderr, "%v\n", err)
+		}
+	}
+}
+
+// followPoll is how often follow checks its pin for a new tree.
+const followPoll = time.Second
+
+// follow checks out the tree pinned with the given name, or each hash read
+// from input if the name is "-", and keeps the checkout up to date with each
+// new tree, until the context is canceled or input ends.
+// Given a remote peer, follow polls the pin on the remote peer rather than
+// the local .cask.
+func follow(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer, store cask.Store, refs *caskdiskstore.Store, remote *casknet.Peer, fs billy.Filesystem, path, name string) error {
+	pinned := func(name string) (cask.Hash, error) {
+		return refs.Pinned(name)
+	}
+	if remote != nil {
+		pinned = func(name string) (cask.Hash, error) {
+			return remote.Pinned(ctx, name)
+		}
+	} else if name != "-" && refs == nil {
+		return fmt.Errorf("cannot follow pin %s without a local .cask", name)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	hashes := make(chan cask.Hash)
+	go func() {
+		defer close(hashes)
+		send := func(hash cask.Hash) bool {
+			select {
+			case hashes <- hash:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		if name == "-" {
+			scanner := bufio.NewScanner(stdin)
+			for scanner.Scan() {
+				line := strings.TrimSpace(scanner.Text())
+				if line == "" {
+					continue
+				}
+				hash, parseErr := parseRef(refs, line)
+				if parseErr != nil {
+					fmt.Fprintf(stderr, "%v\n", parseErr)
+					continue
+				}
+				if !send(hash) {
+					return
+				}
+			}
+			return
+		}
+		var last cask.Hash
+		for {
+			if hash, pinErr := pinned(name); pinErr == nil && hash != last {
+				if !send(hash) {
+					return
+				}
+				last = hash
+			} else if pinErr != nil && !os.IsNotExist(pinErr) && !errors.Is(pinErr, casknet.ErrNoPin) {
+				fmt.Fprintf(stderr, "%v\n", pinErr)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(followPoll):
+			}
+		}
+	}()
+
+	var current cask.Hash
+	loaded := false
+	for {
+		var hash cask.Hash
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case h, ok := <-hashes:
+			if !ok {
+				return nil
+			}
+			hash = h
+		}
+
+		tree, err := caskcommit.Peel(ctx, store, hash)
+		if err == nil && loaded && tree == current {
+			continue
+		}
+		if err == nil && !loaded {
+			err = caskdir.Load(ctx, store, fs, path, tree)
+		} else if err == nil {
+			err = caskdir.Update(ctx, store, fs, path, current, tree)
+		}
+		if err != nil {
+			// The checkout may be partly updated, which the next tree repairs,
+			// since updating from the prior tree rewrites every entry that
+			// differs.
+			fmt.Fprintf(stderr, "cannot check out %x: %v\n", hash, err)
+			continue
+		}
+		current = tree
+		loaded = true
+		fmt.Fprintf(stdout, "%x\n", tree)
+	}
+}
+
+// log writes the history of a commit, newest first.
+func log(ctx context.Context, stdout io.Writer, store cask.Store, hash cask.Hash) error {
+	history := caskcommit.NewHistory(store, hash)
+	for {
+		hash, commit, err := history.Next(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "commit %x\n", hash)
+		fmt.Fprintf(stdout, "tree %x\n", commit.Tree)
+		for _, parent := range commit.Parents {
+			fmt.Fprintf(stdout, "parent %x\n", parent)
+		}
+		fmt.Fprintf(stdout, "date %s\n", commit.Time.Format(time.RFC3339))
+		if commit.Message != "" {
+			fmt.Fprintf(stdout, "\n")
+			for _, line := range strings.Split(strings.TrimRight(commit.Message, "\n"), "\n") {
+				fmt.Fprintf(stdout, "    %s\n", line)
+			}
+		}
+		fmt.Fprintf(stdout, "\n")
+	}
+}
+
+// serverLogger reports server errors on stderr.
+type serverLogger struct {
+	stderr io.Writer
+}
+
+func (l *serverLogger) Error(err error) {
+	fmt.Fprintf(l.stderr, "%v\n", err)
+}
+
+func (l *serverLogger) Handle(*net.UDPAddr, string, string, time.Duration) {}
+func (l *serverLogger) Duplicate(*net.UDPAddr, string)                     {}
+func (l *serverLogger) Retransmit(*net.UDPAddr, string, int)               {}
+
+const (
+	// raftFile is the name of the file in the local .cask that records the
+	// term, vote, and head of the log of a cluster member.
+	raftFile = "raft"
+	// clusterPin names the latest committed hash of a cluster, and
+	// clusterLogPin the head of the log, which garbage collection would
+	// otherwise remove.
+	clusterPin    = "cluster"
+	clusterLogPin = "cluster-log"
+)
+
+// cluster runs a member of a raft election over the server's socket,
+// proposing each hash read from input and pinning each committed hash, until
+// the context expires.
+// Lines of input may instead add or remove members.
+func cluster(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer, server *casknet.Server, disk *caskdiskstore.Store, member string, members []string, join bool) (err error) {
+	election := caskraft.NewElection(member, members, 100, server, &raftLogger{stderr: stderr})
+	election.Joining = join
+	election.Store = disk
+	election.Persistence = &clusterPersistence{
+		FilePersistence: caskraft.FilePersistence{Path: filepath.Join(disk.Filesystem.Root(), raftFile)},
+		disk:            disk,
+	}
+	election.Machine = &clusterMachine{stdout: stdout, stderr: stderr, disk: disk}
+	server.Join(election)
+	if err := election.Start(ctx); err != nil {
+		return err
+	}
+	defer func() {
+		err = multierr.Append(err, election.Stop(context.Background()))
+	}()
+	fmt.Fprintf(stderr, "Member %s of a cluster with %s\n", member, strings.Join(members, " "))
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(stdin)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case line, ok := <-lines:
+			if !ok {
+				// Keep serving the cluster after input ends.
+				lines = nil
+				continue
+			}
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			if len(fields) == 2 && (fields[0] == "add" || fields[0] == "remove") {
+				change := election.AddMember
+				if fields[0] == "remove" {
+					change = election.RemoveMember
+				}
+				if _, _, changeErr := change(ctx, fields[1]); changeErr == caskraft.ErrNotLeader {
+					fmt.Fprintf(stderr, "cannot %s %s: not the leader, %s leads\n", fields[0], fields[1], election.State().Leader)
+				} else if changeErr != nil {
+					fmt.Fprintf(stderr, "cannot %s %s: %v\n", fields[0], fields[1], changeErr)
+				}
+				continue
+			}
+			hash, parseErr := parseRef(disk, fields[0])
+			if parseErr != nil {
+				fmt.Fprintf(stderr, "%v\n", parseErr)
+				continue
+			}
+			if _, _, proposeErr := election.Propose(ctx, hash); proposeErr == caskraft.ErrNotLeader {
+				fmt.Fprintf(stderr, "cannot propose %x: not the leader, %s leads\n", hash, election.State().Leader)
+			} else if proposeErr != nil {
+				fmt.Fprintf(stderr, "cannot propose %x: %v\n", hash, proposeErr)
+			}
+		}
+	}
+}
+
+// clusterPersistence pins the head of the log before recording it, so that
+// garbage collection retains the log.
+type clusterPersistence struct {
+	caskraft.FilePersistence
+	disk *caskdiskstore.Store
+}
+
+func (p *clusterPersistence) Save(state caskraft.HardState) error {
+	if state.Head != cask.ZeroHash {
+		if err := p.disk.Pin(clusterLogPin, state.Head); err != nil {
+			return err
+		}
+	}
+	return p.FilePersistence.Save(state)
+}
+
+// clusterMachine pins and writes each committed hash.
+type clusterMachine struct {
+	stdout, stderr io.Writer
+	disk           *caskdiskstore.Store
+}
+
+func (m *clusterMachine) Apply(index int, entry caskraft.Entry) {
+	if err := m.disk.Pin(clusterPin, entry.Value); err != nil {
+		fmt.Fprintf(m.stderr, "%v\n", err)
+	}
+	fmt.Fprintf(m.stdout, "%d %x\n", index, entry.Value)
+}
+
+// raftLogger reports transitions and protocol errors on stderr.
+type raftLogger struct {
+	stderr io.Writer
+}
+
+func (l *raftLogger) Transition(member string, next, prior caskraft.State) {
+	if next.Type != prior.Type || next.Term != prior.Term || next.Leader != prior.Leader {
+		fmt.Fprintf(l.stderr, "%s %s\n", member, next)
+	}
+}
+
+func (l *raftLogger) Error(err caskraft.Error) {
+	fmt.Fprintf(l.stderr, "%s %s: %v\n", err.Member, err.State, err)
+}
+
+func (l *raftLogger) Membership(member string, state caskraft.State, members []string) {
+	fmt.Fprintf(l.stderr, "%s %s members %s\n", member, state, strings.Join(members, " "))
+}
+
+func (l *raftLogger) Send(string, caskraft.State, caskraft.Message)    {}
+func (l *raftLogger) Receive(string, caskraft.State, caskraft.Message) {}
+func (l *raftLogger) Drop(string, caskraft.State, caskraft.Message)    {}
+func (l *raftLogger) Timeout(string, caskraft.State, time.Duration)    {}
+
+// hostFS adds support for changing permissions, owners, and times to a
+// filesystem rooted at a directory on the host, so that checkout can restore
+// metadata.
+type hostFS struct {
+	billy.Filesystem
+	root string
+}
+
+var _ billy.Change = hostFS{}
+
+func (fs hostFS) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(filepath.Join(fs.root, name), mode)
+}
+
+func (fs hostFS) Lchown(name string, uid, gid int) error {
+	return os.Lchown(filepath.Join(fs.root, name), uid, gid)
+}
+
+func (fs hostFS) Chown(name string, uid, gid int) error {
+	return os.Chown(filepath.Join(fs.root, name), uid, gid)
+}
+
+func (fs hostFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return os.Chtimes(filepath.Join(fs.root, name), atime, mtime)
+}
@@ -0,0 +1,145 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// notifyMask selects the inotify events that change a checked in tree.
+const notifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY |
+	syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB | syscall.IN_MOVED_FROM |
+	syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF |
+	syscall.IN_ONLYDIR | syscall.IN_DONT_FOLLOW
+
+// notifier reports changes beneath a directory, watching every directory
+// of the tree with inotify.
+type notifier struct {
+	fd   int
+	file *os.File
+	// watches maps inotify watch descriptors to the directories they watch.
+	watches map[int32]string
+	changes chan struct{}
+	err     error
+}
+
+// newNotifier watches the directory tree at a path on the host.
+//
+// The notifier skips .cask directories, whose blocks and pins change with
+// every check in.
+func newNotifier(root string) (*notifier, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	n := &notifier{
+		fd: fd,
+		// A nonblocking descriptor joins the runtime's poller, so Close
+		// interrupts a pending Read.
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		watches: make(map[int32]string),
+		changes: make(chan struct{}, 1),
+	}
+	if err := n.watchTree(root); err != nil {
+		n.file.Close()
+		return nil, err
+	}
+	go n.read()
+	return n, nil
+}
+
+// Changes returns a channel that receives a value after the tree changes,
+// coalescing changes that arrive before the value is received.
+// The channel closes if the notifier fails, with the cause in Err.
+func (n *notifier) Changes() <-chan struct{} {
+	return n.changes
+}
+
+// Err returns the error that stopped the notifier, if any.
+func (n *notifier) Err() error {
+	return n.err
+}
+
+// Close stops watching.
+func (n *notifier) Close() error {
+	return n.file.Close()
+}
+
+// watchTree adds a watch for every directory beneath a path.
+// Directories may vanish while watchTree walks them, which the events of
+// their parents report.
+func (n *notifier) watchTree(root string) error {
+	return filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if info.Name() == ".cask" {
+			return filepath.SkipDir
+		}
+		wd, err := syscall.InotifyAddWatch(n.fd, p, notifyMask)
+		if err == syscall.ENOENT || err == syscall.ENOTDIR {
+			return filepath.SkipDir
+		} else if err != nil {
+			return os.NewSyscallError("inotify_add_watch", err)
+		}
+		n.watches[int32(wd)] = p
+		return nil
+	})
+}
+
+// read decodes events until the notifier closes.
+func (n *notifier) read() {
+	defer close(n.changes)
+	var buf [64 * (syscall.SizeofInotifyEvent + syscall.NAME_MAX + 1)]byte
+	for {
+		size, err := n.file.Read(buf[:])
+		if errors.Is(err, os.ErrClosed) {
+			return
+		} else if err != nil {
+			n.err = err
+			return
+		}
+
+		changed := false
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= size; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			start := offset + syscall.SizeofInotifyEvent
+			offset = start + int(event.Len)
+			name := string(bytes.TrimRight(buf[start:offset], "\x00"))
+
+			if event.Mask&syscall.IN_IGNORED != 0 {
+				delete(n.watches, event.Wd)
+				continue
+			}
+			if name == ".cask" {
+				continue
+			}
+			changed = true
+			dir, ok := n.watches[event.Wd]
+			if ok && event.Mask&syscall.IN_ISDIR != 0 && event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+				if err := n.watchTree(filepath.Join(dir, name)); err != nil {
+					n.err = err
+					return
+				}
+			}
+		}
+
+		if changed {
+			select {
+			case n.changes <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,66 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// notifyPoll is how often a notifier without inotify reports that the tree
+// may have changed.
+const notifyPoll = 2 * time.Second
+
+// notifier reports that a directory tree may have changed at regular
+// intervals, leaving it to the stat cache of checkin to find what changed.
+type notifier struct {
+	changes chan struct{}
+	stop    chan struct{}
+	once    sync.Once
+}
+
+// newNotifier watches the directory tree at a path on the host.
+func newNotifier(root string) (*notifier, error) {
+	n := &notifier{
+		changes: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+	go n.poll()
+	return n, nil
+}
+
+// Changes returns a channel that receives a value whenever the tree may have
+// changed.
+func (n *notifier) Changes() <-chan struct{} {
+	return n.changes
+}
+
+// Err returns nil, since polling does not fail.
+func (n *notifier) Err() error {
+	return nil
+}
+
+// Close stops watching.
+func (n *notifier) Close() error {
+	n.once.Do(func() {
+		close(n.stop)
+	})
+	return nil
+}
+
+func (n *notifier) poll() {
+	ticker := time.NewTicker(notifyPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+			select {
+			case n.changes <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package cask_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"testing"
+
+	"borkshop/cask"
+	"borkshop/cask/memstore"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockHash(t *testing.T) {
+	model := &cask.Model{}
+	model.AppendString("hello world!\n")
+	var block cask.Block
+	require.NoError(t, model.Put(&block))
+
+	// The hash covers the whole block, not just its occupied bytes.
+	assert.Equal(t, cask.Hash(sha256.Sum256(block[:])), block.Hash())
+	assert.NotEqual(t, cask.Hash(sha256.Sum256(block[:block.Size()])), block.Hash())
+
+	// A byte beyond the occupied bytes changes the hash, so that a check can
+	// tell a damaged block from an intact one.
+	damaged := block
+	damaged[cask.BlockSize-1] = 1
+	assert.Equal(t, block.Size(), damaged.Size())
+	assert.NotEqual(t, block.Hash(), damaged.Hash())
+
+	// Models store blocks at their hash.
+	store := caskmemstore.New()
+	h, err := model.Store(context.Background(), store)
+	require.NoError(t, err)
+	assert.Equal(t, block.Hash(), h)
+}
@@ -0,0 +1,220 @@
+// Package caskcommit reads and writes commit blocks, which capture the
+// history of a directory tree in a content address store.
+//
+// A commit is a single leaf block.
+// The first link is the hash of the committed tree and the remaining links
+// are the hashes of the parent commits.
+// The content is a magic string that distinguishes commits from other leaf
+// blocks, the time of the commit as nanoseconds since the Unix epoch, then
+// the commit message.
+//
+//	height:1 = 0
+//	links:32*n = tree, parents...
+//	bytes = "cask commit\n", time:8, message
+//
+// Since a commit links its tree and parents, transferring or retaining a
+// commit transfers or retains its entire history.
+package caskcommit
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"borkshop/cask"
+)
+
+const magic = "cask commit\n"
+
+// MaxParents is the number of parents that fit in a commit block alongside
+// the tree.
+const MaxParents = 30
+
+// ErrNotCommit indicates that a block is not a commit.
+var ErrNotCommit = errors.New("not a commit")
+
+// Commit represents a snapshot of a directory tree in its history.
+type Commit struct {
+	// Tree is the hash of the root directory of the snapshot.
+	Tree cask.Hash
+	// Parents are the hashes of prior commits.
+	Parents []cask.Hash
+	// Time is when the commit was made.
+	Time time.Time
+	// Message describes the commit.
+	Message string
+}
+
+// Store encodes and stores a commit block, returning its hash.
+func Store(ctx context.Context, store cask.Store, commit Commit) (cask.Hash, error) {
+	var model cask.Model
+	if err := commit.put(&model); err != nil {
+		return cask.ZeroHash, err
+	}
+	return model.Store(ctx, store)
+}
+
+// Load reads and decodes a commit block.
+func Load(ctx context.Context, store cask.Store, hash cask.Hash) (Commit, error) {
+	var commit Commit
+	var model cask.Model
+	if err := model.Load(ctx, store, hash); err != nil {
+		return commit, err
+	}
+	err := commit.get(&model)
+	return commit, err
+}
+
+// Is reports whether a block is a commit.
+func Is(block *cask.Block) bool {
+	var model cask.Model
+	if err := model.Get(block); err != nil {
+		return false
+	}
+	return isCommit(&model)
+}
+
+// Peel returns the tree of the addressed commit, or the given hash if it
+// does not address a commit.
+func Peel(ctx context.Context, store cask.Store, hash cask.Hash) (cask.Hash, error) {
+	var block cask.Block
+	if err := store.Load(ctx, hash, &block); err != nil {
+		return cask.ZeroHash, err
+	}
+	if !Is(&block) {
+		return hash, nil
+	}
+	return block.Links()[0], nil
+}
+
+func isCommit(model *cask.Model) bool {
+	return model.Height == 0 &&
+		len(model.Links) > 0 &&
+		len(model.Bytes) >= len(magic)+8 &&
+		bytes.HasPrefix(model.Bytes, []byte(magic))
+}
+
+func (commit *Commit) put(model *cask.Model) error {
+	if len(commit.Parents) > MaxParents {
+		return fmt.Errorf("commit has %d parents, exceeding the limit of %d", len(commit.Parents), MaxParents)
+	}
+	model.Height = 0
+	model.AppendLink(commit.Tree)
+	for _, parent := range commit.Parents {
+		model.AppendLink(parent)
+	}
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(commit.Time.UnixNano()))
+	model.AppendString(magic)
+	model.AppendBytes(buf[:])
+	if n := model.AppendString(commit.Message); n < len(commit.Message) {
+		return fmt.Errorf("commit message of %d bytes exceeds the %d bytes that fit in the block", len(commit.Message), n)
+	}
+	return nil
+}
+
+func (commit *Commit) get(model *cask.Model) error {
+	if !isCommit(model) {
+		return ErrNotCommit
+	}
+	at := len(magic)
+	commit.Tree = model.Links[0]
+	commit.Parents = model.Links[1:]
+	commit.Time = time.Unix(0, int64(binary.BigEndian.Uint64(model.Bytes[at:at+8])))
+	commit.Message = string(model.Bytes[at+8:])
+	return nil
+}
+
+// History iterates the commits reachable from a head commit, newest first.
+type History struct {
+	store cask.Store
+	queue historyQueue
+	seen  map[cask.Hash]struct{}
+	head  cask.Hash
+	began bool
+}
+
+// NewHistory returns an iterator over the history of the given commit,
+// backed by the given store.
+func NewHistory(store cask.Store, head cask.Hash) *History {
+	return &History{
+		store: store,
+		seen:  map[cask.Hash]struct{}{head: {}},
+		head:  head,
+	}
+}
+
+// Next returns the next newest commit and its hash.
+//
+// If there are no further commits, returns io.EOF for the error.
+// All other errors indicate premature termination.
+func (h *History) Next(ctx context.Context) (cask.Hash, Commit, error) {
+	if !h.began {
+		if err := h.push(ctx, h.head); err != nil {
+			return cask.ZeroHash, Commit{}, err
+		}
+		h.began = true
+	}
+	if len(h.queue) == 0 {
+		return cask.ZeroHash, Commit{}, io.EOF
+	}
+
+	next := heap.Pop(&h.queue).(historyItem)
+	for _, parent := range next.commit.Parents {
+		if _, ok := h.seen[parent]; ok {
+			continue
+		}
+		h.seen[parent] = struct{}{}
+		if err := h.push(ctx, parent); err != nil {
+			return cask.ZeroHash, Commit{}, err
+		}
+	}
+	return next.hash, next.commit, nil
+}
+
+func (h *History) push(ctx context.Context, hash cask.Hash) error {
+	commit, err := Load(ctx, h.store, hash)
+	if err != nil {
+		return fmt.Errorf("cannot load commit %x: %v", hash, err)
+	}
+	heap.Push(&h.queue, historyItem{hash: hash, commit: commit})
+	return nil
+}
+
+type historyItem struct {
+	hash   cask.Hash
+	commit Commit
+}
+
+// historyQueue orders commits newest first.
+type historyQueue []historyItem
+
+var _ heap.Interface = (*historyQueue)(nil)
+
+func (q historyQueue) Len() int {
+	return len(q)
+}
+
+func (q historyQueue) Less(i, j int) bool {
+	return q[i].commit.Time.After(q[j].commit.Time)
+}
+
+func (q historyQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q *historyQueue) Push(x interface{}) {
+	*q = append(*q, x.(historyItem))
+}
+
+func (q *historyQueue) Pop() interface{} {
+	last := len(*q) - 1
+	item := (*q)[last]
+	*q = (*q)[:last]
+	return item
+}
@@ -0,0 +1,98 @@
+package caskcommit_test
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"borkshop/cask"
+	"borkshop/cask/blob"
+	"borkshop/cask/commit"
+	"borkshop/cask/memstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreLoad(t *testing.T) {
+	ctx := context.Background()
+	store := caskmemstore.New()
+
+	expected := caskcommit.Commit{
+		Tree:    cask.Hash{1},
+		Parents: []cask.Hash{{2}, {3}},
+		Time:    time.Unix(1500000000, 42),
+		Message: "Initial import\n",
+	}
+	hash, err := caskcommit.Store(ctx, store, expected)
+	require.NoError(t, err)
+
+	actual, err := caskcommit.Load(ctx, store, hash)
+	require.NoError(t, err)
+	assert.Equal(t, expected.Tree, actual.Tree)
+	assert.Equal(t, expected.Parents, actual.Parents)
+	assert.True(t, expected.Time.Equal(actual.Time))
+	assert.Equal(t, expected.Message, actual.Message)
+
+	peeled, err := caskcommit.Peel(ctx, store, hash)
+	require.NoError(t, err)
+	assert.Equal(t, cask.Hash{1}, peeled)
+}
+
+func TestNotCommit(t *testing.T) {
+	ctx := context.Background()
+	store := caskmemstore.New()
+
+	hash, err := caskblob.WriteString(ctx, store, "cask commit\nnot really")
+	require.NoError(t, err)
+
+	_, err = caskcommit.Load(ctx, store, hash)
+	assert.Equal(t, caskcommit.ErrNotCommit, err)
+
+	peeled, err := caskcommit.Peel(ctx, store, hash)
+	require.NoError(t, err)
+	assert.Equal(t, hash, peeled)
+}
+
+func TestMessageTooLong(t *testing.T) {
+	ctx := context.Background()
+	store := caskmemstore.New()
+
+	_, err := caskcommit.Store(ctx, store, caskcommit.Commit{
+		Message: string(make([]byte, cask.BlockSize)),
+	})
+	assert.Error(t, err)
+}
+
+func TestHistory(t *testing.T) {
+	ctx := context.Background()
+	store := caskmemstore.New()
+	start := time.Unix(1500000000, 0)
+
+	// a <- b <- d
+	//  \       /
+	//   <- c <-
+	a, err := caskcommit.Store(ctx, store, caskcommit.Commit{Tree: cask.Hash{1}, Time: start, Message: "a"})
+	require.NoError(t, err)
+	b, err := caskcommit.Store(ctx, store, caskcommit.Commit{Tree: cask.Hash{2}, Time: start.Add(1), Parents: []cask.Hash{a}, Message: "b"})
+	require.NoError(t, err)
+	c, err := caskcommit.Store(ctx, store, caskcommit.Commit{Tree: cask.Hash{3}, Time: start.Add(2), Parents: []cask.Hash{a}, Message: "c"})
+	require.NoError(t, err)
+	d, err := caskcommit.Store(ctx, store, caskcommit.Commit{Tree: cask.Hash{4}, Time: start.Add(3), Parents: []cask.Hash{b, c}, Message: "d"})
+	require.NoError(t, err)
+
+	history := caskcommit.NewHistory(store, d)
+	var hashes []cask.Hash
+	var messages []string
+	for {
+		hash, commit, err := history.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		hashes = append(hashes, hash)
+		messages = append(messages, commit.Message)
+	}
+	assert.Equal(t, []cask.Hash{d, c, b, a}, hashes)
+	assert.Equal(t, []string{"d", "c", "b", "a"}, messages)
+}
@@ -0,0 +1,191 @@
+// Package caskcrypt provides a content address store that encrypts blocks
+// before they reach an underlying store, so that untrusted peers and disks
+// hold only ciphertext.
+//
+// The store uses convergent encryption.
+// The key of each block derives from the hash of its content and a secret
+// key that a team shares, so the same content always encrypts to the same
+// ciphertext under the same address, and the underlying store still
+// deduplicates blocks.
+// Without the secret key, an observer can neither read a block nor confirm a
+// guess of its content.
+//
+// The store presents the plaintext blocks at their usual hashes.
+// Underneath, it stores each block encrypted with AES-256 in counter mode,
+// under an address derived from the block key.
+// The underlying store cannot see the links of encrypted blocks, so it can
+// neither traverse nor garbage collect their trees on its own, and a check of
+// the underlying store reports every encrypted block as corrupt.
+package caskcrypt
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"borkshop/cask"
+)
+
+// KeySize is the number of bytes in a secret key (32).
+const KeySize = 32
+
+// Key is a secret key that a team shares to encrypt and decrypt blocks.
+type Key [KeySize]byte
+
+// ErrCorrupt indicates that a block does not decrypt to content that matches
+// its hash, either because it was encrypted with another key or because it
+// was altered.
+var ErrCorrupt = errors.New("encrypted block does not match its hash")
+
+// NewKey returns a random secret key.
+func NewKey() (Key, error) {
+	var key Key
+	_, err := rand.Read(key[:])
+	return key, err
+}
+
+// ParseKey parses a secret key from hex.
+func ParseKey(str string) (Key, error) {
+	var key Key
+	if buf, err := hex.DecodeString(str); err != nil || len(buf) != KeySize {
+		return key, fmt.Errorf("invalid key: %s", str)
+	} else {
+		copy(key[:], buf)
+	}
+	return key, nil
+}
+
+// Store is a CAS block store that encrypts blocks into an underlying store.
+type Store struct {
+	// Backing is the underlying store, which receives only encrypted blocks.
+	Backing cask.Store
+	// Key is the secret key from which the store derives the key of each
+	// block.
+	Key Key
+}
+
+var _ cask.Store = (*Store)(nil)
+var _ cask.Checker = (*Store)(nil)
+
+// blockKey derives the key of a block from its hash.
+func (s *Store) blockKey(h cask.Hash) [KeySize]byte {
+	mac := hmac.New(sha256.New, s.Key[:])
+	mac.Write(h[:])
+	var key [KeySize]byte
+	copy(key[:], mac.Sum(nil))
+	return key
+}
+
+// Address returns the address of the encrypted block in the underlying
+// store, which is the SHA-256 hash of the block key.
+func (s *Store) Address(h cask.Hash) cask.Hash {
+	return address(s.blockKey(h))
+}
+
+func address(key [KeySize]byte) cask.Hash {
+	return cask.Hash(sha256.Sum256(key[:]))
+}
+
+// crypt encrypts or decrypts a block, which are the same operation in
+// counter mode.
+// Since every block key encrypts only the one block whose hash it derives
+// from, the counter can start at zero.
+func crypt(key [KeySize]byte, dst, src *cask.Block) {
+	c, err := aes.NewCipher(key[:])
+	if err != nil {
+		panic(fmt.Sprintf("assertion failed: %v", err))
+	}
+	var iv [aes.BlockSize]byte
+	cipher.NewCTR(c, iv[:]).XORKeyStream(dst[:], src[:])
+}
+
+// Store encrypts a block and writes it to the underlying store.
+func (s *Store) Store(ctx context.Context, h cask.Hash, b *cask.Block) error {
+	key := s.blockKey(h)
+	var encrypted cask.Block
+	crypt(key, &encrypted, b)
+	return s.Backing.Store(ctx, address(key), &encrypted)
+}
+
+// Load reads an encrypted block from the underlying store and decrypts it,
+// failing if the decrypted block does not match its hash.
+func (s *Store) Load(ctx context.Context, h cask.Hash, b *cask.Block) error {
+	key := s.blockKey(h)
+	var encrypted cask.Block
+	if err := s.Backing.Load(ctx, address(key), &encrypted); err != nil {
+		return err
+	}
+	var decrypted cask.Block
+	crypt(key, &decrypted, &encrypted)
+	if decrypted.Hash() != h {
+		return ErrCorrupt
+	}
+	*b = decrypted
+	return nil
+}
+
+// Has reports whether the underlying store contains the encrypted block for
+// each hash.
+//
+// Stores that do not implement cask.Checker are assumed to contain none of
+// the blocks.
+func (s *Store) Has(ctx context.Context, hs []cask.Hash) ([]bool, error) {
+	checker, ok := s.Backing.(cask.Checker)
+	if !ok {
+		return make([]bool, len(hs)), nil
+	}
+	addresses := make([]cask.Hash, len(hs))
+	for i, h := range hs {
+		addresses[i] = s.Address(h)
+	}
+	return checker.Has(ctx, addresses)
+}
+
+// KeyedHash is the hash of a block with the secret key that decrypts it.
+//
+// A keyed hash is not a capability for the tree it addresses.
+// The key is the team's secret key, which decrypts every block stored with
+// it, so share a keyed hash only within the team that shares the key.
+type KeyedHash struct {
+	Hash cask.Hash
+	Key  Key
+}
+
+// String formats a keyed hash as the hash and the key in hex, joined by a
+// plus sign.
+func (k KeyedHash) String() string {
+	return hex.EncodeToString(k.Hash[:]) + "+" + hex.EncodeToString(k.Key[:])
+}
+
+// IsKeyedHash reports whether a string has the form of a keyed hash, a hash
+// and a key joined by a plus sign, without validating them.
+func IsKeyedHash(str string) bool {
+	return strings.Contains(str, "+")
+}
+
+// ParseKeyedHash parses a keyed hash from its string form.
+func ParseKeyedHash(str string) (KeyedHash, error) {
+	var k KeyedHash
+	parts := strings.SplitN(str, "+", 2)
+	if len(parts) != 2 {
+		return k, fmt.Errorf("invalid keyed hash: %s", str)
+	}
+	if buf, err := hex.DecodeString(parts[0]); err != nil || len(buf) != cask.HashSize {
+		return k, fmt.Errorf("invalid keyed hash: %s", parts[0])
+	} else {
+		copy(k.Hash[:], buf)
+	}
+	key, err := ParseKey(parts[1])
+	if err != nil {
+		return k, err
+	}
+	k.Key = key
+	return k, nil
+}
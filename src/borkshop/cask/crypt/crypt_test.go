@@ -0,0 +1,104 @@
+package caskcrypt_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"borkshop/cask"
+	"borkshop/cask/crypt"
+	"borkshop/cask/dir"
+	"borkshop/cask/io"
+	"borkshop/cask/memstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/osfs"
+)
+
+func TestStoreThenLoad(t *testing.T) {
+	ctx := context.Background()
+	key, err := caskcrypt.NewKey()
+	require.NoError(t, err)
+	backing := caskmemstore.New()
+	store := &caskcrypt.Store{Backing: backing, Key: key}
+
+	hash, err := caskdir.Store(ctx, store, osfs.New(".."), "testdata/nominal")
+	require.NoError(t, err)
+
+	fs := memfs.New()
+	err = caskdir.Load(ctx, store, fs, ".", hash)
+	require.NoError(t, err)
+	again, err := caskdir.Store(ctx, caskmemstore.New(), fs, "")
+	require.NoError(t, err)
+	assert.Equal(t, hash, again)
+
+	// The backing store has the encrypted blocks at other addresses.
+	plain := caskmemstore.New()
+	_, err = caskdir.Store(ctx, plain, osfs.New(".."), "testdata/nominal")
+	require.NoError(t, err)
+	bom, err := caskio.BOM(ctx, plain, hash)
+	require.NoError(t, err)
+	for h := range bom {
+		have, err := backing.Has(ctx, []cask.Hash{h, store.Address(h)})
+		require.NoError(t, err)
+		assert.Equal(t, []bool{false, true}, have)
+
+		var b, e cask.Block
+		require.NoError(t, plain.Load(ctx, h, &b))
+		require.NoError(t, backing.Load(ctx, store.Address(h), &e))
+		assert.False(t, bytes.Contains(e[:], b[4:b.Size()]), "ciphertext contains plaintext")
+	}
+
+	have, err := store.Has(ctx, []cask.Hash{hash, {1}})
+	require.NoError(t, err)
+	assert.Equal(t, []bool{true, false}, have)
+}
+
+func TestConvergence(t *testing.T) {
+	ctx := context.Background()
+	key1, err := caskcrypt.NewKey()
+	require.NoError(t, err)
+	key2, err := caskcrypt.NewKey()
+	require.NoError(t, err)
+
+	model := cask.Model{Bytes: []byte("hello")}
+	var b cask.Block
+	require.NoError(t, model.Put(&b))
+	h := b.Hash()
+
+	// The same content under the same key has the same address, regardless
+	// of the backing store.
+	store1 := &caskcrypt.Store{Backing: caskmemstore.New(), Key: key1}
+	store2 := &caskcrypt.Store{Backing: caskmemstore.New(), Key: key1}
+	store3 := &caskcrypt.Store{Backing: caskmemstore.New(), Key: key2}
+	assert.Equal(t, store1.Address(h), store2.Address(h))
+	assert.NotEqual(t, store1.Address(h), store3.Address(h))
+
+	// A tampered block fails to decrypt.
+	backing := caskmemstore.New()
+	var encrypted cask.Block
+	store1.Backing = backing
+	require.NoError(t, store1.Store(ctx, h, &b))
+	require.NoError(t, backing.Load(ctx, store1.Address(h), &encrypted))
+	encrypted[0] ^= 1
+	tampered := caskmemstore.New()
+	require.NoError(t, tampered.Store(ctx, store1.Address(h), &encrypted))
+	store2.Backing = tampered
+	assert.Equal(t, caskcrypt.ErrCorrupt, store2.Load(ctx, h, &b))
+}
+
+func TestKeyedHash(t *testing.T) {
+	key, err := caskcrypt.NewKey()
+	require.NoError(t, err)
+	c := caskcrypt.KeyedHash{Hash: cask.Hash{1, 2, 3}, Key: key}
+	assert.True(t, caskcrypt.IsKeyedHash(c.String()))
+
+	parsed, err := caskcrypt.ParseKeyedHash(c.String())
+	require.NoError(t, err)
+	assert.Equal(t, c, parsed)
+
+	_, err = caskcrypt.ParseKeyedHash("0102+0304")
+	assert.Error(t, err)
+	assert.False(t, caskcrypt.IsKeyedHash("0102"))
+}
@@ -0,0 +1,199 @@
+package caskdir
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"borkshop/cask"
+
+	billy "gopkg.in/src-d/go-billy.v4"
+	"gopkg.in/src-d/go-billy.v4/util"
+)
+
+// ChangeType indicates how an entry differs between two directory trees.
+type ChangeType int
+
+const (
+	// Added indicates an entry that exists only in the newer tree.
+	Added ChangeType = iota + 1
+	// Removed indicates an entry that exists only in the older tree.
+	Removed
+	// Modified indicates an entry whose hash or mode changed.
+	Modified
+)
+
+func (t ChangeType) String() string {
+	switch t {
+	case Added:
+		return "A"
+	case Removed:
+		return "D"
+	case Modified:
+		return "M"
+	}
+	return "?"
+}
+
+// Change represents a difference between two directory trees.
+type Change struct {
+	// Type is one of added, removed, or modified.
+	Type ChangeType
+	// Path is the slash delimited path of the entry from the root of the
+	// trees.
+	Path string
+	// Old is the entry in the older tree, absent for added entries.
+	Old Entry
+	// New is the entry in the newer tree, absent for removed entries.
+	New Entry
+}
+
+// Diff returns the changes from directory tree a to directory tree b, ordered
+// by path.
+//
+// Diff descends into directories that exist in both trees, skipping any
+// subtree that has the same hash in both, so the cost of a diff is
+// proportional to the size of the change rather than the size of the trees.
+// Added and removed directories are reported as a single change, without
+// their contents.
+// Files that differ are reported as modified, as are entries that change
+// between file and directory, and entries whose metadata changed, including
+// directories, which precede the changes within them.
+func Diff(ctx context.Context, store cask.Store, a, b cask.Hash) ([]Change, error) {
+	var changes []Change
+	if err := diff(ctx, store, "", a, b, &changes); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+func diff(ctx context.Context, store cask.Store, prefix string, a, b cask.Hash, changes *[]Change) error {
+	if a == b {
+		return nil
+	}
+	olds, err := List(ctx, store, a)
+	if err != nil {
+		return err
+	}
+	news, err := List(ctx, store, b)
+	if err != nil {
+		return err
+	}
+
+	i, j := 0, 0
+	for i < len(olds) || j < len(news) {
+		var cmp int
+		switch {
+		case i >= len(olds):
+			cmp = 1
+		case j >= len(news):
+			cmp = -1
+		default:
+			cmp = bytes.Compare(olds[i].Name, news[j].Name)
+		}
+
+		switch {
+		case cmp < 0:
+			old := olds[i]
+			*changes = append(*changes, Change{Type: Removed, Path: path.Join(prefix, string(old.Name)), Old: old})
+			i++
+		case cmp > 0:
+			new := news[j]
+			*changes = append(*changes, Change{Type: Added, Path: path.Join(prefix, string(new.Name)), New: new})
+			j++
+		default:
+			old, new := olds[i], news[j]
+			p := path.Join(prefix, string(old.Name))
+			if old.Mode == DirMode && new.Mode == DirMode {
+				if !old.Meta.equal(new.Meta) {
+					*changes = append(*changes, Change{Type: Modified, Path: p, Old: old, New: new})
+				}
+				if err := diff(ctx, store, p, old.Hash, new.Hash, changes); err != nil {
+					return err
+				}
+			} else if !old.same(new) {
+				*changes = append(*changes, Change{Type: Modified, Path: p, Old: old, New: new})
+			}
+			i++
+			j++
+		}
+	}
+	return nil
+}
+
+// Update changes a directory that holds tree a to hold tree b instead,
+// writing only the entries that differ.
+//
+// Update assumes that the directory still matches tree a, and overwrites or
+// removes local changes to the entries that differ, leaving the rest alone.
+// Directories that remain keep their own permissions and modification times.
+func Update(ctx context.Context, store cask.Store, fs billy.Filesystem, p string, a, b cask.Hash) error {
+	changes, err := Diff(ctx, store, a, b)
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		if change.Type == Modified && change.Old.Mode == DirMode && change.New.Mode == DirMode {
+			// Only the metadata of the directory changed.
+			continue
+		}
+		name := path.Join(p, change.Path)
+		if err := checkParents(fs, p, change.Path); err != nil {
+			return err
+		}
+		// Writing a file through a symbolic link would change its target, so
+		// a symbolic link gives way to whatever replaces it, as does any entry
+		// that changes mode.
+		if change.Type == Removed || (change.Type == Modified && (change.Old.Mode != change.New.Mode || change.Old.Mode == SymlinkMode)) {
+			if err := util.RemoveAll(fs, name); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if change.Type != Removed {
+			if err := loadEntry(ctx, store, fs, name, change.New); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkParents returns ErrSymlink if any directory between the root and
+// the entry at a relative path is a symbolic link, through which Update
+// would otherwise write outside the tree.
+func checkParents(fs billy.Filesystem, root, rel string) error {
+	p := root
+	for _, part := range strings.Split(path.Dir(rel), "/") {
+		if part == "." {
+			break
+		}
+		p = path.Join(p, part)
+		info, err := fs.Lstat(p)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%w: %s", ErrSymlink, p)
+		}
+	}
+	return nil
+}
+
+// same reports whether two entries have the same content, mode, and
+// metadata.
+func (entry Entry) same(other Entry) bool {
+	return entry.Hash == other.Hash && entry.Mode == other.Mode && entry.Meta.equal(other.Meta)
+}
+
+// equal reports whether two entries have the same metadata, or both lack it.
+func (meta *Meta) equal(other *Meta) bool {
+	if meta == nil || other == nil {
+		return meta == other
+	}
+	return meta.Perm == other.Perm && meta.ModTime.Equal(other.ModTime)
+}
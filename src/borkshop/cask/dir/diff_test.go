@@ -0,0 +1,327 @@
+package caskdir_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"borkshop/cask"
+	"borkshop/cask/dir"
+	"borkshop/cask/memstore"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	billy "gopkg.in/src-d/go-billy.v4"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/osfs"
+	"gopkg.in/src-d/go-billy.v4/util"
+)
+
+// storeFiles stores a directory tree with the given files, by path and
+// content.
+func storeFiles(t *testing.T, store cask.Store, files map[string]string) cask.Hash {
+	fs := memfs.New()
+	for name, content := range files {
+		err := util.WriteFile(fs, name, []byte(content), 0644)
+		require.NoError(t, err)
+	}
+	hash, err := caskdir.Store(context.Background(), store, fs, "")
+	require.NoError(t, err)
+	return hash
+}
+
+// storeMetaFiles stores a directory tree with metadata, with the given files,
+// by path and content, and directories with the given permissions, by path.
+// Every entry has the same modification time.
+func storeMetaFiles(t *testing.T, store cask.Store, files map[string]string, dirs map[string]os.FileMode) cask.Hash {
+	dir, err := ioutil.TempDir("", "caskdir")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	for name, content := range files {
+		name = filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(name), 0755))
+		require.NoError(t, ioutil.WriteFile(name, []byte(content), 0644))
+	}
+	for name, perm := range dirs {
+		require.NoError(t, os.Chmod(filepath.Join(dir, name), perm))
+	}
+	then := time.Unix(1500000000, 0)
+	require.NoError(t, filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err == nil {
+			err = os.Chtimes(name, then, then)
+		}
+		return err
+	}))
+	hash, err := caskdir.StoreConfig{Meta: true}.Store(context.Background(), store, osfs.New(dir), "")
+	require.NoError(t, err)
+	return hash
+}
+
+// loadFiles loads a directory tree and returns its files by path and
+// content.
+func loadFiles(t *testing.T, store cask.Store, hash cask.Hash) map[string]string {
+	fs := memfs.New()
+	err := caskdir.Load(context.Background(), store, fs, "", hash)
+	require.NoError(t, err)
+	files := make(map[string]string)
+	walkFiles(t, fs, "", files)
+	return files
+}
+
+func walkFiles(t *testing.T, fs billy.Filesystem, dir string, files map[string]string) {
+	infos, err := fs.ReadDir(dir)
+	require.NoError(t, err)
+	for _, info := range infos {
+		name := fs.Join(dir, info.Name())
+		if info.IsDir() {
+			walkFiles(t, fs, name, files)
+			continue
+		}
+		file, err := fs.Open(name)
+		require.NoError(t, err)
+		content, err := ioutil.ReadAll(file)
+		require.NoError(t, err)
+		file.Close()
+		files[name] = string(content)
+	}
+}
+
+func changeSummary(changes []caskdir.Change) []string {
+	summary := make([]string, 0, len(changes))
+	for _, change := range changes {
+		summary = append(summary, change.Type.String()+" "+change.Path)
+	}
+	return summary
+}
+
+func TestDiff(t *testing.T) {
+	ctx := context.Background()
+	store := caskmemstore.New()
+
+	a := storeFiles(t, store, map[string]string{
+		"same/x":      "x",
+		"same/y":      "y",
+		"changed/x":   "x",
+		"changed/y":   "y",
+		"removed/z":   "z",
+		"file":        "file",
+		"becomes-dir": "file",
+	})
+	b := storeFiles(t, store, map[string]string{
+		"same/x":        "x",
+		"same/y":        "y",
+		"changed/x":     "x",
+		"changed/y":     "Y",
+		"changed/w":     "w",
+		"added/z":       "z",
+		"file":          "FILE",
+		"becomes-dir/q": "q",
+	})
+
+	changes, err := caskdir.Diff(ctx, store, a, b)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"A added",
+		"M becomes-dir",
+		"A changed/w",
+		"M changed/y",
+		"M file",
+		"D removed",
+	}, changeSummary(changes))
+
+	assert.Equal(t, caskdir.FileMode, changes[1].Old.Mode)
+	assert.Equal(t, caskdir.DirMode, changes[1].New.Mode)
+
+	changes, err = caskdir.Diff(ctx, store, a, a)
+	require.NoError(t, err)
+	assert.Len(t, changes, 0)
+}
+
+func TestDiffMeta(t *testing.T) {
+	ctx := context.Background()
+	store := caskmemstore.New()
+
+	files := map[string]string{"dir/x": "x", "same/x": "x"}
+	a := storeMetaFiles(t, store, files, map[string]os.FileMode{"dir": 0755})
+	b := storeMetaFiles(t, store, files, map[string]os.FileMode{"dir": 0700})
+
+	changes, err := caskdir.Diff(ctx, store, a, b)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"M dir"}, changeSummary(changes))
+
+	// Update leaves the permissions of remaining directories alone.
+	fs := memfs.New()
+	require.NoError(t, caskdir.Load(ctx, store, fs, "checkout", a))
+	require.NoError(t, caskdir.Update(ctx, store, fs, "checkout", a, b))
+	got := make(map[string]string)
+	walkFiles(t, fs, "checkout", got)
+	assert.Equal(t, map[string]string{"checkout/dir/x": "x", "checkout/same/x": "x"}, got)
+}
+
+func TestUpdate(t *testing.T) {
+	ctx := context.Background()
+	store := caskmemstore.New()
+
+	a := storeFiles(t, store, map[string]string{
+		"same/x":         "x",
+		"changed/y":      "y",
+		"removed/z":      "z",
+		"file":           "file",
+		"becomes-dir":    "file",
+		"becomes-file/q": "q",
+	})
+	b := storeFiles(t, store, map[string]string{
+		"same/x":        "x",
+		"changed/y":     "Y",
+		"added/z":       "z",
+		"file":          "FILE",
+		"becomes-dir/q": "q",
+		"becomes-file":  "file",
+	})
+
+	fs := memfs.New()
+	require.NoError(t, caskdir.Load(ctx, store, fs, "checkout", a))
+	// Entries that do not change survive, local changes and all.
+	require.NoError(t, util.WriteFile(fs, "checkout/same/x", []byte("local"), 0644))
+
+	require.NoError(t, caskdir.Update(ctx, store, fs, "checkout", a, b))
+	files := make(map[string]string)
+	walkFiles(t, fs, "checkout", files)
+	assert.Equal(t, map[string]string{
+		"checkout/same/x":        "local",
+		"checkout/changed/y":     "Y",
+		"checkout/added/z":       "z",
+		"checkout/file":          "FILE",
+		"checkout/becomes-dir/q": "q",
+		"checkout/becomes-file":  "file",
+	}, files)
+}
+
+func TestMerge(t *testing.T) {
+	ctx := context.Background()
+	store := caskmemstore.New()
+
+	base := storeFiles(t, store, map[string]string{
+		"a":     "a",
+		"b":     "b",
+		"dir/x": "x",
+		"dir/y": "y",
+	})
+	ours := storeFiles(t, store, map[string]string{
+		"a":     "A",
+		"b":     "b",
+		"dir/x": "X",
+		"dir/y": "y",
+		"ours":  "ours",
+	})
+	theirs := storeFiles(t, store, map[string]string{
+		"a":      "a",
+		"dir/x":  "x",
+		"dir/y":  "Y",
+		"theirs": "theirs",
+	})
+
+	merged, conflicts, err := caskdir.Merge(ctx, store, base, ours, theirs)
+	require.NoError(t, err)
+	assert.Len(t, conflicts, 0)
+	assert.Equal(t, map[string]string{
+		"a":      "A",
+		"dir/x":  "X",
+		"dir/y":  "Y",
+		"ours":   "ours",
+		"theirs": "theirs",
+	}, loadFiles(t, store, merged))
+
+	// Merging is symmetric, absent conflicts.
+	merged2, conflicts, err := caskdir.Merge(ctx, store, base, theirs, ours)
+	require.NoError(t, err)
+	assert.Len(t, conflicts, 0)
+	assert.Equal(t, merged, merged2)
+
+	// Merging with an ancestor is a fast forward.
+	merged, conflicts, err = caskdir.Merge(ctx, store, base, base, theirs)
+	require.NoError(t, err)
+	assert.Len(t, conflicts, 0)
+	assert.Equal(t, theirs, merged)
+}
+
+func TestMergeMeta(t *testing.T) {
+	ctx := context.Background()
+	store := caskmemstore.New()
+
+	// Both sides change the contents of both directories, but only ours
+	// changes the permissions of one.
+	base := storeMetaFiles(t, store, map[string]string{
+		"changed/x": "x",
+		"same/x":    "x",
+	}, map[string]os.FileMode{"changed": 0755, "same": 0750})
+	ours := storeMetaFiles(t, store, map[string]string{
+		"changed/x": "X",
+		"same/x":    "X",
+	}, map[string]os.FileMode{"changed": 0700, "same": 0750})
+	theirs := storeMetaFiles(t, store, map[string]string{
+		"changed/x": "x",
+		"changed/y": "y",
+		"same/x":    "x",
+		"same/y":    "y",
+	}, map[string]os.FileMode{"changed": 0755, "same": 0750})
+
+	merged, conflicts, err := caskdir.Merge(ctx, store, base, ours, theirs)
+	require.NoError(t, err)
+	assert.Len(t, conflicts, 0)
+	entries, err := caskdir.List(ctx, store, merged)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.NotNil(t, entries[0].Meta)
+	assert.Equal(t, os.FileMode(0700), entries[0].Meta.Perm, "from the side that changed it")
+	require.NotNil(t, entries[1].Meta)
+	assert.Equal(t, os.FileMode(0750), entries[1].Meta.Perm, "from the base")
+
+	merged2, conflicts, err := caskdir.Merge(ctx, store, base, theirs, ours)
+	require.NoError(t, err)
+	assert.Len(t, conflicts, 0)
+	assert.Equal(t, merged, merged2)
+}
+
+func TestMergeConflicts(t *testing.T) {
+	ctx := context.Background()
+	store := caskmemstore.New()
+
+	base := storeFiles(t, store, map[string]string{
+		"both":    "base",
+		"deleted": "base",
+		"dir/x":   "x",
+	})
+	ours := storeFiles(t, store, map[string]string{
+		"both":    "ours",
+		"deleted": "ours",
+		"dir/x":   "x",
+		"added":   "ours",
+	})
+	theirs := storeFiles(t, store, map[string]string{
+		"both":  "theirs",
+		"dir/x": "x",
+		"added": "theirs",
+	})
+
+	merged, conflicts, err := caskdir.Merge(ctx, store, base, ours, theirs)
+	require.NoError(t, err)
+
+	paths := make([]string, 0, len(conflicts))
+	for _, conflict := range conflicts {
+		paths = append(paths, conflict.Path)
+	}
+	assert.Equal(t, []string{"added", "both", "deleted"}, paths)
+	assert.Equal(t, caskdir.Mode(0), conflicts[0].Base.Mode, "absent from base")
+	assert.Equal(t, caskdir.Mode(0), conflicts[2].Theirs.Mode, "absent from theirs")
+
+	assert.Equal(t, map[string]string{
+		"added":   "ours",
+		"both":    "ours",
+		"deleted": "ours",
+		"dir/x":   "x",
+	}, loadFiles(t, store, merged))
+}
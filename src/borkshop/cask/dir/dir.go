@@ -11,6 +11,7 @@ import (
 	"path"
 	"sort"
 	"strings"
+	"time"
 
 	"borkshop/cask"
 	"borkshop/cask/blob"
@@ -31,8 +32,70 @@ const (
 	DirMode
 	// ExecMode indicates an executable file.
 	ExecMode
+	// SymlinkMode indicates a symbolic link, whose hash addresses the link
+	// target as a blob.
+	SymlinkMode
 )
 
+// Entries are encoded in the leaf blocks of a directory as a link to the
+// entry's content and a header, optional metadata, and name.
+//
+//	link:32 = hash
+//	bytes = mode:2, namelen:2, [perm:2, mtime:8], name
+//
+// The high bit of the mode indicates that the entry carries metadata, so
+// directories stored without metadata keep their prior encoding.
+const (
+	headerSize = 4
+	metaSize   = 10
+	metaFlag   = 0x8000
+)
+
+// Meta is optional POSIX metadata for a file or directory entry.
+type Meta struct {
+	// Perm is the permission bits, including setuid, setgid, and sticky.
+	Perm os.FileMode
+	// ModTime is the modification time, to the nanosecond.
+	ModTime time.Time
+}
+
+func metaOf(info os.FileInfo) *Meta {
+	return &Meta{
+		Perm:    info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky),
+		ModTime: info.ModTime(),
+	}
+}
+
+// posixPerm converts permission bits to their POSIX encoding.
+func posixPerm(mode os.FileMode) uint16 {
+	perm := uint16(mode & os.ModePerm)
+	if mode&os.ModeSetuid != 0 {
+		perm |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		perm |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		perm |= 01000
+	}
+	return perm
+}
+
+// filePerm converts POSIX permission bits to their Go representation.
+func filePerm(perm uint16) os.FileMode {
+	mode := os.FileMode(perm) & os.ModePerm
+	if perm&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if perm&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if perm&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
 // entries are sorted by the byte value of their name to facilitate fast
 // search.
 
@@ -42,11 +105,15 @@ type Entry struct {
 	// B-tree.
 	Hash cask.Hash
 
-	// Mode is the type of the entry, file or directory.
+	// Mode is the type of the entry, file, directory, or symbolic link.
 	Mode Mode
 
 	// Name is the name of the entry, as bytes.
 	Name []byte
+
+	// Meta is the metadata of the entry, or nil if the entry was stored
+	// without metadata.
+	Meta *Meta
 }
 
 // Entries are ordered by name.
@@ -74,52 +141,26 @@ func (e entries) Swap(i, j int) {
 // Store reads a directory tree from a filesystem and writes it as blocks to a
 // content address store.
 func Store(ctx context.Context, store cask.Store, fs billy.Filesystem, p string) (cask.Hash, error) {
-	writer := caskio.NewWriter(store)
-
-	dirEnts, err := fs.ReadDir(p)
-	if err != nil {
-		return cask.ZeroHash, err
-	}
+	return StoreConfig{}.Store(ctx, store, fs, p)
+}
 
-	entries := make(entries, 0, len(dirEnts))
-	for _, dirEnt := range dirEnts {
-		var err error
-		mode := NoMode
-		hash := cask.ZeroHash
-		name := path.Join(p, dirEnt.Name())
-		if dirEnt.IsDir() {
-			mode = DirMode
-			hash, err = Store(ctx, store, fs, name)
-			if err != nil {
-				return cask.ZeroHash, err
-			}
-		} else if dirEnt.Mode().IsRegular() {
-			if dirEnt.Mode()&0111 == 0 {
-				mode = FileMode
-			} else {
-				mode = ExecMode
-			}
-			reader, err := fs.Open(name)
-			if err != nil {
-				return cask.ZeroHash, err
-			}
-			hash, err = caskblob.Store(ctx, store, reader)
-			if err != nil {
-				return cask.ZeroHash, err
-			}
-		} else {
-			continue
+// storeEntries writes a sorted list of entries as a directory B-tree.
+func storeEntries(ctx context.Context, store cask.Store, entries []Entry) (cask.Hash, error) {
+	writer := caskio.NewWriter(store)
+	for _, entry := range entries {
+		var buf [headerSize + metaSize]byte
+		header := buf[:headerSize]
+		mode := uint16(entry.Mode)
+		if entry.Meta != nil {
+			header = buf[:]
+			mode |= metaFlag
+			binary.BigEndian.PutUint16(buf[4:6], posixPerm(entry.Meta.Perm))
+			binary.BigEndian.PutUint64(buf[6:14], uint64(entry.Meta.ModTime.UnixNano()))
 		}
-		entries = append(entries, Entry{
-			Name: []byte(dirEnt.Name()),
-			Mode: mode,
-			Hash: hash,
-		})
-	}
+		binary.BigEndian.PutUint16(buf[0:2], mode)
+		binary.BigEndian.PutUint16(buf[2:4], uint16(len(entry.Name)))
 
-	sort.Sort(entries)
-	for _, entry := range entries {
-		if writer.Size()+cask.HashSize+4+len(entry.Name) > cask.BlockSize {
+		if writer.Size()+cask.HashSize+len(header)+len(entry.Name) > cask.BlockSize {
 			if err := writer.Flush(ctx); err != nil {
 				return cask.ZeroHash, err
 			}
@@ -128,10 +169,7 @@ func Store(ctx context.Context, store cask.Store, fs billy.Filesystem, p string)
 		if err != nil {
 			return cask.ZeroHash, err
 		}
-		var buf [4]byte
-		binary.BigEndian.PutUint16(buf[0:2], uint16(entry.Mode))
-		binary.BigEndian.PutUint16(buf[2:4], uint16(len(entry.Name)))
-		err = writer.Copy(ctx, buf[:])
+		err = writer.Copy(ctx, header)
 		if err != nil {
 			return cask.ZeroHash, err
 		}
@@ -144,56 +182,175 @@ func Store(ctx context.Context, store cask.Store, fs billy.Filesystem, p string)
 	return writer.Sum(ctx)
 }
 
+// ErrInvalidName indicates a directory entry whose name is empty, is . or
+// .., contains a slash or NUL, or does not follow the name of the entry
+// before it in byte order, which a directory read from a filesystem cannot
+// produce.
+// Such names could otherwise place files outside the directory they load
+// into.
+var ErrInvalidName = errors.New("invalid directory entry name")
+
+func validName(name []byte) bool {
+	s := string(name)
+	return s != "" && s != "." && s != ".." && !strings.ContainsAny(s, "/\x00")
+}
+
+// entryReader reads the entries of a directory, leaf by leaf, checking that
+// every name is valid and that names strictly ascend across leaves.
+type entryReader struct {
+	reader *caskio.Reader
+	last   []byte
+}
+
+func newEntryReader(store cask.Store, h cask.Hash) *entryReader {
+	return &entryReader{reader: caskio.NewReader(store, h)}
+}
+
+// next returns the entries of the next leaf, or io.EOF.
+func (r *entryReader) next(ctx context.Context) ([]Entry, error) {
+	links, buf, err := r.reader.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := decodeEntries(links, buf)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !validName(entry.Name) || (r.last != nil && bytes.Compare(r.last, entry.Name) >= 0) {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidName, entry.Name)
+		}
+		r.last = entry.Name
+	}
+	return entries, nil
+}
+
+// decodeEntries decodes the entries of a directory leaf block.
+func decodeEntries(links []cask.Hash, buf []byte) ([]Entry, error) {
+	entries := make([]Entry, 0, len(links))
+	at := 0
+	for _, link := range links {
+		if at+headerSize > len(buf) {
+			return nil, errors.New("truncated directory entry")
+		}
+		mode := binary.BigEndian.Uint16(buf[at : at+2])
+		namelen := int(binary.BigEndian.Uint16(buf[at+2 : at+4]))
+		at += headerSize
+
+		var meta *Meta
+		if mode&metaFlag != 0 {
+			if at+metaSize > len(buf) {
+				return nil, errors.New("truncated directory entry")
+			}
+			meta = &Meta{
+				Perm:    filePerm(binary.BigEndian.Uint16(buf[at : at+2])),
+				ModTime: time.Unix(0, int64(binary.BigEndian.Uint64(buf[at+2:at+10]))),
+			}
+			at += metaSize
+		}
+
+		if at+namelen > len(buf) {
+			return nil, errors.New("truncated directory entry")
+		}
+		entries = append(entries, Entry{
+			Name: buf[at : at+namelen],
+			Mode: Mode(mode &^ metaFlag),
+			Hash: link,
+			Meta: meta,
+		})
+		at += namelen
+	}
+	return entries, nil
+}
+
 // Load reads blocks from a content address store and builds a directory tree
 // on a given filesystem.
+//
+// Load applies the permissions and modification times of entries stored
+// with metadata if the filesystem supports changing them, and otherwise
+// creates files and directories with default permissions.
 func Load(ctx context.Context, store cask.Store, fs billy.Filesystem, p string, h cask.Hash) error {
-	reader := caskio.NewReader(store, h)
+	reader := newEntryReader(store, h)
 	for {
-		links, buf, err := reader.Next(ctx)
+		entries, err := reader.next(ctx)
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
 			return err
 		}
-		at := 0
-		for _, link := range links {
-			mode := Mode(binary.BigEndian.Uint16(buf[at : at+2]))
-			namelen := int(binary.BigEndian.Uint16(buf[at+2 : at+4]))
-			name := string(buf[at+4 : at+4+namelen])
-
-			var perm os.FileMode
-			switch mode {
-			case DirMode, ExecMode:
-				perm = 0755
-			case FileMode:
-				perm = 0644
+		for _, entry := range entries {
+			if err := loadEntry(ctx, store, fs, path.Join(p, string(entry.Name)), entry); err != nil {
+				return err
 			}
+		}
+	}
+	return nil
+}
 
-			switch mode {
-			case DirMode:
-				err := fs.MkdirAll(path.Join(p, name), perm)
-				if err != nil {
-					return err
-				}
-				err = Load(ctx, store, fs, path.Join(p, name), link)
-				if err != nil {
-					return err
-				}
-			case FileMode, ExecMode:
-				writer, err := fs.OpenFile(path.Join(p, name), os.O_WRONLY|os.O_CREATE, perm)
-				if err != nil {
-					return err
-				}
-				err = caskblob.Load(ctx, store, writer, link)
-				if err != nil {
-					return err
-				}
-			default:
-				return fmt.Errorf("unexpected mode")
-			}
+func loadEntry(ctx context.Context, store cask.Store, fs billy.Filesystem, name string, entry Entry) error {
+	// Creating a file or directory through a symbolic link would write
+	// wherever the link points, so an existing link gives way to the entry.
+	if info, err := fs.Lstat(name); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if err := fs.Remove(name); err != nil {
+			return err
+		}
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var perm os.FileMode
+	switch entry.Mode {
+	case DirMode, ExecMode:
+		perm = 0755
+	case FileMode:
+		perm = 0644
+	}
 
-			at += 4 + namelen
+	switch entry.Mode {
+	case DirMode:
+		err := fs.MkdirAll(name, perm)
+		if err != nil {
+			return err
+		}
+		err = Load(ctx, store, fs, name, entry.Hash)
+		if err != nil {
+			return err
+		}
+	case FileMode, ExecMode:
+		writer, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+		if err != nil {
+			return err
+		}
+		err = caskblob.Load(ctx, store, writer, entry.Hash)
+		if closeErr := writer.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	case SymlinkMode:
+		var target bytes.Buffer
+		if err := caskblob.Load(ctx, store, &target, entry.Hash); err != nil {
+			return err
+		}
+		if err := fs.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		// Symbolic links carry no metadata.
+		return fs.Symlink(target.String(), name)
+	default:
+		return fmt.Errorf("unexpected mode")
+	}
+
+	// Apply metadata last, so that the modification time of a directory
+	// follows the creation of its entries.
+	if changer, ok := fs.(billy.Change); ok && entry.Meta != nil {
+		if err := changer.Chmod(name, entry.Meta.Perm); err != nil {
+			return err
+		}
+		if err := changer.Chtimes(name, entry.Meta.ModTime, entry.Meta.ModTime); err != nil {
+			return err
 		}
 	}
 	return nil
@@ -201,36 +358,34 @@ func Load(ctx context.Context, store cask.Store, fs billy.Filesystem, p string,
 
 // List reads a directory and returns a list of entries.
 func List(ctx context.Context, store cask.Store, h cask.Hash) ([]Entry, error) {
-	reader := caskio.NewReader(store, h)
+	reader := newEntryReader(store, h)
 	// TODO expose API on reader for guessing the necessary capacity.
 	entries := make([]Entry, 0, 0)
 	for {
-		links, buf, err := reader.Next(ctx)
+		leaf, err := reader.next(ctx)
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
 			return nil, err
 		}
-		at := 0
-		for _, link := range links {
-			mode := Mode(binary.BigEndian.Uint16(buf[at : at+2]))
-			namelen := int(binary.BigEndian.Uint16(buf[at+2 : at+4]))
-			name := buf[at+4 : at+4+namelen]
-
-			entries = append(entries, Entry{
-				Name: name,
-				Mode: mode,
-				Hash: link,
-			})
-
-			at += 4 + namelen
-		}
+		entries = append(entries, leaf...)
 	}
 
 	return entries, nil
 }
 
+var (
+	// ErrNotFound indicates that a path does not name an entry.
+	ErrNotFound = errors.New("not found")
+	// ErrNotDir indicates that a path descends through an entry that is not
+	// a directory.
+	ErrNotDir = errors.New("cannot open file as dir")
+	// ErrSymlink indicates a path that descends through a symbolic link on
+	// the filesystem, where a directory was expected.
+	ErrSymlink = errors.New("cannot descend through symbolic link")
+)
+
 // Resolve traverses a directory tree to the entry at the given path from the hash.
 func Resolve(ctx context.Context, store cask.Store, h cask.Hash, p string) (Entry, error) {
 	parts := strings.SplitN(p, "/", 2)
@@ -240,38 +395,27 @@ func Resolve(ctx context.Context, store cask.Store, h cask.Hash, p string) (Entr
 		tail = parts[1]
 	}
 
-	reader := caskio.NewReader(store, h)
+	reader := newEntryReader(store, h)
 	for {
-		links, buf, err := reader.Next(ctx)
+		entries, err := reader.next(ctx)
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
 			return Entry{}, err
 		}
-		at := 0
-		for _, link := range links {
-			mode := Mode(binary.BigEndian.Uint16(buf[at : at+2]))
-			namelen := int(binary.BigEndian.Uint16(buf[at+2 : at+4]))
-			name := buf[at+4 : at+4+namelen]
-
-			if string(name) == head {
+		for _, entry := range entries {
+			if string(entry.Name) == head {
 				if tail == "" {
-					return Entry{
-						Name: name,
-						Mode: mode,
-						Hash: link,
-					}, nil
-				} else if mode == DirMode {
-					return Resolve(ctx, store, link, tail)
+					return entry, nil
+				} else if entry.Mode == DirMode {
+					return Resolve(ctx, store, entry.Hash, tail)
 				} else {
-					return Entry{}, fmt.Errorf("cannot open file as dir: %s", string(name))
+					return Entry{}, fmt.Errorf("%w: %s", ErrNotDir, string(entry.Name))
 				}
 			}
-
-			at += 4 + namelen
 		}
 	}
 
-	return Entry{}, errors.New("not found")
+	return Entry{}, ErrNotFound
 }
@@ -3,15 +3,19 @@ package caskdir_test
 import (
 	"context"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"borkshop/cask/dir"
 	"borkshop/cask/memstore"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	billy "gopkg.in/src-d/go-billy.v4"
 	"gopkg.in/src-d/go-billy.v4/memfs"
 	"gopkg.in/src-d/go-billy.v4/osfs"
 )
@@ -102,3 +106,90 @@ func TestResolveFileAsDir(t *testing.T) {
 	_, err = caskdir.Resolve(ctx, store, dataHash, "nominal/0/0.names/bogus")
 	require.Error(t, err, "not dir")
 }
+
+// changeFS adds support for changing permissions and times to a filesystem
+// rooted at a directory on the host.
+type changeFS struct {
+	billy.Filesystem
+	root string
+}
+
+func (fs changeFS) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(filepath.Join(fs.root, name), mode)
+}
+
+func (fs changeFS) Lchown(name string, uid, gid int) error {
+	return os.Lchown(filepath.Join(fs.root, name), uid, gid)
+}
+
+func (fs changeFS) Chown(name string, uid, gid int) error {
+	return os.Chown(filepath.Join(fs.root, name), uid, gid)
+}
+
+func (fs changeFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return os.Chtimes(filepath.Join(fs.root, name), atime, mtime)
+}
+
+func TestSymlinksAndMeta(t *testing.T) {
+	ctx := context.Background()
+	store := caskmemstore.New()
+	source, err := ioutil.TempDir("", "caskdir")
+	require.NoError(t, err)
+	defer os.RemoveAll(source)
+	target, err := ioutil.TempDir("", "caskdir")
+	require.NoError(t, err)
+	defer os.RemoveAll(target)
+
+	then := time.Unix(1500000000, 123456789)
+	require.NoError(t, os.Mkdir(filepath.Join(source, "sub"), 0750))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(source, "sub", "secret"), []byte("secret"), 0600))
+	require.NoError(t, os.Chmod(filepath.Join(source, "sub", "secret"), 0600))
+	require.NoError(t, os.Chtimes(filepath.Join(source, "sub", "secret"), then, then))
+	require.NoError(t, os.Symlink("sub/secret", filepath.Join(source, "link")))
+	require.NoError(t, os.Chtimes(filepath.Join(source, "sub"), then, then))
+
+	// Without metadata, symbolic links are still recorded.
+	plain, err := caskdir.Store(ctx, store, osfs.New(source), "")
+	require.NoError(t, err)
+	entries, err := caskdir.List(ctx, store, plain)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "link", string(entries[0].Name))
+	assert.Equal(t, caskdir.SymlinkMode, entries[0].Mode)
+	assert.Nil(t, entries[0].Meta)
+	assert.Nil(t, entries[1].Meta)
+
+	hash, err := caskdir.StoreConfig{Meta: true}.Store(ctx, store, osfs.New(source), "")
+	require.NoError(t, err)
+	assert.NotEqual(t, plain, hash, "metadata changes the hash")
+	entries, err = caskdir.List(ctx, store, hash)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Nil(t, entries[0].Meta, "symbolic links carry no metadata")
+	require.NotNil(t, entries[1].Meta)
+	assert.Equal(t, os.FileMode(0750), entries[1].Meta.Perm)
+	assert.True(t, then.Equal(entries[1].Meta.ModTime))
+
+	err = caskdir.Load(ctx, store, changeFS{osfs.New(target), target}, "", hash)
+	require.NoError(t, err)
+
+	link, err := os.Readlink(filepath.Join(target, "link"))
+	require.NoError(t, err)
+	assert.Equal(t, "sub/secret", link)
+	body, err := ioutil.ReadFile(filepath.Join(target, "link"))
+	require.NoError(t, err)
+	assert.Equal(t, "secret", string(body))
+
+	for _, name := range []string{"sub", "sub/secret"} {
+		want, err := os.Stat(filepath.Join(source, name))
+		require.NoError(t, err)
+		got, err := os.Stat(filepath.Join(target, name))
+		require.NoError(t, err)
+		assert.Equal(t, want.Mode(), got.Mode(), name)
+		assert.True(t, want.ModTime().Equal(got.ModTime()), name)
+	}
+
+	again, err := caskdir.StoreConfig{Meta: true}.Store(ctx, store, osfs.New(target), "")
+	require.NoError(t, err)
+	assert.Equal(t, hash, again, "checkout reproduces the tree")
+}
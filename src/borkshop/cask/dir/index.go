@@ -0,0 +1,208 @@
+package caskdir
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"borkshop/cask"
+
+	"go.uber.org/multierr"
+	billy "gopkg.in/src-d/go-billy.v4"
+)
+
+// IndexEntry records the hash of a file, directory, or symbolic link along
+// with the stat information it had when it was stored.
+type IndexEntry struct {
+	Hash cask.Hash
+	Mode Mode
+	// Meta indicates that a directory was stored with metadata, and
+	// ContentDefined that an entry was stored with content defined
+	// chunking, either of which changes its hash.
+	Meta           bool
+	ContentDefined bool
+	Perm           os.FileMode
+	Size           int64
+	ModTime        time.Time
+	Inode          uint64
+}
+
+// Index caches the hashes of files and directories by path, so that storing
+// a directory tree again only reads the files that changed since.
+//
+// An entry is valid while the size, modification time, inode, mode, and
+// permissions of its path remain the same.
+// A directory entry is valid only if all of its children are also valid,
+// since modifying a file does not change the modification time of its
+// directory.
+type Index struct {
+	entries map[string]IndexEntry
+}
+
+// NewIndex returns an empty index.
+func NewIndex() *Index {
+	return &Index{entries: make(map[string]IndexEntry)}
+}
+
+// Len returns the number of entries in the index.
+func (index *Index) Len() int {
+	return len(index.entries)
+}
+
+// Lookup returns the entry for a path, if any.
+func (index *Index) Lookup(p string) (IndexEntry, bool) {
+	entry, ok := index.entries[p]
+	return entry, ok
+}
+
+// ReadIndex reads an index in the format written by WriteTo.
+func ReadIndex(r io.Reader) (*Index, error) {
+	index := NewIndex()
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		p, entry, err := parseIndexLine(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("corrupt index at line %d: %v", line, err)
+		}
+		index.entries[p] = entry
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// WriteTo writes the index as a line for each path, ordered by path.
+//
+// Each line has the hash, mode, flags for the options the entry was stored
+// with, "m" for metadata and "c" for content defined chunking or "-" for
+// neither, octal permissions, size, modification time in nanoseconds since the Unix epoch,
+// inode, and quoted path, separated by spaces.
+func (index *Index) WriteTo(w io.Writer) (int64, error) {
+	paths := make([]string, 0, len(index.entries))
+	for p := range index.entries {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	var total int64
+	buf := bufio.NewWriter(w)
+	for _, p := range paths {
+		entry := index.entries[p]
+		flags := ""
+		if entry.Meta {
+			flags += "m"
+		}
+		if entry.ContentDefined {
+			flags += "c"
+		}
+		if flags == "" {
+			flags = "-"
+		}
+		n, err := fmt.Fprintf(buf, "%x %d %s %o %d %d %d %s\n", entry.Hash, entry.Mode, flags, posixPerm(entry.Perm), entry.Size, entry.ModTime.UnixNano(), entry.Inode, strconv.Quote(p))
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, buf.Flush()
+}
+
+func parseIndexLine(line string) (string, IndexEntry, error) {
+	var entry IndexEntry
+	fields := strings.SplitN(line, " ", 8)
+	if len(fields) != 8 {
+		return "", entry, fmt.Errorf("expected 8 fields, got %d", len(fields))
+	}
+	if buf, err := hex.DecodeString(fields[0]); err != nil || len(buf) != len(entry.Hash) {
+		return "", entry, fmt.Errorf("invalid hash %q", fields[0])
+	} else {
+		copy(entry.Hash[:], buf)
+	}
+	mode, err := strconv.ParseUint(fields[1], 10, 16)
+	if err != nil {
+		return "", entry, err
+	}
+	entry.Mode = Mode(mode)
+	if fields[2] != "-" {
+		for _, flag := range fields[2] {
+			switch flag {
+			case 'm':
+				entry.Meta = true
+			case 'c':
+				entry.ContentDefined = true
+			default:
+				return "", entry, fmt.Errorf("invalid flag %q", flag)
+			}
+		}
+	}
+	perm, err := strconv.ParseUint(fields[3], 8, 16)
+	if err != nil {
+		return "", entry, err
+	}
+	entry.Perm = filePerm(uint16(perm))
+	if entry.Size, err = strconv.ParseInt(fields[4], 10, 64); err != nil {
+		return "", entry, err
+	}
+	nanos, err := strconv.ParseInt(fields[5], 10, 64)
+	if err != nil {
+		return "", entry, err
+	}
+	entry.ModTime = time.Unix(0, nanos)
+	if entry.Inode, err = strconv.ParseUint(fields[6], 10, 64); err != nil {
+		return "", entry, err
+	}
+	p, err := strconv.Unquote(fields[7])
+	if err != nil {
+		return "", entry, err
+	}
+	return p, entry, nil
+}
+
+// ReadIndexFile reads an index from a file, returning an empty index if the
+// file does not exist.
+func ReadIndexFile(fs billy.Filesystem, name string) (*Index, error) {
+	file, err := fs.Open(name)
+	if os.IsNotExist(err) {
+		return NewIndex(), nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadIndex(file)
+}
+
+// WriteFile writes the index to a file, replacing it atomically.
+func (index *Index) WriteFile(fs billy.Filesystem, name string) error {
+	temp, err := fs.OpenFile(name+".partial", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = index.WriteTo(temp)
+	err = multierr.Append(err, temp.Close())
+	if err != nil {
+		return multierr.Append(err, fs.Remove(temp.Name()))
+	}
+	return fs.Rename(temp.Name(), name)
+}
+
+// take removes and returns the entries for a path and everything beneath it.
+func (index *Index) take(p string) map[string]IndexEntry {
+	taken := make(map[string]IndexEntry)
+	// Paths beneath a relative root directory have no prefix.
+	all := p == "" || p == "."
+	prefix := strings.TrimSuffix(p, "/") + "/"
+	for q, entry := range index.entries {
+		if all || q == p || strings.HasPrefix(q, prefix) {
+			taken[q] = entry
+			delete(index.entries, q)
+		}
+	}
+	return taken
+}
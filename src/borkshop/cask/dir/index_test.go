@@ -0,0 +1,133 @@
+package caskdir_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"borkshop/cask"
+	"borkshop/cask/blob"
+	"borkshop/cask/dir"
+	"borkshop/cask/memstore"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-billy.v4/osfs"
+)
+
+// storeCountingStore counts the blocks stored to the underlying store.
+type storeCountingStore struct {
+	*caskmemstore.MemStore
+	stores int
+}
+
+func (s *storeCountingStore) Store(ctx context.Context, h cask.Hash, b *cask.Block) error {
+	s.stores++
+	return s.MemStore.Store(ctx, h, b)
+}
+
+// writeAged writes a file with a modification time old enough to index.
+func writeAged(t *testing.T, root, name, content string, age time.Duration) {
+	name = filepath.Join(root, name)
+	require.NoError(t, os.MkdirAll(filepath.Dir(name), 0755))
+	require.NoError(t, ioutil.WriteFile(name, []byte(content), 0644))
+	then := time.Now().Add(-age)
+	require.NoError(t, os.Chtimes(name, then, then))
+	require.NoError(t, os.Chtimes(filepath.Dir(name), then, then))
+}
+
+func TestStoreIndexed(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "caskdir")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	fs := osfs.New(root)
+
+	writeAged(t, root, "a/x", "x", time.Hour)
+	writeAged(t, root, "a/y", "y", time.Hour)
+	writeAged(t, root, "b/z", "z", time.Hour)
+	writeAged(t, root, "top", "top", time.Hour)
+
+	store := &storeCountingStore{MemStore: caskmemstore.New()}
+	index := caskdir.NewIndex()
+	hash1, err := caskdir.StoreConfig{Index: index}.Store(ctx, store, fs, "")
+	require.NoError(t, err)
+	plain, err := caskdir.Store(ctx, caskmemstore.New(), fs, "")
+	require.NoError(t, err)
+	assert.Equal(t, plain, hash1, "same hash as without an index")
+	assert.Equal(t, 7, index.Len(), "every file and directory indexed")
+
+	// Nothing changed, so nothing is read or stored.
+	store.stores = 0
+	hash2, err := caskdir.StoreConfig{Index: index}.Store(ctx, store, fs, "")
+	require.NoError(t, err)
+	assert.Equal(t, hash1, hash2)
+	assert.Equal(t, 0, store.stores)
+
+	// Changing a file restores only the file and its ancestors.
+	writeAged(t, root, "a/x", "changed", time.Hour/2)
+	store.stores = 0
+	hash3, err := caskdir.StoreConfig{Index: index}.Store(ctx, store, fs, "")
+	require.NoError(t, err)
+	plain, err = caskdir.Store(ctx, caskmemstore.New(), fs, "")
+	require.NoError(t, err)
+	assert.Equal(t, plain, hash3)
+	assert.Equal(t, 3, store.stores, "file, a, and root")
+
+	// The index survives a round trip through a file.
+	require.NoError(t, index.WriteFile(fs, "index"))
+	reread, err := caskdir.ReadIndexFile(fs, "index")
+	require.NoError(t, err)
+	require.NoError(t, fs.Remove("index"))
+	for _, p := range []string{"", "a", "a/x", "b/z", "top"} {
+		want, ok := index.Lookup(p)
+		require.True(t, ok, p)
+		got, ok := reread.Lookup(p)
+		require.True(t, ok, p)
+		assert.Equal(t, want.Hash, got.Hash, p)
+		assert.True(t, want.ModTime.Equal(got.ModTime), p)
+	}
+
+	// Changing how content is stored invalidates the index.
+	cdc := caskblob.StoreConfig{ContentDefined: true}
+	chunked, err := caskdir.StoreConfig{Index: index, Blob: cdc}.Store(ctx, store, fs, "")
+	require.NoError(t, err)
+	plain, err = caskdir.StoreConfig{Blob: cdc}.Store(ctx, caskmemstore.New(), fs, "")
+	require.NoError(t, err)
+	assert.Equal(t, plain, chunked)
+
+	// A store that lacks the indexed blocks receives them anyway.
+	other := caskmemstore.New()
+	hash4, err := caskdir.StoreConfig{Index: reread}.Store(ctx, other, fs, "")
+	require.NoError(t, err)
+	assert.Equal(t, hash3, hash4)
+	assert.Equal(t, map[string]string{
+		"a/x": "changed",
+		"a/y": "y",
+		"b/z": "z",
+		"top": "top",
+	}, loadFiles(t, other, hash4))
+}
+
+func TestStoreIndexedRacy(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "caskdir")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	fs := osfs.New(root)
+
+	writeAged(t, root, "old", "old", time.Hour)
+	writeAged(t, root, "new", "new", 0)
+
+	index := caskdir.NewIndex()
+	_, err = caskdir.StoreConfig{Index: index}.Store(ctx, caskmemstore.New(), fs, "")
+	require.NoError(t, err)
+
+	_, ok := index.Lookup("old")
+	assert.True(t, ok, "old file indexed")
+	_, ok = index.Lookup("new")
+	assert.False(t, ok, "recently modified file not trusted")
+}
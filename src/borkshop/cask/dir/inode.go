@@ -0,0 +1,18 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package caskdir
+
+import (
+	"os"
+	"syscall"
+)
+
+// inode returns the inode number of a file, or zero if the file system does
+// not provide one.
+func inode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
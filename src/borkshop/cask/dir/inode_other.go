@@ -0,0 +1,11 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package caskdir
+
+import "os"
+
+// inode returns zero, since the file system does not provide inode numbers.
+func inode(info os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,156 @@
+package caskdir
+
+import (
+	"bytes"
+	"context"
+	"path"
+
+	"borkshop/cask"
+)
+
+// Conflict represents an entry that both sides of a merge changed in
+// different ways.
+//
+// Absent entries have a zero mode.
+type Conflict struct {
+	// Path is the slash delimited path of the entry from the root of the
+	// trees.
+	Path string
+	// Base is the entry in the common ancestor.
+	Base Entry
+	// Ours is the entry on our side of the merge.
+	Ours Entry
+	// Theirs is the entry on their side of the merge.
+	Theirs Entry
+}
+
+// Merge combines the changes from a common base directory tree to two
+// divergent trees, ours and theirs, and stores the resulting tree.
+//
+// Merge takes every entry that changed on only one side, and descends into
+// directories that changed on both sides, skipping subtrees that have the
+// same hash on either side as in the base.
+// Entries that changed on both sides in different ways are conflicts.
+// A directory that changed on both sides takes the metadata of the side
+// that changed it, and ours if both did.
+// The merged tree retains our side of every conflict, and Merge returns the
+// conflicts ordered by path, leaving their resolution to the caller.
+func Merge(ctx context.Context, store cask.Store, base, ours, theirs cask.Hash) (cask.Hash, []Conflict, error) {
+	var conflicts []Conflict
+	hash, err := merge(ctx, store, "", &base, ours, theirs, &conflicts)
+	if err != nil {
+		return cask.ZeroHash, nil, err
+	}
+	return hash, conflicts, nil
+}
+
+// merge merges two directories, with a nil base for directories that are
+// absent from the base tree.
+func merge(ctx context.Context, store cask.Store, prefix string, base *cask.Hash, ours, theirs cask.Hash, conflicts *[]Conflict) (cask.Hash, error) {
+	if ours == theirs {
+		return ours, nil
+	}
+	if base != nil && *base == ours {
+		return theirs, nil
+	}
+	if base != nil && *base == theirs {
+		return ours, nil
+	}
+
+	var bases []Entry
+	if base != nil {
+		var err error
+		bases, err = List(ctx, store, *base)
+		if err != nil {
+			return cask.ZeroHash, err
+		}
+	}
+	ourEntries, err := List(ctx, store, ours)
+	if err != nil {
+		return cask.ZeroHash, err
+	}
+	theirEntries, err := List(ctx, store, theirs)
+	if err != nil {
+		return cask.ZeroHash, err
+	}
+
+	merged := make([]Entry, 0, len(ourEntries))
+	for len(bases) > 0 || len(ourEntries) > 0 || len(theirEntries) > 0 {
+		// Take the entries with the least name from each side.
+		var name []byte
+		for _, entries := range [][]Entry{bases, ourEntries, theirEntries} {
+			if len(entries) > 0 && (name == nil || bytes.Compare(entries[0].Name, name) < 0) {
+				name = entries[0].Name
+			}
+		}
+		b := takeEntry(&bases, name)
+		o := takeEntry(&ourEntries, name)
+		t := takeEntry(&theirEntries, name)
+		p := path.Join(prefix, string(name))
+
+		entry, err := mergeEntry(ctx, store, p, b, o, t, conflicts)
+		if err != nil {
+			return cask.ZeroHash, err
+		}
+		if entry.Mode != 0 {
+			merged = append(merged, entry)
+		}
+	}
+
+	return storeEntries(ctx, store, merged)
+}
+
+// mergeEntry merges a single entry, returning an entry with a zero mode if
+// the merged directory should not contain it.
+func mergeEntry(ctx context.Context, store cask.Store, p string, b, o, t Entry, conflicts *[]Conflict) (Entry, error) {
+	switch {
+	case equalEntries(o, t):
+		return o, nil
+	case equalEntries(b, o):
+		return t, nil
+	case equalEntries(b, t):
+		return o, nil
+	case o.Mode == DirMode && t.Mode == DirMode:
+		var base *cask.Hash
+		if b.Mode == DirMode {
+			base = &b.Hash
+		}
+		hash, err := merge(ctx, store, p, base, o.Hash, t.Hash, conflicts)
+		if err != nil {
+			return Entry{}, err
+		}
+		return Entry{Name: o.Name, Mode: DirMode, Hash: hash, Meta: mergeMeta(b, o, t)}, nil
+	}
+
+	*conflicts = append(*conflicts, Conflict{Path: p, Base: b, Ours: o, Theirs: t})
+	return o, nil
+}
+
+// mergeMeta returns the metadata of a merged directory, from the side that
+// changed it, or from our side if both did.
+func mergeMeta(b, o, t Entry) *Meta {
+	if b.Mode == DirMode && b.Meta.equal(o.Meta) {
+		return t.Meta
+	}
+	return o.Meta
+}
+
+// takeEntry removes and returns the first entry if it has the given name, or
+// returns an absent entry.
+func takeEntry(entries *[]Entry, name []byte) Entry {
+	if len(*entries) > 0 && bytes.Equal((*entries)[0].Name, name) {
+		entry := (*entries)[0]
+		*entries = (*entries)[1:]
+		return entry
+	}
+	return Entry{}
+}
+
+// equalEntries reports whether two entries are either both absent or the
+// same.
+func equalEntries(a, b Entry) bool {
+	if a.Mode == 0 || b.Mode == 0 {
+		return a.Mode == b.Mode
+	}
+	return a.same(b)
+}
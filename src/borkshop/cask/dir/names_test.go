@@ -0,0 +1,107 @@
+package caskdir
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"borkshop/cask"
+	"borkshop/cask/blob"
+	"borkshop/cask/memstore"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-billy.v4/osfs"
+)
+
+func TestInvalidNames(t *testing.T) {
+	ctx := context.Background()
+	store := caskmemstore.New()
+	file, err := caskblob.WriteString(ctx, store, "hello")
+	require.NoError(t, err)
+	target, err := caskblob.WriteString(ctx, store, "/etc")
+	require.NoError(t, err)
+	empty, err := storeEntries(ctx, store, nil)
+	require.NoError(t, err)
+
+	for _, entries := range [][]Entry{
+		{{Name: []byte(""), Mode: FileMode, Hash: file}},
+		{{Name: []byte("."), Mode: DirMode, Hash: empty}},
+		{{Name: []byte(".."), Mode: DirMode, Hash: empty}},
+		{{Name: []byte("a/b"), Mode: FileMode, Hash: file}},
+		{{Name: []byte("a\x00"), Mode: FileMode, Hash: file}},
+		{{Name: []byte("b"), Mode: FileMode, Hash: file}, {Name: []byte("a"), Mode: FileMode, Hash: file}},
+		{{Name: []byte("x"), Mode: SymlinkMode, Hash: target}, {Name: []byte("x"), Mode: DirMode, Hash: empty}},
+	} {
+		h, err := storeEntries(ctx, store, entries)
+		require.NoError(t, err)
+		_, err = List(ctx, store, h)
+		assert.True(t, errors.Is(err, ErrInvalidName), "%q: %v", entries[0].Name, err)
+		err = Load(ctx, store, osfs.New(t.TempDir()), ".", h)
+		assert.True(t, errors.Is(err, ErrInvalidName), "%q: %v", entries[0].Name, err)
+	}
+}
+
+func TestLoadReplacesSymlink(t *testing.T) {
+	ctx := context.Background()
+	store := caskmemstore.New()
+	outside := t.TempDir()
+	inside := t.TempDir()
+	require.NoError(t, os.Symlink(outside, filepath.Join(inside, "x")))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "f"), filepath.Join(inside, "f")))
+
+	file, err := caskblob.WriteString(ctx, store, "hello")
+	require.NoError(t, err)
+	sub, err := storeEntries(ctx, store, []Entry{{Name: []byte("g"), Mode: FileMode, Hash: file}})
+	require.NoError(t, err)
+	root, err := storeEntries(ctx, store, []Entry{
+		{Name: []byte("f"), Mode: FileMode, Hash: file},
+		{Name: []byte("x"), Mode: DirMode, Hash: sub},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, Load(ctx, store, osfs.New(inside), ".", root))
+	written, err := ioutil.ReadDir(outside)
+	require.NoError(t, err)
+	assert.Empty(t, written)
+	info, err := os.Lstat(filepath.Join(inside, "x"))
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+	body, err := ioutil.ReadFile(filepath.Join(inside, "x", "g"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+}
+
+func TestUpdateRefusesSymlinkParent(t *testing.T) {
+	ctx := context.Background()
+	store := caskmemstore.New()
+	outside := t.TempDir()
+	inside := t.TempDir()
+
+	before, err := caskblob.WriteString(ctx, store, "before")
+	require.NoError(t, err)
+	after, err := caskblob.WriteString(ctx, store, "after")
+	require.NoError(t, err)
+	tree := func(file cask.Hash) cask.Hash {
+		sub, err := storeEntries(ctx, store, []Entry{{Name: []byte("g"), Mode: FileMode, Hash: file}})
+		require.NoError(t, err)
+		root, err := storeEntries(ctx, store, []Entry{{Name: []byte("x"), Mode: DirMode, Hash: sub}})
+		require.NoError(t, err)
+		return root
+	}
+	a, b := tree(before), tree(after)
+
+	fs := osfs.New(inside)
+	require.NoError(t, Load(ctx, store, fs, ".", a))
+	require.NoError(t, os.RemoveAll(filepath.Join(inside, "x")))
+	require.NoError(t, os.Symlink(outside, filepath.Join(inside, "x")))
+
+	err = Update(ctx, store, fs, ".", a, b)
+	assert.True(t, errors.Is(err, ErrSymlink), "%v", err)
+	written, err := ioutil.ReadDir(outside)
+	require.NoError(t, err)
+	assert.Empty(t, written)
+}
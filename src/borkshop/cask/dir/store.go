@@ -0,0 +1,248 @@
+package caskdir
+
+import (
+	"context"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"borkshop/cask"
+	"borkshop/cask/blob"
+	"borkshop/cask/io"
+
+	billy "gopkg.in/src-d/go-billy.v4"
+)
+
+// racyWindow is how recently a file may have been modified and still be
+// recorded in an index.
+// A file modified within the granularity of its file system's timestamps
+// after it was read would otherwise keep its stale hash indefinitely.
+const racyWindow = 2 * time.Second
+
+// StoreConfig captures the options for storing a directory tree.
+type StoreConfig struct {
+	// Index, if not nil, caches the hashes of files and directories by their
+	// stat information, so that storing a tree again only reads the files
+	// that changed since.
+	// A hash from the index is only reused if the store still has the
+	// addressed block, so an index remains safe to use after garbage
+	// collection or with a different store.
+	// Storing replaces the entries of the index under the given path, so an
+	// index should consistently use either absolute paths or paths relative
+	// to one directory.
+	Index *Index
+
+	// Meta records the permissions and modification time of every file and
+	// directory, so that Load can reproduce them.
+	// Symbolic links carry no metadata.
+	// Since directory blocks then include modification times, touching a
+	// file changes the hash of every directory above it.
+	Meta bool
+
+	// Blob configures how the content of files is stored.
+	Blob caskblob.StoreConfig
+}
+
+// Store reads a directory tree from a filesystem and writes it as blocks to a
+// content address store.
+//
+// Store records symbolic links and skips other special files.
+func (c StoreConfig) Store(ctx context.Context, store cask.Store, fs billy.Filesystem, p string) (cask.Hash, error) {
+	s := &storer{
+		config:  c,
+		store:   store,
+		fs:      fs,
+		horizon: time.Now().Add(-racyWindow),
+	}
+	var info os.FileInfo
+	if c.Index != nil {
+		var err error
+		if info, err = fs.Stat(p); err != nil {
+			return cask.ZeroHash, err
+		}
+		s.prior = c.Index.take(p)
+	}
+	hash, _, err := s.storeDir(ctx, p, info)
+	return hash, err
+}
+
+type storer struct {
+	config  StoreConfig
+	store   cask.Store
+	fs      billy.Filesystem
+	prior   map[string]IndexEntry
+	horizon time.Time
+}
+
+// lookup returns the prior hash of a path from the index if its stat
+// information is unchanged.
+func (s *storer) lookup(p string, info os.FileInfo, mode Mode) (cask.Hash, bool) {
+	entry, ok := s.prior[p]
+	if !ok ||
+		entry.Mode != mode ||
+		entry.Meta != s.hasMeta(mode) ||
+		entry.ContentDefined != s.config.Blob.ContentDefined ||
+		entry.Perm != metaOf(info).Perm ||
+		entry.Size != info.Size() ||
+		!entry.ModTime.Equal(info.ModTime()) ||
+		entry.Inode != inode(info) {
+		return cask.ZeroHash, false
+	}
+	return entry.Hash, true
+}
+
+// record notes the hash of a path in the index, unless it changed too
+// recently to trust its modification time.
+func (s *storer) record(p string, info os.FileInfo, mode Mode, hash cask.Hash) {
+	if s.config.Index == nil || !info.ModTime().Before(s.horizon) {
+		return
+	}
+	s.config.Index.entries[p] = IndexEntry{
+		Hash:           hash,
+		Mode:           mode,
+		Meta:           s.hasMeta(mode),
+		ContentDefined: s.config.Blob.ContentDefined,
+		Perm:           metaOf(info).Perm,
+		Size:           info.Size(),
+		ModTime:        info.ModTime(),
+		Inode:          inode(info),
+	}
+}
+
+// hasMeta reports whether the hash of an entry with the given mode depends
+// on whether the tree is stored with metadata.
+// Only directory blocks contain metadata.
+func (s *storer) hasMeta(mode Mode) bool {
+	return mode == DirMode && s.config.Meta
+}
+
+// storeDir stores a directory, reporting whether every entry beneath it
+// was unchanged since it was indexed.
+func (s *storer) storeDir(ctx context.Context, p string, info os.FileInfo) (cask.Hash, bool, error) {
+	dirEnts, err := s.fs.ReadDir(p)
+	if err != nil {
+		return cask.ZeroHash, false, err
+	}
+
+	// Check that the store still has the prior hashes of unchanged files
+	// in one batch.
+	var candidates []cask.Hash
+	for _, dirEnt := range dirEnts {
+		if mode := entryMode(dirEnt); mode != NoMode && mode != DirMode {
+			if hash, ok := s.lookup(path.Join(p, dirEnt.Name()), dirEnt, mode); ok {
+				candidates = append(candidates, hash)
+			}
+		}
+	}
+	present := make(map[cask.Hash]bool, len(candidates))
+	if len(candidates) > 0 {
+		have, err := caskio.Has(ctx, s.store, candidates)
+		if err != nil {
+			return cask.ZeroHash, false, err
+		}
+		for i, hash := range candidates {
+			present[hash] = have[i]
+		}
+	}
+
+	unchanged := true
+	entries := make(entries, 0, len(dirEnts))
+	for _, dirEnt := range dirEnts {
+		mode := entryMode(dirEnt)
+		if mode == NoMode {
+			continue
+		}
+		var hash cask.Hash
+		var hit bool
+		name := path.Join(p, dirEnt.Name())
+		if mode == DirMode {
+			hash, hit, err = s.storeDir(ctx, name, dirEnt)
+		} else if hash, hit = s.lookup(name, dirEnt, mode); !hit || !present[hash] {
+			hit = false
+			if mode == SymlinkMode {
+				hash, err = s.storeSymlink(ctx, name)
+			} else {
+				hash, err = s.storeFile(ctx, name)
+			}
+		}
+		if err != nil {
+			return cask.ZeroHash, false, err
+		}
+		if mode != DirMode {
+			s.record(name, dirEnt, mode, hash)
+		}
+
+		entry := Entry{
+			Name: []byte(dirEnt.Name()),
+			Mode: mode,
+			Hash: hash,
+		}
+		if s.config.Meta && mode != SymlinkMode {
+			entry.Meta = metaOf(dirEnt)
+		}
+		unchanged = unchanged && hit
+		entries = append(entries, entry)
+	}
+
+	// Adding, removing, or renaming an entry changes the modification time
+	// of the directory, so a directory whose entries are all unchanged has
+	// the same hash as before, if the store still has it.
+	if unchanged && info != nil {
+		if hash, ok := s.lookup(p, info, DirMode); ok {
+			if have, err := caskio.Has(ctx, s.store, []cask.Hash{hash}); err != nil {
+				return cask.ZeroHash, false, err
+			} else if have[0] {
+				s.record(p, info, DirMode, hash)
+				return hash, true, nil
+			}
+		}
+	}
+
+	sort.Sort(entries)
+	hash, err := storeEntries(ctx, s.store, entries)
+	if err != nil {
+		return cask.ZeroHash, false, err
+	}
+	if info != nil {
+		s.record(p, info, DirMode, hash)
+	}
+	return hash, false, nil
+}
+
+// entryMode returns the mode of the entry for a file, or NoMode if the file
+// cannot be stored.
+func entryMode(info os.FileInfo) Mode {
+	switch {
+	case info.IsDir():
+		return DirMode
+	case info.Mode().IsRegular():
+		if info.Mode()&0111 == 0 {
+			return FileMode
+		}
+		return ExecMode
+	case info.Mode()&os.ModeSymlink != 0:
+		return SymlinkMode
+	}
+	return NoMode
+}
+
+// storeSymlink writes the target of a symbolic link as a blob.
+func (s *storer) storeSymlink(ctx context.Context, name string) (cask.Hash, error) {
+	target, err := s.fs.Readlink(name)
+	if err != nil {
+		return cask.ZeroHash, err
+	}
+	return s.config.Blob.Store(ctx, s.store, strings.NewReader(target))
+}
+
+// storeFile writes the content of a file as blocks.
+func (s *storer) storeFile(ctx context.Context, name string) (cask.Hash, error) {
+	reader, err := s.fs.Open(name)
+	if err != nil {
+		return cask.ZeroHash, err
+	}
+	defer reader.Close()
+	return s.config.Blob.Store(ctx, s.store, reader)
+}
@@ -0,0 +1,93 @@
+package caskdir
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"borkshop/cask"
+	"borkshop/cask/blob"
+)
+
+// WriteTar writes a directory tree as a tar stream, with paths relative to
+// the root of the tree.
+//
+// Entries stored with metadata carry their permissions and modification
+// times, and other entries carry default permissions and the Unix epoch.
+func WriteTar(ctx context.Context, store cask.Store, w io.Writer, h cask.Hash) error {
+	tw := tar.NewWriter(w)
+	if err := writeTar(ctx, store, tw, "", h); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func writeTar(ctx context.Context, store cask.Store, tw *tar.Writer, prefix string, h cask.Hash) error {
+	entries, err := List(ctx, store, h)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := writeTarEntry(ctx, store, tw, path.Join(prefix, string(entry.Name)), entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeTarEntry(ctx context.Context, store cask.Store, tw *tar.Writer, name string, entry Entry) error {
+	header := &tar.Header{
+		Name:    name,
+		ModTime: time.Unix(0, 0),
+		Format:  tar.FormatPAX,
+	}
+	var perm os.FileMode
+	switch entry.Mode {
+	case DirMode, ExecMode:
+		perm = 0755
+	case FileMode:
+		perm = 0644
+	}
+	if entry.Meta != nil {
+		perm = entry.Meta.Perm
+		header.ModTime = entry.Meta.ModTime
+	}
+	header.Mode = int64(posixPerm(perm))
+
+	switch entry.Mode {
+	case DirMode:
+		header.Typeflag = tar.TypeDir
+		header.Name += "/"
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		return writeTar(ctx, store, tw, name, entry.Hash)
+	case FileMode, ExecMode:
+		blob, err := caskblob.Open(ctx, store, entry.Hash)
+		if err != nil {
+			return err
+		}
+		header.Typeflag = tar.TypeReg
+		header.Size = blob.Size()
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, blob)
+		return err
+	case SymlinkMode:
+		target, err := caskblob.ReadString(ctx, store, entry.Hash)
+		if err != nil {
+			return err
+		}
+		header.Typeflag = tar.TypeSymlink
+		header.Linkname = target
+		header.Mode = 0777
+		return tw.WriteHeader(header)
+	default:
+		return fmt.Errorf("unexpected mode")
+	}
+}
@@ -0,0 +1,73 @@
+package caskdir_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"borkshop/cask/dir"
+	"borkshop/cask/memstore"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-billy.v4/osfs"
+)
+
+func TestWriteTar(t *testing.T) {
+	ctx := context.Background()
+	store := caskmemstore.New()
+	source, err := ioutil.TempDir("", "caskdir")
+	require.NoError(t, err)
+	defer os.RemoveAll(source)
+
+	then := time.Unix(1500000000, 0)
+	require.NoError(t, os.Mkdir(filepath.Join(source, "sub"), 0750))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(source, "sub", "run"), []byte("#!/bin/sh\n"), 0755))
+	require.NoError(t, os.Chtimes(filepath.Join(source, "sub", "run"), then, then))
+	require.NoError(t, os.Symlink("sub/run", filepath.Join(source, "link")))
+	big := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(source, "big"), big, 0644))
+
+	hash, err := caskdir.StoreConfig{Meta: true}.Store(ctx, store, osfs.New(source), "")
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, caskdir.WriteTar(ctx, store, &buf, hash))
+
+	type file struct {
+		typ     byte
+		mode    int64
+		modTime time.Time
+		body    string
+	}
+	files := make(map[string]file)
+	tr := tar.NewReader(&buf)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(tr)
+		require.NoError(t, err)
+		if header.Typeflag == tar.TypeSymlink {
+			body = []byte(header.Linkname)
+		}
+		files[header.Name] = file{header.Typeflag, header.Mode, header.ModTime, string(body)}
+	}
+
+	assert.Len(t, files, 4)
+	assert.Equal(t, string(big), files["big"].body)
+	assert.Equal(t, byte(tar.TypeDir), files["sub/"].typ)
+	assert.Equal(t, int64(0750), files["sub/"].mode)
+	assert.Equal(t, "#!/bin/sh\n", files["sub/run"].body)
+	assert.Equal(t, int64(0755), files["sub/run"].mode)
+	assert.True(t, then.Equal(files["sub/run"].modTime))
+	assert.Equal(t, byte(tar.TypeSymlink), files["link"].typ)
+	assert.Equal(t, "sub/run", files["link"].body)
+}
@@ -0,0 +1,173 @@
+package caskdiskstore
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"borkshop/cask"
+	"borkshop/cask/io"
+)
+
+// ErrTruncated indicates that the file of a block is not exactly 1KB.
+var ErrTruncated = errors.New("block file is not 1KB")
+
+// CheckConfig captures the parameters of an integrity check of a store.
+type CheckConfig struct {
+	// Roots are hashes to check along with their transitive links, in
+	// addition to the pinned roots.
+	Roots []cask.Hash
+
+	// Repair is an optional store from which to load intact copies of
+	// missing, truncated, and corrupt blocks.
+	Repair cask.Store
+}
+
+// CheckReport summarizes an integrity check of a store.
+type CheckReport struct {
+	// Blocks is the number of block files in the store, and blocks in packs.
+	Blocks int
+	// Reachable is the number of blocks reachable from a root.
+	Reachable int
+	// Partial lists the partially written files that writers abandoned or
+	// have yet to finish, which a garbage collection removes.
+	Partial []string
+	// Damaged lists the blocks that failed the check.
+	Damaged []caskio.Damage
+}
+
+// Check verifies the integrity of the store.
+//
+// Check rehashes every block file in the store, whether reachable or not,
+// and reports files that are not exactly 1KB and leftover partial files.
+// In the pack format, Check also rehashes the current record of every block
+// in a pack, and reports packs that end with an unfinished record.
+// Then, Check verifies the structure of every tree reachable from a pinned
+// root or one of the configured roots with caskio, reporting dangling links
+// and interior blocks of the wrong height.
+func (c CheckConfig) Check(ctx context.Context, s *Store) (*CheckReport, error) {
+	report := &CheckReport{}
+	prefixes, err := s.Filesystem.ReadDir("")
+	if err != nil {
+		return nil, err
+	}
+	for _, prefix := range prefixes {
+		if !prefix.IsDir() || len(prefix.Name()) != 2 {
+			continue
+		}
+		files, err := s.Filesystem.ReadDir(prefix.Name())
+		if err != nil {
+			return report, err
+		}
+		for _, file := range files {
+			select {
+			case <-ctx.Done():
+				return report, ctx.Err()
+			default:
+			}
+
+			name := file.Name()
+			loc := path.Join(prefix.Name(), name)
+			if strings.HasSuffix(name, ".partial") {
+				report.Partial = append(report.Partial, loc)
+				continue
+			}
+			h, ok := parseHash(prefix.Name() + name)
+			if !ok {
+				continue
+			}
+			report.Blocks++
+			if damage, err := c.checkFile(ctx, s, h, loc); err != nil {
+				return report, err
+			} else if damage != nil {
+				report.Damaged = append(report.Damaged, *damage)
+			}
+		}
+	}
+
+	if err := c.checkPacks(ctx, s, report); err != nil {
+		return report, err
+	}
+
+	pins, err := s.Pins()
+	if err != nil {
+		return report, err
+	}
+	roots := append([]cask.Hash(nil), c.Roots...)
+	for _, h := range pins {
+		roots = append(roots, h)
+	}
+	checked := make(map[cask.Hash]struct{}, len(report.Damaged))
+	for _, damage := range report.Damaged {
+		checked[damage.Hash] = struct{}{}
+	}
+	r, err := caskio.CheckConfig{Repair: c.Repair}.Check(ctx, s, roots...)
+	if r != nil {
+		report.Reachable = r.Checked
+		for _, damage := range r.Damaged {
+			// The sweep already reported the damaged files that it could
+			// not repair.
+			if _, ok := checked[damage.Hash]; !ok {
+				report.Damaged = append(report.Damaged, damage)
+			}
+		}
+	}
+	return report, err
+}
+
+// checkFile verifies the size and hash of a block file, and replaces it with
+// an intact copy from the repair store, if possible.
+func (c CheckConfig) checkFile(ctx context.Context, s *Store, h cask.Hash, loc string) (*caskio.Damage, error) {
+	file, err := s.Filesystem.Open(loc)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := ioutil.ReadAll(file)
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	damage := &caskio.Damage{Hash: h}
+	var block cask.Block
+	copy(block[:], buf)
+	if len(buf) != cask.BlockSize {
+		damage.Err = ErrTruncated
+	} else if block.Hash() != h {
+		damage.Err = caskio.ErrHashMismatch
+	} else {
+		return nil, nil
+	}
+
+	intact, ok := c.repair(ctx, h)
+	if !ok {
+		return damage, nil
+	}
+	if err := s.Remove(ctx, h); err != nil {
+		return damage, err
+	}
+	if err := s.Store(ctx, h, intact); err != nil {
+		return damage, err
+	}
+	damage.Repaired = true
+	return damage, nil
+}
+
+// repair loads an intact copy of a block from the repair store, if possible.
+func (c CheckConfig) repair(ctx context.Context, h cask.Hash) (*cask.Block, bool) {
+	if c.Repair == nil {
+		return nil, false
+	}
+	if checker, ok := c.Repair.(cask.Checker); ok {
+		if have, err := checker.Has(ctx, []cask.Hash{h}); err != nil || !have[0] {
+			return nil, false
+		}
+	}
+	var intact cask.Block
+	if err := c.Repair.Load(ctx, h, &intact); err != nil || intact.Hash() != h {
+		return nil, false
+	}
+	return &intact, true
+}
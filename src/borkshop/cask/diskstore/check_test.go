@@ -0,0 +1,77 @@
+package caskdiskstore
+
+import (
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"borkshop/cask"
+	"borkshop/cask/io"
+	"borkshop/cask/memstore"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+	store, dir, cleanup := newTempStore(t)
+	defer cleanup()
+	repair := caskmemstore.New()
+
+	leaves := make([]cask.Hash, 3)
+	for i := range leaves {
+		model := cask.Model{Bytes: []byte{byte(i)}}
+		h, err := model.Store(ctx, store)
+		require.NoError(t, err)
+		_, err = model.Store(ctx, repair)
+		require.NoError(t, err)
+		leaves[i] = h
+	}
+	root := cask.Model{Links: append([]cask.Hash{{1}}, leaves...)}
+	rootHash, err := root.Store(ctx, store)
+	require.NoError(t, err)
+	require.NoError(t, store.Pin("root", rootHash))
+
+	report, err := CheckConfig{}.Check(ctx, store)
+	require.NoError(t, err)
+	assert.Equal(t, 4, report.Blocks)
+	assert.Equal(t, 5, report.Reachable)
+	assert.Equal(t, []caskio.Damage{
+		{Hash: cask.Hash{1}, Parent: rootHash, Err: caskio.ErrMissing},
+	}, report.Damaged)
+
+	// Truncate one leaf, corrupt another, and abandon a partial file.
+	file := func(h cask.Hash) string {
+		hex := hex.EncodeToString(h[:])
+		return filepath.Join(dir, hex[:2], hex[2:])
+	}
+	require.NoError(t, ioutil.WriteFile(file(leaves[0]), []byte{0, 0, 0, 1}, 0644))
+	require.NoError(t, ioutil.WriteFile(file(leaves[1]), make([]byte, cask.BlockSize), 0644))
+	require.NoError(t, ioutil.WriteFile(file(leaves[2])+".partial", nil, 0644))
+
+	report, err = CheckConfig{}.Check(ctx, store)
+	require.NoError(t, err)
+	assert.Len(t, report.Partial, 1)
+	assert.ElementsMatch(t, []caskio.Damage{
+		{Hash: leaves[0], Err: ErrTruncated},
+		{Hash: leaves[1], Err: caskio.ErrHashMismatch},
+		{Hash: cask.Hash{1}, Parent: rootHash, Err: caskio.ErrMissing},
+	}, report.Damaged)
+
+	report, err = CheckConfig{Repair: repair}.Check(ctx, store)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []caskio.Damage{
+		{Hash: leaves[0], Err: ErrTruncated, Repaired: true},
+		{Hash: leaves[1], Err: caskio.ErrHashMismatch, Repaired: true},
+		{Hash: cask.Hash{1}, Parent: rootHash, Err: caskio.ErrMissing},
+	}, report.Damaged)
+
+	var block cask.Block
+	for _, h := range leaves {
+		require.NoError(t, store.Load(ctx, h, &block))
+		assert.Equal(t, h, block.Hash())
+	}
+}
@@ -8,6 +8,15 @@
 // system, though this is not likely 1KB.
 // But, who are we kidding?
 // Blocks are a figment of a modern filesystem's imagination anyway.
+//
+// Alternately, a store in the pack format appends blocks to pack files,
+// which spares the filesystem an inode and a filesystem block for each 1KB
+// block, and compresses blocks that compress.
+// InitPacks selects the pack format.
+//
+// The store never deletes blocks on its own.
+// Instead, named pins retain root blocks and their transitive links, and a
+// garbage collection removes every block that no pin reaches.
 package caskdiskstore
 
 import (
@@ -24,20 +33,41 @@ import (
 	billy "gopkg.in/src-d/go-billy.v4"
 )
 
+// freshenAge is the age beyond which storing an existing block, or finding
+// it with Has, writes it again, to protect it from garbage collection for the
+// duration of the grace period.
+const freshenAge = 10 * time.Minute
+
 // Store is a CAS block store that uses a directory tree to store the
 // blocks, using their hashes to denote their file name.
 type Store struct {
 	// Filesystem is an object representing the directory to use for storage.
 	Filesystem billy.Filesystem
+
+	packs packs
 }
 
 var _ cask.Store = (*Store)(nil)
+var _ cask.Checker = (*Store)(nil)
+var _ cask.Remover = (*Store)(nil)
 
 // Store writes a block to the content address store.
 //
 // Store is concurrency safe assuming no hash collisions, because it writes
 // first to a temporary file then renames the file to its final location.
+//
+// In the pack format, Store appends the block to a pack of its own instead.
 func (s *Store) Store(ctx context.Context, h cask.Hash, b *cask.Block) error {
+	s.packs.lock.Lock()
+	if packed, err := s.packed(); err != nil || packed {
+		if err == nil {
+			err = s.storePacked(ctx, h, b)
+		}
+		s.packs.lock.Unlock()
+		return err
+	}
+	s.packs.lock.Unlock()
+
 	hex := hex.EncodeToString(h[:])
 	prefix := hex[0:2]
 	suffix := hex[2:]
@@ -59,8 +89,11 @@ func (s *Store) Store(ctx context.Context, h cask.Hash, b *cask.Block) error {
 		// If the block already exists, chances are it contains the same data
 		// we would write, so let's just all agree we did the work and go home
 		// early.
-		_, err := s.Filesystem.Stat(loc)
-		if err == nil {
+		// Unless the block is old enough that a garbage collection might
+		// consider it abandoned, in which case we write it again to refresh
+		// its modification time.
+		info, err := s.Filesystem.Stat(loc)
+		if err == nil && time.Since(info.ModTime()) < freshenAge {
 			return nil
 		}
 
@@ -77,6 +110,7 @@ func (s *Store) Store(ctx context.Context, h cask.Hash, b *cask.Block) error {
 
 		// Write to scratch
 		_, err = temp.Write(b[:])
+		err = multierr.Append(err, temp.Close())
 		if err != nil {
 			// We do try to clean up if we fail, so someone might succeed in
 			// our stead afterward.
@@ -92,7 +126,24 @@ func (s *Store) Store(ctx context.Context, h cask.Hash, b *cask.Block) error {
 }
 
 // Load reads a block from the content address store.
+//
+// Load fails if the file of the block is not exactly 1KB, but otherwise
+// trusts that the file matches its hash.
+// In the pack format, Load reads the block from a pack if any pack has it,
+// and from its own file otherwise.
 func (s *Store) Load(ctx context.Context, h cask.Hash, b *cask.Block) error {
+	s.packs.lock.Lock()
+	packed, err := s.packed()
+	s.packs.lock.Unlock()
+	if err != nil {
+		return err
+	} else if packed {
+		found, err := s.loadPacked(ctx, h, b)
+		if found || err != nil {
+			return err
+		}
+	}
+
 	hex := hex.EncodeToString(h[:])
 	prefix := hex[0:2]
 	suffix := hex[2:]
@@ -102,12 +153,103 @@ func (s *Store) Load(ctx context.Context, h cask.Hash, b *cask.Block) error {
 	if err != nil {
 		return err
 	}
+	defer file.Close()
 
 	buf, err := ioutil.ReadAll(file)
 	if err != nil {
 		return err
 	}
+	if len(buf) != cask.BlockSize {
+		return ErrTruncated
+	}
 
 	copy(b[:], buf)
 	return nil
 }
+
+// Has reports whether each block has a file, or a record in a pack, in the
+// content address store.
+//
+// Writers that find a block with Has reuse it, and its subtree, instead of
+// storing it, so Has freshens the blocks it finds as Store would.
+// Garbage collection spares the links of freshened blocks along with them.
+func (s *Store) Has(ctx context.Context, hs []cask.Hash) ([]bool, error) {
+	have := make([]bool, len(hs))
+	var stale []cask.Hash
+	s.packs.lock.Lock()
+	if packed, err := s.packed(); err != nil {
+		s.packs.lock.Unlock()
+		return nil, err
+	} else if packed {
+		if have, err = s.hasPacked(hs); err != nil {
+			s.packs.lock.Unlock()
+			return nil, err
+		}
+		if stale, err = s.stalePacked(hs, have); err != nil {
+			s.packs.lock.Unlock()
+			return nil, err
+		}
+	}
+	s.packs.lock.Unlock()
+
+	for i, h := range hs {
+		if have[i] {
+			continue
+		}
+		hex := hex.EncodeToString(h[:])
+		info, err := s.Filesystem.Stat(path.Join(hex[0:2], hex[2:]))
+		if err == nil {
+			have[i] = true
+			if time.Since(info.ModTime()) >= freshenAge {
+				stale = append(stale, h)
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	for _, h := range stale {
+		if err := s.freshen(ctx, h); err != nil {
+			return nil, err
+		}
+	}
+	return have, nil
+}
+
+// freshen writes a block again, which Store does for blocks older than
+// freshenAge.
+func (s *Store) freshen(ctx context.Context, h cask.Hash) error {
+	var block cask.Block
+	if err := s.Load(ctx, h, &block); err != nil {
+		return err
+	}
+	return s.Store(ctx, h, &block)
+}
+
+// Remove deletes the file of a block from the content address store.
+// In the pack format, Remove also appends a record to a pack that hides the
+// block, until a compaction reclaims its space, though other stores that
+// already found the block may continue to find it.
+//
+// Remove does not check whether a pin or another block retains the block, so
+// it suits a store that caches blocks for another store.
+func (s *Store) Remove(ctx context.Context, h cask.Hash) error {
+	s.packs.lock.Lock()
+	if packed, err := s.packed(); err != nil || packed {
+		if err == nil {
+			err = s.removePacked(h)
+		}
+		if err != nil {
+			s.packs.lock.Unlock()
+			return err
+		}
+	}
+	s.packs.lock.Unlock()
+
+	hex := hex.EncodeToString(h[:])
+	err := s.Filesystem.Remove(path.Join(hex[0:2], hex[2:]))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
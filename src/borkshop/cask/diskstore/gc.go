@@ -0,0 +1,246 @@
+package caskdiskstore
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"borkshop/cask"
+	"borkshop/cask/io"
+)
+
+// CollectConfig captures the parameters of a garbage collection.
+type CollectConfig struct {
+	// Roots are hashes to retain along with their transitive links, in
+	// addition to the pinned roots.
+	Roots []cask.Hash
+
+	// Grace protects blocks written more recently than the grace period from
+	// collection, along with their transitive links, so that concurrent
+	// writers have time to finish storing a tree and pin it.
+	// Writers refresh blocks older than ten minutes when they store them
+	// again, or find them with Has to reuse them, so the grace period should
+	// exceed ten minutes when writers are active.
+	// A zero grace period collects every unreachable block.
+	Grace time.Duration
+
+	// DryRun reports what a collection would remove without removing
+	// anything.
+	DryRun bool
+}
+
+// CollectReport summarizes a garbage collection.
+type CollectReport struct {
+	// Retained is the number of blocks reachable from a root.
+	Retained int
+	// Recent is the number of unreachable blocks spared by the grace period.
+	Recent int
+	// Collected is the number of unreachable blocks removed.
+	Collected int
+	// Deferred is the number of unreachable blocks left in packs that hold
+	// too few of them to rewrite.
+	Deferred int
+	// Partial is the number of abandoned partially written blocks and pins
+	// removed.
+	Partial int
+}
+
+// Collect removes every block from the store that is not reachable from a
+// pinned root or one of the configured roots.
+//
+// Collect marks reachable blocks with caskio.BOM, and the links of blocks
+// modified within the grace period, then sweeps the directory tree, sparing
+// blocks modified within the grace period.
+// A writer may reuse an old subtree by freshening only its root, so the
+// recent root spares the rest of the subtree.
+// Collect also removes partial files of blocks and pins abandoned by writers
+// for longer than the grace period.
+//
+// In the pack format, Collect moves the reachable blocks that have files of
+// their own into a pack, and removes the unreachable blocks of the packs last
+// modified before the grace period.
+// Collect rewrites only those packs that dropping their unreachable,
+// removed, and superseded records would shrink by a quarter or more, and
+// defers the unreachable blocks of the other packs to a later collection.
+// The blocks of packs modified within the grace period count as recent.
+func (c CollectConfig) Collect(ctx context.Context, s *Store) (*CollectReport, error) {
+	pins, err := s.Pins()
+	if err != nil {
+		return nil, err
+	}
+	roots := append([]cask.Hash(nil), c.Roots...)
+	for _, h := range pins {
+		roots = append(roots, h)
+	}
+
+	// Mark
+	marked := make(map[cask.Hash]struct{})
+	for _, root := range roots {
+		links, err := caskio.BOM(ctx, s, root)
+		if err != nil {
+			return nil, fmt.Errorf("cannot mark root %x: %v", root, err)
+		}
+		for h := range links {
+			marked[h] = struct{}{}
+		}
+	}
+
+	packed, err := s.Packed()
+	if err != nil {
+		return nil, err
+	}
+
+	horizon := time.Now().Add(-c.Grace)
+	type blockFile struct {
+		prefix string
+		info   os.FileInfo
+		hash   cask.Hash
+	}
+	var files []blockFile
+	prefixes, err := s.Filesystem.ReadDir("")
+	if err != nil {
+		return nil, err
+	}
+	for _, prefix := range prefixes {
+		if !prefix.IsDir() || len(prefix.Name()) != 2 {
+			continue
+		}
+		infos, err := s.Filesystem.ReadDir(prefix.Name())
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			h, ok := parseHash(prefix.Name() + strings.TrimSuffix(info.Name(), ".partial"))
+			if ok {
+				files = append(files, blockFile{prefix: prefix.Name(), info: info, hash: h})
+			}
+		}
+	}
+
+	// Mark the links of recent blocks, tolerating missing blocks, since a
+	// writer may not have finished storing the tree.
+	recent, err := s.recentPacked(horizon)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.info.Name(), ".partial") && file.info.ModTime().After(horizon) {
+			recent = append(recent, file.hash)
+		}
+	}
+	for _, h := range recent {
+		var block cask.Block
+		if err := s.Load(ctx, h, &block); err != nil {
+			continue
+		}
+		for _, link := range block.Links() {
+			if err := mark(ctx, s, link, marked); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Sweep
+	report := &CollectReport{}
+	for _, file := range files {
+		select {
+		case <-ctx.Done():
+			return report, ctx.Err()
+		default:
+		}
+
+		name := file.info.Name()
+		partial := strings.HasSuffix(name, ".partial")
+		if _, ok := marked[file.hash]; ok && !partial {
+			if packed && !c.DryRun {
+				if err := s.migrate(ctx, file.hash); err != nil {
+					return report, err
+				}
+				// The pack counts the block.
+				continue
+			}
+			report.Retained++
+			continue
+		}
+		if file.info.ModTime().After(horizon) {
+			report.Recent++
+			continue
+		}
+		if !c.DryRun {
+			if err := s.Filesystem.Remove(path.Join(file.prefix, name)); err != nil {
+				return report, err
+			}
+		}
+		if partial {
+			report.Partial++
+		} else {
+			report.Collected++
+		}
+	}
+	if err := c.collectPartialPins(s, horizon, report); err != nil {
+		return report, err
+	}
+	return report, c.collectPacks(ctx, s, marked, report)
+}
+
+// collectPartialPins removes the partial files of pins that writers
+// abandoned before the horizon.
+func (c CollectConfig) collectPartialPins(s *Store, horizon time.Time, report *CollectReport) error {
+	infos, err := s.Filesystem.ReadDir(pinsDir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), ".partial") || info.ModTime().After(horizon) {
+			continue
+		}
+		if !c.DryRun {
+			if err := s.Filesystem.Remove(path.Join(pinsDir, info.Name())); err != nil {
+				return err
+			}
+		}
+		report.Partial++
+	}
+	return nil
+}
+
+// mark marks a block and its transitive links, skipping blocks already
+// marked and blocks the store lacks.
+func mark(ctx context.Context, s *Store, h cask.Hash, marked map[cask.Hash]struct{}) error {
+	if _, ok := marked[h]; ok {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var block cask.Block
+	if err := s.Load(ctx, h, &block); err != nil {
+		return nil
+	}
+	marked[h] = struct{}{}
+	for _, link := range block.Links() {
+		if err := mark(ctx, s, link, marked); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrate moves a block from its own file into a pack.
+func (s *Store) migrate(ctx context.Context, h cask.Hash) error {
+	var block cask.Block
+	if err := s.Load(ctx, h, &block); err != nil {
+		return err
+	}
+	if err := s.Store(ctx, h, &block); err != nil {
+		return err
+	}
+	hex := hex.EncodeToString(h[:])
+	return s.Filesystem.Remove(path.Join(hex[0:2], hex[2:]))
+}
@@ -0,0 +1,233 @@
+package caskdiskstore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"borkshop/cask"
+	"borkshop/cask/blob"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-billy.v4/osfs"
+)
+
+func newTempStore(t *testing.T) (*Store, string, func()) {
+	dir, err := ioutil.TempDir("", "caskdiskstore")
+	require.NoError(t, err)
+	return &Store{Filesystem: osfs.New(dir)}, dir, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func TestPins(t *testing.T) {
+	store, _, cleanup := newTempStore(t)
+	defer cleanup()
+
+	pins, err := store.Pins()
+	require.NoError(t, err)
+	assert.Len(t, pins, 0)
+
+	err = store.Pin("a", cask.Hash{1})
+	require.NoError(t, err)
+	err = store.Pin("b", cask.Hash{2})
+	require.NoError(t, err)
+	err = store.Pin("a", cask.Hash{3})
+	require.NoError(t, err)
+
+	h, err := store.Pinned("a")
+	require.NoError(t, err)
+	assert.Equal(t, cask.Hash{3}, h)
+
+	pins, err = store.Pins()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]cask.Hash{"a": {3}, "b": {2}}, pins)
+
+	err = store.Unpin("b")
+	require.NoError(t, err)
+	pins, err = store.Pins()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]cask.Hash{"a": {3}}, pins)
+
+	err = store.Pin("../escape", cask.Hash{})
+	assert.Error(t, err)
+}
+
+func TestRemove(t *testing.T) {
+	ctx := context.Background()
+	store, _, cleanup := newTempStore(t)
+	defer cleanup()
+
+	b := cask.Block{1}
+	h := b.Hash()
+	require.NoError(t, store.Store(ctx, h, &b))
+	require.NoError(t, store.Remove(ctx, h))
+	have, err := store.Has(ctx, []cask.Hash{h})
+	require.NoError(t, err)
+	assert.Equal(t, []bool{false}, have)
+
+	assert.NoError(t, store.Remove(ctx, h), "removing a missing block")
+}
+
+func TestCollect(t *testing.T) {
+	ctx := context.Background()
+	store, _, cleanup := newTempStore(t)
+	defer cleanup()
+
+	big := make([]byte, 10*cask.BlockSize)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	pinned, err := caskblob.Write(ctx, store, big)
+	require.NoError(t, err)
+	err = store.Pin("big", pinned)
+	require.NoError(t, err)
+
+	rooted, err := caskblob.WriteString(ctx, store, "rooted")
+	require.NoError(t, err)
+
+	garbage, err := caskblob.WriteString(ctx, store, "garbage")
+	require.NoError(t, err)
+
+	// Everything is recent.
+	report, err := CollectConfig{Roots: []cask.Hash{rooted}, Grace: time.Hour}.Collect(ctx, store)
+	require.NoError(t, err)
+	assert.Equal(t, &CollectReport{Retained: 13, Recent: 1}, report)
+
+	report, err = CollectConfig{Roots: []cask.Hash{rooted}, DryRun: true}.Collect(ctx, store)
+	require.NoError(t, err)
+	assert.Equal(t, &CollectReport{Retained: 13, Collected: 1}, report)
+
+	report, err = CollectConfig{Roots: []cask.Hash{rooted}}.Collect(ctx, store)
+	require.NoError(t, err)
+	assert.Equal(t, &CollectReport{Retained: 13, Collected: 1}, report)
+
+	have, err := store.Has(ctx, []cask.Hash{pinned, rooted, garbage})
+	require.NoError(t, err)
+	assert.Equal(t, []bool{true, true, false}, have)
+
+	str, err := caskblob.Read(ctx, store, pinned)
+	require.NoError(t, err)
+	assert.Equal(t, big, str)
+
+	err = store.Unpin("big")
+	require.NoError(t, err)
+	report, err = CollectConfig{}.Collect(ctx, store)
+	require.NoError(t, err)
+	assert.Equal(t, &CollectReport{Collected: 13}, report)
+}
+
+func TestCollectPartial(t *testing.T) {
+	ctx := context.Background()
+	store, dir, cleanup := newTempStore(t)
+	defer cleanup()
+
+	h, err := caskblob.WriteString(ctx, store, "hello")
+	require.NoError(t, err)
+	err = store.Pin("hello", h)
+	require.NoError(t, err)
+
+	// Simulate a writer that died an hour ago, leaving a partial file that
+	// would otherwise block writes to the same block forever.
+	var abandoned cask.Hash
+	abandoned[0] = 0xab
+	loc := filepath.Join(dir, "ab", "00000000000000000000000000000000000000000000000000000000000000.partial")
+	require.NoError(t, os.MkdirAll(filepath.Dir(loc), 0755))
+	require.NoError(t, ioutil.WriteFile(loc, []byte("partial"), 0644))
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(loc, old, old))
+
+	report, err := CollectConfig{Grace: time.Hour}.Collect(ctx, store)
+	require.NoError(t, err)
+	assert.Equal(t, &CollectReport{Retained: 1, Partial: 1}, report)
+
+	_, err = os.Stat(loc)
+	assert.True(t, os.IsNotExist(err))
+
+	b := cask.Block{1}
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	err = store.Store(ctx, abandoned, &b)
+	assert.NoError(t, err)
+}
+
+func TestCollectPartialPins(t *testing.T) {
+	ctx := context.Background()
+	store, dir, cleanup := newTempStore(t)
+	defer cleanup()
+
+	// Simulate a pin that died an hour ago and another still being written.
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, pinsDir), 0755))
+	abandoned := filepath.Join(dir, pinsDir, "a.partial")
+	require.NoError(t, ioutil.WriteFile(abandoned, nil, 0644))
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(abandoned, old, old))
+	writing := filepath.Join(dir, pinsDir, "b.0123456789abcdef.partial")
+	require.NoError(t, ioutil.WriteFile(writing, nil, 0644))
+
+	// Neither blocks pinning, even concurrently.
+	h, err := caskblob.WriteString(ctx, store, "hello")
+	require.NoError(t, err)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, store.Pin("a", h))
+		}()
+	}
+	wg.Wait()
+	pins, err := store.Pins()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]cask.Hash{"a": h}, pins)
+
+	report, err := CollectConfig{Grace: time.Hour}.Collect(ctx, store)
+	require.NoError(t, err)
+	assert.Equal(t, &CollectReport{Retained: 1, Partial: 1}, report)
+
+	_, err = os.Stat(abandoned)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(writing)
+	assert.NoError(t, err)
+}
+
+func TestCollectSparesReusedSubtree(t *testing.T) {
+	ctx := context.Background()
+	store, dir, cleanup := newTempStore(t)
+	defer cleanup()
+
+	big := make([]byte, 10*cask.BlockSize)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	h, err := caskblob.Write(ctx, store, big)
+	require.NoError(t, err)
+
+	// Age every block beyond the grace period, as though an unpinned tree
+	// had been written long ago.
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			err = os.Chtimes(p, old, old)
+		}
+		return err
+	}))
+
+	// A writer that finds the root with Has reuses the whole tree.
+	have, err := store.Has(ctx, []cask.Hash{h})
+	require.NoError(t, err)
+	assert.Equal(t, []bool{true}, have)
+
+	report, err := CollectConfig{Grace: time.Hour}.Collect(ctx, store)
+	require.NoError(t, err)
+	assert.Equal(t, &CollectReport{Retained: 11, Recent: 1}, report)
+
+	got, err := caskblob.Read(ctx, store, h)
+	require.NoError(t, err)
+	assert.Equal(t, big, got)
+}
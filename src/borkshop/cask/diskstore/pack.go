@@ -0,0 +1,954 @@
+package caskdiskstore
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"borkshop/cask"
+	"borkshop/cask/io"
+
+	"go.uber.org/multierr"
+	billy "gopkg.in/src-d/go-billy.v4"
+)
+
+// The pack format stores blocks in append-only pack files instead of one
+// file per block.
+//
+// Each writer appends to a pack file of its own, so writers in separate
+// processes never contend.
+// A pack begins with packMagic, followed by records.
+// Each record has a 32 byte hash, a kind, a 16 bit big-endian length, and
+// the data of the block.
+// Raw records hold the block with its trailing zeroes trimmed.
+// Compressed records hold the block compressed with DEFLATE, which a writer
+// chooses only for blocks that compress.
+// Removal records hold no data and hide earlier records of their block.
+//
+// When a pack reaches packLimit, its writer seals it with an index file that
+// lists the hash, offset, and kind of each record, so readers need not scan
+// sealed packs.
+// Readers scan unsealed packs, and stop at a record that a writer has yet to
+// finish.
+// Like block files, readers trust that records match their hash, and a check
+// rehashes them.
+//
+// Pack names begin with the time their writer created them, so later packs
+// sort after earlier packs, and their records supersede earlier records of
+// the same block.
+const (
+	packsDir  = "packs"
+	packMagic = "cask pack\n"
+	packLimit = 64 << 20
+)
+
+const (
+	kindRaw byte = iota
+	kindCompressed
+	kindRemoved
+)
+
+const (
+	recordHeaderSize = cask.HashSize + 1 + 2
+	indexEntrySize   = cask.HashSize + 8 + 1
+)
+
+// ErrNotPacked indicates that a store uses the format of one file per block
+// where an operation requires the pack format.
+var ErrNotPacked = errors.New("store is not in the pack format")
+
+// errBadRecord indicates a record that does not decode to a block.
+var errBadRecord = errors.New("malformed pack record")
+
+// packs is the state of a store in the pack format.
+type packs struct {
+	lock   sync.Mutex
+	probed bool
+	packed bool
+	loaded bool
+	files  map[string]*pack
+	index  map[cask.Hash]record
+	active *pack
+	writer billy.File
+}
+
+// pack is a pack file.
+type pack struct {
+	name string
+	// reader is open for reading records, once a record is read.
+	reader billy.File
+	// size is the length of the records of the pack that the index covers.
+	size int64
+	// sealed indicates that the pack has an index file and will not grow.
+	sealed bool
+	// written is when this writer last appended to the pack.
+	written time.Time
+}
+
+// record locates the current record of a block.
+type record struct {
+	pack   *pack
+	offset int64
+}
+
+var compressors = sync.Pool{
+	New: func() interface{} {
+		w, err := flate.NewWriter(nil, flate.BestSpeed)
+		if err != nil {
+			panic(fmt.Sprintf("assertion failed: %v", err))
+		}
+		return w
+	},
+}
+
+// InitPacks converts the store to the pack format, so that it writes every
+// block that it stores from now on to a pack.
+//
+// Blocks already stored one per file remain readable, and a garbage
+// collection moves the reachable ones into packs.
+func (s *Store) InitPacks() error {
+	if err := s.Filesystem.MkdirAll(packsDir, 0755); err != nil {
+		return err
+	}
+	s.packs.lock.Lock()
+	defer s.packs.lock.Unlock()
+	s.packs.probed = false
+	return nil
+}
+
+// Packed reports whether the store uses the pack format.
+func (s *Store) Packed() (bool, error) {
+	s.packs.lock.Lock()
+	defer s.packs.lock.Unlock()
+	return s.probe()
+}
+
+// probe detects the format of the store once.
+func (s *Store) probe() (bool, error) {
+	if s.packs.probed {
+		return s.packs.packed, nil
+	}
+	info, err := s.Filesystem.Stat(packsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	s.packs.probed = true
+	s.packs.packed = err == nil && info.IsDir()
+	return s.packs.packed, nil
+}
+
+// packed probes the format of the store and loads the indexes of its packs,
+// if it uses the pack format.
+func (s *Store) packed() (bool, error) {
+	packed, err := s.probe()
+	if err != nil || !packed || s.packs.loaded {
+		return packed, err
+	}
+	s.packs.files = make(map[string]*pack)
+	s.packs.index = make(map[cask.Hash]record)
+	if err := s.refresh(); err != nil {
+		return true, err
+	}
+	s.packs.loaded = true
+	return true, nil
+}
+
+// refresh indexes the records that other writers added since the last
+// refresh.
+// If another process removed a pack, refresh rebuilds the index from
+// scratch.
+func (s *Store) refresh() error {
+	infos, err := s.Filesystem.ReadDir(packsDir)
+	if err != nil {
+		return err
+	}
+	present := make(map[string]struct{}, len(infos))
+	var names []string
+	for _, info := range infos {
+		name := info.Name()
+		if strings.HasSuffix(name, ".pack") {
+			present[name] = struct{}{}
+			names = append(names, name)
+		}
+	}
+	for name := range s.packs.files {
+		if _, ok := present[name]; !ok {
+			s.closePacks()
+			s.packs.files = make(map[string]*pack)
+			s.packs.index = make(map[cask.Hash]record)
+			break
+		}
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		p, ok := s.packs.files[name]
+		if !ok {
+			p = &pack{name: name}
+			s.packs.files[name] = p
+			if err := s.readIndex(p); err != nil {
+				return err
+			}
+		}
+		if p.sealed || p == s.packs.active {
+			continue
+		}
+		if _, err := s.scan(p, func(h cask.Hash, offset int64, kind byte) {
+			s.apply(p, h, offset, kind)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply indexes a record.
+func (s *Store) apply(p *pack, h cask.Hash, offset int64, kind byte) {
+	if kind == kindRemoved {
+		delete(s.packs.index, h)
+	} else {
+		s.packs.index[h] = record{pack: p, offset: offset}
+	}
+}
+
+// closePacks closes every open pack file.
+func (s *Store) closePacks() {
+	for _, p := range s.packs.files {
+		if p.reader != nil {
+			p.reader.Close()
+			p.reader = nil
+		}
+	}
+	if s.packs.writer != nil {
+		s.packs.writer.Close()
+		s.packs.writer = nil
+		s.packs.active = nil
+	}
+}
+
+// readIndex indexes the records of a sealed pack from its index file, and
+// leaves a pack without an intact index file unsealed.
+func (s *Store) readIndex(p *pack) error {
+	buf, err := readFile(s.Filesystem, indexName(p.name))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if len(buf)%indexEntrySize != 0 {
+		return nil
+	}
+	info, err := s.Filesystem.Stat(path.Join(packsDir, p.name))
+	if err != nil {
+		return err
+	}
+	for ; len(buf) > 0; buf = buf[indexEntrySize:] {
+		var h cask.Hash
+		copy(h[:], buf)
+		offset := int64(binary.BigEndian.Uint64(buf[cask.HashSize:]))
+		s.apply(p, h, offset, buf[cask.HashSize+8])
+	}
+	p.size = info.Size()
+	p.sealed = true
+	return nil
+}
+
+// writeIndex seals a pack with an index file of its current records.
+func (s *Store) writeIndex(p *pack, entries []byte) error {
+	name := indexName(p.name)
+	temp, err := s.Filesystem.OpenFile(name+".partial", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = temp.Write(entries)
+	err = multierr.Append(err, temp.Close())
+	if err != nil {
+		return multierr.Append(err, s.Filesystem.Remove(temp.Name()))
+	}
+	if err := s.Filesystem.Rename(temp.Name(), name); err != nil {
+		return err
+	}
+	p.sealed = true
+	return nil
+}
+
+// scan reads the records of a pack that follow the indexed size, and stops
+// at the end of the last complete record.
+// It returns the number of bytes beyond the last complete record, which
+// belong to a record that a writer has yet to finish or abandoned.
+func (s *Store) scan(p *pack, visit func(h cask.Hash, offset int64, kind byte)) (int64, error) {
+	file, err := s.reader(p)
+	if err != nil {
+		return 0, err
+	}
+	if p.size == 0 {
+		magic := make([]byte, len(packMagic))
+		if _, err := file.ReadAt(magic, 0); err != nil && err != io.EOF {
+			return 0, err
+		} else if string(magic) != packMagic {
+			// A writer has yet to finish writing the magic, or the file is
+			// not a pack.
+			return 0, nil
+		}
+		p.size = int64(len(packMagic))
+	}
+	for {
+		h, kind, data, err := readRecord(file, p.size)
+		if err == io.EOF {
+			return 0, nil
+		} else if err == io.ErrUnexpectedEOF || err == errBadRecord {
+			info, statErr := s.Filesystem.Stat(path.Join(packsDir, p.name))
+			if statErr != nil {
+				return 0, statErr
+			}
+			return info.Size() - p.size, nil
+		} else if err != nil {
+			return 0, err
+		}
+		visit(h, p.size, kind)
+		p.size += int64(recordHeaderSize + len(data))
+	}
+}
+
+// reader returns the file of a pack, open for reading.
+func (s *Store) reader(p *pack) (billy.File, error) {
+	if p.reader == nil {
+		file, err := s.Filesystem.Open(path.Join(packsDir, p.name))
+		if err != nil {
+			return nil, err
+		}
+		p.reader = file
+	}
+	return p.reader, nil
+}
+
+// readRecord reads the record at an offset of a pack, and returns its hash,
+// kind, and data.
+// readRecord returns io.EOF if no record begins at the offset, and
+// io.ErrUnexpectedEOF if the pack ends within the record.
+func readRecord(r io.ReaderAt, offset int64) (cask.Hash, byte, []byte, error) {
+	var h cask.Hash
+	var header [recordHeaderSize]byte
+	if n, err := r.ReadAt(header[:], offset); n == 0 && err == io.EOF {
+		return h, 0, nil, io.EOF
+	} else if n < len(header) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return h, 0, nil, err
+	}
+	copy(h[:], header[:])
+	kind := header[cask.HashSize]
+	length := int(binary.BigEndian.Uint16(header[cask.HashSize+1:]))
+	if kind > kindRemoved || length > cask.BlockSize {
+		return h, 0, nil, errBadRecord
+	}
+	data := make([]byte, length)
+	if n, err := r.ReadAt(data, offset+recordHeaderSize); n < length {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return h, 0, nil, err
+	}
+	return h, kind, data, nil
+}
+
+// decodeRecord decodes the data of a record into a block.
+func decodeRecord(kind byte, data []byte, b *cask.Block) error {
+	*b = cask.Block{}
+	switch kind {
+	case kindRaw:
+		copy(b[:], data)
+	case kindCompressed:
+		buf, err := ioutil.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(data)), cask.BlockSize+1))
+		if err != nil || len(buf) > cask.BlockSize {
+			return errBadRecord
+		}
+		copy(b[:], buf)
+	default:
+		return errBadRecord
+	}
+	return nil
+}
+
+// encodeRecord returns the record of a block, compressing the block if that
+// makes the record smaller.
+func encodeRecord(h cask.Hash, kind byte, b *cask.Block) []byte {
+	var data []byte
+	if kind != kindRemoved {
+		data = bytes.TrimRight(b[:], "\x00")
+		var compressed bytes.Buffer
+		w := compressors.Get().(*flate.Writer)
+		w.Reset(&compressed)
+		w.Write(data)
+		w.Close()
+		compressors.Put(w)
+		if compressed.Len() < len(data) {
+			kind = kindCompressed
+			data = compressed.Bytes()
+		}
+	}
+	buf := make([]byte, recordHeaderSize, recordHeaderSize+len(data))
+	copy(buf, h[:])
+	buf[cask.HashSize] = kind
+	binary.BigEndian.PutUint16(buf[cask.HashSize+1:], uint16(len(data)))
+	return append(buf, data...)
+}
+
+// append writes a record to the pack of this writer, creating a pack if
+// necessary, and seals the pack once it reaches the limit.
+func (s *Store) append(h cask.Hash, kind byte, rec []byte) error {
+	// A writer abandons a pack that it has not written to for a while, since
+	// a garbage collection may remove the pack once the grace period passes.
+	if s.packs.active != nil && time.Since(s.packs.active.written) >= freshenAge {
+		if err := s.seal(); err != nil {
+			return err
+		}
+	}
+	// A record supersedes the records of its block only in packs that sort
+	// before its own.
+	if r, ok := s.packs.index[h]; ok && s.packs.active != nil && r.pack.name > s.packs.active.name {
+		if err := s.seal(); err != nil {
+			return err
+		}
+	}
+	if s.packs.active == nil {
+		if err := s.create(); err != nil {
+			return err
+		}
+	}
+	p := s.packs.active
+	if _, err := s.packs.writer.Write(rec); err != nil {
+		return err
+	}
+	s.apply(p, h, p.size, kind)
+	p.size += int64(len(rec))
+	p.written = time.Now()
+	if p.size >= packLimit {
+		return s.seal()
+	}
+	return nil
+}
+
+// create begins a new pack for this writer.
+func (s *Store) create() error {
+	var suffix [4]byte
+	if _, err := rand.Read(suffix[:]); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%016x%x.pack", time.Now().UnixNano(), suffix)
+	file, err := s.Filesystem.OpenFile(path.Join(packsDir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write([]byte(packMagic)); err != nil {
+		return multierr.Append(err, file.Close())
+	}
+	p := &pack{name: name, size: int64(len(packMagic))}
+	s.packs.files[name] = p
+	s.packs.active = p
+	s.packs.writer = file
+	return nil
+}
+
+// seal writes the index of the pack of this writer, so that the next record
+// begins a new pack.
+func (s *Store) seal() error {
+	p := s.packs.active
+	if p == nil {
+		return nil
+	}
+	err := s.packs.writer.Close()
+	s.packs.writer = nil
+	s.packs.active = nil
+	if err != nil {
+		return err
+	}
+
+	var entries []byte
+	var entry [indexEntrySize]byte
+	file, err := s.reader(p)
+	if err != nil {
+		return err
+	}
+	for offset := int64(len(packMagic)); offset < p.size; {
+		h, kind, data, err := readRecord(file, offset)
+		if err != nil {
+			return err
+		}
+		copy(entry[:], h[:])
+		binary.BigEndian.PutUint64(entry[cask.HashSize:], uint64(offset))
+		entry[cask.HashSize+8] = kind
+		entries = append(entries, entry[:]...)
+		offset += int64(recordHeaderSize + len(data))
+	}
+	return s.writeIndex(p, entries)
+}
+
+// storePacked appends a block to a pack, unless the store holds a recent
+// record of the block.
+func (s *Store) storePacked(ctx context.Context, h cask.Hash, b *cask.Block) error {
+	if r, ok := s.packs.index[h]; ok {
+		if r.pack == s.packs.active {
+			return nil
+		}
+		info, err := s.Filesystem.Stat(path.Join(packsDir, r.pack.name))
+		if err == nil && time.Since(info.ModTime()) < freshenAge {
+			return nil
+		}
+	}
+	return s.append(h, kindRaw, encodeRecord(h, kindRaw, b))
+}
+
+// loadPacked reads a block from a pack, refreshing the index once if the
+// block is missing or its pack is gone.
+// It reports whether any pack has the block.
+//
+// loadPacked holds the lock only to find the record and its pack, and reads
+// and inflates the record without it, so loads proceed in parallel.
+// A compaction that replaces the pack in the meantime closes its reader and
+// indexes the record anew, so the load looks it up again.
+func (s *Store) loadPacked(ctx context.Context, h cask.Hash, b *cask.Block) (bool, error) {
+	for attempt := 0; ; {
+		s.packs.lock.Lock()
+		if attempt > 0 {
+			if err := s.refresh(); err != nil {
+				s.packs.lock.Unlock()
+				return false, err
+			}
+		}
+		r, ok := s.packs.index[h]
+		var file billy.File
+		var err error
+		if ok {
+			file, err = s.reader(r.pack)
+		}
+		s.packs.lock.Unlock()
+
+		if ok && err == nil {
+			var kind byte
+			var data []byte
+			if _, kind, data, err = readRecord(file, r.offset); err == nil {
+				return true, decodeRecord(kind, data, b)
+			} else if errors.Is(err, os.ErrClosed) {
+				continue
+			}
+		}
+		if attempt > 0 {
+			return ok, err
+		} else if ok && !os.IsNotExist(err) {
+			return true, err
+		}
+		attempt++
+	}
+}
+
+// hasPacked reports whether a pack has each block, refreshing the index
+// once if any block is missing.
+func (s *Store) hasPacked(hs []cask.Hash) ([]bool, error) {
+	have := make([]bool, len(hs))
+	for attempt := 0; attempt < 2; attempt++ {
+		missing := false
+		for i, h := range hs {
+			_, have[i] = s.packs.index[h]
+			missing = missing || !have[i]
+		}
+		if !missing || attempt > 0 {
+			break
+		}
+		if err := s.refresh(); err != nil {
+			return nil, err
+		}
+	}
+	return have, nil
+}
+
+// stalePacked returns the blocks found in packs last modified longer than
+// freshenAge ago, which storePacked would append again.
+func (s *Store) stalePacked(hs []cask.Hash, have []bool) ([]cask.Hash, error) {
+	var stale []cask.Hash
+	ages := make(map[*pack]bool)
+	for i, h := range hs {
+		if !have[i] {
+			continue
+		}
+		r := s.packs.index[h]
+		if r.pack == s.packs.active {
+			continue
+		}
+		old, ok := ages[r.pack]
+		if !ok {
+			info, err := s.Filesystem.Stat(path.Join(packsDir, r.pack.name))
+			if err != nil {
+				return nil, err
+			}
+			old = time.Since(info.ModTime()) >= freshenAge
+			ages[r.pack] = old
+		}
+		if old {
+			stale = append(stale, h)
+		}
+	}
+	return stale, nil
+}
+
+// recentPacked returns the blocks in packs modified after the horizon.
+func (s *Store) recentPacked(horizon time.Time) ([]cask.Hash, error) {
+	s.packs.lock.Lock()
+	defer s.packs.lock.Unlock()
+	if packed, err := s.packed(); err != nil || !packed {
+		return nil, err
+	}
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+	recent := make(map[*pack]bool)
+	for _, p := range s.packs.files {
+		info, err := s.Filesystem.Stat(path.Join(packsDir, p.name))
+		if err != nil {
+			return nil, err
+		}
+		recent[p] = info.ModTime().After(horizon)
+	}
+	var hs []cask.Hash
+	for h, r := range s.packs.index {
+		if recent[r.pack] {
+			hs = append(hs, h)
+		}
+	}
+	return hs, nil
+}
+
+// removePacked hides the records of a block with a removal record, if any
+// pack has the block.
+func (s *Store) removePacked(h cask.Hash) error {
+	if _, ok := s.packs.index[h]; !ok {
+		return nil
+	}
+	return s.append(h, kindRemoved, encodeRecord(h, kindRemoved, nil))
+}
+
+// CompactConfig captures the parameters of a compaction.
+type CompactConfig struct {
+	// Grace spares the packs written more recently than the grace period,
+	// which concurrent writers may still be appending to.
+	Grace time.Duration
+}
+
+// CompactReport summarizes a compaction.
+type CompactReport struct {
+	// Packs is the number of packs the compaction rewrote.
+	Packs int
+	// Blocks is the number of blocks the compaction copied to a new pack.
+	Blocks int
+	// Reclaimed is the number of bytes of superseded and removed records
+	// and unfinished records that the compaction reclaimed.
+	Reclaimed int64
+}
+
+// Compact rewrites the packs of the store into a new sealed pack, dropping
+// records of removed blocks and records that later records supersede.
+// Unlike a garbage collection, Compact rewrites every pack last modified
+// before the grace period, however little it would reclaim.
+func (c CompactConfig) Compact(ctx context.Context, s *Store) (*CompactReport, error) {
+	s.packs.lock.Lock()
+	defer s.packs.lock.Unlock()
+	if packed, err := s.packed(); err != nil {
+		return nil, err
+	} else if !packed {
+		return nil, ErrNotPacked
+	}
+	report := &CompactReport{}
+	_, err := s.repack(ctx, c.Grace, 0, nil, report)
+	return report, err
+}
+
+// collectWaste is the share of a sealed pack that must be removed or
+// superseded records before a garbage collection rewrites the pack.
+// Rewriting a pack that mostly holds current records would copy much to
+// reclaim little, on every collection.
+const collectWaste = 0.25
+
+// repack copies the current records of the blocks in packs last modified
+// before the grace period into a new sealed pack, then removes those packs.
+// repack spares the old sealed packs in which removed and superseded records
+// take less than the given share of the records.
+// If keep is not nil, repack drops the blocks for which keep returns false,
+// except from the spared packs, where they count as waste.
+// repack returns the blocks in recent packs.
+func (s *Store) repack(ctx context.Context, grace time.Duration, waste float64, keep func(cask.Hash) bool, report *CompactReport) (map[cask.Hash]struct{}, error) {
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+	if err := s.seal(); err != nil {
+		return nil, err
+	}
+	old, rewrite, err := s.plan(ctx, grace, waste, keep)
+	if err != nil {
+		return nil, err
+	}
+	recent := make(map[cask.Hash]struct{})
+	var copied []cask.Hash
+	for h, r := range s.packs.index {
+		if _, ok := old[r.pack]; !ok {
+			recent[h] = struct{}{}
+		} else if !rewrite[r.pack] {
+			continue
+		} else if keep != nil && !keep(h) {
+			delete(s.packs.index, h)
+		} else {
+			copied = append(copied, h)
+		}
+	}
+	for _, h := range copied {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		r := s.packs.index[h]
+		file, err := s.reader(r.pack)
+		if err != nil {
+			return nil, err
+		}
+		_, kind, data, err := readRecord(file, r.offset)
+		if err != nil {
+			return nil, err
+		}
+		rec := make([]byte, recordHeaderSize+len(data))
+		if _, err := file.ReadAt(rec, r.offset); err != nil {
+			return nil, err
+		}
+		if err := s.append(h, kind, rec); err != nil {
+			return nil, err
+		}
+		report.Blocks++
+		report.Reclaimed -= int64(len(rec))
+	}
+	if err := s.seal(); err != nil {
+		return nil, err
+	}
+
+	for p, size := range old {
+		if !rewrite[p] {
+			continue
+		}
+		if p.reader != nil {
+			p.reader.Close()
+			p.reader = nil
+		}
+		delete(s.packs.files, p.name)
+		err := s.Filesystem.Remove(indexName(p.name))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err := s.Filesystem.Remove(path.Join(packsDir, p.name)); err != nil {
+			return nil, err
+		}
+		report.Packs++
+		report.Reclaimed += size - int64(len(packMagic))
+	}
+	return recent, nil
+}
+
+// plan returns the sizes of the packs last modified before the grace
+// period, and which of them to rewrite: the unsealed packs, and the sealed
+// packs in which removed and superseded records, and the records of blocks
+// for which keep returns false, take at least the given share of the
+// records.
+func (s *Store) plan(ctx context.Context, grace time.Duration, waste float64, keep func(cask.Hash) bool) (map[*pack]int64, map[*pack]bool, error) {
+	horizon := time.Now().Add(-grace)
+	old := make(map[*pack]int64)
+	for name, p := range s.packs.files {
+		info, err := s.Filesystem.Stat(path.Join(packsDir, name))
+		if err != nil {
+			return nil, nil, err
+		}
+		if info.ModTime().Before(horizon) {
+			old[p] = info.Size()
+		}
+	}
+	live := make(map[*pack]int64)
+	if waste > 0 {
+		for h, r := range s.packs.index {
+			if ctx.Err() != nil {
+				return nil, nil, ctx.Err()
+			}
+			if _, ok := old[r.pack]; !ok || (keep != nil && !keep(h)) {
+				continue
+			}
+			file, err := s.reader(r.pack)
+			if err != nil {
+				return nil, nil, err
+			}
+			_, _, data, err := readRecord(file, r.offset)
+			if err != nil {
+				return nil, nil, err
+			}
+			live[r.pack] += int64(recordHeaderSize + len(data))
+		}
+	}
+	rewrite := make(map[*pack]bool, len(old))
+	for p, size := range old {
+		records := size - int64(len(packMagic))
+		// The pack of this writer is as good as sealed, since repack seals
+		// it first.
+		sealed := p.sealed || p == s.packs.active
+		rewrite[p] = !sealed || float64(records-live[p]) >= waste*float64(records)
+	}
+	return old, rewrite, nil
+}
+
+// collectPacks drops the unreachable blocks in packs last modified before the
+// grace period, and counts the blocks of the packs toward the report.
+// collectPacks rewrites only the packs with enough waste, and leaves the
+// unreachable blocks of the others for a later collection.
+func (c CollectConfig) collectPacks(ctx context.Context, s *Store, marked map[cask.Hash]struct{}, report *CollectReport) error {
+	s.packs.lock.Lock()
+	defer s.packs.lock.Unlock()
+	if packed, err := s.packed(); err != nil || !packed {
+		return err
+	}
+	if err := s.refresh(); err != nil {
+		return err
+	}
+	keep := func(h cask.Hash) bool {
+		_, ok := marked[h]
+		return ok
+	}
+	if c.DryRun {
+		old, rewrite, err := s.plan(ctx, c.Grace, collectWaste, keep)
+		if err != nil {
+			return err
+		}
+		for h, r := range s.packs.index {
+			if _, ok := old[r.pack]; keep(h) {
+				report.Retained++
+			} else if !ok {
+				report.Recent++
+			} else if rewrite[r.pack] {
+				report.Collected++
+			} else {
+				report.Deferred++
+			}
+		}
+		return nil
+	}
+
+	var unmarked []cask.Hash
+	for h := range s.packs.index {
+		if _, ok := marked[h]; !ok {
+			unmarked = append(unmarked, h)
+		}
+	}
+	recent, err := s.repack(ctx, c.Grace, collectWaste, keep, &CompactReport{})
+	if err != nil {
+		return err
+	}
+	for _, h := range unmarked {
+		if _, ok := s.packs.index[h]; !ok {
+			report.Collected++
+		}
+	}
+	for h := range s.packs.index {
+		if _, ok := marked[h]; ok {
+			report.Retained++
+		} else if _, ok := recent[h]; ok {
+			report.Recent++
+		} else {
+			report.Deferred++
+		}
+	}
+	return nil
+}
+
+// checkPacks rehashes the current record of every block in the packs of the
+// store, and replaces damaged blocks with intact copies from the repair
+// store, if possible.
+// checkPacks also reports packs that end with an unfinished record.
+func (c CheckConfig) checkPacks(ctx context.Context, s *Store, report *CheckReport) error {
+	s.packs.lock.Lock()
+	defer s.packs.lock.Unlock()
+	if packed, err := s.packed(); err != nil || !packed {
+		return err
+	}
+	if err := s.refresh(); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(s.packs.files))
+	for name := range s.packs.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p := s.packs.files[name]
+		if p.sealed || p == s.packs.active {
+			continue
+		}
+		if tail, err := s.scan(p, func(cask.Hash, int64, byte) {}); err != nil {
+			return err
+		} else if tail > 0 {
+			report.Partial = append(report.Partial, fmt.Sprintf("%s@%d", path.Join(packsDir, name), p.size))
+		}
+	}
+
+	hashes := make([]cask.Hash, 0, len(s.packs.index))
+	for h := range s.packs.index {
+		hashes = append(hashes, h)
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		return bytes.Compare(hashes[i][:], hashes[j][:]) < 0
+	})
+	var block cask.Block
+	for _, h := range hashes {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		report.Blocks++
+		r := s.packs.index[h]
+		file, err := s.reader(r.pack)
+		if err != nil {
+			return err
+		}
+		if _, kind, data, err := readRecord(file, r.offset); err != nil && err != errBadRecord && err != io.ErrUnexpectedEOF {
+			return err
+		} else if err == nil && decodeRecord(kind, data, &block) == nil && block.Hash() == h {
+			continue
+		}
+
+		damage := caskio.Damage{Hash: h, Err: caskio.ErrHashMismatch}
+		if intact, ok := c.repair(ctx, h); ok {
+			if err := s.append(h, kindRaw, encodeRecord(h, kindRaw, intact)); err != nil {
+				return err
+			}
+			damage.Repaired = true
+		}
+		report.Damaged = append(report.Damaged, damage)
+	}
+	return nil
+}
+
+// indexName returns the name of the index file of a pack.
+func indexName(name string) string {
+	return path.Join(packsDir, strings.TrimSuffix(name, ".pack")+".idx")
+}
+
+// readFile reads a whole file.
+func readFile(fs billy.Filesystem, name string) ([]byte, error) {
+	file, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(file)
+}
@@ -0,0 +1,339 @@
+package caskdiskstore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"borkshop/cask"
+	"borkshop/cask/blob"
+	"borkshop/cask/io"
+	"borkshop/cask/memstore"
+	"borkshop/cask/test"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-billy.v4/osfs"
+)
+
+func newTempPackStore(t *testing.T) (*Store, string, func()) {
+	store, dir, cleanup := newTempStore(t)
+	require.NoError(t, store.InitPacks())
+	return store, dir, cleanup
+}
+
+func packFiles(t *testing.T, dir string) []string {
+	names, err := filepath.Glob(filepath.Join(dir, packsDir, "*.pack"))
+	require.NoError(t, err)
+	return names
+}
+
+func TestPackStress(t *testing.T) {
+	store, _, cleanup := newTempPackStore(t)
+	defer cleanup()
+	report := casktest.StressStoreConfig{
+		Concurrency: 100,
+		Duration:    200 * time.Millisecond,
+	}.Stress(store)
+
+	assert.Equal(t, 0, report.WriteErrors, "write errors")
+	assert.Equal(t, 0, report.ReadErrors, "read errors")
+	assert.Equal(t, 0, report.DataErrors, "data integrity errors")
+	assert.NotEqual(t, 0, report.Cycles, "no cycles")
+}
+
+func TestPacks(t *testing.T) {
+	ctx := context.Background()
+	store, dir, cleanup := newTempPackStore(t)
+	defer cleanup()
+
+	packed, err := store.Packed()
+	require.NoError(t, err)
+	assert.True(t, packed)
+
+	// A block of text compresses, and a block of noise does not.
+	text, err := caskblob.WriteString(ctx, store, "all work and no play makes jack a dull boy. all work and no play makes jack a dull boy.")
+	require.NoError(t, err)
+	var noise cask.Block
+	for i := range noise {
+		noise[i] = byte(i*7919 + i>>3)
+	}
+	require.NoError(t, store.Store(ctx, noise.Hash(), &noise))
+
+	files := packFiles(t, dir)
+	require.Len(t, files, 1)
+	info, err := os.Stat(files[0])
+	require.NoError(t, err)
+	assert.True(t, info.Size() < 2*cask.BlockSize, "pack of %d bytes", info.Size())
+
+	// Another store over the same directory scans the pack.
+	other := &Store{Filesystem: osfs.New(dir)}
+	str, err := caskblob.ReadString(ctx, other, text)
+	require.NoError(t, err)
+	assert.Contains(t, str, "dull boy")
+	var block cask.Block
+	require.NoError(t, other.Load(ctx, noise.Hash(), &block))
+	assert.Equal(t, noise, block)
+
+	// The first store notices blocks that the other store writes.
+	later, err := caskblob.WriteString(ctx, other, "later")
+	require.NoError(t, err)
+	have, err := store.Has(ctx, []cask.Hash{text, later, {1}})
+	require.NoError(t, err)
+	assert.Equal(t, []bool{true, true, false}, have)
+	assert.Len(t, packFiles(t, dir), 2)
+
+	require.NoError(t, store.Remove(ctx, later))
+	have, err = (&Store{Filesystem: osfs.New(dir)}).Has(ctx, []cask.Hash{later})
+	require.NoError(t, err)
+	assert.Equal(t, []bool{false}, have)
+}
+
+func TestPacksReadLooseFiles(t *testing.T) {
+	ctx := context.Background()
+	store, dir, cleanup := newTempStore(t)
+	defer cleanup()
+
+	loose, err := caskblob.WriteString(ctx, store, "loose")
+	require.NoError(t, err)
+	require.NoError(t, store.Pin("loose", loose))
+	garbage, err := caskblob.WriteString(ctx, store, "garbage")
+	require.NoError(t, err)
+
+	store = &Store{Filesystem: osfs.New(dir)}
+	require.NoError(t, store.InitPacks())
+	str, err := caskblob.ReadString(ctx, store, loose)
+	require.NoError(t, err)
+	assert.Equal(t, "loose", str)
+
+	// Collection moves the reachable block into a pack.
+	report, err := CollectConfig{}.Collect(ctx, store)
+	require.NoError(t, err)
+	assert.Equal(t, &CollectReport{Retained: 1, Collected: 1}, report)
+	assert.Len(t, packFiles(t, dir), 1)
+	have, err := store.Has(ctx, []cask.Hash{loose, garbage})
+	require.NoError(t, err)
+	assert.Equal(t, []bool{true, false}, have)
+	str, err = caskblob.ReadString(ctx, store, loose)
+	require.NoError(t, err)
+	assert.Equal(t, "loose", str)
+}
+
+func TestCompact(t *testing.T) {
+	ctx := context.Background()
+	store, dir, cleanup := newTempPackStore(t)
+	defer cleanup()
+
+	_, err := CompactConfig{}.Compact(ctx, &Store{Filesystem: osfs.New(os.TempDir())})
+	assert.Equal(t, ErrNotPacked, err)
+
+	hashes := make([]cask.Hash, 10)
+	for i := range hashes {
+		hashes[i], err = caskblob.WriteString(ctx, store, string(rune('a'+i)))
+		require.NoError(t, err)
+	}
+	for _, h := range hashes[:5] {
+		require.NoError(t, store.Remove(ctx, h))
+	}
+	other := &Store{Filesystem: osfs.New(dir)}
+	_, err = caskblob.WriteString(ctx, other, "z")
+	require.NoError(t, err)
+	require.Len(t, packFiles(t, dir), 2)
+
+	// Recent packs survive.
+	report, err := CompactConfig{Grace: time.Hour}.Compact(ctx, store)
+	require.NoError(t, err)
+	assert.Equal(t, &CompactReport{}, report)
+
+	report, err = CompactConfig{}.Compact(ctx, store)
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Packs)
+	assert.Equal(t, 6, report.Blocks)
+	assert.True(t, report.Reclaimed > 0)
+	require.Len(t, packFiles(t, dir), 1)
+	index, err := filepath.Glob(filepath.Join(dir, packsDir, "*.idx"))
+	require.NoError(t, err)
+	assert.Len(t, index, 1)
+
+	// A new store reads the index of the sealed pack, and the other store
+	// rebuilds its index once it finds its pack gone.
+	for _, s := range []*Store{{Filesystem: osfs.New(dir)}, other} {
+		have, err := s.Has(ctx, hashes)
+		require.NoError(t, err)
+		assert.Equal(t, []bool{false, false, false, false, false, true, true, true, true, true}, have)
+		str, err := caskblob.ReadString(ctx, s, hashes[9])
+		require.NoError(t, err)
+		assert.Equal(t, "j", str)
+	}
+}
+
+func TestLoadDuringCompact(t *testing.T) {
+	ctx := context.Background()
+	store, _, cleanup := newTempPackStore(t)
+	defer cleanup()
+
+	hashes := make([]cask.Hash, 20)
+	for i := range hashes {
+		var err error
+		hashes[i], err = caskblob.WriteString(ctx, store, string(rune('a'+i)))
+		require.NoError(t, err)
+	}
+
+	// Loads read packs outside the lock, while compaction replaces them.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for i, h := range hashes {
+					str, err := caskblob.ReadString(ctx, store, h)
+					if !assert.NoError(t, err) {
+						return
+					}
+					assert.Equal(t, string(rune('a'+i)), str)
+				}
+			}
+		}()
+	}
+	for i := 0; i < 200; i++ {
+		_, err := CompactConfig{}.Compact(ctx, store)
+		require.NoError(t, err)
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestCollectPacks(t *testing.T) {
+	ctx := context.Background()
+	store, dir, cleanup := newTempPackStore(t)
+	defer cleanup()
+
+	big := make([]byte, 10*cask.BlockSize)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	pinned, err := caskblob.WriteString(ctx, store, "pinned")
+	require.NoError(t, err)
+	require.NoError(t, store.Pin("small", pinned))
+	garbage, err := caskblob.Write(ctx, store, big)
+	require.NoError(t, err)
+
+	// The recent garbage spares its links.
+	report, err := CollectConfig{Grace: time.Hour}.Collect(ctx, store)
+	require.NoError(t, err)
+	assert.Equal(t, &CollectReport{Retained: 12, Recent: 1}, report)
+
+	report, err = CollectConfig{DryRun: true}.Collect(ctx, store)
+	require.NoError(t, err)
+	assert.Equal(t, &CollectReport{Retained: 1, Collected: 12}, report)
+
+	report, err = CollectConfig{}.Collect(ctx, store)
+	require.NoError(t, err)
+	assert.Equal(t, &CollectReport{Retained: 1, Collected: 12}, report)
+
+	store = &Store{Filesystem: osfs.New(dir)}
+	have, err := store.Has(ctx, []cask.Hash{pinned, garbage})
+	require.NoError(t, err)
+	assert.Equal(t, []bool{true, false}, have)
+	str, err := caskblob.ReadString(ctx, store, pinned)
+	require.NoError(t, err)
+	assert.Equal(t, "pinned", str)
+}
+
+func TestCollectPacksSparesDensePacks(t *testing.T) {
+	ctx := context.Background()
+	store, dir, cleanup := newTempPackStore(t)
+	defer cleanup()
+
+	big := make([]byte, 10*cask.BlockSize)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	pinned, err := caskblob.Write(ctx, store, big)
+	require.NoError(t, err)
+	require.NoError(t, store.Pin("big", pinned))
+	garbage, err := caskblob.WriteString(ctx, store, "garbage")
+	require.NoError(t, err)
+
+	// One block of thirteen is too little garbage to rewrite the pack.
+	report, err := CollectConfig{DryRun: true}.Collect(ctx, store)
+	require.NoError(t, err)
+	assert.Equal(t, &CollectReport{Retained: 12, Deferred: 1}, report)
+	report, err = CollectConfig{}.Collect(ctx, store)
+	require.NoError(t, err)
+	assert.Equal(t, &CollectReport{Retained: 12, Deferred: 1}, report)
+	files := packFiles(t, dir)
+	require.Len(t, files, 1)
+	report, err = CollectConfig{}.Collect(ctx, store)
+	require.NoError(t, err)
+	assert.Equal(t, &CollectReport{Retained: 12, Deferred: 1}, report)
+	assert.Equal(t, files, packFiles(t, dir))
+
+	// Once most of the blocks are garbage, a collection rewrites the pack.
+	require.NoError(t, store.Unpin("big"))
+	report, err = CollectConfig{DryRun: true}.Collect(ctx, store)
+	require.NoError(t, err)
+	assert.Equal(t, &CollectReport{Collected: 13}, report)
+	report, err = CollectConfig{}.Collect(ctx, store)
+	require.NoError(t, err)
+	assert.Equal(t, &CollectReport{Collected: 13}, report)
+	assert.Empty(t, packFiles(t, dir))
+	have, err := (&Store{Filesystem: osfs.New(dir)}).Has(ctx, []cask.Hash{pinned, garbage})
+	require.NoError(t, err)
+	assert.Equal(t, []bool{false, false}, have)
+}
+
+func TestCheckPacks(t *testing.T) {
+	ctx := context.Background()
+	store, dir, cleanup := newTempPackStore(t)
+	defer cleanup()
+	repair := caskmemstore.New()
+
+	model := cask.Model{Bytes: []byte("leaf")}
+	leaf, err := model.Store(ctx, store)
+	require.NoError(t, err)
+	_, err = model.Store(ctx, repair)
+	require.NoError(t, err)
+	root := cask.Model{Links: []cask.Hash{leaf}}
+	rootHash, err := root.Store(ctx, store)
+	require.NoError(t, err)
+	require.NoError(t, store.Pin("root", rootHash))
+
+	report, err := CheckConfig{}.Check(ctx, store)
+	require.NoError(t, err)
+	assert.Equal(t, &CheckReport{Blocks: 2, Reachable: 2}, report)
+
+	// Corrupt the leaf in place, and leave an unfinished record.
+	files := packFiles(t, dir)
+	require.Len(t, files, 1)
+	buf, err := ioutil.ReadFile(files[0])
+	require.NoError(t, err)
+	offset := len(packMagic) + recordHeaderSize
+	require.Equal(t, leaf[:], buf[len(packMagic):offset-3])
+	buf[offset] ^= 0xff
+	buf = append(buf, leaf[:10]...)
+	require.NoError(t, ioutil.WriteFile(files[0], buf, 0644))
+
+	store = &Store{Filesystem: osfs.New(dir)}
+	report, err = CheckConfig{Repair: repair}.Check(ctx, store)
+	require.NoError(t, err)
+	assert.Len(t, report.Partial, 1)
+	assert.Equal(t, []caskio.Damage{
+		{Hash: leaf, Err: caskio.ErrHashMismatch, Repaired: true},
+	}, report.Damaged)
+
+	report, err = CheckConfig{}.Check(ctx, &Store{Filesystem: osfs.New(dir)})
+	require.NoError(t, err)
+	assert.Empty(t, report.Damaged)
+}
@@ -0,0 +1,125 @@
+package caskdiskstore
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"borkshop/cask"
+
+	"go.uber.org/multierr"
+)
+
+// pinsDir is the directory of pinned roots within the store.
+// The name cannot collide with the two hex digit prefixes of block files.
+const pinsDir = "pins"
+
+// Pin retains the block with the given hash and all of its transitive links
+// under the given name, protecting them from garbage collection.
+//
+// Pinning an existing name replaces the prior pin.
+// Concurrent pins of the same name each write their own partial file, and
+// the last to finish wins.
+func (s *Store) Pin(name string, h cask.Hash) error {
+	if err := validPinName(name); err != nil {
+		return err
+	}
+	if err := s.Filesystem.MkdirAll(pinsDir, 0755); err != nil {
+		return err
+	}
+
+	var nonce [8]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return err
+	}
+	loc := path.Join(pinsDir, name)
+	temp, err := s.Filesystem.OpenFile(fmt.Sprintf("%s.%x.partial", loc, nonce), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(temp, "%x\n", h)
+	err = multierr.Append(err, temp.Close())
+	if err == nil {
+		err = s.Filesystem.Rename(temp.Name(), loc)
+	}
+	if err != nil {
+		// A partial file left behind lingers until garbage collection.
+		return multierr.Append(err, s.Filesystem.Remove(temp.Name()))
+	}
+	return nil
+}
+
+// Unpin removes the pin with the given name, leaving the blocks it retained
+// to garbage collection.
+func (s *Store) Unpin(name string) error {
+	if err := validPinName(name); err != nil {
+		return err
+	}
+	return s.Filesystem.Remove(path.Join(pinsDir, name))
+}
+
+// Pinned returns the hash pinned under the given name.
+func (s *Store) Pinned(name string) (cask.Hash, error) {
+	if err := validPinName(name); err != nil {
+		return cask.ZeroHash, err
+	}
+	file, err := s.Filesystem.Open(path.Join(pinsDir, name))
+	if err != nil {
+		return cask.ZeroHash, err
+	}
+	defer file.Close()
+	buf, err := ioutil.ReadAll(file)
+	if err != nil {
+		return cask.ZeroHash, err
+	}
+	h, ok := parseHash(strings.TrimSpace(string(buf)))
+	if !ok {
+		return cask.ZeroHash, fmt.Errorf("corrupt pin %q", name)
+	}
+	return h, nil
+}
+
+// Pins returns all pinned hashes by name.
+func (s *Store) Pins() (map[string]cask.Hash, error) {
+	infos, err := s.Filesystem.ReadDir(pinsDir)
+	if os.IsNotExist(err) {
+		return map[string]cask.Hash{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	pins := make(map[string]cask.Hash, len(infos))
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || validPinName(name) != nil {
+			continue
+		}
+		h, err := s.Pinned(name)
+		if err != nil {
+			return nil, err
+		}
+		pins[name] = h
+	}
+	return pins, nil
+}
+
+func validPinName(name string) error {
+	if name == "" || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".partial") || strings.ContainsAny(name, "/\\") {
+		return fmt.Errorf("invalid pin name %q", name)
+	}
+	return nil
+}
+
+func parseHash(str string) (cask.Hash, bool) {
+	var h cask.Hash
+	buf, err := hex.DecodeString(str)
+	if err != nil || len(buf) != len(h) {
+		return h, false
+	}
+	copy(h[:], buf)
+	return h, true
+}
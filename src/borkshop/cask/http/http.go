@@ -0,0 +1,312 @@
+// Package caskhttp provides an HTTP gateway to a content address store, so
+// that browsers and HTTP clients can fetch blobs and browse directory trees.
+//
+// The gateway serves these routes:
+//
+//	GET /blob/HASH
+//	    The content of a blob.
+//	GET /tree/HASH/PATH
+//	    The content of a file in a directory tree, or a listing of a
+//	    directory, in HTML, or in JSON if the request accepts
+//	    application/json or has the query format=json.
+//	    If the hash addresses a commit, the path descends from its tree.
+//	PUT /blob/
+//	    Stores the request body as a blob and responds with its hash.
+//
+// Since content at a hash never changes, responses for hashes carry caching
+// headers that let clients and proxies keep them indefinitely.
+// Blobs support range requests.
+// Blobs and files carry headers that keep browsers from running their content
+// as scripts with the gateway's origin.
+package caskhttp
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"borkshop/cask"
+	"borkshop/cask/blob"
+	"borkshop/cask/commit"
+	"borkshop/cask/dir"
+)
+
+// immutable is the Cache-Control header of responses for hashes.
+const immutable = "public, max-age=31536000, immutable"
+
+// Handler is an http.Handler that serves the blobs and directory trees of a
+// content address store.
+type Handler struct {
+	// Store is the content address store to serve.
+	Store cask.Store
+
+	// Blob configures how PUT stores blobs.
+	Blob caskblob.StoreConfig
+
+	// Names optionally resolves names other than hashes, such as pins.
+	// Since a name may come to address other content, responses for names
+	// require clients to revalidate.
+	Names func(name string) (cask.Hash, error)
+}
+
+var _ http.Handler = (*Handler)(nil)
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/blob/":
+		if r.Method != http.MethodPut {
+			w.Header().Set("Allow", http.MethodPut)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.put(w, r)
+	case strings.HasPrefix(r.URL.Path, "/blob/"), strings.HasPrefix(r.URL.Path, "/tree/"):
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/blob/") {
+			h.blob(w, r, strings.TrimPrefix(r.URL.Path, "/blob/"))
+		} else {
+			h.tree(w, r, strings.TrimPrefix(r.URL.Path, "/tree/"))
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// put stores the body of a request as a blob.
+func (h *Handler) put(w http.ResponseWriter, r *http.Request) {
+	hash, err := h.Blob.Store(r.Context(), h.Store, r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/blob/%x", hash))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "%x\n", hash)
+}
+
+// blob serves the content of a blob.
+func (h *Handler) blob(w http.ResponseWriter, r *http.Request, ref string) {
+	hash, fixed, err := h.resolve(ref)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	h.serveBlob(w, r, hash, fixed, "", time.Time{})
+}
+
+// tree serves a file or a directory listing from a directory tree.
+func (h *Handler) tree(w http.ResponseWriter, r *http.Request, p string) {
+	ctx := r.Context()
+	parts := strings.SplitN(p, "/", 2)
+	hash, fixed, err := h.resolve(parts[0])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	root, err := caskcommit.Peel(ctx, h.Store, hash)
+	if err != nil {
+		h.error(w, err)
+		return
+	}
+	rest := ""
+	if len(parts) > 1 {
+		rest = parts[1]
+	}
+
+	entry := caskdir.Entry{Hash: root, Mode: caskdir.DirMode}
+	if name := strings.TrimSuffix(rest, "/"); name != "" {
+		if entry, err = caskdir.Resolve(ctx, h.Store, root, name); err != nil {
+			h.error(w, err)
+			return
+		}
+	}
+
+	switch entry.Mode {
+	case caskdir.DirMode:
+		// Relative links in a listing need the trailing slash.
+		if len(parts) == 1 || (rest != "" && !strings.HasSuffix(rest, "/")) {
+			http.Redirect(w, r, (&url.URL{Path: r.URL.Path + "/"}).String(), http.StatusMovedPermanently)
+			return
+		}
+		h.serveList(w, r, entry.Hash, fixed)
+	case caskdir.SymlinkMode:
+		target, err := caskblob.ReadString(ctx, h.Store, entry.Hash)
+		if err != nil {
+			h.error(w, err)
+			return
+		}
+		// A relative link may lead elsewhere in the tree, but no further.
+		dest := path.Join(path.Dir(strings.TrimSuffix(rest, "/")), target)
+		if path.IsAbs(target) || dest == ".." || strings.HasPrefix(dest, "../") {
+			http.Error(w, "symbolic link leads out of the tree", http.StatusNotFound)
+			return
+		}
+		http.Redirect(w, r, (&url.URL{Path: path.Join("/tree", parts[0], dest)}).String(), http.StatusFound)
+	default:
+		var modTime time.Time
+		if entry.Meta != nil {
+			modTime = entry.Meta.ModTime
+		}
+		h.serveBlob(w, r, entry.Hash, fixed, path.Base(rest), modTime)
+	}
+}
+
+// resolve parses a hash or resolves a name, and reports whether the
+// reference is a hash and so always addresses the same content.
+func (h *Handler) resolve(ref string) (cask.Hash, bool, error) {
+	var hash cask.Hash
+	if buf, err := hex.DecodeString(ref); err == nil && len(buf) == cask.HashSize {
+		copy(hash[:], buf)
+		return hash, true, nil
+	}
+	if h.Names == nil {
+		return hash, false, fmt.Errorf("invalid hash: %s", ref)
+	}
+	hash, err := h.Names(ref)
+	return hash, false, err
+}
+
+// cache sets the caching headers of a response for the given content, and
+// reports whether the client already has it.
+func cache(w http.ResponseWriter, r *http.Request, hash cask.Hash, fixed bool) bool {
+	etag := fmt.Sprintf(`"%x"`, hash)
+	w.Header().Set("ETag", etag)
+	if fixed {
+		w.Header().Set("Cache-Control", immutable)
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	for _, match := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if match = strings.TrimSpace(match); match == etag || match == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// serveBlob serves the content of a blob, with a content type that follows
+// from the name or the content.
+//
+// Anyone who can store a blob can make the gateway serve it, so the browser
+// must not sniff a more dangerous type than the one served, and a blob served
+// as HTML runs in a sandbox, without scripts or access to the gateway's
+// origin.
+func (h *Handler) serveBlob(w http.ResponseWriter, r *http.Request, hash cask.Hash, fixed bool, name string, modTime time.Time) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	if cache(w, r, hash, fixed) {
+		return
+	}
+	blob, err := caskblob.Open(r.Context(), h.Store, hash)
+	if err != nil {
+		h.error(w, err)
+		return
+	}
+	// ServeContent answers range and conditional requests.
+	http.ServeContent(w, r, name, modTime, blob)
+}
+
+// listEntry is the JSON form of a directory entry.
+type listEntry struct {
+	Name    string     `json:"name"`
+	Hash    string     `json:"hash"`
+	Mode    string     `json:"mode"`
+	Perm    string     `json:"perm,omitempty"`
+	ModTime *time.Time `json:"mtime,omitempty"`
+	// Href is the link to the entry, relative to the directory.
+	Href string `json:"-"`
+}
+
+var modeNames = map[caskdir.Mode]string{
+	caskdir.FileMode:    "file",
+	caskdir.ExecMode:    "exec",
+	caskdir.DirMode:     "dir",
+	caskdir.SymlinkMode: "symlink",
+}
+
+var listTemplate = template.Must(template.New("list").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Path}}</title></head>
+<body>
+<h1>{{.Path}}</h1>
+<table>
+{{range .Entries}}<tr><td><a href="{{.Href}}">{{.Name}}</a></td><td>{{.Mode}}</td><td>{{.Perm}}</td><td><a href="/blob/{{.Hash}}"><code>{{.Hash}}</code></a></td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// serveList serves the listing of a directory in HTML or JSON.
+func (h *Handler) serveList(w http.ResponseWriter, r *http.Request, hash cask.Hash, fixed bool) {
+	w.Header().Set("Vary", "Accept")
+	if cache(w, r, hash, fixed) {
+		return
+	}
+	list, err := caskdir.List(r.Context(), h.Store, hash)
+	if err != nil {
+		h.error(w, err)
+		return
+	}
+	entries := make([]listEntry, len(list))
+	for i, entry := range list {
+		name := string(entry.Name)
+		href := url.PathEscape(name)
+		if entry.Mode == caskdir.DirMode {
+			href += "/"
+		}
+		entries[i] = listEntry{
+			Name: name,
+			Hash: hex.EncodeToString(entry.Hash[:]),
+			Mode: modeNames[entry.Mode],
+			Href: href,
+		}
+		if entry.Meta != nil {
+			modTime := entry.Meta.ModTime
+			entries[i].Perm = fmt.Sprintf("%04o", uint32(entry.Meta.Perm.Perm()))
+			entries[i].ModTime = &modTime
+		}
+	}
+
+	if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodHead {
+			return
+		}
+		json.NewEncoder(w).Encode(entries)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+	listTemplate.Execute(w, struct {
+		Path    string
+		Entries []listEntry
+	}{r.URL.Path, entries})
+}
+
+// error responds with the status that best fits an error.
+func (h *Handler) error(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if errors.Is(err, caskdir.ErrNotFound) || errors.Is(err, caskdir.ErrNotDir) || os.IsNotExist(err) {
+		status = http.StatusNotFound
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		status = http.StatusGatewayTimeout
+	}
+	http.Error(w, err.Error(), status)
+}
@@ -0,0 +1,175 @@
+package caskhttp_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"borkshop/cask"
+	"borkshop/cask/blob"
+	"borkshop/cask/commit"
+	"borkshop/cask/dir"
+	"borkshop/cask/diskstore"
+	"borkshop/cask/http"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/osfs"
+)
+
+func newServer(t *testing.T) (*httptest.Server, cask.Store, cask.Hash) {
+	ctx := context.Background()
+	store := &caskdiskstore.Store{Filesystem: memfs.New()}
+	tree, err := caskdir.Store(ctx, store, osfs.New(".."), "testdata")
+	require.NoError(t, err)
+	handler := &caskhttp.Handler{
+		Store: store,
+		Names: func(name string) (cask.Hash, error) {
+			if name == "main" {
+				return tree, nil
+			}
+			return cask.ZeroHash, fmt.Errorf("no pin named %q", name)
+		},
+	}
+	return httptest.NewServer(handler), store, tree
+}
+
+func get(t *testing.T, url string, header ...string) (*http.Response, string) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	for i := 0; i < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	res, err := client.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	return res, string(body)
+}
+
+func TestTree(t *testing.T) {
+	server, _, tree := newServer(t)
+	defer server.Close()
+	want, err := ioutil.ReadFile("../testdata/firstand.txt")
+	require.NoError(t, err)
+
+	res, body := get(t, fmt.Sprintf("%s/tree/%x/firstand.txt", server.URL, tree))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, string(want), body)
+	assert.Equal(t, "text/plain; charset=utf-8", res.Header.Get("Content-Type"))
+	assert.Equal(t, "nosniff", res.Header.Get("X-Content-Type-Options"))
+	assert.Equal(t, "sandbox", res.Header.Get("Content-Security-Policy"))
+	assert.Contains(t, res.Header.Get("Cache-Control"), "immutable")
+	etag := res.Header.Get("ETag")
+
+	res, _ = get(t, fmt.Sprintf("%s/tree/%x/firstand.txt", server.URL, tree), "If-None-Match", etag)
+	assert.Equal(t, http.StatusNotModified, res.StatusCode)
+
+	res, body = get(t, fmt.Sprintf("%s/tree/%x/firstand.txt", server.URL, tree), "Range", "bytes=2-5")
+	assert.Equal(t, http.StatusPartialContent, res.StatusCode)
+	assert.Equal(t, string(want[2:6]), body)
+
+	// Names resolve, but clients must revalidate them.
+	res, body = get(t, server.URL+"/tree/main/firstand.txt")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, string(want), body)
+	assert.Equal(t, "no-cache", res.Header.Get("Cache-Control"))
+	assert.Equal(t, etag, res.Header.Get("ETag"))
+
+	res, _ = get(t, server.URL+"/tree/main/bogus")
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	res, _ = get(t, server.URL+"/tree/main/firstand.txt/bogus")
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	res, _ = get(t, server.URL+"/tree/other/")
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	res, _ = get(t, fmt.Sprintf("%s/tree/%x/", server.URL, cask.Hash{1}))
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestList(t *testing.T) {
+	server, _, tree := newServer(t)
+	defer server.Close()
+
+	res, _ := get(t, server.URL+"/tree/main/nominal")
+	assert.Equal(t, http.StatusMovedPermanently, res.StatusCode)
+	assert.Equal(t, "/tree/main/nominal/", res.Header.Get("Location"))
+
+	res, body := get(t, server.URL+"/tree/main/")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", res.Header.Get("Content-Type"))
+	assert.Contains(t, body, `<a href="nominal/">nominal</a>`)
+	assert.Contains(t, body, `<a href="firstand.txt">firstand.txt</a>`)
+
+	res, body = get(t, fmt.Sprintf("%s/tree/%x/?format=json", server.URL, tree))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	var entries []struct {
+		Name string
+		Hash string
+		Mode string
+	}
+	require.NoError(t, json.Unmarshal([]byte(body), &entries))
+	list, err := caskdir.List(context.Background(), server.Config.Handler.(*caskhttp.Handler).Store, tree)
+	require.NoError(t, err)
+	require.Len(t, entries, len(list))
+	for i, entry := range list {
+		assert.Equal(t, string(entry.Name), entries[i].Name)
+		assert.Equal(t, fmt.Sprintf("%x", entry.Hash), entries[i].Hash)
+	}
+	assert.Equal(t, "dir", entries[len(entries)-1].Mode)
+
+	res, body = get(t, server.URL+"/tree/main/nominal/", "Accept", "application/json")
+	assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+	assert.True(t, strings.HasPrefix(body, "["))
+}
+
+func TestBlob(t *testing.T) {
+	ctx := context.Background()
+	server, store, _ := newServer(t)
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodPut, server.URL+"/blob/", strings.NewReader("hello, world"))
+	require.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+
+	hash, err := caskblob.WriteString(ctx, store, "hello, world")
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("%x\n", hash), string(body))
+	assert.Equal(t, fmt.Sprintf("/blob/%x", hash), res.Header.Get("Location"))
+
+	res, str := get(t, server.URL+res.Header.Get("Location"))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "hello, world", str)
+	assert.Equal(t, "nosniff", res.Header.Get("X-Content-Type-Options"))
+	assert.Equal(t, "sandbox", res.Header.Get("Content-Security-Policy"))
+
+	res, _ = get(t, server.URL+"/blob/")
+	assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+	res, _ = get(t, server.URL+"/blob/xyz")
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestCommit(t *testing.T) {
+	ctx := context.Background()
+	server, store, tree := newServer(t)
+	defer server.Close()
+
+	commit, err := caskcommit.Store(ctx, store, caskcommit.Commit{Tree: tree, Message: "test"})
+	require.NoError(t, err)
+	res, _ := get(t, fmt.Sprintf("%s/tree/%x/firstand.txt", server.URL, commit))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
@@ -0,0 +1,203 @@
+package caskio
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"borkshop/cask"
+)
+
+var (
+	// ErrMissing indicates that a store cannot load a block, which is a
+	// dangling link if another block links it.
+	ErrMissing = errors.New("missing block")
+	// ErrHashMismatch indicates that the content of a block does not hash to
+	// its address.
+	ErrHashMismatch = errors.New("block does not match its hash")
+	// ErrMalformed indicates that the headers of a block claim more links and
+	// bytes than fit in the block.
+	ErrMalformed = errors.New("block headers exceed block size")
+	// ErrHeight indicates that an interior block of a B-tree links a block
+	// that is not exactly one level lower.
+	ErrHeight = errors.New("block height does not follow its parent")
+)
+
+// Damage describes a block that fails an integrity check.
+type Damage struct {
+	// Hash is the address of the damaged block.
+	Hash cask.Hash
+	// Parent is the address of the block that links the damaged block, or
+	// the zero hash if the damaged block is a root.
+	Parent cask.Hash
+	// Err is ErrMissing, ErrHashMismatch, ErrMalformed, ErrHeight, or a
+	// problem particular to the store.
+	Err error
+	// Repaired indicates that the check replaced the damaged block with an
+	// intact copy from the repair store.
+	Repaired bool
+}
+
+func (d Damage) String() string {
+	s := fmt.Sprintf("%x: %v", d.Hash, d.Err)
+	if d.Parent != cask.ZeroHash {
+		s += fmt.Sprintf(", linked from %x", d.Parent)
+	}
+	if d.Repaired {
+		s += ", repaired"
+	}
+	return s
+}
+
+// CheckConfig captures the parameters of an integrity check.
+type CheckConfig struct {
+	// Repair is an optional store from which to load intact copies of missing
+	// and corrupt blocks, which the check then stores in the checked store.
+	//
+	// If the checked store implements cask.Remover, the check removes a
+	// corrupt block before storing its replacement.
+	Repair cask.Store
+}
+
+// CheckReport summarizes an integrity check.
+type CheckReport struct {
+	// Checked is the number of distinct blocks the check visited.
+	Checked int
+	// Damaged lists the blocks that failed the check.
+	Damaged []Damage
+}
+
+// Repaired returns the number of damaged blocks the check repaired.
+func (r *CheckReport) Repaired() int {
+	repaired := 0
+	for _, damage := range r.Damaged {
+		if damage.Repaired {
+			repaired++
+		}
+	}
+	return repaired
+}
+
+// Check verifies blocks and their transitive links, rehashing every block and
+// checking that every block has valid headers, and that the interior blocks
+// of each B-tree link blocks exactly one level lower.
+//
+// Check reports damage rather than failing, and fails only if the context
+// expires or it cannot store a repaired block.
+// The checked store should fail to load a block it lacks rather than wait
+// for it.
+func Check(ctx context.Context, store cask.Store, hashes ...cask.Hash) (*CheckReport, error) {
+	return CheckConfig{}.Check(ctx, store, hashes...)
+}
+
+// Check verifies blocks and their transitive links, repairing damaged blocks
+// if the configuration provides a repair store.
+func (c CheckConfig) Check(ctx context.Context, store cask.Store, hashes ...cask.Hash) (*CheckReport, error) {
+	k := &checker{
+		config: c,
+		store:  store,
+		seen:   make(map[cask.Hash]struct{}),
+		report: &CheckReport{},
+	}
+	for _, hash := range hashes {
+		if err := k.check(ctx, hash, cask.ZeroHash, -1); err != nil {
+			return k.report, err
+		}
+	}
+	return k.report, nil
+}
+
+type checker struct {
+	config CheckConfig
+	store  cask.Store
+	seen   map[cask.Hash]struct{}
+	report *CheckReport
+}
+
+// check verifies a block, which must have the given height unless the height
+// is negative.
+func (k *checker) check(ctx context.Context, hash, parent cask.Hash, height int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if _, ok := k.seen[hash]; ok {
+		return nil
+	}
+	k.seen[hash] = struct{}{}
+	k.report.Checked++
+
+	var block cask.Block
+	if err := k.store.Load(ctx, hash, &block); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		ok, err := k.damage(ctx, hash, parent, ErrMissing, &block, false)
+		if err != nil || !ok {
+			return err
+		}
+	} else if block.Hash() != hash {
+		ok, err := k.damage(ctx, hash, parent, ErrHashMismatch, &block, true)
+		if err != nil || !ok {
+			return err
+		}
+	}
+
+	// An intact block with bad structure has no better copy anywhere, since
+	// any copy has the same content.
+	var model cask.Model
+	if err := model.Get(&block); err != nil {
+		k.report.Damaged = append(k.report.Damaged, Damage{Hash: hash, Parent: parent, Err: ErrMalformed})
+		return nil
+	}
+	if height >= 0 && model.Height != height {
+		k.report.Damaged = append(k.report.Damaged, Damage{Hash: hash, Parent: parent, Err: ErrHeight})
+	}
+
+	linkHeight := -1
+	if model.Height > 0 {
+		linkHeight = model.Height - 1
+	}
+	for _, link := range model.Links {
+		if err := k.check(ctx, link, hash, linkHeight); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// damage reports a missing or corrupt block and replaces it with an intact
+// copy from the repair store, if possible.
+// It returns whether the block is repaired, in which case the block holds
+// the intact copy.
+func (k *checker) damage(ctx context.Context, hash, parent cask.Hash, cause error, block *cask.Block, corrupt bool) (bool, error) {
+	damage := Damage{Hash: hash, Parent: parent, Err: cause}
+	defer func() {
+		k.report.Damaged = append(k.report.Damaged, damage)
+	}()
+
+	if k.config.Repair == nil {
+		return false, nil
+	}
+	// A repair store that can report lacking the block should not be asked
+	// to load it, since some stores wait for a block to arrive.
+	if checker, ok := k.config.Repair.(cask.Checker); ok {
+		if have, err := checker.Has(ctx, []cask.Hash{hash}); err != nil || !have[0] {
+			return false, nil
+		}
+	}
+	var intact cask.Block
+	if err := k.config.Repair.Load(ctx, hash, &intact); err != nil || intact.Hash() != hash {
+		return false, nil
+	}
+	if remover, ok := k.store.(cask.Remover); ok && corrupt {
+		if err := remover.Remove(ctx, hash); err != nil {
+			return false, err
+		}
+	}
+	if err := k.store.Store(ctx, hash, &intact); err != nil {
+		return false, err
+	}
+	*block = intact
+	damage.Repaired = true
+	return true, nil
+}
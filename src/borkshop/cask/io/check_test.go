@@ -0,0 +1,92 @@
+package caskio_test
+
+import (
+	"context"
+	"testing"
+
+	"borkshop/cask"
+	"borkshop/cask/blob"
+	"borkshop/cask/dir"
+	"borkshop/cask/diskstore"
+	"borkshop/cask/io"
+	"borkshop/cask/memstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/osfs"
+)
+
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+	store := &caskdiskstore.Store{Filesystem: memfs.New()}
+
+	hash1, err := caskdir.Store(ctx, store, osfs.New(".."), "testdata/nominal")
+	require.NoError(t, err)
+	config := caskdir.StoreConfig{Blob: caskblob.StoreConfig{ContentDefined: true}}
+	hash2, err := config.Store(ctx, store, osfs.New(".."), "testdata")
+	require.NoError(t, err)
+	bom1, err := caskio.BOM(ctx, store, hash1)
+	require.NoError(t, err)
+
+	report, err := caskio.Check(ctx, store, hash1, hash2)
+	require.NoError(t, err)
+	assert.Empty(t, report.Damaged)
+	assert.True(t, report.Checked > len(bom1))
+}
+
+func TestCheckDamage(t *testing.T) {
+	ctx := context.Background()
+	store := caskmemstore.New()
+	repair := caskmemstore.New()
+
+	// A leaf, an interior block that links it, and a root that links the
+	// interior block and a block at the wrong height.
+	leaf := cask.Model{Bytes: []byte("leaf")}
+	leafHash, err := leaf.Store(ctx, repair)
+	require.NoError(t, err)
+	interior := cask.Model{Height: 1, Links: []cask.Hash{leafHash}}
+	interiorHash, err := interior.Store(ctx, store)
+	require.NoError(t, err)
+	tall := cask.Model{Height: 1, Links: []cask.Hash{interiorHash}}
+	tallHash, err := tall.Store(ctx, store)
+	require.NoError(t, err)
+
+	// The store holds a corrupt copy of the leaf.
+	var corrupt cask.Block
+	require.NoError(t, leaf.Put(&corrupt))
+	corrupt[4] = 'L'
+	require.NoError(t, store.Store(ctx, leafHash, &corrupt))
+
+	report, err := caskio.Check(ctx, store, tallHash)
+	require.NoError(t, err)
+	assert.Equal(t, 3, report.Checked)
+	assert.Equal(t, []caskio.Damage{
+		{Hash: interiorHash, Parent: tallHash, Err: caskio.ErrHeight},
+		{Hash: leafHash, Parent: interiorHash, Err: caskio.ErrHashMismatch},
+	}, report.Damaged)
+
+	// The repair store has an intact copy of the leaf.
+	report, err = caskio.CheckConfig{Repair: repair}.Check(ctx, store, interiorHash)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Repaired())
+	var block cask.Block
+	require.NoError(t, store.Load(ctx, leafHash, &block))
+	assert.Equal(t, leafHash, block.Hash())
+
+	report, err = caskio.Check(ctx, store, interiorHash)
+	require.NoError(t, err)
+	assert.Empty(t, report.Damaged)
+}
+
+func TestCheckMissing(t *testing.T) {
+	ctx := context.Background()
+	store := &caskdiskstore.Store{Filesystem: memfs.New()}
+	root := cask.Model{Links: []cask.Hash{{1}}}
+	rootHash, err := root.Store(ctx, store)
+	require.NoError(t, err)
+
+	report, err := caskio.Check(ctx, store, rootHash)
+	require.NoError(t, err)
+	require.Len(t, report.Damaged, 1)
+	assert.Equal(t, caskio.Damage{Hash: cask.Hash{1}, Parent: rootHash, Err: caskio.ErrMissing}, report.Damaged[0])
+}
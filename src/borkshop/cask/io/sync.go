@@ -0,0 +1,196 @@
+package caskio
+
+import (
+	"context"
+	"sync"
+
+	"borkshop/cask"
+)
+
+const defaultSyncConcurrency = 64
+
+// Has reports whether a store contains each of the given blocks.
+//
+// Stores that do not implement cask.Checker are assumed to contain none of
+// the blocks.
+func Has(ctx context.Context, store cask.Store, hashes []cask.Hash) ([]bool, error) {
+	if checker, ok := store.(cask.Checker); ok {
+		return checker.Has(ctx, hashes)
+	}
+	return make([]bool, len(hashes)), nil
+}
+
+// SyncConfig captures the parameters for a transfer between stores.
+type SyncConfig struct {
+	// Concurrency is the maximum number of outstanding loads, stores, and
+	// checks, defaulting to 64.
+	Concurrency int
+}
+
+// Sync transfers a block and its transitive links from one store to another,
+// skipping any subtree that the target already has.
+func Sync(ctx context.Context, target, source cask.Store, hash cask.Hash) error {
+	return SyncConfig{}.Sync(ctx, target, source, hash)
+}
+
+// Sync transfers a block and its transitive links from one store to another,
+// skipping any subtree that the target already has.
+//
+// Sync asks the target which of the links of each block it already has,
+// with one check per interior block, and transfers the rest concurrently.
+// With a remote target, each check is a round trip, but Sync keeps many
+// checks, loads, and stores in flight to hide their latency.
+// Sync trusts the target to have the subtree of any block it has, which
+// only some stores promise; see cask.Checker.
+// Sync stores every block in the target only after all of its links, so an
+// interrupted transfer never leaves a block in the target without its
+// subtree.
+func (c SyncConfig) Sync(ctx context.Context, target, source cask.Store, hash cask.Hash) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	have, err := Has(ctx, target, []cask.Hash{hash})
+	if err != nil {
+		return err
+	}
+	if have[0] {
+		return nil
+	}
+
+	concurrency := c.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultSyncConcurrency
+	}
+	s := &syncer{
+		target: target,
+		source: source,
+		cancel: cancel,
+		slots:  make(chan struct{}, concurrency),
+		calls:  make(map[cask.Hash]*syncCall),
+	}
+	if err := s.sync(ctx, hash); err != nil {
+		return s.firstErr(err)
+	}
+	return nil
+}
+
+type syncer struct {
+	target cask.Store
+	source cask.Store
+	cancel context.CancelFunc
+	slots  chan struct{}
+
+	lock  sync.Mutex
+	calls map[cask.Hash]*syncCall
+	err   error
+}
+
+// syncCall tracks the transfer of a single block, so that subtrees shared
+// within the tree are only transferred once.
+type syncCall struct {
+	done chan struct{}
+	err  error
+}
+
+// sync transfers a block that the target lacks, or waits for another
+// transfer of the same block to finish.
+func (s *syncer) sync(ctx context.Context, hash cask.Hash) error {
+	s.lock.Lock()
+	if call, ok := s.calls[hash]; ok {
+		s.lock.Unlock()
+		select {
+		case <-call.done:
+			return call.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	call := &syncCall{done: make(chan struct{}, 0)}
+	s.calls[hash] = call
+	s.lock.Unlock()
+
+	call.err = s.transfer(ctx, hash)
+	if call.err != nil {
+		s.fail(call.err)
+	}
+	close(call.done)
+	return call.err
+}
+
+// transfer loads a block from the source, transfers the links the target
+// lacks, then stores the block in the target.
+func (s *syncer) transfer(ctx context.Context, hash cask.Hash) error {
+	block := &cask.Block{}
+	if err := s.do(ctx, func() error {
+		return s.source.Load(ctx, hash, block)
+	}); err != nil {
+		return err
+	}
+
+	links := block.Links()
+	if len(links) > 0 {
+		var have []bool
+		if err := s.do(ctx, func() (err error) {
+			have, err = Has(ctx, s.target, links)
+			return err
+		}); err != nil {
+			return err
+		}
+
+		var wg sync.WaitGroup
+		errs := make([]error, len(links))
+		for i, link := range links {
+			if have[i] {
+				continue
+			}
+			wg.Add(1)
+			go func(i int, link cask.Hash) {
+				defer wg.Done()
+				errs[i] = s.sync(ctx, link)
+			}(i, link)
+		}
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return s.do(ctx, func() error {
+		return s.target.Store(ctx, hash, block)
+	})
+}
+
+// do runs an operation on one of the stores, waiting for a free slot so that
+// no more than the configured number of operations are outstanding.
+func (s *syncer) do(ctx context.Context, op func() error) error {
+	select {
+	case s.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-s.slots }()
+	return op()
+}
+
+// fail records the first error and cancels all outstanding transfers.
+func (s *syncer) fail(err error) {
+	s.lock.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.lock.Unlock()
+	s.cancel()
+}
+
+// firstErr returns the error that caused the transfer to fail, rather than
+// the cancellation that followed from it.
+func (s *syncer) firstErr(err error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	return err
+}
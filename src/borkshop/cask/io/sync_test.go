@@ -0,0 +1,119 @@
+package caskio_test
+
+import (
+	"context"
+	"testing"
+
+	"borkshop/cask"
+	"borkshop/cask/dir"
+	"borkshop/cask/io"
+	"borkshop/cask/memstore"
+	"borkshop/cask/net"
+	"borkshop/cask/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/osfs"
+)
+
+func TestSync(t *testing.T) {
+	ctx := context.Background()
+	source := casktest.NewCountingStore()
+	target := caskmemstore.New()
+	osfs := osfs.New("..")
+	memfs := memfs.New()
+
+	hash1, err := caskdir.Store(ctx, source, osfs, "testdata/nominal")
+	require.NoError(t, err)
+	bom, err := caskio.BOM(ctx, source, hash1)
+	require.NoError(t, err)
+
+	source.Reset()
+	err = caskio.Sync(ctx, target, source, hash1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(bom)), source.Loads(), "every block loaded once")
+
+	err = caskdir.Load(ctx, target, memfs, ".", hash1)
+	require.NoError(t, err)
+
+	hash2, err := caskdir.Store(ctx, target, memfs, "")
+	require.NoError(t, err)
+	assert.Equal(t, hash1, hash2)
+
+	// A second sync finds the root in the target and loads nothing.
+	source.Reset()
+	err = caskio.Sync(ctx, target, source, hash1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), source.Loads())
+}
+
+func TestSyncSkipsSubtrees(t *testing.T) {
+	ctx := context.Background()
+	source := casktest.NewCountingStore()
+	target := caskmemstore.New()
+	osfs := osfs.New("..")
+
+	rootHash, err := caskdir.Store(ctx, source, osfs, "testdata")
+	require.NoError(t, err)
+	nominal, err := caskdir.Resolve(ctx, source, rootHash, "nominal")
+	require.NoError(t, err)
+
+	err = caskio.Sync(ctx, target, source, nominal.Hash)
+	require.NoError(t, err)
+
+	rootBOM, err := caskio.BOM(ctx, source, rootHash)
+	require.NoError(t, err)
+	nominalBOM, err := caskio.BOM(ctx, source, nominal.Hash)
+	require.NoError(t, err)
+
+	source.Reset()
+	err = caskio.Sync(ctx, target, source, rootHash)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(rootBOM)-len(nominalBOM)), source.Loads(), "only blocks outside the nominal subtree")
+
+	have, err := caskio.Has(ctx, target, []cask.Hash{rootHash})
+	require.NoError(t, err)
+	assert.Equal(t, []bool{true}, have)
+}
+
+func TestSyncOverNetwork(t *testing.T) {
+	ctx := context.Background()
+	local := caskmemstore.New()
+	osfs := osfs.New("..")
+
+	hash, err := caskdir.Store(ctx, local, osfs, "testdata/nominal")
+	require.NoError(t, err)
+
+	server := &casknet.Server{
+		Addr:  "127.0.0.1:0",
+		Store: caskmemstore.New(),
+	}
+	err = server.Start(ctx)
+	require.NoError(t, err)
+	defer server.Stop(ctx)
+
+	client := &casknet.Server{
+		Addr:  "127.0.0.1:0",
+		Store: local,
+	}
+	err = client.Start(ctx)
+	require.NoError(t, err)
+	defer client.Stop(ctx)
+
+	peer := client.Peer(server.LocalAddr())
+
+	// Push
+	err = caskio.Sync(ctx, peer, local, hash)
+	require.NoError(t, err)
+
+	// Pull
+	pulled := caskmemstore.New()
+	err = caskio.Sync(ctx, pulled, peer, hash)
+	require.NoError(t, err)
+
+	expected, err := caskio.BOM(ctx, local, hash)
+	require.NoError(t, err)
+	actual, err := caskio.BOM(ctx, pulled, hash)
+	require.NoError(t, err)
+	assert.Equal(t, expected, actual)
+}
@@ -0,0 +1,92 @@
+package caskmap
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"borkshop/cask"
+	"borkshop/cask/memstore"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEditMatchesBuild(t *testing.T) {
+	ctx := context.Background()
+	store := caskmemstore.New()
+
+	// Putting a key before the first key of a block, where the new key ends
+	// a block of its own, must keep the old block.
+	before, err := Build(ctx, store, []Entry{{Key: []byte("m")}, {Key: []byte("n")}})
+	require.NoError(t, err)
+	require.True(t, boundary([]byte("a2"), 0))
+	after, err := Put(ctx, store, before, Entry{Key: []byte("a2")})
+	require.NoError(t, err)
+	want, err := Build(ctx, store, []Entry{{Key: []byte("a2")}, {Key: []byte("m")}, {Key: []byte("n")}})
+	require.NoError(t, err)
+	require.Equal(t, want, after)
+
+	for seed := int64(0); seed < 20; seed++ {
+		r := rand.New(rand.NewSource(seed))
+		entries := make(map[string]Entry)
+		root := cask.ZeroHash
+		for op := 0; op < 200; op++ {
+			keys := make([]string, 0, len(entries))
+			for k := range entries {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			var boundaries []string
+			for _, k := range keys {
+				if boundary([]byte(k), 0) {
+					boundaries = append(boundaries, k)
+				}
+			}
+
+			var k string
+			switch choice := r.Intn(6); {
+			case choice == 0 && len(keys) > 0:
+				k = keys[r.Intn(len(keys))]
+				delete(entries, k)
+				root, err = Delete(ctx, store, root, []byte(k))
+			case choice == 1 && len(boundaries) > 0:
+				k = boundaries[r.Intn(len(boundaries))]
+				delete(entries, k)
+				root, err = Delete(ctx, store, root, []byte(k))
+			case choice == 2 && len(boundaries) > 0:
+				// A key that sorts immediately before a key that ends a block.
+				b := []byte(boundaries[r.Intn(len(boundaries))])
+				b[len(b)-1]--
+				k = string(append(b, 'z'))
+				fallthrough
+			default:
+				if k == "" {
+					k = fmt.Sprintf("%x", r.Intn(4096))
+				}
+				entry := Entry{Key: []byte(k), Value: make([]byte, r.Intn(MaxValueSize/4))}
+				r.Read(entry.Value)
+				entries[k] = entry
+				root, err = Put(ctx, store, root, entry)
+			}
+			require.NoError(t, err)
+
+			all := make([]Entry, 0, len(entries))
+			for _, entry := range entries {
+				all = append(all, entry)
+			}
+			built, err := Build(ctx, store, all)
+			require.NoError(t, err)
+			require.Equal(t, built, root, "seed %d op %d key %q", seed, op, k)
+
+			for k, entry := range entries {
+				got, ok, err := Get(ctx, store, root, []byte(k))
+				require.NoError(t, err)
+				require.True(t, ok, "seed %d op %d lost %q", seed, op, k)
+				require.True(t, bytes.Equal(entry.Value, got.Value))
+			}
+		}
+	}
+}
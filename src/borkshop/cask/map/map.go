@@ -0,0 +1,693 @@
+// Package caskmap provides immutable, content addressed maps of byte string
+// keys to values, ordered by key, as B-trees of blocks.
+//
+// Maps are persistent: Put and Delete return the root of a new map and leave
+// the old map intact, sharing every block that the change did not touch.
+// The shape of a map depends only on its entries, so equal maps have equal
+// root hashes however they were built, and a change writes new blocks only
+// along the path to the changed entry.
+//
+// The empty map is the zero hash, and has no blocks.
+package caskmap
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"borkshop/cask"
+)
+
+// Leaf blocks hold entries, in key order.
+// The links of a leaf are the links of its entries that have one.
+//
+//	height:1 = 0
+//	links:32*n = links of entries...
+//	bytes = entries..., each flags:1, keylen:2, valuelen:2, key, value
+//
+// Interior blocks link their children and record the first key of each.
+//
+//	height:1 > 0
+//	links:32*n = children...
+//	bytes = keys..., each keylen:2, key
+//
+// A block ends after an entry or child whose key hashes to a pattern, or
+// once it might not fit another, so the boundaries of blocks depend only on
+// the keys and sizes of the entries since the last boundary.
+const (
+	// MaxKeySize is the greatest length of a key.
+	MaxKeySize = 128
+	// MaxValueSize is the greatest length of a value.
+	// Larger values belong in blobs that entries link.
+	MaxValueSize = 384
+
+	capacity       = cask.BlockSize - 4
+	maxLinks       = 31
+	entryHeader    = 5
+	childHeader    = 2
+	maxEntrySize   = entryHeader + MaxKeySize + MaxValueSize + cask.HashSize
+	maxChildSize   = childHeader + MaxKeySize + cask.HashSize
+	leafMask       = 1<<4 - 1
+	interiorMask   = 1<<3 - 1
+	flagLink       = 1
+	flagsReserved  = ^byte(flagLink)
+	hashPrefixSize = 4
+)
+
+var (
+	// ErrTooLarge indicates a key or value that exceeds its maximum size.
+	ErrTooLarge = errors.New("map entry exceeds maximum size")
+	// ErrMalformed indicates a block that does not decode as part of a map.
+	ErrMalformed = errors.New("malformed map block")
+)
+
+// Entry is a key and its value.
+type Entry struct {
+	Key   []byte
+	Value []byte
+	// Link optionally addresses a block, such as the root of a blob, that
+	// the map retains along with the entry, or is the zero hash.
+	Link cask.Hash
+}
+
+func (e Entry) equal(other Entry) bool {
+	return bytes.Equal(e.Key, other.Key) && bytes.Equal(e.Value, other.Value) && e.Link == other.Link
+}
+
+func (e Entry) validate() error {
+	if len(e.Key) > MaxKeySize || len(e.Value) > MaxValueSize {
+		return ErrTooLarge
+	}
+	return nil
+}
+
+// item is an entry of a leaf block, or a child of an interior block with the
+// first key of the child and the hash of the child as its link.
+type item Entry
+
+// cost returns the number of bytes of a block, including links, that an item
+// occupies at a height.
+func (it item) cost(height int) (int, int) {
+	if height > 0 {
+		return childHeader + len(it.Key) + cask.HashSize, 1
+	}
+	if it.Link == cask.ZeroHash {
+		return entryHeader + len(it.Key) + len(it.Value), 0
+	}
+	return entryHeader + len(it.Key) + len(it.Value) + cask.HashSize, 1
+}
+
+// boundary reports whether a block ends after an item with the given key.
+func boundary(key []byte, height int) bool {
+	h := sha256.New()
+	h.Write([]byte{byte(height)})
+	h.Write(key)
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	pattern := binary.BigEndian.Uint32(sum[:hashPrefixSize])
+	if height > 0 {
+		return pattern&interiorMask == 0
+	}
+	return pattern&leafMask == 0
+}
+
+// node is a decoded block of a map.
+type node struct {
+	height int
+	items  []item
+}
+
+func load(ctx context.Context, store cask.Store, hash cask.Hash) (*node, error) {
+	var block cask.Block
+	if err := store.Load(ctx, hash, &block); err != nil {
+		return nil, err
+	}
+	var model cask.Model
+	if err := model.Get(&block); err != nil {
+		return nil, fmt.Errorf("%w: %x: %v", ErrMalformed, hash, err)
+	}
+	n, err := decode(&model)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %x", err, hash)
+	}
+	return n, nil
+}
+
+func decode(model *cask.Model) (*node, error) {
+	n := &node{height: model.Height}
+	buf := model.Bytes
+	links := model.Links
+	for len(buf) > 0 {
+		var it item
+		if n.height > 0 {
+			if len(buf) < childHeader || len(links) == 0 {
+				return nil, ErrMalformed
+			}
+			keylen := int(binary.BigEndian.Uint16(buf))
+			buf = buf[childHeader:]
+			if len(buf) < keylen {
+				return nil, ErrMalformed
+			}
+			it.Key, buf = buf[:keylen], buf[keylen:]
+			it.Link, links = links[0], links[1:]
+		} else {
+			if len(buf) < entryHeader || buf[0]&flagsReserved != 0 {
+				return nil, ErrMalformed
+			}
+			flags := buf[0]
+			keylen := int(binary.BigEndian.Uint16(buf[1:]))
+			valuelen := int(binary.BigEndian.Uint16(buf[3:]))
+			buf = buf[entryHeader:]
+			if len(buf) < keylen+valuelen {
+				return nil, ErrMalformed
+			}
+			it.Key, buf = buf[:keylen], buf[keylen:]
+			it.Value, buf = buf[:valuelen], buf[valuelen:]
+			if flags&flagLink != 0 {
+				if len(links) == 0 {
+					return nil, ErrMalformed
+				}
+				it.Link, links = links[0], links[1:]
+			}
+		}
+		n.items = append(n.items, it)
+	}
+	if len(links) > 0 {
+		return nil, ErrMalformed
+	}
+	return n, nil
+}
+
+func (n *node) encode() *cask.Model {
+	model := &cask.Model{Height: n.height}
+	var header [entryHeader]byte
+	for _, it := range n.items {
+		if n.height > 0 {
+			binary.BigEndian.PutUint16(header[:], uint16(len(it.Key)))
+			model.Bytes = append(model.Bytes, header[:childHeader]...)
+			model.Bytes = append(model.Bytes, it.Key...)
+			model.Links = append(model.Links, it.Link)
+			continue
+		}
+		header[0] = 0
+		if it.Link != cask.ZeroHash {
+			header[0] = flagLink
+			model.Links = append(model.Links, it.Link)
+		}
+		binary.BigEndian.PutUint16(header[1:], uint16(len(it.Key)))
+		binary.BigEndian.PutUint16(header[3:], uint16(len(it.Value)))
+		model.Bytes = append(model.Bytes, header[:]...)
+		model.Bytes = append(model.Bytes, it.Key...)
+		model.Bytes = append(model.Bytes, it.Value...)
+	}
+	return model
+}
+
+// search returns the index of the first entry of a leaf with a key at or
+// after the given key, or of the child of an interior block whose range
+// covers the key.
+func (n *node) search(key []byte) int {
+	i := sort.Search(len(n.items), func(i int) bool {
+		return bytes.Compare(n.items[i].Key, key) >= 0
+	})
+	if n.height > 0 && (i == len(n.items) || !bytes.Equal(n.items[i].Key, key)) && i > 0 {
+		i--
+	}
+	return i
+}
+
+// chunker writes the blocks of one level of a map from the items of the
+// level in order, and collects the items of the level above.
+type chunker struct {
+	ctx    context.Context
+	store  cask.Store
+	height int
+	items  []item
+	size   int
+	links  int
+	out    []item
+}
+
+func (c *chunker) add(it item) error {
+	size, links := it.cost(c.height)
+	c.items = append(c.items, it)
+	c.size += size
+	c.links += links
+	maxSize := maxEntrySize
+	if c.height > 0 {
+		maxSize = maxChildSize
+	}
+	if boundary(it.Key, c.height) || c.links == maxLinks || c.size+maxSize > capacity {
+		return c.flush()
+	}
+	return nil
+}
+
+func (c *chunker) flush() error {
+	if len(c.items) == 0 {
+		return nil
+	}
+	n := &node{height: c.height, items: c.items}
+	hash, err := n.encode().Store(c.ctx, c.store)
+	if err != nil {
+		return err
+	}
+	c.out = append(c.out, item{Key: c.items[0].Key, Link: hash})
+	c.items = nil
+	c.size = 0
+	c.links = 0
+	return nil
+}
+
+// Build writes a map of the given entries, where the last entry with each
+// key prevails, and returns its root.
+func Build(ctx context.Context, store cask.Store, entries []Entry) (cask.Hash, error) {
+	sorted := make([]Entry, len(entries))
+	copy(sorted, entries)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].Key, sorted[j].Key) < 0
+	})
+	items := make([]item, 0, len(sorted))
+	for i, entry := range sorted {
+		if err := entry.validate(); err != nil {
+			return cask.ZeroHash, err
+		}
+		if i+1 < len(sorted) && bytes.Equal(entry.Key, sorted[i+1].Key) {
+			continue
+		}
+		items = append(items, item(entry))
+	}
+
+	for height := 0; ; height++ {
+		c := &chunker{ctx: ctx, store: store, height: height}
+		for _, it := range items {
+			if err := c.add(it); err != nil {
+				return cask.ZeroHash, err
+			}
+		}
+		if err := c.flush(); err != nil {
+			return cask.ZeroHash, err
+		}
+		if len(c.out) == 0 {
+			return cask.ZeroHash, nil
+		} else if len(c.out) == 1 {
+			return c.out[0].Link, nil
+		}
+		items = c.out
+	}
+}
+
+// Get returns the entry for a key, and whether the map has one.
+func Get(ctx context.Context, store cask.Store, root cask.Hash, key []byte) (Entry, bool, error) {
+	if root == cask.ZeroHash {
+		return Entry{}, false, nil
+	}
+	for {
+		n, err := load(ctx, store, root)
+		if err != nil {
+			return Entry{}, false, err
+		}
+		i := n.search(key)
+		if i == len(n.items) {
+			return Entry{}, false, nil
+		}
+		if n.height > 0 {
+			root = n.items[i].Link
+			continue
+		}
+		if !bytes.Equal(n.items[i].Key, key) {
+			return Entry{}, false, nil
+		}
+		return Entry(n.items[i]), true, nil
+	}
+}
+
+// Put returns the root of a map with the given entry, replacing any entry
+// with the same key.
+func Put(ctx context.Context, store cask.Store, root cask.Hash, entry Entry) (cask.Hash, error) {
+	if err := entry.validate(); err != nil {
+		return cask.ZeroHash, err
+	}
+	it := item(entry)
+	return edit(ctx, store, root, entry.Key, &it)
+}
+
+// Delete returns the root of a map without the entry for a key, which is the
+// same map if it has no such entry.
+func Delete(ctx context.Context, store cask.Store, root cask.Hash, key []byte) (cask.Hash, error) {
+	return edit(ctx, store, root, key, nil)
+}
+
+// edit replaces the entry for a key with the given item, or removes it if
+// the item is nil.
+//
+// Starting from the block that holds the key at each level, edit writes the
+// level again until a new block ends where an old block ended, beyond which
+// the old blocks remain, then carries the new blocks up to the next level.
+func edit(ctx context.Context, store cask.Store, root cask.Hash, key []byte, replacement *item) (cask.Hash, error) {
+	c, err := seek(ctx, store, root, key)
+	if err != nil {
+		return cask.ZeroHash, err
+	}
+	// The items that precede the edit in the block that holds it, at each
+	// level.
+	prefixes := make([][]item, len(c.frames))
+	for level, f := range c.frames {
+		prefixes[level] = f.items[:f.index]
+	}
+
+	found := !c.exhausted(0) && bytes.Equal(c.current(0).Key, key)
+	if !found && replacement == nil {
+		return root, nil
+	}
+	if found && replacement != nil && Entry(c.current(0)).equal(Entry(*replacement)) {
+		return root, nil
+	}
+	if found {
+		err = c.advance(0)
+	} else {
+		// A key after the last entry of a leaf falls before the first entry
+		// of the next leaf.
+		err = c.settle(0)
+	}
+	if err != nil {
+		return cask.ZeroHash, err
+	}
+	var fresh []item
+	if replacement != nil {
+		fresh = []item{*replacement}
+	}
+
+	for height := 0; ; height++ {
+		w := &chunker{ctx: ctx, store: store, height: height}
+		if height < len(prefixes) {
+			for _, it := range prefixes[height] {
+				if err := w.add(it); err != nil {
+					return cask.ZeroHash, err
+				}
+			}
+		}
+		for _, it := range fresh {
+			if err := w.add(it); err != nil {
+				return cask.ZeroHash, err
+			}
+		}
+		if height < len(c.frames) {
+			// The new blocks catch up with the old once they end where an
+			// old block ended, after writing at least one old item again,
+			// and only where a parent level links the remaining old blocks.
+			// A fresh item that ends a block before the first old item has
+			// not caught up, since no old block has been replaced yet.
+			consumed := false
+			for !c.exhausted(height) {
+				if consumed && height+1 < len(c.frames) && len(w.items) == 0 && c.frames[height].index == 0 {
+					break
+				}
+				if err := w.add(c.current(height)); err != nil {
+					return cask.ZeroHash, err
+				}
+				if err := c.advance(height); err != nil {
+					return cask.ZeroHash, err
+				}
+				consumed = true
+			}
+		}
+		if err := w.flush(); err != nil {
+			return cask.ZeroHash, err
+		}
+		fresh = w.out
+		if height+1 >= len(c.frames) && len(fresh) <= 1 {
+			break
+		}
+	}
+	if len(fresh) == 0 {
+		return cask.ZeroHash, nil
+	}
+
+	// A root with one child gives way to the child, as though the map were
+	// built from scratch.
+	root = fresh[0].Link
+	for {
+		n, err := load(ctx, store, root)
+		if err != nil {
+			return cask.ZeroHash, err
+		}
+		if n.height == 0 || len(n.items) != 1 {
+			return root, nil
+		}
+		root = n.items[0].Link
+	}
+}
+
+// cursor is a position in a map, with the block at each level along the path
+// from the root to the leaf, and the index of the item at each level.
+type cursor struct {
+	ctx    context.Context
+	store  cask.Store
+	frames []*frame
+}
+
+type frame struct {
+	items []item
+	index int
+}
+
+// seek returns a cursor at the first entry with a key at or after the given
+// key.
+func seek(ctx context.Context, store cask.Store, root cask.Hash, key []byte) (*cursor, error) {
+	c := &cursor{ctx: ctx, store: store}
+	if root == cask.ZeroHash {
+		c.frames = []*frame{{}}
+		return c, nil
+	}
+	var frames []*frame
+	for {
+		n, err := load(ctx, store, root)
+		if err != nil {
+			return nil, err
+		}
+		f := &frame{items: n.items, index: n.search(key)}
+		frames = append(frames, f)
+		if n.height == 0 {
+			break
+		}
+		if f.index == len(f.items) {
+			return nil, ErrMalformed
+		}
+		root = f.items[f.index].Link
+	}
+	for i := len(frames) - 1; i >= 0; i-- {
+		c.frames = append(c.frames, frames[i])
+	}
+
+	return c, nil
+}
+
+func (c *cursor) exhausted(level int) bool {
+	f := c.frames[level]
+	return f.index >= len(f.items)
+}
+
+func (c *cursor) current(level int) item {
+	f := c.frames[level]
+	return f.items[f.index]
+}
+
+// advance moves the cursor to the next item at a level.
+func (c *cursor) advance(level int) error {
+	c.frames[level].index++
+	return c.settle(level)
+}
+
+// settle moves the cursor from the end of a block to the first item of the
+// next block of the level, if there is one.
+func (c *cursor) settle(level int) error {
+	f := c.frames[level]
+	if f.index < len(f.items) || level+1 == len(c.frames) {
+		return nil
+	}
+	if err := c.advance(level + 1); err != nil {
+		return err
+	}
+	if c.exhausted(level + 1) {
+		return nil
+	}
+	n, err := load(c.ctx, c.store, c.current(level+1).Link)
+	if err != nil {
+		return err
+	}
+	f.items = n.items
+	f.index = 0
+	return nil
+}
+
+// Iterator reads the entries of a map in key order.
+type Iterator struct {
+	store  cask.Store
+	root   cask.Hash
+	start  []byte
+	cursor *cursor
+}
+
+// NewIterator returns an iterator over the entries of a map with keys at or
+// after the start key.
+func NewIterator(store cask.Store, root cask.Hash, start []byte) *Iterator {
+	return &Iterator{store: store, root: root, start: start}
+}
+
+// Next returns the next entry, or io.EOF after the last.
+func (it *Iterator) Next(ctx context.Context) (Entry, error) {
+	if it.cursor == nil {
+		c, err := seek(ctx, it.store, it.root, it.start)
+		if err != nil {
+			return Entry{}, err
+		}
+		it.cursor = c
+		if err := c.settle(0); err != nil {
+			return Entry{}, err
+		}
+	} else {
+		it.cursor.ctx = ctx
+		if err := it.cursor.advance(0); err != nil {
+			return Entry{}, err
+		}
+	}
+	if it.cursor.exhausted(0) {
+		return Entry{}, io.EOF
+	}
+	return Entry(it.cursor.current(0)), nil
+}
+
+// Change is a difference between two maps.
+type Change struct {
+	// Key is the key of the entry that differs.
+	Key []byte
+	// Old is the entry in the older map, or nil if the entry was added.
+	Old *Entry
+	// New is the entry in the newer map, or nil if the entry was removed.
+	New *Entry
+}
+
+// Diff returns the changes from map a to map b, ordered by key.
+//
+// Diff skips every block that appears in both maps, so the cost of a diff is
+// proportional to the size of the change rather than the size of the maps.
+func Diff(ctx context.Context, store cask.Store, a, b cask.Hash) ([]Change, error) {
+	as, err := frontier(ctx, store, a)
+	if err != nil {
+		return nil, err
+	}
+	bs, err := frontier(ctx, store, b)
+	if err != nil {
+		return nil, err
+	}
+
+	// Blocks in both maps hold the same entries in both, and none of those
+	// keys appear elsewhere in either map.
+	// Expanding the tallest blocks that remain eventually leaves only the
+	// leaves that differ.
+	for {
+		as, bs = exclude(as, bs), exclude(bs, as)
+		height := 0
+		for _, n := range append(as, bs...) {
+			if n.height > height {
+				height = n.height
+			}
+		}
+		if height == 0 {
+			break
+		}
+		if as, err = expand(ctx, store, as, height); err != nil {
+			return nil, err
+		}
+		if bs, err = expand(ctx, store, bs, height); err != nil {
+			return nil, err
+		}
+	}
+
+	var changes []Change
+	olds, news := entries(as), entries(bs)
+	for len(olds) > 0 || len(news) > 0 {
+		switch {
+		case len(news) == 0 || len(olds) > 0 && bytes.Compare(olds[0].Key, news[0].Key) < 0:
+			changes = append(changes, Change{Key: olds[0].Key, Old: &olds[0]})
+			olds = olds[1:]
+		case len(olds) == 0 || bytes.Compare(news[0].Key, olds[0].Key) < 0:
+			changes = append(changes, Change{Key: news[0].Key, New: &news[0]})
+			news = news[1:]
+		default:
+			if !olds[0].equal(news[0]) {
+				changes = append(changes, Change{Key: olds[0].Key, Old: &olds[0], New: &news[0]})
+			}
+			olds, news = olds[1:], news[1:]
+		}
+	}
+	return changes, nil
+}
+
+// ref is a loaded block of a map.
+type ref struct {
+	hash cask.Hash
+	*node
+}
+
+func frontier(ctx context.Context, store cask.Store, root cask.Hash) ([]ref, error) {
+	if root == cask.ZeroHash {
+		return nil, nil
+	}
+	n, err := load(ctx, store, root)
+	if err != nil {
+		return nil, err
+	}
+	return []ref{{root, n}}, nil
+}
+
+// exclude returns the blocks of one list that are not in another, in order.
+func exclude(refs, others []ref) []ref {
+	common := make(map[cask.Hash]struct{}, len(others))
+	for _, other := range others {
+		common[other.hash] = struct{}{}
+	}
+	var kept []ref
+	for _, r := range refs {
+		if _, ok := common[r.hash]; !ok {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
+
+// expand replaces the blocks of the given height with their children.
+func expand(ctx context.Context, store cask.Store, refs []ref, height int) ([]ref, error) {
+	var expanded []ref
+	for _, r := range refs {
+		if r.height != height {
+			expanded = append(expanded, r)
+			continue
+		}
+		for _, child := range r.items {
+			n, err := load(ctx, store, child.Link)
+			if err != nil {
+				return nil, err
+			}
+			expanded = append(expanded, ref{child.Link, n})
+		}
+	}
+	return expanded, nil
+}
+
+// entries returns the entries of leaves, in order.
+func entries(leaves []ref) []Entry {
+	var all []Entry
+	for _, leaf := range leaves {
+		for _, it := range leaf.items {
+			all = append(all, Entry(it))
+		}
+	}
+	return all
+}
@@ -0,0 +1,260 @@
+package caskmap_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"borkshop/cask"
+	"borkshop/cask/blob"
+	"borkshop/cask/map"
+	"borkshop/cask/memstore"
+	"borkshop/cask/test"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func key(i int) []byte {
+	return []byte(fmt.Sprintf("key%06d", i))
+}
+
+func entry(i int) caskmap.Entry {
+	return caskmap.Entry{Key: key(i), Value: []byte(fmt.Sprintf("value %d", i))}
+}
+
+func collect(t *testing.T, store cask.Store, root cask.Hash, start []byte) []caskmap.Entry {
+	ctx := context.Background()
+	it := caskmap.NewIterator(store, root, start)
+	var entries []caskmap.Entry
+	for {
+		entry, err := it.Next(ctx)
+		if err == io.EOF {
+			return entries
+		}
+		require.NoError(t, err)
+		entries = append(entries, entry)
+	}
+}
+
+func TestShapeIndependentOfOrder(t *testing.T) {
+	ctx := context.Background()
+	store := caskmemstore.New()
+	const n = 2000
+
+	var entries []caskmap.Entry
+	for i := 0; i < n; i++ {
+		entries = append(entries, entry(i))
+	}
+	built, err := caskmap.Build(ctx, store, entries)
+	require.NoError(t, err)
+
+	root := cask.ZeroHash
+	for _, i := range rand.New(rand.NewSource(1)).Perm(n) {
+		root, err = caskmap.Put(ctx, store, root, entry(i))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, built, root)
+
+	// Deleting half of the entries yields the map of the other half.
+	var half []caskmap.Entry
+	for i := 0; i < n; i++ {
+		if i%2 == 0 {
+			root, err = caskmap.Delete(ctx, store, root, key(i))
+			require.NoError(t, err)
+		} else {
+			half = append(half, entry(i))
+		}
+	}
+	want, err := caskmap.Build(ctx, store, half)
+	require.NoError(t, err)
+	assert.Equal(t, want, root)
+
+	for i := 1; i < n; i += 2 {
+		root, err = caskmap.Delete(ctx, store, root, key(i))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, cask.ZeroHash, root)
+}
+
+func TestGetPutDelete(t *testing.T) {
+	ctx := context.Background()
+	store := caskmemstore.New()
+
+	link, err := caskblob.WriteString(ctx, store, "hello, world")
+	require.NoError(t, err)
+	root, err := caskmap.Put(ctx, store, cask.ZeroHash, caskmap.Entry{Key: []byte("greeting"), Link: link})
+	require.NoError(t, err)
+	root, err = caskmap.Put(ctx, store, root, caskmap.Entry{Key: []byte("name"), Value: []byte("bork")})
+	require.NoError(t, err)
+
+	got, ok, err := caskmap.Get(ctx, store, root, []byte("greeting"))
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, link, got.Link)
+
+	// The map retains linked blocks.
+	var block cask.Block
+	require.NoError(t, store.Load(ctx, root, &block))
+	assert.Contains(t, block.Links(), link)
+
+	_, ok, err = caskmap.Get(ctx, store, root, []byte("gree"))
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	same, err := caskmap.Put(ctx, store, root, caskmap.Entry{Key: []byte("name"), Value: []byte("bork")})
+	require.NoError(t, err)
+	assert.Equal(t, root, same)
+	same, err = caskmap.Delete(ctx, store, root, []byte("absent"))
+	require.NoError(t, err)
+	assert.Equal(t, root, same)
+
+	root, err = caskmap.Put(ctx, store, root, caskmap.Entry{Key: []byte("name"), Value: []byte("shop")})
+	require.NoError(t, err)
+	got, ok, err = caskmap.Get(ctx, store, root, []byte("name"))
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "shop", string(got.Value))
+
+	_, err = caskmap.Put(ctx, store, root, caskmap.Entry{Key: make([]byte, caskmap.MaxKeySize+1)})
+	assert.Equal(t, caskmap.ErrTooLarge, err)
+	_, err = caskmap.Put(ctx, store, root, caskmap.Entry{Key: []byte("big"), Value: make([]byte, caskmap.MaxValueSize+1)})
+	assert.Equal(t, caskmap.ErrTooLarge, err)
+}
+
+func TestIterator(t *testing.T) {
+	ctx := context.Background()
+	store := caskmemstore.New()
+
+	var entries []caskmap.Entry
+	for i := 0; i < 1000; i += 10 {
+		entries = append(entries, entry(i))
+	}
+	root, err := caskmap.Build(ctx, store, entries)
+	require.NoError(t, err)
+
+	assert.Equal(t, entries, collect(t, store, root, nil))
+	for i := 0; i < 1000; i += 7 {
+		got := collect(t, store, root, key(i))
+		if want := entries[(i+9)/10:]; len(want) > 0 {
+			assert.Equal(t, want, got, "from %d", i)
+		} else {
+			assert.Empty(t, got, "from %d", i)
+		}
+	}
+	assert.Empty(t, collect(t, store, root, []byte("z")))
+	assert.Empty(t, collect(t, store, cask.ZeroHash, nil))
+}
+
+func TestDiff(t *testing.T) {
+	ctx := context.Background()
+	store := caskmemstore.New()
+
+	var entries []caskmap.Entry
+	for i := 0; i < 3000; i++ {
+		entries = append(entries, entry(i))
+	}
+	a, err := caskmap.Build(ctx, store, entries)
+	require.NoError(t, err)
+
+	b, err := caskmap.Delete(ctx, store, a, key(10))
+	require.NoError(t, err)
+	b, err = caskmap.Put(ctx, store, b, caskmap.Entry{Key: key(1500), Value: []byte("changed")})
+	require.NoError(t, err)
+	b, err = caskmap.Put(ctx, store, b, entry(5000))
+	require.NoError(t, err)
+
+	changes, err := caskmap.Diff(ctx, store, a, b)
+	require.NoError(t, err)
+	require.Len(t, changes, 3)
+	assert.Equal(t, key(10), changes[0].Key)
+	assert.Nil(t, changes[0].New)
+	assert.Equal(t, key(1500), changes[1].Key)
+	assert.Equal(t, "value 1500", string(changes[1].Old.Value))
+	assert.Equal(t, "changed", string(changes[1].New.Value))
+	assert.Equal(t, key(5000), changes[2].Key)
+	assert.Nil(t, changes[2].Old)
+
+	changes, err = caskmap.Diff(ctx, store, a, a)
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+
+	changes, err = caskmap.Diff(ctx, store, cask.ZeroHash, a)
+	require.NoError(t, err)
+	assert.Len(t, changes, len(entries))
+}
+
+func TestDiffSkipsCommonBlocks(t *testing.T) {
+	ctx := context.Background()
+	store := casktest.NewCountingStore()
+
+	var entries []caskmap.Entry
+	for i := 0; i < 10000; i++ {
+		entries = append(entries, entry(i))
+	}
+	a, err := caskmap.Build(ctx, store, entries)
+	require.NoError(t, err)
+	b, err := caskmap.Put(ctx, store, a, caskmap.Entry{Key: key(5000), Value: []byte("changed")})
+	require.NoError(t, err)
+
+	// A diff of maps that share most of their blocks loads only the blocks
+	// that differ, and their children.
+	store.Reset()
+	changes, err := caskmap.Diff(ctx, store, a, b)
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	assert.Equal(t, key(5000), changes[0].Key)
+	assert.True(t, store.Loads() < 200, "loaded %d blocks", store.Loads())
+}
+
+func TestRandom(t *testing.T) {
+	ctx := context.Background()
+	store := caskmemstore.New()
+	r := rand.New(rand.NewSource(2))
+
+	// Entries of varied sizes, some with links, exercise blocks that end
+	// because they are full as well as at patterns.
+	want := make(map[string]caskmap.Entry)
+	root := cask.ZeroHash
+	for i := 1; i <= 3000; i++ {
+		k := fmt.Sprintf("%x", r.Intn(1000))
+		var err error
+		if r.Intn(3) == 0 {
+			delete(want, k)
+			root, err = caskmap.Delete(ctx, store, root, []byte(k))
+			require.NoError(t, err)
+		} else {
+			entry := caskmap.Entry{Key: []byte(k), Value: make([]byte, r.Intn(caskmap.MaxValueSize))}
+			r.Read(entry.Value)
+			if r.Intn(2) == 0 {
+				r.Read(entry.Link[:])
+			}
+			want[k] = entry
+			root, err = caskmap.Put(ctx, store, root, entry)
+			require.NoError(t, err)
+		}
+		if i%500 != 0 {
+			continue
+		}
+
+		var keys []string
+		var entries []caskmap.Entry
+		for k, entry := range want {
+			keys = append(keys, k)
+			entries = append(entries, entry)
+		}
+		sort.Strings(keys)
+		got := collect(t, store, root, nil)
+		require.Len(t, got, len(keys))
+		for i, k := range keys {
+			assert.Equal(t, want[k], got[i])
+		}
+
+		built, err := caskmap.Build(ctx, store, entries)
+		require.NoError(t, err)
+		require.Equal(t, built, root)
+	}
+}
@@ -3,79 +3,175 @@
 package caskmemstore
 
 import (
+	"container/list"
 	"context"
 	"sync"
 
 	"borkshop/cask"
 )
 
-// TODO come up with better test and benchmark infrastructure and evolve a
-// better data structure and algorithm for high performance concurrent reads
-// and writes.
-// The current algorithm keeps the global lock too long during a concurrent
-// read-then-write of a particular block.
-
-// New returns a simple, in-memory, 1KB blockwise content address store.
+// New returns a simple, in-memory, 1KB blockwise content address store that
+// retains every block.
 func New() *MemStore {
+	return NewBounded(0)
+}
+
+// NewBounded returns an in-memory, 1KB blockwise content address store that
+// retains at most the given number of blocks, evicting the least recently
+// used block to make room for another.
+// Each block occupies a little more than 1KB of memory.
+// Zero capacity retains every block.
+func NewBounded(capacity int) *MemStore {
 	return &MemStore{
-		cells: make(map[cask.Hash]*cell),
+		capacity: capacity,
+		cells:    make(map[cask.Hash]*cell),
 	}
 }
 
 // MemStore is a simple, in-memory, 1KB blockwise content address store.
+//
+// Loads of a block that the store lacks wait for the block to be stored,
+// until their context expires.
+// An evicted block is as though it was never stored.
 type MemStore struct {
-	lock  sync.RWMutex
-	cells map[cask.Hash]*cell
+	lock     sync.Mutex
+	capacity int
+	cells    map[cask.Hash]*cell
+	// recent lists the hashes of stored blocks, most recently used first.
+	recent list.List
+	stats  Stats
 }
 
 var _ cask.Store = (*MemStore)(nil)
+var _ cask.Checker = (*MemStore)(nil)
+var _ cask.Remover = (*MemStore)(nil)
+
+// Stats counts the blocks of a store and the outcomes of its loads.
+type Stats struct {
+	// Blocks is the number of blocks the store holds.
+	Blocks int
+	// Pending is the number of blocks that loads are waiting for.
+	Pending int
+	// Hits is the number of loads that found their block.
+	Hits int
+	// Misses is the number of loads that waited for their block to be
+	// stored, whether or not it arrived before their context expired.
+	Misses int
+	// Evictions is the number of blocks discarded to stay within capacity.
+	Evictions int
+}
 
-// cell captures a block and synchronizes concurrent reads and writes.
+// cell captures a block, or the loads waiting for it.
 type cell struct {
-	block  cask.Block
-	stored bool
-	ready  chan struct{}
+	block cask.Block
+	// elem is the place of a stored block in the recent list, and nil while
+	// loads wait for the block.
+	elem *list.Element
+	// waiters is the number of loads waiting for the block.
+	// The last to give up removes the cell.
+	waiters int
+	// ready closes when the block is stored, releasing the waiters.
+	ready chan struct{}
 }
 
 // Store captures a block in memory.
 func (s *MemStore) Store(_ context.Context, h cask.Hash, b *cask.Block) error {
 	s.lock.Lock()
+	defer s.lock.Unlock()
+
 	c, ok := s.cells[h]
+	if ok && c.elem != nil {
+		s.recent.MoveToFront(c.elem)
+		return nil
+	}
 	if !ok {
-		c = &cell{
-			block:  *b,
-			stored: true,
-			ready:  make(chan struct{}),
-		}
+		c = &cell{}
 		s.cells[h] = c
-		close(c.ready)
-	} else if !c.stored {
-		c.stored = true
-		c.block = *b
+	}
+	c.block = *b
+	c.elem = s.recent.PushFront(h)
+	if c.ready != nil {
 		close(c.ready)
 	}
-	s.lock.Unlock()
 
+	for s.capacity > 0 && s.recent.Len() > s.capacity {
+		oldest := s.recent.Back()
+		s.recent.Remove(oldest)
+		delete(s.cells, oldest.Value.(cask.Hash))
+		s.stats.Evictions++
+	}
 	return nil
 }
 
-// Load retrieves a block from memory.
+// Load retrieves a block from memory, waiting for the block to be stored if
+// necessary.
 func (s *MemStore) Load(ctx context.Context, h cask.Hash, b *cask.Block) error {
-	s.lock.RLock()
+	s.lock.Lock()
 	c, ok := s.cells[h]
+	if ok && c.elem != nil {
+		s.recent.MoveToFront(c.elem)
+		s.stats.Hits++
+		*b = c.block
+		s.lock.Unlock()
+		return nil
+	}
+	s.stats.Misses++
 	if !ok {
-		c = &cell{
-			ready: make(chan struct{}),
-		}
+		c = &cell{ready: make(chan struct{})}
 		s.cells[h] = c
 	}
-	s.lock.RUnlock()
+	c.waiters++
+	ready := c.ready
+	s.lock.Unlock()
 
 	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case <-c.ready:
+	case <-ready:
+		// The block does not change once stored.
 		*b = c.block
 		return nil
+	case <-ctx.Done():
+		s.lock.Lock()
+		c.waiters--
+		if c.waiters == 0 && c.elem == nil && s.cells[h] == c {
+			delete(s.cells, h)
+		}
+		s.lock.Unlock()
+		return ctx.Err()
 	}
 }
+
+// Has reports whether each block has been stored in memory.
+func (s *MemStore) Has(_ context.Context, hs []cask.Hash) ([]bool, error) {
+	have := make([]bool, len(hs))
+	s.lock.Lock()
+	for i, h := range hs {
+		c, ok := s.cells[h]
+		have[i] = ok && c.elem != nil
+	}
+	s.lock.Unlock()
+	return have, nil
+}
+
+// Remove discards a block from memory.
+//
+// Loads waiting for the block to be stored continue to wait.
+func (s *MemStore) Remove(_ context.Context, h cask.Hash) error {
+	s.lock.Lock()
+	if c, ok := s.cells[h]; ok && c.elem != nil {
+		s.recent.Remove(c.elem)
+		delete(s.cells, h)
+	}
+	s.lock.Unlock()
+	return nil
+}
+
+// Stats returns the number of blocks the store holds and awaits, and counts
+// of the outcomes of its loads.
+func (s *MemStore) Stats() Stats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stats := s.stats
+	stats.Blocks = s.recent.Len()
+	stats.Pending = len(s.cells) - stats.Blocks
+	return stats
+}
@@ -8,6 +8,7 @@ import (
 
 	"borkshop/cask"
 	"borkshop/cask/memstore"
+	"borkshop/cask/test"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -48,7 +49,7 @@ func TestMemStoreLoadThenStore(t *testing.T) {
 
 	go func() {
 		time.Sleep(10 * time.Millisecond)
-		err = store.Store(context.Background(), h, &b)
+		err := store.Store(context.Background(), h, &b)
 		assert.NoError(t, err)
 
 		wg.Done()
@@ -61,3 +62,101 @@ func TestMemStoreLoadThenStore(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestMemStoreRemove(t *testing.T) {
+	ctx := context.Background()
+	b := cask.Block{1}
+	h := b.Hash()
+
+	store := caskmemstore.New()
+	assert.NoError(t, store.Remove(ctx, h), "removing a missing block")
+
+	assert.NoError(t, store.Store(ctx, h, &b))
+	assert.NoError(t, store.Remove(ctx, h))
+	have, err := store.Has(ctx, []cask.Hash{h})
+	assert.NoError(t, err)
+	assert.Equal(t, []bool{false}, have)
+}
+
+func TestMemStoreStress(t *testing.T) {
+	store := caskmemstore.New()
+	config := casktest.StressStoreConfig{Concurrency: 50, Duration: 200 * time.Millisecond}
+	report := config.Stress(store)
+	assert.Equal(t, 0, report.WriteErrors, "write errors")
+	assert.Equal(t, 0, report.ReadErrors, "read errors")
+	assert.Equal(t, 0, report.DataErrors, "data integrity errors")
+	assert.NotEqual(t, 0, report.Cycles, "no cycles")
+	assert.Equal(t, 0, store.Stats().Pending)
+}
+
+func TestMemStoreStressBounded(t *testing.T) {
+	store := caskmemstore.NewBounded(4096)
+	config := casktest.StressStoreConfig{
+		Concurrency: 50,
+		Duration:    200 * time.Millisecond,
+		Timeout:     time.Second,
+		Unique:      true,
+	}
+	report := config.Stress(store)
+	stats := store.Stats()
+	assert.Equal(t, 0, report.WriteErrors, "write errors")
+	assert.Equal(t, 0, report.DataErrors, "data integrity errors")
+	assert.NotEqual(t, 0, report.Cycles, "no cycles")
+	// A worker may lose its block to eviction between writing and reading.
+	assert.True(t, report.ReadErrors <= stats.Evictions, "%d read errors without eviction", report.ReadErrors)
+	assert.True(t, stats.Blocks <= 4096, "%d blocks exceed capacity", stats.Blocks)
+	assert.Equal(t, 0, stats.Pending)
+}
+
+func TestMemStoreEviction(t *testing.T) {
+	ctx := context.Background()
+	b1, b2, b3 := cask.Block{1}, cask.Block{2}, cask.Block{3}
+	h1, h2, h3 := b1.Hash(), b2.Hash(), b3.Hash()
+
+	store := caskmemstore.NewBounded(2)
+	assert.NoError(t, store.Store(ctx, h1, &b1))
+	assert.NoError(t, store.Store(ctx, h2, &b2))
+	var b cask.Block
+	assert.NoError(t, store.Load(ctx, h1, &b))
+	// The second block is the least recently used.
+	assert.NoError(t, store.Store(ctx, h3, &b3))
+
+	have, err := store.Has(ctx, []cask.Hash{h1, h2, h3})
+	assert.NoError(t, err)
+	assert.Equal(t, []bool{true, false, true}, have)
+	assert.Equal(t, caskmemstore.Stats{Blocks: 2, Hits: 1, Evictions: 1}, store.Stats())
+}
+
+func TestMemStoreAbandonedLoad(t *testing.T) {
+	b := cask.Block{1}
+	h := b.Hash()
+	store := caskmemstore.New()
+
+	// A load that gives up leaves nothing behind.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	assert.Error(t, store.Load(ctx, h, &cask.Block{}))
+	assert.Equal(t, caskmemstore.Stats{Misses: 1}, store.Stats())
+
+	// A load that gives up does not disturb another that waits.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	impatient, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, store.Load(impatient, h, &cask.Block{}))
+	}()
+	go func() {
+		defer wg.Done()
+		var got cask.Block
+		assert.NoError(t, store.Load(context.Background(), h, &got))
+		assert.Equal(t, b, got)
+	}()
+	for store.Stats().Misses < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	assert.NoError(t, store.Store(context.Background(), h, &b))
+	wg.Wait()
+	assert.Equal(t, caskmemstore.Stats{Blocks: 1, Misses: 3}, store.Stats())
+}
@@ -0,0 +1,86 @@
+package casknet
+
+import (
+	"sync"
+	"time"
+
+	"borkshop/cask"
+)
+
+// replyCache remembers the replies a server has sent so that retransmitted
+// requests can be answered without handling them again.
+type replyCache struct {
+	lock    sync.Mutex
+	replies map[requestKey]*cachedReply
+	expiry  []requestKey
+}
+
+// requestKey identifies a request by the address of the requester and the
+// identifier the requester chose.
+type requestKey struct {
+	addr string
+	id   uint64
+}
+
+type cachedReply struct {
+	kind    string
+	hash    cask.Hash
+	packet  []byte // nil while the request is in flight
+	expires time.Time
+}
+
+func newReplyCache() *replyCache {
+	return &replyCache{
+		replies: make(map[requestKey]*cachedReply),
+	}
+}
+
+// begin records that a request is in flight, unless it is a duplicate.
+//
+// For duplicates, begin returns the packet of the prior reply, or nil if the
+// prior request is still in flight.
+func (c *replyCache) begin(key requestKey, req message, now time.Time) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.expire(now)
+
+	if reply, ok := c.replies[key]; ok && reply.kind == req.kind && reply.hash == req.hash {
+		return reply.packet, true
+	}
+	c.replies[key] = &cachedReply{
+		kind: req.kind,
+		hash: req.hash,
+	}
+	return nil, false
+}
+
+// finish records the reply to a request and retains it for the given window.
+func (c *replyCache) finish(key requestKey, packet []byte, now time.Time, window time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	reply, ok := c.replies[key]
+	if !ok {
+		return
+	}
+	reply.packet = packet
+	reply.expires = now.Add(window)
+	c.expiry = append(c.expiry, key)
+}
+
+// expire forgets replies that have outlived their window, in the order they
+// were finished.
+func (c *replyCache) expire(now time.Time) {
+	i := 0
+	for ; i < len(c.expiry); i++ {
+		key := c.expiry[i]
+		reply, ok := c.replies[key]
+		if ok && reply.packet != nil && now.Before(reply.expires) {
+			break
+		}
+		if ok && reply.packet != nil {
+			delete(c.replies, key)
+		}
+	}
+	c.expiry = c.expiry[i:]
+}
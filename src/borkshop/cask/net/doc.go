@@ -0,0 +1,49 @@
+// Package casknet exposes a content address store to remote peers over UDP.
+//
+// Every 1KB block fits in a single datagram within the typical 1500 byte
+// Ethernet MTU, so each request and each response is exactly one datagram.
+//
+// Every message starts with a header: a 1 byte protocol version, a 4 byte
+// kind, an 8 byte request identifier chosen by the requester, and the 32 byte
+// hash of the block in question.
+// The body of the message follows.
+//
+//	version:1
+//	kind:4
+//	id:8
+//	hash:32
+//	body:*
+//
+// Requests are "stor", carrying the block's content in the body, "load",
+// with an empty body, and "have", with a zero hash and a body of up to 32
+// hashes.
+// The responder echoes the request identifier and hash in its reply, one of
+// "ackn" for a stored block, "blok" carrying the content of a loaded block,
+// "none" for a block the responder does not have, "bits" carrying a byte for
+// each hash of a "have" request, 1 if the responder has the block and 0
+// otherwise, or "nack" carrying an error message.
+//
+// Servers that keep pins also answer "pset", carrying the hash to pin and
+// the name of the pin in the body, with "ackn", and "pget", with a zero hash
+// and the name of the pin in the body, with "pinn" carrying the pinned hash
+// in place of the request's hash, or "none" if there is no such pin.
+//
+// The "have" request allows bulk transfers to skip blocks, and by extension
+// entire subtrees, that the other peer already has.
+//
+// Datagrams may be lost, so the requester retransmits a request with
+// exponential backoff until it receives a reply or its context expires.
+// The responder remembers the replies it sent for a while and answers
+// retransmitted requests from memory instead of handling them again.
+// The requester ignores replies for requests that are no longer outstanding,
+// rejects replies from any address but the one it sent the request to, and
+// checks that a loaded block matches the hash it asked for.
+// A responder that cannot load a block in time replies "nack" rather than
+// "none", so that a slow store does not pass for a missing block.
+//
+// A server may also carry the messages of a raft election among its peers,
+// with the raft subjects "plea", "vote", "poll", and "echo" as kinds, a zero
+// identifier and hash, and the raft message in the body.
+// Raft messages have no replies and are never retransmitted, since the raft
+// algorithm tolerates lost messages.
+package casknet
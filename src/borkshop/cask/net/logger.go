@@ -0,0 +1,34 @@
+package casknet
+
+import (
+	"net"
+	"time"
+)
+
+// Logger receives errors and events from a server, for logging and metrics.
+//
+// Message kinds are the four letter kinds of the wire protocol, like "stor"
+// and "load".
+type Logger interface {
+	// Error indicates that the server failed to read, handle, or reply to a
+	// message.
+	Error(err error)
+	// Handle indicates that the server replied to a request from a remote
+	// peer after the given duration.
+	Handle(raddr *net.UDPAddr, request, reply string, duration time.Duration)
+	// Duplicate indicates that the server received a retransmission of a
+	// request it has already seen.
+	Duplicate(raddr *net.UDPAddr, request string)
+	// Retransmit indicates that the server sent a request to a remote peer
+	// again for want of a reply.
+	Retransmit(raddr *net.UDPAddr, request string, attempt int)
+}
+
+type nopLogger struct{}
+
+var _ Logger = nopLogger{}
+
+func (nopLogger) Error(error)                                        {}
+func (nopLogger) Handle(*net.UDPAddr, string, string, time.Duration) {}
+func (nopLogger) Duplicate(*net.UDPAddr, string)                     {}
+func (nopLogger) Retransmit(*net.UDPAddr, string, int)               {}
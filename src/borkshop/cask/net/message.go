@@ -0,0 +1,79 @@
+package casknet
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"borkshop/cask"
+)
+
+// Version is the version of the wire protocol.
+const Version = 1
+
+const (
+	headerSize     = 1 + 4 + 8 + cask.HashSize
+	maxMessageSize = headerSize + cask.BlockSize
+)
+
+// Message kinds.
+const (
+	storKind = "stor"
+	loadKind = "load"
+	haveKind = "have"
+	acknKind = "ackn"
+	nackKind = "nack"
+	noneKind = "none"
+	blokKind = "blok"
+	bitsKind = "bits"
+	psetKind = "pset"
+	pgetKind = "pget"
+	pinnKind = "pinn"
+)
+
+// maxHaveBatch is the number of hashes that fit in the body of a single
+// "have" request.
+const maxHaveBatch = cask.BlockSize / cask.HashSize
+
+// message is a single datagram of the wire protocol.
+type message struct {
+	kind string
+	id   uint64
+	hash cask.Hash
+	body []byte
+}
+
+// encode writes the message into the given buffer and returns the occupied
+// slice.
+func (m *message) encode(buf []byte) []byte {
+	buf[0] = Version
+	copy(buf[1:5], m.kind)
+	binary.BigEndian.PutUint64(buf[5:13], m.id)
+	copy(buf[13:headerSize], m.hash[:])
+	n := copy(buf[headerSize:], m.body)
+	return buf[:headerSize+n]
+}
+
+// decode reads a message from a datagram.
+//
+// The body of the decoded message aliases the given buffer.
+func (m *message) decode(buf []byte) error {
+	if len(buf) < headerSize {
+		return fmt.Errorf("corrupt message: %d bytes is shorter than the %d byte header", len(buf), headerSize)
+	}
+	if buf[0] != Version {
+		return fmt.Errorf("unsupported protocol version %d", buf[0])
+	}
+	if len(buf) > maxMessageSize {
+		return fmt.Errorf("corrupt message: %d bytes exceeds the %d byte limit", len(buf), maxMessageSize)
+	}
+	m.kind = string(buf[1:5])
+	m.id = binary.BigEndian.Uint64(buf[5:13])
+	copy(m.hash[:], buf[13:headerSize])
+	m.body = buf[headerSize:]
+	return nil
+}
+
+// String returns a representation of the message.
+func (m message) String() string {
+	return fmt.Sprintf("[%s id:%d hash:%x bytes:%d]", m.kind, m.id, m.hash[:4], len(m.body))
+}
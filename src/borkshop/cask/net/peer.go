@@ -2,47 +2,265 @@ package casknet
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"math/rand"
 	"net"
+	"os"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"borkshop/cask"
+	"borkshop/cask/io"
+	"borkshop/cask/raft"
+
+	"go.uber.org/multierr"
+)
+
+const (
+	defaultRetryInterval    = 50 * time.Millisecond
+	defaultMaxRetryInterval = time.Second
+	defaultHandlerTimeout   = time.Second
+	defaultDuplicateWindow  = 10 * time.Second
+)
+
+var (
+	// ErrNotFound indicates that a remote peer does not have the requested
+	// block.
+	ErrNotFound = errors.New("block not found")
+	// ErrStopped indicates that the server stopped before a remote peer
+	// replied.
+	ErrStopped = errors.New("server stopped")
+	// ErrCorrupt indicates that a remote peer sent a block that does not
+	// match its hash.
+	ErrCorrupt = errors.New("peer sent a block that does not match its hash")
+	// ErrNoPin indicates that a remote peer has no pin with the requested
+	// name.
+	ErrNoPin = errors.New("pin not found")
+	// ErrNoPins indicates that a server does not keep pins for remote peers.
+	ErrNoPins = errors.New("server does not keep pins")
 )
 
+// Pinner is the interface of stores that name hashes, like caskdiskstore,
+// which a server may expose to remote peers.
+type Pinner interface {
+	Pin(name string, hash cask.Hash) error
+	Pinned(name string) (cask.Hash, error)
+}
+
 // Peer tracks a remote address and controls the flow of outbound messages.
 type Peer struct {
 	server *Server
 	addr   *net.UDPAddr
+	opaque bool
+}
+
+// Opaque returns a peer for the same remote address that does not check
+// that the blocks it loads match their hashes.
+// Opaque peers suit stores that keep blocks under other addresses, such as
+// the encrypted blocks of caskcrypt, which checks the blocks it decrypts
+// instead.
+func (p *Peer) Opaque() *Peer {
+	return &Peer{server: p.server, addr: p.addr, opaque: true}
 }
 
+var _ cask.Store = (*Peer)(nil)
+var _ cask.Checker = (*Peer)(nil)
+
 // Store instructs the remote peer to store a block with a given hash until the context expires.
+//
+// Store retransmits the block until the remote peer acknowledges it or the
+// context expires.
 func (p *Peer) Store(ctx context.Context, hash cask.Hash, block *cask.Block) error {
-	var buf [1500]byte
-	copy(buf[0:4], []byte("stor")[:])
-	copy(buf[4:4+cask.HashSize], hash[:])
-	copy(buf[4+cask.HashSize:], block[0:block.Size()])
-
-	_, err := p.server.conn.WriteToUDP(buf[:4+cask.HashSize+block.Size()], p.addr)
+	reply, err := p.roundTrip(ctx, message{
+		kind: storKind,
+		hash: hash,
+		body: trimBlock(block),
+	})
 	if err != nil {
 		return err
 	}
 
-	return nil
+	switch reply.kind {
+	case acknKind:
+		return nil
+	case nackKind:
+		return fmt.Errorf("peer %s failed to store %x: %s", p.addr, hash, reply.body)
+	}
+	return fmt.Errorf("unexpected reply to store from peer %s: %s", p.addr, reply)
+}
+
+// trimBlock returns the content of a block without its trailing zeroes, which
+// the recipient restores.
+//
+// Blocks that are not in the usual format, such as encrypted blocks, may
+// use all of their bytes regardless of their headers, so the trailing zeroes
+// are the only bytes a message can safely omit.
+func trimBlock(block *cask.Block) []byte {
+	size := len(block)
+	for size > 0 && block[size-1] == 0 {
+		size--
+	}
+	return block[:size]
 }
 
 // Load instructs the remote peer to send back the block with the given hash.
+//
+// Load retransmits the request until the remote peer replies or the context
+// expires, and returns ErrNotFound if the remote peer does not have the block.
+// Load returns ErrCorrupt if the block does not match its hash, unless the
+// peer is opaque.
 func (p *Peer) Load(ctx context.Context, hash cask.Hash, block *cask.Block) error {
-	var buf [1500]byte
-	copy(buf[0:4], []byte("load")[:])
-	copy(buf[4:4+cask.HashSize], hash[:])
+	reply, err := p.roundTrip(ctx, message{
+		kind: loadKind,
+		hash: hash,
+	})
+	if err != nil {
+		return err
+	}
 
-	_, err := p.server.conn.WriteToUDP(buf[:4+cask.HashSize], p.addr)
+	switch reply.kind {
+	case blokKind:
+		var loaded cask.Block
+		copy(loaded[:], reply.body)
+		if reply.hash != hash || (!p.opaque && loaded.Hash() != hash) {
+			return fmt.Errorf("%w: %x from %s", ErrCorrupt, hash, p.addr)
+		}
+		*block = loaded
+		return nil
+	case noneKind:
+		return ErrNotFound
+	case nackKind:
+		return fmt.Errorf("peer %s failed to load %x: %s", p.addr, hash, reply.body)
+	}
+	return fmt.Errorf("unexpected reply to load from peer %s: %s", p.addr, reply)
+}
+
+// Has asks the remote peer which of the given blocks it has, in batches that
+// fit in a datagram.
+func (p *Peer) Has(ctx context.Context, hashes []cask.Hash) ([]bool, error) {
+	have := make([]bool, 0, len(hashes))
+	for len(hashes) > 0 {
+		batch := hashes
+		if len(batch) > maxHaveBatch {
+			batch = batch[:maxHaveBatch]
+		}
+		hashes = hashes[len(batch):]
+
+		body := make([]byte, 0, len(batch)*cask.HashSize)
+		for _, hash := range batch {
+			body = append(body, hash[:]...)
+		}
+		reply, err := p.roundTrip(ctx, message{
+			kind: haveKind,
+			body: body,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		switch reply.kind {
+		case bitsKind:
+			if len(reply.body) != len(batch) {
+				return nil, fmt.Errorf("peer %s answered for %d blocks but was asked about %d", p.addr, len(reply.body), len(batch))
+			}
+			for _, bit := range reply.body {
+				have = append(have, bit != 0)
+			}
+		case nackKind:
+			return nil, fmt.Errorf("peer %s failed to check blocks: %s", p.addr, reply.body)
+		default:
+			return nil, fmt.Errorf("unexpected reply to have from peer %s: %s", p.addr, reply)
+		}
+	}
+	return have, nil
+}
+
+// Pin instructs the remote peer to pin a hash under the given name.
+//
+// Pin does not send the blocks of the hash, which should reach the peer
+// first.
+func (p *Peer) Pin(ctx context.Context, name string, hash cask.Hash) error {
+	reply, err := p.roundTrip(ctx, message{
+		kind: psetKind,
+		hash: hash,
+		body: []byte(name),
+	})
 	if err != nil {
 		return err
 	}
 
-	return p.server.Store.Load(ctx, hash, block)
+	switch reply.kind {
+	case acknKind:
+		return nil
+	case nackKind:
+		return fmt.Errorf("peer %s failed to pin %s: %s", p.addr, name, reply.body)
+	}
+	return fmt.Errorf("unexpected reply to pin from peer %s: %s", p.addr, reply)
+}
+
+// Pinned asks the remote peer for the hash pinned under the given name, and
+// returns ErrNoPin if the peer has no such pin.
+func (p *Peer) Pinned(ctx context.Context, name string) (cask.Hash, error) {
+	reply, err := p.roundTrip(ctx, message{
+		kind: pgetKind,
+		body: []byte(name),
+	})
+	if err != nil {
+		return cask.ZeroHash, err
+	}
+
+	switch reply.kind {
+	case pinnKind:
+		return reply.hash, nil
+	case noneKind:
+		return cask.ZeroHash, fmt.Errorf("%w: %s on %s", ErrNoPin, name, p.addr)
+	case nackKind:
+		return cask.ZeroHash, fmt.Errorf("peer %s failed to read pin %s: %s", p.addr, name, reply.body)
+	}
+	return cask.ZeroHash, fmt.Errorf("unexpected reply to pinned from peer %s: %s", p.addr, reply)
+}
+
+// roundTrip sends a request and retransmits it with exponential backoff until
+// a reply arrives or the context expires.
+func (p *Peer) roundTrip(ctx context.Context, req message) (message, error) {
+	req.id = atomic.AddUint64(&p.server.lastID, 1)
+	replies := p.server.await(req.id, p.addr)
+	defer p.server.forget(req.id)
+
+	var buf [maxMessageSize]byte
+	packet := req.encode(buf[:])
+
+	interval := p.server.retryInterval()
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			p.server.logger().Retransmit(p.addr, req.kind, attempt)
+		}
+		if _, err := p.server.conn.WriteToUDP(packet, p.addr); err != nil {
+			return message{}, err
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return message{}, ctx.Err()
+		case <-p.server.stopping:
+			timer.Stop()
+			return message{}, ErrStopped
+		case reply := <-replies:
+			timer.Stop()
+			return reply, nil
+		case <-timer.C:
+		}
+
+		interval *= 2
+		if max := p.server.maxRetryInterval(); interval > max {
+			interval = max
+		}
+	}
 }
 
 // Close closes a peer and blocks until it has flushed.
@@ -54,8 +272,39 @@ func (p *Peer) Close(ctx context.Context) error {
 type Server struct {
 	Addr  string
 	Store cask.Store
+	// Pins, if set, lets remote peers read and replace pins.
+	// The server does not authenticate peers, so any peer that reaches it
+	// may replace any pin, and with it what garbage collection spares.
+	// Without pins, the server answers pin requests with an error.
+	Pins Pinner
+
+	// RetryInterval is the delay before the first retransmission of an
+	// unanswered request, doubling for every subsequent retransmission.
+	RetryInterval time.Duration
+	// MaxRetryInterval caps the delay between retransmissions.
+	MaxRetryInterval time.Duration
+	// HandlerTimeout bounds the time the server spends handling a request,
+	// particularly waiting for the local store to load a block.
+	HandlerTimeout time.Duration
+	// DuplicateWindow is how long the server remembers a reply, to answer
+	// retransmissions of the same request.
+	DuplicateWindow time.Duration
+	// Logger receives errors and events from the server.
+	// Logger defaults to discarding everything.
+	Logger Logger
 
-	conn *net.UDPConn
+	conn     *net.UDPConn
+	lastID   uint64
+	lock     sync.Mutex
+	pending  map[uint64]pendingRequest
+	election *caskraft.Election
+	replies  *replyCache
+	handlers sync.WaitGroup
+	ctx      context.Context
+	cancel   context.CancelFunc
+	stopOnce sync.Once
+	stopping chan struct{}
+	served   chan struct{}
 }
 
 // LocalAddr returns the actual UDP address of the local peer.
@@ -91,67 +340,305 @@ func (s *Server) Start(ctx context.Context) error {
 		return err
 	}
 	s.conn = conn
+	// Start request identifiers at a random offset so that a restarted
+	// server is unlikely to collide with replies its remote peers remember.
+	s.lastID = rand.Uint64()
+	s.pending = make(map[uint64]pendingRequest)
+	s.replies = newReplyCache()
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.stopping = make(chan struct{}, 0)
+	s.served = make(chan struct{}, 0)
 
-	go func() {
-		defer conn.Close()
-		var buf [1500]byte
-		for {
-			n, raddr, err := conn.ReadFromUDP(buf[:])
-			if err != nil {
-				log.Printf("%s\n", err)
-				continue
+	go s.serve()
+
+	return nil
+}
+
+// serve reads and handles messages until the server stops.
+func (s *Server) serve() {
+	defer close(s.served)
+	var buf [1500]byte
+	for {
+		n, raddr, err := s.conn.ReadFromUDP(buf[:])
+		if err != nil {
+			select {
+			case <-s.stopping:
+				return
+			default:
 			}
-			if err := s.handle(raddr, buf[:n]); err != nil {
-				log.Printf("%s\n", err)
-				continue
+			if errors.Is(err, net.ErrClosed) {
+				return
 			}
+			s.logger().Error(err)
+			continue
 		}
-	}()
+		if err := s.handle(raddr, buf[:n]); err != nil {
+			s.logger().Error(err)
+			continue
+		}
+	}
+}
+
+func (s *Server) handle(raddr *net.UDPAddr, buf []byte) error {
+	var msg message
+	if err := msg.decode(buf); err != nil {
+		return err
+	}
+	switch msg.kind {
+	case storKind, loadKind, haveKind, psetKind, pgetKind:
+		return s.handleRequest(raddr, msg)
+	case acknKind, nackKind, noneKind, blokKind, bitsKind, pinnKind:
+		return s.handleReply(raddr, msg)
+	}
+	if _, ok := raftKinds[msg.kind]; ok {
+		return s.handleRaft(raddr, msg)
+	}
+	return fmt.Errorf("unrecognized message kind %q from %s", msg.kind, raddr)
+}
 
+// handleRequest answers a request from a remote peer in the background,
+// unless the request is a retransmission, in which case it sends the prior
+// reply again or ignores the request if the prior is still in flight.
+func (s *Server) handleRequest(raddr *net.UDPAddr, req message) error {
+	key := requestKey{addr: raddr.String(), id: req.id}
+	if packet, duplicate := s.replies.begin(key, req, time.Now()); duplicate {
+		s.logger().Duplicate(raddr, req.kind)
+		if packet == nil {
+			return nil
+		}
+		_, err := s.conn.WriteToUDP(packet, raddr)
+		return err
+	}
+
+	// The request body aliases the read buffer.
+	req.body = append([]byte(nil), req.body...)
+	s.handlers.Add(1)
+	go func() {
+		defer s.handlers.Done()
+		start := time.Now()
+		reply := s.respond(req)
+		var buf [maxMessageSize]byte
+		packet := append([]byte(nil), reply.encode(buf[:])...)
+		s.replies.finish(key, packet, time.Now(), s.duplicateWindow())
+		if _, err := s.conn.WriteToUDP(packet, raddr); err != nil {
+			s.logger().Error(err)
+		}
+		s.logger().Handle(raddr, req.kind, reply.kind, time.Since(start))
+	}()
 	return nil
 }
 
-func (s *Server) handle(raddr *net.UDPAddr, buf []byte) error {
-	ctx := context.TODO()
+// respond handles a request with the local store and returns the reply.
+func (s *Server) respond(req message) message {
+	ctx, cancel := context.WithTimeout(s.ctx, s.handlerTimeout())
+	defer cancel()
 
-	if len(buf) < 4 {
-		return fmt.Errorf("corrupt message")
+	reply := message{id: req.id, hash: req.hash}
+	var block cask.Block
+	switch req.kind {
+	case storKind:
+		copy(block[:], req.body)
+		if err := s.Store.Store(ctx, req.hash, &block); err != nil {
+			return nack(reply, err)
+		}
+		reply.kind = acknKind
+	case loadKind:
+		// A store that takes too long to load a block may yet have it, so
+		// only a store that reports the block missing elicits "none".
+		err := s.Store.Load(ctx, req.hash, &block)
+		if os.IsNotExist(err) {
+			reply.kind = noneKind
+		} else if err != nil {
+			return nack(reply, err)
+		} else {
+			reply.kind = blokKind
+			reply.body = trimBlock(&block)
+		}
+	case haveKind:
+		hashes := make([]cask.Hash, len(req.body)/cask.HashSize)
+		for i := range hashes {
+			copy(hashes[i][:], req.body[i*cask.HashSize:])
+		}
+		have, err := caskio.Has(ctx, s.Store, hashes)
+		if err != nil {
+			return nack(reply, err)
+		}
+		reply.kind = bitsKind
+		reply.body = make([]byte, len(have))
+		for i, ok := range have {
+			if ok {
+				reply.body[i] = 1
+			}
+		}
+	case psetKind:
+		if s.Pins == nil {
+			return nack(reply, ErrNoPins)
+		}
+		if err := s.Pins.Pin(string(req.body), req.hash); err != nil {
+			return nack(reply, err)
+		}
+		reply.kind = acknKind
+	case pgetKind:
+		if s.Pins == nil {
+			return nack(reply, ErrNoPins)
+		}
+		hash, err := s.Pins.Pinned(string(req.body))
+		if os.IsNotExist(err) {
+			reply.kind = noneKind
+		} else if err != nil {
+			return nack(reply, err)
+		} else {
+			reply.kind = pinnKind
+			reply.hash = hash
+		}
 	}
-	switch string(buf[0:4]) {
-	case "stor":
-		return s.handleStore(ctx, buf, raddr)
-	case "load":
-		return s.handleLoad(ctx, buf, raddr)
+	return reply
+}
+
+func nack(reply message, err error) message {
+	reply.kind = nackKind
+	reply.body = []byte(err.Error())
+	if len(reply.body) > cask.BlockSize {
+		reply.body = reply.body[:cask.BlockSize]
 	}
+	return reply
+}
+
+// pendingRequest is an outstanding request, awaiting a reply from the
+// address it was sent to.
+type pendingRequest struct {
+	addr    *net.UDPAddr
+	replies chan message
+}
+
+// handleReply delivers a reply to the outstanding request it answers.
+// Replies to requests that are no longer outstanding are duplicates or late,
+// and are ignored.
+// Replies from any address but the one the request was sent to are
+// rejected, so that other hosts cannot answer for a peer.
+func (s *Server) handleReply(raddr *net.UDPAddr, reply message) error {
+	s.lock.Lock()
+	pending, ok := s.pending[reply.id]
+	if ok && !sameAddr(pending.addr, raddr) {
+		s.lock.Unlock()
+		return fmt.Errorf("reply %q from %s to a request sent to %s", reply.kind, raddr, pending.addr)
+	}
+	delete(s.pending, reply.id)
+	s.lock.Unlock()
+	if !ok {
+		return nil
+	}
+
+	// The reply body aliases the read buffer.
+	reply.body = append([]byte(nil), reply.body...)
+	pending.replies <- reply
 	return nil
 }
 
-func (s *Server) handleStore(ctx context.Context, buf []byte, raddr *net.UDPAddr) error {
-	var hash cask.Hash
-	copy(hash[:], buf[4:])
-	var block cask.Block
-	copy(block[:], buf[4+cask.HashSize:])
-	return s.Store.Store(ctx, hash, &block)
+// sameAddr reports whether a reply from one address answers a request sent
+// to another.
+// A request sent to an unspecified address, like 0.0.0.0, reaches the local
+// host, which replies from a loopback address.
+func sameAddr(sent, from *net.UDPAddr) bool {
+	if sent.Port != from.Port {
+		return false
+	}
+	if sent.IP == nil || sent.IP.IsUnspecified() {
+		return from.IP.IsLoopback()
+	}
+	return sent.IP.Equal(from.IP)
 }
 
-func (s *Server) handleLoad(ctx context.Context, buf []byte, raddr *net.UDPAddr) error {
-	var hash cask.Hash
-	copy(hash[:], buf[4:])
-	var block cask.Block
-	err := s.Store.Load(ctx, hash, &block)
-	if err != nil {
-		return err
+// await registers an outstanding request to an address and returns the
+// channel that will receive its reply.
+func (s *Server) await(id uint64, addr *net.UDPAddr) <-chan message {
+	replies := make(chan message, 1)
+	s.lock.Lock()
+	s.pending[id] = pendingRequest{addr: addr, replies: replies}
+	s.lock.Unlock()
+	return replies
+}
+
+// forget abandons an outstanding request.
+func (s *Server) forget(id uint64) {
+	s.lock.Lock()
+	delete(s.pending, id)
+	s.lock.Unlock()
+}
+
+func (s *Server) retryInterval() time.Duration {
+	if s.RetryInterval > 0 {
+		return s.RetryInterval
 	}
-	rpeer := s.Peer(raddr)
-	return rpeer.Store(ctx, hash, &block)
+	return defaultRetryInterval
+}
+
+func (s *Server) maxRetryInterval() time.Duration {
+	if s.MaxRetryInterval > 0 {
+		return s.MaxRetryInterval
+	}
+	return defaultMaxRetryInterval
+}
+
+func (s *Server) handlerTimeout() time.Duration {
+	if s.HandlerTimeout > 0 {
+		return s.HandlerTimeout
+	}
+	return defaultHandlerTimeout
+}
+
+func (s *Server) duplicateWindow() time.Duration {
+	if s.DuplicateWindow > 0 {
+		return s.DuplicateWindow
+	}
+	return defaultDuplicateWindow
+}
+
+func (s *Server) logger() Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return nopLogger{}
 }
 
 // Stop closes the server's listening connection and blocks until
 // all handlers have halted.
+//
+// Stop stops reading new messages, then waits for in-flight handlers to send
+// their replies before closing the connection.
+// Outstanding requests to remote peers fail with ErrStopped.
+// If the context expires first, Stop cancels the in-flight handlers, closes
+// the connection, and returns the context's error.
+// Stop is safe to call more than once.
 func (s *Server) Stop(ctx context.Context) error {
-	// TODO close channel or set an atomic
-	// TODO wait for serve to exit
-	return nil
+	if s.conn == nil {
+		return nil
+	}
+
+	var err error
+	s.stopOnce.Do(func() {
+		close(s.stopping)
+		// Unblock the pending read so serve observes that we are stopping.
+		err = s.conn.SetReadDeadline(time.Now())
+
+		drained := make(chan struct{}, 0)
+		go func() {
+			<-s.served
+			s.handlers.Wait()
+			close(drained)
+		}()
+
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			s.cancel()
+			err = multierr.Append(err, ctx.Err())
+		}
+
+		s.cancel()
+		err = multierr.Append(err, s.conn.Close())
+	})
+	return err
 }
 
 func udpAddr(addr string) (*net.UDPAddr, error) {
@@ -2,7 +2,14 @@ package casknet_test
 
 import (
 	"context"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"borkshop/cask"
 	"borkshop/cask/memstore"
@@ -47,3 +54,353 @@ func TestCasknet(t *testing.T) {
 
 	require.Equal(t, storedblock, loadedblock)
 }
+
+// missingStore has no blocks.
+type missingStore struct{}
+
+func (missingStore) Store(context.Context, cask.Hash, *cask.Block) error {
+	return nil
+}
+
+func (missingStore) Load(context.Context, cask.Hash, *cask.Block) error {
+	return os.ErrNotExist
+}
+
+func TestCasknetNotFound(t *testing.T) {
+	ctx := context.Background()
+
+	server := &casknet.Server{
+		Addr:  "127.0.0.1:0",
+		Store: missingStore{},
+	}
+	err := server.Start(ctx)
+	require.NoError(t, err)
+	defer server.Stop(ctx)
+
+	client := &casknet.Server{
+		Addr:  "127.0.0.1:0",
+		Store: caskmemstore.New(),
+	}
+	err = client.Start(ctx)
+	require.NoError(t, err)
+	defer client.Stop(ctx)
+
+	peer := client.Peer(server.LocalAddr())
+
+	block := &cask.Block{}
+	err = peer.Load(ctx, cask.Hash{1}, block)
+	require.Equal(t, casknet.ErrNotFound, err)
+}
+
+// mapPins keeps pins in memory.
+type mapPins struct {
+	lock sync.Mutex
+	pins map[string]cask.Hash
+}
+
+func (p *mapPins) Pin(name string, hash cask.Hash) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.pins[name] = hash
+	return nil
+}
+
+func (p *mapPins) Pinned(name string) (cask.Hash, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if hash, ok := p.pins[name]; ok {
+		return hash, nil
+	}
+	return cask.ZeroHash, os.ErrNotExist
+}
+
+func TestCasknetPins(t *testing.T) {
+	ctx := context.Background()
+
+	pins := &mapPins{pins: map[string]cask.Hash{}}
+	server := &casknet.Server{
+		Addr:  "127.0.0.1:0",
+		Store: caskmemstore.New(),
+		Pins:  pins,
+	}
+	err := server.Start(ctx)
+	require.NoError(t, err)
+	defer server.Stop(ctx)
+
+	bare := &casknet.Server{
+		Addr:  "127.0.0.1:0",
+		Store: caskmemstore.New(),
+	}
+	err = bare.Start(ctx)
+	require.NoError(t, err)
+	defer bare.Stop(ctx)
+
+	client := &casknet.Server{
+		Addr:  "127.0.0.1:0",
+		Store: caskmemstore.New(),
+	}
+	err = client.Start(ctx)
+	require.NoError(t, err)
+	defer client.Stop(ctx)
+
+	peer := client.Peer(server.LocalAddr())
+	_, err = peer.Pinned(ctx, "main")
+	require.True(t, errors.Is(err, casknet.ErrNoPin), "%v", err)
+
+	hash := cask.Hash{1, 2, 3}
+	err = peer.Pin(ctx, "main", hash)
+	require.NoError(t, err)
+	stored, err := pins.Pinned("main")
+	require.NoError(t, err)
+	require.Equal(t, hash, stored)
+
+	pinned, err := peer.Pinned(ctx, "main")
+	require.NoError(t, err)
+	require.Equal(t, hash, pinned)
+
+	err = client.Peer(bare.LocalAddr()).Pin(ctx, "main", hash)
+	require.Error(t, err)
+	_, err = client.Peer(bare.LocalAddr()).Pinned(ctx, "main")
+	require.Error(t, err)
+	require.False(t, errors.Is(err, casknet.ErrNoPin))
+}
+
+func TestCasknetSlowStore(t *testing.T) {
+	ctx := context.Background()
+
+	// A memory store waits for a block it lacks, which is not the same as
+	// lacking it.
+	server := &casknet.Server{
+		Addr:           "127.0.0.1:0",
+		Store:          caskmemstore.New(),
+		HandlerTimeout: 10 * time.Millisecond,
+	}
+	err := server.Start(ctx)
+	require.NoError(t, err)
+	defer server.Stop(ctx)
+
+	client := &casknet.Server{
+		Addr:  "127.0.0.1:0",
+		Store: caskmemstore.New(),
+	}
+	err = client.Start(ctx)
+	require.NoError(t, err)
+	defer client.Stop(ctx)
+
+	err = client.Peer(server.LocalAddr()).Load(ctx, cask.Hash{1}, &cask.Block{})
+	require.Error(t, err)
+	require.NotEqual(t, casknet.ErrNotFound, err)
+}
+
+func TestCasknetForgedReplies(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	// A socket that answers requests by hand, and another that tries to
+	// answer for it.
+	remote, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer remote.Close()
+	forger, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer forger.Close()
+
+	client := &casknet.Server{
+		Addr:          "127.0.0.1:0",
+		Store:         caskmemstore.New(),
+		RetryInterval: time.Hour,
+	}
+	err = client.Start(ctx)
+	require.NoError(t, err)
+	defer client.Stop(ctx)
+	peer := client.Peer(remote.LocalAddr().(*net.UDPAddr))
+
+	var want, forged cask.Block
+	copy(want[:], "want")
+	copy(forged[:], "forged")
+	hash := want.Hash()
+
+	// reply answers the next request with the given hash and content in
+	// the reply header and body, from the given socket.
+	reply := func(from *net.UDPConn, hash cask.Hash, block *cask.Block) {
+		var buf [1500]byte
+		n, raddr, err := remote.ReadFromUDP(buf[:])
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		packet := append([]byte(nil), buf[:n]...)
+		copy(packet[1:5], "blok")
+		copy(packet[13:45], hash[:])
+		packet = append(packet, block[:16]...)
+		if from == forger {
+			// The forger answers first, to no avail.
+			if _, err := forger.WriteToUDP(packet, raddr); err != nil {
+				t.Error(err)
+			}
+			time.Sleep(10 * time.Millisecond)
+			copy(packet[45:], want[:16])
+			copy(packet[13:45], hash[:])
+		}
+		if _, err := remote.WriteToUDP(packet, raddr); err != nil {
+			t.Error(err)
+		}
+	}
+
+	go reply(forger, hash, &forged)
+	var got cask.Block
+	require.NoError(t, peer.Load(ctx, hash, &got))
+	require.Equal(t, want, got)
+
+	// The peer itself may answer with the wrong block.
+	go reply(remote, hash, &forged)
+	err = peer.Load(ctx, hash, &got)
+	require.True(t, errors.Is(err, casknet.ErrCorrupt), "%v", err)
+
+	// Or with the right block for the wrong hash.
+	go reply(remote, cask.Hash{1}, &want)
+	err = peer.Opaque().Load(ctx, hash, &got)
+	require.True(t, errors.Is(err, casknet.ErrCorrupt), "%v", err)
+
+	// An opaque peer trusts content that does not match its hash.
+	go reply(remote, hash, &forged)
+	require.NoError(t, peer.Opaque().Load(ctx, hash, &got))
+	require.Equal(t, forged, got)
+}
+
+func TestCasknetPacketLoss(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	store := caskmemstore.New()
+	server := &casknet.Server{
+		Addr:  "127.0.0.1:0",
+		Store: store,
+	}
+	err := server.Start(ctx)
+	require.NoError(t, err)
+	defer server.Stop(ctx)
+
+	proxy, err := newLossyProxy(server.LocalAddr())
+	require.NoError(t, err)
+	defer proxy.Close()
+
+	client := &casknet.Server{
+		Addr:          "127.0.0.1:0",
+		Store:         caskmemstore.New(),
+		RetryInterval: time.Millisecond,
+	}
+	err = client.Start(ctx)
+	require.NoError(t, err)
+	defer client.Stop(ctx)
+
+	peer := client.Peer(proxy.LocalAddr())
+
+	for i := 0; i < 10; i++ {
+		storedmodel := &cask.Model{}
+		storedmodel.AppendString("hello world " + strconv.Itoa(i) + "!\n")
+		storedblock := &cask.Block{}
+		err = storedmodel.Put(storedblock)
+		require.NoError(t, err)
+
+		err = peer.Store(ctx, storedblock.Hash(), storedblock)
+		require.NoError(t, err)
+
+		// The server must have the block once the store is acknowledged.
+		localblock := &cask.Block{}
+		err = store.Load(ctx, storedblock.Hash(), localblock)
+		require.NoError(t, err)
+		require.Equal(t, storedblock, localblock)
+
+		loadedblock := &cask.Block{}
+		err = peer.Load(ctx, storedblock.Hash(), loadedblock)
+		require.NoError(t, err)
+		require.Equal(t, storedblock, loadedblock)
+	}
+}
+
+func TestCasknetStop(t *testing.T) {
+	ctx := context.Background()
+
+	// A socket that never replies.
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer silent.Close()
+
+	client := &casknet.Server{
+		Addr:  "127.0.0.1:0",
+		Store: caskmemstore.New(),
+	}
+	err = client.Start(ctx)
+	require.NoError(t, err)
+
+	peer := client.Peer(silent.LocalAddr().(*net.UDPAddr))
+	loaded := make(chan error, 1)
+	go func() {
+		loaded <- peer.Load(ctx, cask.Hash{1}, &cask.Block{})
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	err = client.Stop(ctx)
+	require.NoError(t, err)
+	require.Equal(t, casknet.ErrStopped, <-loaded)
+
+	err = client.Stop(ctx)
+	require.NoError(t, err)
+}
+
+// lossyProxy relays datagrams between a single client and a server, dropping
+// every other datagram in each direction.
+type lossyProxy struct {
+	front  *net.UDPConn
+	back   *net.UDPConn
+	server *net.UDPAddr
+	client atomic.Value
+}
+
+func newLossyProxy(server *net.UDPAddr) (*lossyProxy, error) {
+	front, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	back, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		front.Close()
+		return nil, err
+	}
+	p := &lossyProxy{front: front, back: back, server: server}
+	go p.relay(front, back, func(raddr *net.UDPAddr) *net.UDPAddr {
+		p.client.Store(raddr)
+		return p.server
+	})
+	go p.relay(back, front, func(*net.UDPAddr) *net.UDPAddr {
+		return p.client.Load().(*net.UDPAddr)
+	})
+	return p, nil
+}
+
+func (p *lossyProxy) relay(from, to *net.UDPConn, route func(*net.UDPAddr) *net.UDPAddr) {
+	var buf [1500]byte
+	for i := 0; ; i++ {
+		n, raddr, err := from.ReadFromUDP(buf[:])
+		if err != nil {
+			return
+		}
+		addr := route(raddr)
+		if i%2 == 0 {
+			continue
+		}
+		to.WriteToUDP(buf[:n], addr)
+	}
+}
+
+func (p *lossyProxy) LocalAddr() *net.UDPAddr {
+	return p.front.LocalAddr().(*net.UDPAddr)
+}
+
+func (p *lossyProxy) Close() {
+	p.front.Close()
+	p.back.Close()
+}
@@ -0,0 +1,180 @@
+package casknet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"borkshop/cask"
+	"borkshop/cask/raft"
+)
+
+// Raft message kinds are the subjects of raft messages, which are distinct
+// from the kinds of block requests and replies.
+var raftKinds = map[string]caskraft.Subject{
+	caskraft.RequestVote.String(): caskraft.RequestVote,
+	caskraft.Vote.String():        caskraft.Vote,
+	caskraft.Heartbeat.String():   caskraft.Heartbeat,
+	caskraft.Ack.String():         caskraft.Ack,
+}
+
+const (
+	raftFixedSize = 5*8 + 1
+	raftEntrySize = 8 + cask.HashSize + 1
+	// maxMemberSize is the longest member address a raft message can carry.
+	maxMemberSize = 255
+)
+
+var _ caskraft.Network = (*Server)(nil)
+
+// Send sends a raft message to the member addressed by its To field, which
+// must be a HOST:PORT address.
+//
+// Send sends a single datagram and does not retransmit it, since the raft
+// algorithm tolerates lost messages.
+// A heartbeat carries only as many of its entries as fit in the datagram.
+func (s *Server) Send(m caskraft.Message) {
+	if err := s.sendRaft(m); err != nil {
+		s.logger().Error(err)
+	}
+}
+
+func (s *Server) sendRaft(m caskraft.Message) error {
+	raddr, err := net.ResolveUDPAddr("udp", m.To)
+	if err != nil {
+		return err
+	}
+	body, err := encodeRaft(m)
+	if err != nil {
+		return err
+	}
+	req := message{kind: m.Subject.String(), body: body}
+	var buf [maxMessageSize]byte
+	_, err = s.conn.WriteToUDP(req.encode(buf[:]), raddr)
+	return err
+}
+
+// Join directs the raft messages that remote peers send to the server to an
+// election, which in turn should use the server as its Network.
+//
+// Join may be called before or after Start, so that an election can take
+// the actual address of the server as its member address.
+func (s *Server) Join(election *caskraft.Election) {
+	s.lock.Lock()
+	s.election = election
+	s.lock.Unlock()
+}
+
+// handleRaft delivers a raft message to the election.
+func (s *Server) handleRaft(raddr *net.UDPAddr, msg message) error {
+	s.lock.Lock()
+	election := s.election
+	s.lock.Unlock()
+	if election == nil {
+		return fmt.Errorf("unexpected raft message %s from %s", msg, raddr)
+	}
+	m, err := decodeRaft(raftKinds[msg.kind], msg.body)
+	if err != nil {
+		return fmt.Errorf("corrupt raft message from %s: %v", raddr, err)
+	}
+	election.Handle(m)
+	return nil
+}
+
+// encodeRaft writes the body of a raft message.
+//
+//	term:8 logIndex:8 logTerm:8 commit:8 match:8 success:1
+//	fromLen:1 from toLen:1 to
+//	count:1 (term:8 value:32 members:1 (length:1 member)*members)*count
+func encodeRaft(m caskraft.Message) ([]byte, error) {
+	if len(m.From) > maxMemberSize || len(m.To) > maxMemberSize {
+		return nil, errors.New("raft member address too long")
+	}
+	body := make([]byte, raftFixedSize, cask.BlockSize)
+	for i, n := range []int{m.Term, m.LogIndex, m.LogTerm, m.Commit, m.Match} {
+		binary.BigEndian.PutUint64(body[i*8:], uint64(n))
+	}
+	if m.Success {
+		body[raftFixedSize-1] = 1
+	}
+	body = append(body, byte(len(m.From)))
+	body = append(body, m.From...)
+	body = append(body, byte(len(m.To)))
+	body = append(body, m.To...)
+
+	countAt := len(body)
+	body = append(body, 0)
+	for _, entry := range m.Entries {
+		size := raftEntrySize
+		for _, member := range entry.Members {
+			size += 1 + len(member)
+		}
+		if len(body)+size > cask.BlockSize || body[countAt] == 255 || len(entry.Members) > 255 {
+			break
+		}
+		var term [8]byte
+		binary.BigEndian.PutUint64(term[:], uint64(entry.Term))
+		body = append(body, term[:]...)
+		body = append(body, entry.Value[:]...)
+		body = append(body, byte(len(entry.Members)))
+		for _, member := range entry.Members {
+			body = append(body, byte(len(member)))
+			body = append(body, member...)
+		}
+		body[countAt]++
+	}
+	return body, nil
+}
+
+// decodeRaft reads the body of a raft message.
+func decodeRaft(subject caskraft.Subject, body []byte) (caskraft.Message, error) {
+	m := caskraft.Message{Subject: subject}
+	if len(body) < raftFixedSize {
+		return m, errors.New("truncated header")
+	}
+	ints := []*int{&m.Term, &m.LogIndex, &m.LogTerm, &m.Commit, &m.Match}
+	for i, n := range ints {
+		*n = int(binary.BigEndian.Uint64(body[i*8:]))
+	}
+	m.Success = body[raftFixedSize-1] != 0
+	body = body[raftFixedSize:]
+
+	for _, member := range []*string{&m.From, &m.To} {
+		if len(body) < 1 || len(body) < 1+int(body[0]) {
+			return m, errors.New("truncated member address")
+		}
+		*member = string(body[1 : 1+body[0]])
+		body = body[1+body[0]:]
+	}
+
+	if len(body) < 1 {
+		return m, errors.New("truncated entries")
+	}
+	count := int(body[0])
+	body = body[1:]
+	if count > 0 {
+		m.Entries = make([]caskraft.Entry, count)
+	}
+	for i := range m.Entries {
+		if len(body) < raftEntrySize {
+			return m, errors.New("truncated entry")
+		}
+		entry := &m.Entries[i]
+		entry.Term = int(binary.BigEndian.Uint64(body))
+		copy(entry.Value[:], body[8:8+cask.HashSize])
+		members := int(body[raftEntrySize-1])
+		body = body[raftEntrySize:]
+		for j := 0; j < members; j++ {
+			if len(body) < 1 || len(body) < 1+int(body[0]) {
+				return m, errors.New("truncated member address")
+			}
+			entry.Members = append(entry.Members, string(body[1:1+body[0]]))
+			body = body[1+body[0]:]
+		}
+	}
+	if len(body) > 0 {
+		return m, errors.New("trailing bytes")
+	}
+	return m, nil
+}
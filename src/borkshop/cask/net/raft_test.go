@@ -0,0 +1,110 @@
+package casknet_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"borkshop/cask"
+	"borkshop/cask/memstore"
+	"borkshop/cask/net"
+	"borkshop/cask/raft"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type nopRaftLogger struct{}
+
+func (nopRaftLogger) Transition(string, caskraft.State, caskraft.State) {}
+func (nopRaftLogger) Send(string, caskraft.State, caskraft.Message)     {}
+func (nopRaftLogger) Receive(string, caskraft.State, caskraft.Message)  {}
+func (nopRaftLogger) Drop(string, caskraft.State, caskraft.Message)     {}
+func (nopRaftLogger) Timeout(string, caskraft.State, time.Duration)     {}
+func (nopRaftLogger) Error(caskraft.Error)                              {}
+func (nopRaftLogger) Membership(string, caskraft.State, []string)       {}
+
+// valueMachine records the values applied to it.
+type valueMachine struct {
+	lock   sync.Mutex
+	values []cask.Hash
+}
+
+func (m *valueMachine) Apply(index int, entry caskraft.Entry) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.values = append(m.values, entry.Value)
+}
+
+func (m *valueMachine) applied() []cask.Hash {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]cask.Hash(nil), m.values...)
+}
+
+func TestCasknetRaft(t *testing.T) {
+	ctx := context.Background()
+
+	const count = 3
+	servers := make([]*casknet.Server, count)
+	addrs := make([]string, count)
+	for i := range servers {
+		servers[i] = &casknet.Server{
+			Addr:  "127.0.0.1:0",
+			Store: caskmemstore.New(),
+		}
+		require.NoError(t, servers[i].Start(ctx))
+		defer servers[i].Stop(ctx)
+		addrs[i] = servers[i].LocalAddr().String()
+	}
+
+	elections := make([]*caskraft.Election, count)
+	machines := make([]*valueMachine, count)
+	for i, server := range servers {
+		var members []string
+		for j, addr := range addrs {
+			if j != i {
+				members = append(members, addr)
+			}
+		}
+		elections[i] = caskraft.NewElection(addrs[i], members, 100, server, nopRaftLogger{})
+		machines[i] = &valueMachine{}
+		elections[i].Machine = machines[i]
+		server.Join(elections[i])
+	}
+	for _, election := range elections {
+		require.NoError(t, election.Start(ctx))
+		defer election.Stop(ctx)
+	}
+
+	// Propose entries to whichever member leads, once elected.
+	var want []cask.Hash
+	for i := 0; i < 60; i++ {
+		value := cask.Hash{byte(i + 1), 0xff}
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			var err error
+			for _, election := range elections {
+				if _, _, err = election.Propose(ctx, value); err == nil {
+					break
+				}
+			}
+			if err == nil {
+				break
+			}
+			require.Equal(t, caskraft.ErrNotLeader, err)
+			require.True(t, time.Now().Before(deadline), "no leader elected")
+			time.Sleep(10 * time.Millisecond)
+		}
+		want = append(want, value)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for i, machine := range machines {
+		for len(machine.applied()) < len(want) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, want, machine.applied(), addrs[i])
+	}
+}
@@ -0,0 +1,43 @@
+package caskraft
+
+import "time"
+
+// Clock is a source of timers for an election.
+//
+// A simulation may replace the clock to control the passage of time.
+type Clock interface {
+	// NewTimer returns a stopped timer.
+	NewTimer() Timer
+}
+
+// Timer is a timer from a Clock, with the semantics of a time.Timer.
+type Timer interface {
+	// C returns the channel on which the timer delivers its expiry.
+	C() <-chan time.Time
+	// Stop prevents the timer from firing, returning false if the timer
+	// already fired or was stopped.
+	Stop() bool
+	// Reset changes the timer to expire after a duration.
+	// Reset must only be called on a stopped or expired timer whose channel
+	// was drained.
+	Reset(time.Duration) bool
+}
+
+// realClock provides timers from the time package.
+type realClock struct{}
+
+var _ Clock = realClock{}
+
+func (realClock) NewTimer() Timer {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	return realTimer{timer}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
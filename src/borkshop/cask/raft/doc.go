@@ -1,4 +1,14 @@
 // Package caskraft implements the RAFT distributed consensus algorithm.
 //
+// An Election elects a leader among its members, and the leader replicates a
+// log of entries to the other members, each entry carrying a hash.
+// Once a majority of the members have an entry, it is committed, and every
+// member applies it to its Machine in the same order.
+// So, a cluster of cask peers can agree upon a sequence of root hashes, for
+// example the values of a named ref.
+//
+// Every member stores its log as a chain of blocks in a content address
+// store, which LoadLog reads back.
+//
 // https://raft.github.io/
 package caskraft
@@ -1,5 +1,21 @@
 package caskraft
 
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrNotLeader indicates that a member cannot accept a proposal because
+	// it is not the leader of the current term.
+	ErrNotLeader = errors.New("not the leader")
+	// ErrMembershipChange indicates that a leader cannot start a membership
+	// change until the prior change, and an entry of its own term, commit.
+	ErrMembershipChange = errors.New("membership change in progress")
+	// ErrStopped indicates that the election has stopped.
+	ErrStopped = errors.New("election stopped")
+)
+
 // Error is a RAFT protocol error, indicating an unexpected message for a
 // member's state.
 type Error struct {
@@ -7,6 +23,8 @@ type Error struct {
 	Member  string
 	State   State
 	Message Message
+	// Err is the underlying error for a store or persistence failure.
+	Err error
 }
 
 // ErrorClass indicates the type of a RAFT protocol error.
@@ -22,12 +40,26 @@ const (
 	// InvalidState indicates that the RAFT state machine is in an invalid
 	// state.
 	InvalidState
+	// StoreFailure indicates that the member could not write an entry of its
+	// log to its store.
+	StoreFailure
+	// PersistenceFailure indicates that the member could not save its hard
+	// state, so it withheld a message that depended on it.
+	PersistenceFailure
 )
 
 func (err Error) Error() string {
 	switch err.Class {
 	case InvalidVote:
 		return "received a vote for this term but not in the candidate state"
+	case InvalidSubject:
+		return fmt.Sprintf("received a message with an unrecognized subject %d", err.Message.Subject)
+	case InvalidState:
+		return "passed through an invalid state"
+	case StoreFailure:
+		return fmt.Sprintf("could not store log entry: %v", err.Err)
+	case PersistenceFailure:
+		return fmt.Sprintf("could not save hard state: %v", err.Err)
 	default:
 		return "unrecognized raft error class"
 	}
@@ -0,0 +1,192 @@
+package caskraft
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"borkshop/cask"
+)
+
+// Each entry of the replicated log is a leaf block that links the block of
+// the preceding entry, so the hash of the last entry addresses the whole log.
+// The content is a magic string that distinguishes log entries from other
+// leaf blocks, then the term and index of the entry, then its value, then
+// the addresses of the members for an entry that changes the membership.
+//
+//	height:1 = 0
+//	links:32*n = preceding entry, absent for the first entry
+//	bytes = "cask raft\n", term:8, index:8, value:32, (length:1, member)*
+//
+// The value is not a link, so retaining the log does not retain every tree
+// the members ever agreed upon.
+const logMagic = "cask raft\n"
+
+const entrySize = len(logMagic) + 16 + cask.HashSize
+
+// ErrNotLogEntry indicates that a block is not a log entry.
+var ErrNotLogEntry = errors.New("not a raft log entry")
+
+// raftLog is the replicated log, with the hash of the block for each entry.
+// Entry indexes start at 1, and index 0 stands for the empty log.
+type raftLog struct {
+	entries []Entry
+	hashes  []cask.Hash
+	// membership is the index of the last entry that changes the
+	// membership, or 0 if none does.
+	membership int
+}
+
+// last returns the index and term of the last entry.
+func (l *raftLog) last() (int, int) {
+	return len(l.entries), l.term(len(l.entries))
+}
+
+// term returns the term of the entry at an index, or 0 for index 0.
+func (l *raftLog) term(index int) int {
+	if index <= 0 || index > len(l.entries) {
+		return 0
+	}
+	return l.entries[index-1].Term
+}
+
+// head returns the hash of the block of the last entry, or the zero hash for
+// an empty log.
+func (l *raftLog) head() cask.Hash {
+	if len(l.hashes) == 0 {
+		return cask.ZeroHash
+	}
+	return l.hashes[len(l.hashes)-1]
+}
+
+// slice returns a copy of up to limit entries starting at an index.
+func (l *raftLog) slice(index, limit int) []Entry {
+	if index < 1 || index > len(l.entries) {
+		return nil
+	}
+	end := index - 1 + limit
+	if end > len(l.entries) {
+		end = len(l.entries)
+	}
+	return append([]Entry(nil), l.entries[index-1:end]...)
+}
+
+// truncate discards the entries after an index.
+func (l *raftLog) truncate(index int) {
+	l.entries = l.entries[:index]
+	l.hashes = l.hashes[:index]
+	l.findMembership()
+}
+
+// findMembership finds the last entry that changes the membership.
+func (l *raftLog) findMembership() {
+	if l.membership > len(l.entries) {
+		l.membership = len(l.entries)
+	}
+	for l.membership > 0 && l.entries[l.membership-1].Members == nil {
+		l.membership--
+	}
+}
+
+// append stores and appends entries.
+func (l *raftLog) append(ctx context.Context, store cask.Store, entries ...Entry) error {
+	for _, entry := range entries {
+		hash, err := storeEntry(ctx, store, l.head(), len(l.entries)+1, entry)
+		if err != nil {
+			return err
+		}
+		l.entries = append(l.entries, entry)
+		l.hashes = append(l.hashes, hash)
+		if entry.Members != nil {
+			l.membership = len(l.entries)
+		}
+	}
+	return nil
+}
+
+func storeEntry(ctx context.Context, store cask.Store, prior cask.Hash, index int, entry Entry) (cask.Hash, error) {
+	var model cask.Model
+	if index > 1 {
+		model.AppendLink(prior)
+	}
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[0:8], uint64(entry.Term))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(index))
+	model.AppendString(logMagic)
+	model.AppendBytes(buf[:])
+	model.AppendBytes(entry.Value[:])
+	for _, member := range entry.Members {
+		if len(member) == 0 || len(member) > 255 {
+			return cask.ZeroHash, fmt.Errorf("invalid raft member address %q", member)
+		}
+		model.AppendBytes([]byte{byte(len(member))})
+		model.AppendString(member)
+	}
+	if model.Size() > cask.BlockSize {
+		return cask.ZeroHash, errors.New("too many raft members to fit in a block")
+	}
+	return model.Store(ctx, store)
+}
+
+// LoadLog reads the entries of a replicated log, in order, from the hash of
+// the block of its last entry.
+//
+// The zero hash addresses the empty log.
+func LoadLog(ctx context.Context, store cask.Store, head cask.Hash) ([]Entry, error) {
+	var log raftLog
+	if err := log.load(ctx, store, head); err != nil {
+		return nil, err
+	}
+	return log.entries, nil
+}
+
+// load replaces the log with the entries read back from the hash of the
+// block of its last entry.
+func (l *raftLog) load(ctx context.Context, store cask.Store, head cask.Hash) error {
+	var entries []Entry
+	var hashes []cask.Hash
+	for hash, want := head, -1; hash != cask.ZeroHash; want-- {
+		var model cask.Model
+		if err := model.Load(ctx, store, hash); err != nil {
+			return err
+		}
+		if model.Height != 0 || len(model.Links) > 1 || len(model.Bytes) < entrySize || !bytes.HasPrefix(model.Bytes, []byte(logMagic)) {
+			return ErrNotLogEntry
+		}
+		buf := model.Bytes[len(logMagic):]
+		var entry Entry
+		entry.Term = int(binary.BigEndian.Uint64(buf[0:8]))
+		index := int(binary.BigEndian.Uint64(buf[8:16]))
+		copy(entry.Value[:], buf[16:])
+		for rest := model.Bytes[entrySize:]; len(rest) > 0; {
+			if int(rest[0]) == 0 || len(rest) < 1+int(rest[0]) {
+				return fmt.Errorf("raft log entry %x has a truncated member", hash)
+			}
+			entry.Members = append(entry.Members, string(rest[1:1+rest[0]]))
+			rest = rest[1+rest[0]:]
+		}
+		if want < 0 {
+			want = index
+		}
+		if index != want || (index == 1) != (len(model.Links) == 0) {
+			return fmt.Errorf("raft log entry %x has index %d, expected %d", hash, index, want)
+		}
+		entries = append(entries, entry)
+		hashes = append(hashes, hash)
+
+		hash = cask.ZeroHash
+		if len(model.Links) > 0 {
+			hash = model.Links[0]
+		}
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+		hashes[i], hashes[j] = hashes[j], hashes[i]
+	}
+	l.entries, l.hashes = entries, hashes
+	l.membership = len(entries)
+	l.findMembership()
+	return nil
+}
@@ -3,6 +3,8 @@ package caskraft
 import (
 	"fmt"
 	"time"
+
+	"borkshop/cask"
 )
 
 const (
@@ -52,11 +54,13 @@ type State struct {
 	// NumVotes is the number of votes this node has received in this election
 	// term.
 	NumVotes int
+	// Commit is the index of the last log entry known to be committed.
+	Commit int
 }
 
 // String returns a representation of the state.
 func (s State) String() string {
-	return fmt.Sprintf("[%s term:%d vote:%1s leader:%1s votes:%d]", s.Type, s.Term, s.Vote, s.Leader, s.NumVotes)
+	return fmt.Sprintf("[%s term:%d vote:%1s leader:%1s votes:%d commit:%d]", s.Type, s.Term, s.Vote, s.Leader, s.NumVotes, s.Commit)
 }
 
 // Subject identifies the type of message sent between members of the
@@ -68,8 +72,13 @@ const (
 	RequestVote Subject = iota
 	// Vote is the subject of a vote message.
 	Vote
-	// Heartbeat is the subject of a heartbeat message.
+	// Heartbeat is the subject of a heartbeat message, by which the leader
+	// asserts its leadership and replicates its log, in the manner of the
+	// append entries call of the RAFT algorithm.
 	Heartbeat
+	// Ack is the subject of a reply to a heartbeat, reporting whether the
+	// follower's log matched the leader's.
+	Ack
 )
 
 func (t Subject) String() string {
@@ -80,6 +89,8 @@ func (t Subject) String() string {
 		return "vote"
 	case Heartbeat:
 		return "poll"
+	case Ack:
+		return "echo"
 	}
 	return "unkn"
 }
@@ -99,9 +110,50 @@ type Message struct {
 	// Term is the election term that the sender recognized when sending the
 	// message.
 	Term int
+
+	// LogIndex and LogTerm identify an entry of the sender's log.
+	//
+	// For request vote, it is the candidate's last entry.
+	// For heartbeat, it is the entry preceding the entries.
+	LogIndex int
+	LogTerm  int
+	// Entries are log entries for a follower to append, for heartbeat.
+	Entries []Entry
+	// Commit is the index of the leader's last committed entry, for
+	// heartbeat.
+	Commit int
+	// Success indicates that the follower's log matched the leader's log, for
+	// ack.
+	Success bool
+	// Match is the index of the follower's last entry that matches the
+	// leader's log, or, if unsuccessful, an index for the leader to retry
+	// from, for ack.
+	Match int
 }
 
 // String returns a representation of the message.
 func (m Message) String() string {
+	switch m.Subject {
+	case RequestVote:
+		return fmt.Sprintf("[to:%s subject:%s from:%s term:%d last:%d/%d]", m.To, m.Subject, m.From, m.Term, m.LogIndex, m.LogTerm)
+	case Heartbeat:
+		return fmt.Sprintf("[to:%s subject:%s from:%s term:%d prev:%d/%d entries:%d commit:%d]", m.To, m.Subject, m.From, m.Term, m.LogIndex, m.LogTerm, len(m.Entries), m.Commit)
+	case Ack:
+		return fmt.Sprintf("[to:%s subject:%s from:%s term:%d success:%t match:%d]", m.To, m.Subject, m.From, m.Term, m.Success, m.Match)
+	}
 	return fmt.Sprintf("[to:%s subject:%s from:%s term:%d]", m.To, m.Subject, m.From, m.Term)
 }
+
+// Entry is an entry in the replicated log.
+type Entry struct {
+	// Term is the election term in which the leader appended the entry.
+	Term int
+	// Value is the hash that the members agree upon, for example the root
+	// of a named tree.
+	// Leaders append an entry with a zero value at the start of their term.
+	Value cask.Hash
+	// Members, if not nil, changes the membership of the cluster to the
+	// given members, including the leader that appended the entry.
+	// An entry that changes the membership has a zero value.
+	Members []string
+}
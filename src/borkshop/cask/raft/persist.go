@@ -0,0 +1,100 @@
+package caskraft
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"borkshop/cask"
+
+	"go.uber.org/multierr"
+)
+
+// HardState is the state a member must remember across restarts, so that it
+// never votes twice in a term, nor forgets entries it acknowledged.
+type HardState struct {
+	// Term is the latest term the member has seen.
+	Term int
+	// Vote is the member it voted for in that term, if any.
+	Vote string
+	// Head is the hash of the block of the last entry of its log, or the zero
+	// hash for an empty log.
+	Head cask.Hash
+}
+
+// Persistence durably records the hard state of a member.
+type Persistence interface {
+	// Load returns the last saved state, or the zero state if none was ever
+	// saved.
+	Load() (HardState, error)
+	// Save records a state, and must not return until the state would
+	// survive a crash.
+	Save(HardState) error
+}
+
+// FilePersistence records the hard state of a member in a file.
+//
+// The file has a single line with the term, the hash of the head of the
+// log, and the quoted vote, separated by spaces.
+type FilePersistence struct {
+	Path string
+}
+
+var _ Persistence = (*FilePersistence)(nil)
+
+// Load reads the state from the file, returning the zero state if the file
+// does not exist.
+func (p *FilePersistence) Load() (HardState, error) {
+	var state HardState
+	buf, err := ioutil.ReadFile(p.Path)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return state, err
+	}
+	fields := strings.SplitN(strings.TrimSuffix(string(buf), "\n"), " ", 3)
+	if len(fields) != 3 {
+		return state, fmt.Errorf("corrupt raft state %q", p.Path)
+	}
+	if state.Term, err = strconv.Atoi(fields[0]); err != nil {
+		return state, fmt.Errorf("corrupt raft state %q: %v", p.Path, err)
+	}
+	if head, err := hex.DecodeString(fields[1]); err != nil || len(head) != len(state.Head) {
+		return state, fmt.Errorf("corrupt raft state %q: invalid head %q", p.Path, fields[1])
+	} else {
+		copy(state.Head[:], head)
+	}
+	if state.Vote, err = strconv.Unquote(fields[2]); err != nil {
+		return state, fmt.Errorf("corrupt raft state %q: %v", p.Path, err)
+	}
+	return state, nil
+}
+
+// Save writes the state to a temporary file, syncs it, and renames it over
+// the file, so the file always has either the prior or the new state.
+func (p *FilePersistence) Save(state HardState) error {
+	temp := p.Path + ".partial"
+	file, err := os.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(file, "%d %x %s\n", state.Term, state.Head, strconv.Quote(state.Vote))
+	err = multierr.Append(err, file.Sync())
+	err = multierr.Append(err, file.Close())
+	if err != nil {
+		return multierr.Append(err, os.Remove(temp))
+	}
+	if err := os.Rename(temp, p.Path); err != nil {
+		return err
+	}
+	// Sync the directory so that the rename survives a crash.
+	dir, err := os.Open(filepath.Dir(p.Path))
+	if err != nil {
+		return err
+	}
+	return multierr.Append(dir.Sync(), dir.Close())
+}
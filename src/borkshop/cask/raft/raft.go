@@ -2,9 +2,14 @@ package caskraft
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"math/rand"
 	"runtime"
 	"time"
+
+	"borkshop/cask"
+	"borkshop/cask/memstore"
 )
 
 // Network implementations enable an election to send messages to other peers.
@@ -14,6 +19,18 @@ type Network interface {
 	Send(Message)
 }
 
+// Machine is a replicated state machine, receiving the values of committed
+// log entries in order.
+type Machine interface {
+	// Apply applies a committed entry at an index of the log.
+	//
+	// Apply is called from the goroutine that runs the election, so it must
+	// not call methods of the election.
+	// The entries that leaders append at the start of their term, with zero
+	// values, are not applied, so indexes may skip.
+	Apply(index int, entry Entry)
+}
+
 // Logger tracks log messages for an election.
 type Logger interface {
 	// Transition indicates a state transition.
@@ -27,36 +44,71 @@ type Logger interface {
 	Drop(member string, state State, message Message)
 	// Timeout indicates that the member has set its next timeout.
 	Timeout(member string, state State, timeout time.Duration)
+	// Membership indicates that the membership of the cluster changed, by
+	// the member appending or discarding an entry of its log that changes
+	// the membership.
+	Membership(member string, state State, members []string)
 	// Error indicates that the election passed through an invalid state or
 	// received an invalid message.
 	Error(Error)
 }
 
+// maxEntries is the greatest number of entries a heartbeat carries.
+const maxEntries = 16
+
 // NewElection creates a new election.
 func NewElection(member string, members []string, capacity int, network Network, logger Logger) *Election {
-	timer := time.NewTimer(0)
-	if !timer.Stop() {
-		<-timer.C
-	}
 	return &Election{
 		member:    member,
-		members:   members,
+		initial:   members,
 		network:   network,
 		logger:    logger,
 		stopping:  make(chan struct{}, 0),
 		stopped:   make(chan struct{}, 0),
 		messages:  make(chan Message, capacity),
-		timer:     timer,
+		requests:  make(chan func(), 0),
 		timerRead: true,
 	}
 }
 
-// Election is the logical core of a RAFT election.
+// Election is the logical core of a RAFT election, and of the log that the
+// elected leader replicates to the other members.
 type Election struct {
+	// Store receives a block for every entry of the replicated log.
+	// Store defaults to an in-memory store.
+	Store cask.Store
+	// Machine, if not nil, receives every committed entry of the log.
+	// A restarted member applies its log again from the start, as it learns
+	// which entries are committed.
+	Machine Machine
+	// Clock provides the timers for elections and heartbeats.
+	// Clock defaults to the real time.
+	Clock Clock
+	// Rand, if not nil, chooses the random election timeouts.
+	// Rand must not be shared with other elections.
+	Rand *rand.Rand
+	// Joining indicates that the member is joining a cluster of the given
+	// members, so it does not count itself as a member, nor campaign, until
+	// the leader's log adds it.
+	Joining bool
+	// Persistence, if not nil, records the term, vote, and head of the log
+	// before the member sends any message that depends on them, and Start
+	// restores them, along with the log from the Store.
+	// A member that may restart must have a Persistence and a durable Store,
+	// or else it may vote twice in a term or forget entries it acknowledged.
+	Persistence Persistence
+
 	// Member is the address of our own peer.
 	member string
-	// Members are the addresses of other peers.
+	// Initial are the addresses of the other peers, until the log changes
+	// the membership.
+	initial []string
+	// Members are the addresses of the other peers in the current
+	// membership, and voting indicates that our own peer is a member.
 	members []string
+	voting  bool
+	// Membership is every member of the current membership.
+	membership []string
 	// Network is a pluggable implementation of a network protocol for sending
 	// messages to other peers.
 	network Network
@@ -64,13 +116,56 @@ type Election struct {
 	logger Logger
 
 	state     State
-	quorum    int
+	saved     HardState
+	voters    map[string]bool
+	log       raftLog
+	applied   int
+	next      map[string]int
+	match     map[string]int
 	messages  chan Message
-	timer     *time.Timer
+	requests  chan func()
+	timer     Timer
 	timerRead bool
 	start     time.Time
+	ctx       context.Context
+	cancel    context.CancelFunc
 	stopping  chan struct{}
 	stopped   chan struct{}
+	// final is the snapshot that the election leaves when it stops, for
+	// methods called after it stops.
+	final snapshot
+}
+
+// snapshot is the state of an election that its methods report.
+type snapshot struct {
+	state      State
+	membership []string
+	head       cask.Hash
+	index      int
+}
+
+// snapshot captures the state of the election.
+func (e *Election) snapshot() snapshot {
+	index, _ := e.log.last()
+	return snapshot{
+		state:      e.state,
+		membership: append([]string(nil), e.membership...),
+		head:       e.log.head(),
+		index:      index,
+	}
+}
+
+// read runs a function with a snapshot of the election, taken on the
+// goroutine that runs the election, or the final snapshot if the election has
+// stopped.
+func (e *Election) read(fn func(snapshot)) {
+	if err := e.do(context.Background(), func() {
+		fn(e.snapshot())
+	}); err != nil {
+		// The election has stopped, and left its final snapshot before it
+		// closed the stopped channel.
+		fn(e.final)
+	}
 }
 
 // Handle ingests a message from another member of the electorate.
@@ -83,93 +178,311 @@ func (e *Election) Handle(message Message) {
 	}
 }
 
-// Start begins running elections.
+// Start begins running elections, first restoring the state of the member
+// from its Persistence, if any.
 //
 // Other methods must not be called until Start returns.
 // Once Start returns, all other methods are safe to call concurrently.
 func (e *Election) Start(ctx context.Context) error {
-	e.start = time.Now()
-	e.quorum = (len(e.members) + 3) / 2
+	if err := e.setup(ctx); err != nil {
+		return err
+	}
 	e.resetElectionTimer()
 	go e.run()
 	return nil
 }
 
+// setup restores the state of the member and prepares to run.
+func (e *Election) setup(ctx context.Context) error {
+	if e.Clock == nil {
+		e.Clock = realClock{}
+	}
+	if e.Store == nil {
+		e.Store = caskmemstore.New()
+	}
+	if e.Persistence != nil {
+		saved, err := e.Persistence.Load()
+		if err != nil {
+			return err
+		}
+		if err := e.log.load(ctx, e.Store, saved.Head); err != nil {
+			return err
+		}
+		e.saved = saved
+		e.state = State{Type: Follower, Term: saved.Term, Vote: saved.Vote}
+	}
+	e.start = time.Now()
+	e.configure()
+	e.ctx, e.cancel = context.WithCancel(context.Background())
+	e.timer = e.Clock.NewTimer()
+	return nil
+}
+
 // Stop halts this election.
 func (e *Election) Stop(ctx context.Context) error {
 	close(e.stopping)
 	<-e.stopped
+	e.cancel()
 	return nil
 }
 
-func (e *Election) run() {
-Election:
-	for {
-		select {
-		case message := <-e.messages:
-			e.logger.Receive(e.member, e.state, message)
-
-			if message.Term > e.state.Term {
-				if message.Subject == Heartbeat {
-					e.transition(State{Type: Follower, Term: message.Term, Leader: message.From})
-					e.resetHeartbeatTimer()
-				} else {
-					e.transition(State{Type: Follower, Term: message.Term})
-					e.resetElectionTimer()
-				}
+// Propose appends a value to the replicated log, if this member is the
+// leader, returning the index and term of the new entry.
+//
+// The entry is committed once the Machine receives it, which may never
+// happen if this member loses its leadership before a majority of the
+// members have the entry.
+func (e *Election) Propose(ctx context.Context, value cask.Hash) (index, term int, err error) {
+	if value == cask.ZeroHash {
+		return 0, 0, errors.New("cannot propose the zero hash")
+	}
+	if doErr := e.do(ctx, func() {
+		index, term, err = e.propose(value)
+	}); doErr != nil {
+		return 0, 0, doErr
+	}
+	return index, term, err
+}
+
+func (e *Election) propose(value cask.Hash) (int, int, error) {
+	if e.state.Type != Leader {
+		return 0, 0, ErrNotLeader
+	}
+	entry := Entry{Term: e.state.Term, Value: value}
+	if err := e.log.append(e.ctx, e.Store, entry); err != nil {
+		return 0, 0, err
+	}
+	if err := e.persist(); err != nil {
+		return 0, 0, err
+	}
+	index, term := e.log.last()
+	e.advanceCommit()
+	for _, member := range e.members {
+		e.sendAppend(member)
+	}
+	return index, term, nil
+}
+
+// AddMember adds a member to the cluster, if this member is the leader,
+// returning the index and term of the entry that changes the membership.
+//
+// The new member should start Joining the current members.
+// A cluster changes its membership by one member at a time, so AddMember
+// returns ErrMembershipChange until the previous change commits.
+func (e *Election) AddMember(ctx context.Context, member string) (index, term int, err error) {
+	if doErr := e.do(ctx, func() {
+		index, term, err = e.addMember(member)
+	}); doErr != nil {
+		return 0, 0, doErr
+	}
+	return index, term, err
+}
+
+// RemoveMember removes a member from the cluster, if this member is the
+// leader, returning the index and term of the entry that changes the
+// membership.
+//
+// A leader may remove itself, in which case it leads until the change
+// commits, then steps down.
+// A removed member stops campaigning once it learns of its removal, and
+// should then stop.
+func (e *Election) RemoveMember(ctx context.Context, member string) (index, term int, err error) {
+	if doErr := e.do(ctx, func() {
+		index, term, err = e.removeMember(member)
+	}); doErr != nil {
+		return 0, 0, doErr
+	}
+	return index, term, err
+}
+
+// Members returns the addresses of every member of the cluster, as of the
+// last entry of this member's log that changes the membership.
+// Once the election stops, Members returns the membership as of the stop.
+func (e *Election) Members() []string {
+	var members []string
+	e.read(func(s snapshot) {
+		members = append([]string(nil), s.membership...)
+	})
+	return members
+}
+
+func (e *Election) addMember(member string) (int, int, error) {
+	return e.changeMembership(func(members []string) ([]string, error) {
+		if contains(members, member) {
+			return nil, fmt.Errorf("%s is already a member", member)
+		}
+		return append(members, member), nil
+	})
+}
+
+func (e *Election) removeMember(member string) (int, int, error) {
+	return e.changeMembership(func(members []string) ([]string, error) {
+		if !contains(members, member) {
+			return nil, fmt.Errorf("%s is not a member", member)
+		}
+		if len(members) == 1 {
+			return nil, errors.New("cannot remove the last member")
+		}
+		var remaining []string
+		for _, other := range members {
+			if other != member {
+				remaining = append(remaining, other)
 			}
+		}
+		return remaining, nil
+	})
+}
+
+// changeMembership appends an entry that changes the membership.
+//
+// Changing the membership one member at a time means that a majority of the
+// old members and a majority of the new members always overlap, so the
+// cluster cannot elect two leaders in a term while the change is under way.
+// The leader must have committed an entry in its own term before starting a
+// change, or else a change from a prior term could still be overridden.
+func (e *Election) changeMembership(change func([]string) ([]string, error)) (int, int, error) {
+	if e.state.Type != Leader {
+		return 0, 0, ErrNotLeader
+	}
+	if e.log.membership > e.state.Commit || e.log.term(e.state.Commit) != e.state.Term {
+		return 0, 0, ErrMembershipChange
+	}
+	members, err := change(append([]string(nil), e.membership...))
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := e.log.append(e.ctx, e.Store, Entry{Term: e.state.Term, Members: members}); err != nil {
+		return 0, 0, err
+	}
+	if err := e.persist(); err != nil {
+		return 0, 0, err
+	}
+	e.configure()
+	index, term := e.log.last()
+	e.advanceCommit()
+	e.heartbeat()
+	return index, term, nil
+}
 
-			switch message.Subject {
-			case RequestVote:
-				if e.state.Leader == "" {
-					e.transition(State{Type: Follower, Term: e.state.Term, Vote: message.From, NumVotes: e.state.NumVotes, Leader: e.state.Leader})
-					e.send(Message{Subject: Vote, To: message.From, From: e.member, Term: e.state.Term})
-				}
-
-			case Vote:
-				switch e.state.Type {
-				case Follower:
-					e.logger.Error(Error{Class: InvalidVote, Member: e.member, State: e.state, Message: message})
-				case Candidate:
-					// Receive vote
-					voteCount := e.state.NumVotes + 1
-					if voteCount == e.quorum {
-						e.transition(State{Type: Leader, Term: e.state.Term, Leader: e.member})
-						e.heartbeat()
-						e.resetHeartbeatTimer()
-					} else {
-						e.transition(State{Type: Follower, Term: e.state.Term, Vote: e.state.Vote, NumVotes: voteCount})
-					}
-				}
-
-			case Heartbeat:
-				e.transition(State{Type: Follower, Term: message.Term, Leader: message.From})
-				e.resetElectionTimer()
-
-			default:
-				e.logger.Error(Error{Class: InvalidSubject, Member: e.member, State: e.state, Message: message})
+// configure adopts the membership of the last entry of the log that changes
+// the membership, or the initial membership.
+// A member adopts a membership as soon as it appends the entry, without
+// waiting for it to commit.
+func (e *Election) configure() {
+	var membership []string
+	if e.log.membership > 0 {
+		membership = e.log.entries[e.log.membership-1].Members
+	} else {
+		if !e.Joining {
+			membership = append(membership, e.member)
+		}
+		membership = append(membership, e.initial...)
+	}
+	if e.membership != nil && equalMembers(membership, e.membership) {
+		return
+	}
+	first := e.membership == nil
 
+	e.membership = append([]string(nil), membership...)
+	e.voting = false
+	e.members = e.members[:0]
+	for _, member := range membership {
+		if member == e.member {
+			e.voting = true
+		} else {
+			e.members = append(e.members, member)
+		}
+	}
+	if e.state.Type == Leader {
+		lastIndex, _ := e.log.last()
+		next, match := e.next, e.match
+		e.next = make(map[string]int, len(e.members))
+		e.match = make(map[string]int, len(e.members))
+		for _, member := range e.members {
+			if n, ok := next[member]; ok {
+				e.next[member], e.match[member] = n, match[member]
+			} else {
+				e.next[member] = lastIndex + 1
 			}
+		}
+	}
+	if !first {
+		e.logger.Membership(e.member, e.state, append([]string(nil), e.membership...))
+	}
+}
 
-		case <-e.timer.C:
-			e.timerRead = true
-			switch e.state.Type {
-			case Candidate, Follower:
-				// New election
-				e.transition(State{Type: Candidate, Term: e.state.Term + 1, Vote: e.member, NumVotes: 1})
-				for _, member := range e.members {
-					e.send(Message{Subject: RequestVote, To: member, From: e.member, Term: e.state.Term})
-				}
-				e.resetElectionTimer()
+// majority reports whether a majority of the current members, including our
+// own peer if it is a member, satisfy a condition.
+func (e *Election) majority(has func(member string) bool) bool {
+	total, count := len(e.members), 0
+	if e.voting {
+		total++
+		if has(e.member) {
+			count++
+		}
+	}
+	for _, member := range e.members {
+		if has(member) {
+			count++
+		}
+	}
+	return count > total/2
+}
 
-			case Leader:
-				e.heartbeat()
-				e.resetHeartbeatTimer()
+// State returns the current state of this member.
+// Once the election stops, State returns the state as of the stop.
+func (e *Election) State() State {
+	var state State
+	e.read(func(s snapshot) {
+		state = s.state
+	})
+	return state
+}
 
-			default:
-				e.logger.Error(Error{Class: InvalidState, Member: e.member, State: e.state})
+// Head returns the hash of the block of the last entry in this member's log,
+// and its index, or the zero hash and 0 for an empty log.
+// LoadLog reads the entries back from the hash.
+//
+// The last entry is not necessarily committed.
+// Once the election stops, Head returns the head as of the stop.
+func (e *Election) Head() (cask.Hash, int) {
+	var head cask.Hash
+	var index int
+	e.read(func(s snapshot) {
+		head, index = s.head, s.index
+	})
+	return head, index
+}
 
-			}
+// do runs a function on the goroutine that runs the election.
+func (e *Election) do(ctx context.Context, fn func()) error {
+	done := make(chan struct{})
+	select {
+	case e.requests <- func() {
+		fn()
+		close(done)
+	}:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-e.stopped:
+		return ErrStopped
+	}
+	<-done
+	return nil
+}
+
+func (e *Election) run() {
+Election:
+	for {
+		select {
+		case message := <-e.messages:
+			e.receive(message)
+
+		case fn := <-e.requests:
+			fn()
+
+		case <-e.timer.C():
+			e.expire()
 
 		case <-e.stopping:
 			break Election
@@ -177,22 +490,308 @@ Election:
 
 		runtime.Gosched()
 	}
+	e.final = e.snapshot()
 	close(e.stopped)
 }
 
+// expire handles the expiry of the timer.
+func (e *Election) expire() {
+	e.timerRead = true
+	switch e.state.Type {
+	case Candidate, Follower:
+		e.campaign()
+
+	case Leader:
+		e.heartbeat()
+		e.resetHeartbeatTimer()
+
+	default:
+		e.logger.Error(Error{Class: InvalidState, Member: e.member, State: e.state})
+
+	}
+}
+
+func (e *Election) receive(message Message) {
+	e.logger.Receive(e.member, e.state, message)
+
+	if message.Subject == RequestVote && message.Term > e.state.Term && e.state.Leader != "" {
+		// A member that recognizes a leader ignores candidates until its own
+		// election timer expires, so that a removed member that does not
+		// know of its removal cannot disrupt the cluster with its terms.
+		return
+	}
+
+	if message.Term > e.state.Term {
+		e.transition(State{Type: Follower, Term: message.Term, Commit: e.state.Commit})
+		e.resetElectionTimer()
+	}
+
+	switch message.Subject {
+	case RequestVote:
+		e.receiveRequestVote(message)
+
+	case Vote:
+		e.receiveVote(message)
+
+	case Heartbeat:
+		e.receiveHeartbeat(message)
+
+	case Ack:
+		e.receiveAck(message)
+
+	default:
+		e.logger.Error(Error{Class: InvalidSubject, Member: e.member, State: e.state, Message: message})
+
+	}
+}
+
+// campaign starts a new election term, if this member is a member.
+//
+// A member that is not a member of its latest membership still campaigns
+// while the change that removed it is uncommitted, since its log may be the
+// only one with the change, though it does not vote for itself.
+func (e *Election) campaign() {
+	if !e.voting && e.log.membership <= e.state.Commit {
+		if e.state.Leader != "" {
+			e.transition(State{Type: Follower, Term: e.state.Term, Vote: e.state.Vote, Commit: e.state.Commit})
+		}
+		e.resetElectionTimer()
+		return
+	}
+	e.transition(State{Type: Candidate, Term: e.state.Term + 1, Vote: e.member, NumVotes: 1, Commit: e.state.Commit})
+	e.voters = map[string]bool{e.member: true}
+	lastIndex, lastTerm := e.log.last()
+	for _, member := range e.members {
+		e.send(Message{Subject: RequestVote, To: member, From: e.member, Term: e.state.Term, LogIndex: lastIndex, LogTerm: lastTerm})
+	}
+	e.resetElectionTimer()
+	if e.majority(e.voted) {
+		e.lead()
+	}
+}
+
+func (e *Election) voted(member string) bool {
+	return e.voters[member]
+}
+
+func (e *Election) receiveRequestVote(message Message) {
+	// Vote at most once per term, and only for a candidate whose log is at
+	// least as up to date as ours, so that the leader has every committed
+	// entry.
+	lastIndex, lastTerm := e.log.last()
+	if message.Term < e.state.Term ||
+		(e.state.Vote != "" && e.state.Vote != message.From) ||
+		message.LogTerm < lastTerm ||
+		(message.LogTerm == lastTerm && message.LogIndex < lastIndex) {
+		return
+	}
+	if e.state.Vote != message.From {
+		e.transition(State{Type: Follower, Term: e.state.Term, Vote: message.From, Commit: e.state.Commit})
+	}
+	e.resetElectionTimer()
+	e.send(Message{Subject: Vote, To: message.From, From: e.member, Term: e.state.Term})
+}
+
+func (e *Election) receiveVote(message Message) {
+	if message.Term < e.state.Term {
+		return
+	}
+	switch e.state.Type {
+	case Follower:
+		// A candidate that learns of the leader of its term before counting
+		// every vote may still receive them.
+		if e.state.Vote != e.member {
+			e.logger.Error(Error{Class: InvalidVote, Member: e.member, State: e.state, Message: message})
+		}
+	case Candidate:
+		if e.voters[message.From] {
+			return
+		}
+		e.voters[message.From] = true
+		state := e.state
+		state.NumVotes = len(e.voters)
+		e.transition(state)
+		if e.majority(e.voted) {
+			e.lead()
+		}
+	}
+}
+
+// lead assumes leadership for the current term.
+func (e *Election) lead() {
+	e.transition(State{Type: Leader, Term: e.state.Term, Leader: e.member, Vote: e.state.Vote, NumVotes: e.state.NumVotes, Commit: e.state.Commit})
+	lastIndex, _ := e.log.last()
+	e.next = make(map[string]int, len(e.members))
+	e.match = make(map[string]int, len(e.members))
+	for _, member := range e.members {
+		e.next[member] = lastIndex + 1
+	}
+	// A leader may only count replicas of entries from its own term toward
+	// committing, so it appends an empty entry to commit the entries of
+	// prior terms along with it.
+	// A leader that cannot append that entry could commit nothing, so it
+	// steps down and campaigns again once its election timer expires.
+	if err := e.log.append(e.ctx, e.Store, Entry{Term: e.state.Term}); err != nil {
+		e.logger.Error(Error{Class: StoreFailure, Member: e.member, State: e.state, Err: err})
+		e.voters = nil
+		e.transition(State{Type: Follower, Term: e.state.Term, Vote: e.state.Vote, Commit: e.state.Commit})
+		e.resetElectionTimer()
+		return
+	}
+	e.voters = nil
+	e.advanceCommit()
+	e.heartbeat()
+	e.resetHeartbeatTimer()
+}
+
+func (e *Election) receiveHeartbeat(message Message) {
+	if message.Term < e.state.Term {
+		// Inform the stale leader of the current term.
+		e.send(Message{Subject: Ack, To: message.From, From: e.member, Term: e.state.Term})
+		return
+	}
+	if e.state.Type == Leader {
+		e.logger.Error(Error{Class: InvalidState, Member: e.member, State: e.state, Message: message})
+		return
+	}
+	if e.state.Type != Follower || e.state.Leader != message.From {
+		e.transition(State{Type: Follower, Term: e.state.Term, Leader: message.From, Vote: e.state.Vote, Commit: e.state.Commit})
+	}
+	e.resetElectionTimer()
+
+	lastIndex, _ := e.log.last()
+	if message.LogIndex > lastIndex || e.log.term(message.LogIndex) != message.LogTerm {
+		// Suggest that the leader retry from before the conflicting term, or
+		// from the end of our log.
+		retry := lastIndex
+		if message.LogIndex <= lastIndex {
+			term := e.log.term(message.LogIndex)
+			retry = message.LogIndex - 1
+			for retry > e.state.Commit && e.log.term(retry) == term {
+				retry--
+			}
+		}
+		e.send(Message{Subject: Ack, To: message.From, From: e.member, Term: e.state.Term, Match: retry})
+		return
+	}
+
+	for i, entry := range message.Entries {
+		index := message.LogIndex + 1 + i
+		if index <= lastIndex && e.log.term(index) == entry.Term {
+			continue
+		}
+		if index <= e.state.Commit {
+			e.logger.Error(Error{Class: InvalidState, Member: e.member, State: e.state, Message: message})
+			return
+		}
+		e.log.truncate(index - 1)
+		err := e.log.append(e.ctx, e.Store, message.Entries[i:]...)
+		e.configure()
+		if err != nil {
+			e.logger.Error(Error{Class: StoreFailure, Member: e.member, State: e.state, Message: message, Err: err})
+			return
+		}
+		break
+	}
+
+	// Only the entries the leader sent are known to match, since any entries
+	// after them may remain from a prior term.
+	match := message.LogIndex + len(message.Entries)
+	if commit := min(message.Commit, match); commit > e.state.Commit {
+		e.commit(commit)
+	}
+	e.send(Message{Subject: Ack, To: message.From, From: e.member, Term: e.state.Term, Success: true, Match: match})
+}
+
+func (e *Election) receiveAck(message Message) {
+	if e.state.Type != Leader || message.Term != e.state.Term {
+		return
+	}
+	if _, ok := e.next[message.From]; !ok {
+		// The member was removed.
+		return
+	}
+	if message.Success {
+		if message.Match > e.match[message.From] {
+			e.match[message.From] = message.Match
+			e.advanceCommit()
+		}
+		if e.next[message.From] <= message.Match {
+			e.next[message.From] = message.Match + 1
+		}
+	} else if message.Match < e.next[message.From]-1 {
+		e.next[message.From] = max(message.Match, e.match[message.From]) + 1
+	} else {
+		return
+	}
+	// Continue replicating to a member that lags behind.
+	if lastIndex, _ := e.log.last(); e.next[message.From] <= lastIndex {
+		e.sendAppend(message.From)
+	}
+}
+
+// advanceCommit commits the last entry of the current term that a majority
+// of the members have.
+func (e *Election) advanceCommit() {
+	for index, _ := e.log.last(); index > e.state.Commit && e.log.term(index) == e.state.Term; index-- {
+		if e.majority(func(member string) bool {
+			return member == e.member || e.match[member] >= index
+		}) {
+			e.commit(index)
+			return
+		}
+	}
+}
+
+// commit advances the commit index and applies the newly committed entries.
+func (e *Election) commit(index int) {
+	state := e.state
+	state.Commit = index
+	e.transition(state)
+	for e.applied < e.state.Commit {
+		e.applied++
+		entry := e.log.entries[e.applied-1]
+		if e.Machine != nil && entry.Value != cask.ZeroHash {
+			e.Machine.Apply(e.applied, entry)
+		}
+	}
+	// A leader that removed itself steps down once the change commits.
+	if e.state.Type == Leader && !e.voting && e.log.membership <= e.state.Commit {
+		e.transition(State{Type: Follower, Term: e.state.Term, Vote: e.state.Vote, Commit: e.state.Commit})
+		e.resetElectionTimer()
+	}
+}
+
 func (e *Election) heartbeat() {
 	for _, member := range e.members {
-		e.send(Message{
-			Subject: Heartbeat,
-			From:    e.member,
-			To:      member,
-			Term:    e.state.Term,
-		})
+		e.sendAppend(member)
 	}
 }
 
+// sendAppend sends a heartbeat to a member with the entries it lacks.
+func (e *Election) sendAppend(member string) {
+	next := e.next[member]
+	e.send(Message{
+		Subject:  Heartbeat,
+		From:     e.member,
+		To:       member,
+		Term:     e.state.Term,
+		LogIndex: next - 1,
+		LogTerm:  e.log.term(next - 1),
+		Entries:  e.log.slice(next, maxEntries),
+		Commit:   e.state.Commit,
+	})
+}
+
 func (e *Election) resetElectionTimer() {
-	timeout := minElectionTimeout + time.Duration(rand.Int63n(int64(maxElectionTimeout-minElectionTimeout)))
+	spread := int64(maxElectionTimeout - minElectionTimeout)
+	var jitter int64
+	if e.Rand != nil {
+		jitter = e.Rand.Int63n(spread)
+	} else {
+		jitter = rand.Int63n(spread)
+	}
+	timeout := minElectionTimeout + time.Duration(jitter)
 	e.resetTimer(timeout)
 }
 
@@ -202,7 +801,7 @@ func (e *Election) resetHeartbeatTimer() {
 
 func (e *Election) resetTimer(timeout time.Duration) {
 	if !e.timer.Stop() && !e.timerRead {
-		<-e.timer.C
+		<-e.timer.C()
 	}
 	e.timerRead = false
 	e.timer.Reset(timeout)
@@ -215,6 +814,62 @@ func (e *Election) transition(state State) {
 }
 
 func (e *Election) send(message Message) {
+	if err := e.persist(); err != nil {
+		e.logger.Error(Error{Class: PersistenceFailure, Member: e.member, State: e.state, Message: message, Err: err})
+		return
+	}
 	e.logger.Send(e.member, e.state, message)
 	e.network.Send(message)
 }
+
+// persist saves the hard state of the member if it changed since it was last
+// saved.
+func (e *Election) persist() error {
+	if e.Persistence == nil {
+		return nil
+	}
+	state := HardState{Term: e.state.Term, Vote: e.state.Vote, Head: e.log.head()}
+	if state == e.saved {
+		return nil
+	}
+	if err := e.Persistence.Save(state); err != nil {
+		return err
+	}
+	e.saved = state
+	return nil
+}
+
+func contains(members []string, member string) bool {
+	for _, other := range members {
+		if other == member {
+			return true
+		}
+	}
+	return false
+}
+
+func equalMembers(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -2,20 +2,44 @@ package caskraft
 
 import (
 	"context"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"borkshop/cask"
+	"borkshop/cask/memstore"
+
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
-type fakeNetwork map[string]*Election
+// fakeNetwork delivers messages between elections in memory, and can crash
+// and restart its members.
+type fakeNetwork struct {
+	lock      sync.Mutex
+	elections map[string]*Election
+	members   map[string][]string
+	down      map[string]bool
+	logger    *testLogger
+}
 
-func newFakeNetwork(t *testing.T, count int) fakeNetwork {
-	fakeNetwork := make(fakeNetwork, count)
-	testLogger := &testLogger{
-		t:     t,
-		start: time.Now(),
+func newFakeNetwork(t *testing.T, count int) *fakeNetwork {
+	fakeNetwork := &fakeNetwork{
+		elections: make(map[string]*Election, count),
+		members:   make(map[string][]string, count),
+		down:      make(map[string]bool),
+		logger: &testLogger{
+			t:       t,
+			start:   time.Now(),
+			leaders: make(map[int]string),
+		},
 	}
 
 	for i := 0; i < count; i++ {
@@ -26,7 +50,8 @@ func newFakeNetwork(t *testing.T, count int) fakeNetwork {
 				members = append(members, name(j))
 			}
 		}
-		fakeNetwork[member] = NewElection(member, members, 10, fakeNetwork, testLogger)
+		fakeNetwork.members[member] = members
+		fakeNetwork.elections[member] = NewElection(member, members, 10, fakeNetwork, fakeNetwork.logger)
 	}
 
 	return fakeNetwork
@@ -34,32 +59,86 @@ func newFakeNetwork(t *testing.T, count int) fakeNetwork {
 
 func name(i int) string {
 	if i <= 26 {
-		return string('A' + i)
+		return string(rune('A' + i))
 	}
 	return strconv.Itoa(i)
 }
 
-func (n fakeNetwork) Start(ctx context.Context) error {
-	for _, election := range n {
+// each returns the elections of the members that are up, by member.
+func (n *fakeNetwork) each() map[string]*Election {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	elections := make(map[string]*Election, len(n.elections))
+	for member, election := range n.elections {
+		if !n.down[member] {
+			elections[member] = election
+		}
+	}
+	return elections
+}
+
+func (n *fakeNetwork) Start(ctx context.Context) error {
+	for _, election := range n.each() {
 		_ = election.Start(ctx) // TODO error merging and abort
 	}
 	return nil
 }
 
-func (n fakeNetwork) Stop(ctx context.Context) error {
-	for _, election := range n {
+func (n *fakeNetwork) Stop(ctx context.Context) error {
+	for _, election := range n.each() {
 		_ = election.Stop(ctx) // TODO error merging and abort
 	}
 	return nil
 }
 
-func (n fakeNetwork) Send(message Message) {
-	n[message.To].Handle(message)
+// crash stops a member and drops the messages sent to it until it restarts.
+func (n *fakeNetwork) crash(ctx context.Context, member string) error {
+	n.lock.Lock()
+	n.down[member] = true
+	election := n.elections[member]
+	n.lock.Unlock()
+	return election.Stop(ctx)
+}
+
+// restart starts a new election for a crashed member, configured like the
+// prior election, with a new machine.
+func (n *fakeNetwork) restart(ctx context.Context, member string, machine Machine) error {
+	n.lock.Lock()
+	prior := n.elections[member]
+	n.lock.Unlock()
+
+	election := NewElection(member, n.members[member], 10, n, n.logger)
+	election.Store = prior.Store
+	election.Persistence = prior.Persistence
+	election.Machine = machine
+	if err := election.Start(ctx); err != nil {
+		return err
+	}
+
+	n.lock.Lock()
+	n.elections[member] = election
+	n.down[member] = false
+	n.lock.Unlock()
+	return nil
+}
+
+func (n *fakeNetwork) Send(message Message) {
+	n.lock.Lock()
+	election, down := n.elections[message.To], n.down[message.To]
+	n.lock.Unlock()
+	if !down {
+		election.Handle(message)
+	}
 }
 
 type testLogger struct {
 	t     *testing.T
 	start time.Time
+
+	// leaders records the leader of each term, to check that no term ever
+	// has two.
+	lock    sync.Mutex
+	leaders map[int]string
 }
 
 func (l *testLogger) Receive(member string, state State, message Message) {
@@ -76,12 +155,24 @@ func (l *testLogger) Send(member string, state State, message Message) {
 
 func (l *testLogger) Transition(member string, next, prior State) {
 	l.log(member, next, "")
+	if next.Type == Leader {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		if leader, ok := l.leaders[next.Term]; ok && leader != member {
+			l.t.Errorf("%s and %s both lead term %d", leader, member, next.Term)
+		}
+		l.leaders[next.Term] = member
+	}
 }
 
 func (l *testLogger) Timeout(member string, state State, timeout time.Duration) {
 	l.log(member, state, " sleep %s", timeout)
 }
 
+func (l *testLogger) Membership(member string, state State, members []string) {
+	l.log(member, state, " members %v", members)
+}
+
 func (l *testLogger) Error(err Error) {
 	l.log(err.Member, err.State, " %v", err)
 	panic("protocol error")
@@ -102,7 +193,7 @@ func TestRaft(t *testing.T) {
 	network.Stop(context.Background())
 
 	leaders := 0
-	for _, member := range network {
+	for _, member := range network.each() {
 		assert.Equal(t, 1, member.state.Term)
 		if member.state.Type == Leader {
 			leaders++
@@ -110,3 +201,397 @@ func TestRaft(t *testing.T) {
 	}
 	assert.Equal(t, 1, leaders)
 }
+
+// recordingMachine records the entries applied to it.
+type recordingMachine struct {
+	lock   sync.Mutex
+	values []cask.Hash
+}
+
+func (m *recordingMachine) Apply(index int, entry Entry) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.values = append(m.values, entry.Value)
+}
+
+func (m *recordingMachine) applied() []cask.Hash {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]cask.Hash(nil), m.values...)
+}
+
+// leader waits for a member to win an election.
+func (n *fakeNetwork) leader(t *testing.T) *Election {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, election := range n.each() {
+			if election.State().Type == Leader {
+				return election
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no leader elected")
+	return nil
+}
+
+func TestReplication(t *testing.T) {
+	ctx := context.Background()
+	network := newFakeNetwork(t, 3)
+	machines := make(map[string]*recordingMachine)
+	for member, election := range network.each() {
+		machines[member] = &recordingMachine{}
+		election.Machine = machines[member]
+	}
+	network.Start(ctx)
+	defer network.Stop(ctx)
+
+	var want []cask.Hash
+	for i := 0; i < 40; i++ {
+		value := cask.Hash{byte(i + 1)}
+		for {
+			_, _, err := network.leader(t).Propose(ctx, value)
+			if err == ErrNotLeader {
+				continue
+			}
+			require.NoError(t, err)
+			break
+		}
+		want = append(want, value)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for member, machine := range machines {
+		for len(machine.applied()) < len(want) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, want, machine.applied(), member)
+	}
+
+	// Every member has the same log, which survives in the store.
+	leader := network.leader(t)
+	head, index := leader.Head()
+	entries, err := LoadLog(ctx, leader.Store, head)
+	require.NoError(t, err)
+	assert.Len(t, entries, index)
+	var values []cask.Hash
+	for _, entry := range entries {
+		if entry.Value != cask.ZeroHash {
+			values = append(values, entry.Value)
+		}
+	}
+	assert.Equal(t, want, values)
+	for member, election := range network.each() {
+		other, _ := election.Head()
+		assert.Equal(t, head, other, member)
+	}
+}
+
+// recordingNetwork records the messages an election sends.
+type recordingNetwork struct {
+	lock     sync.Mutex
+	messages []Message
+}
+
+func (n *recordingNetwork) Send(message Message) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.messages = append(n.messages, message)
+}
+
+// sent reports whether the election sent a message with the given subject
+// to a member.
+func (n *recordingNetwork) sent(subject Subject, to string) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for _, message := range n.messages {
+		if message.Subject == subject && message.To == to {
+			return true
+		}
+	}
+	return false
+}
+
+func TestVoteSurvivesRestart(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "caskraft")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	logger := &testLogger{t: t, start: time.Now(), leaders: make(map[int]string)}
+	persistence := &FilePersistence{Path: filepath.Join(dir, "state")}
+	store := caskmemstore.New()
+
+	network := &recordingNetwork{}
+	election := NewElection("A", []string{"B", "C"}, 10, network, logger)
+	election.Store = store
+	election.Persistence = persistence
+	require.NoError(t, election.Start(ctx))
+	election.Handle(Message{Subject: RequestVote, From: "B", To: "A", Term: 5})
+	deadline := time.Now().Add(time.Second)
+	for !network.sent(Vote, "B") && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	require.True(t, network.sent(Vote, "B"), "votes for B")
+	require.NoError(t, election.Stop(ctx))
+
+	saved, err := persistence.Load()
+	require.NoError(t, err)
+	assert.Equal(t, HardState{Term: 5, Vote: "B"}, saved)
+
+	// The restarted member remembers its vote and refuses another candidate
+	// in the same term.
+	network = &recordingNetwork{}
+	election = NewElection("A", []string{"B", "C"}, 10, network, logger)
+	election.Store = store
+	election.Persistence = persistence
+	require.NoError(t, election.Start(ctx))
+	defer election.Stop(ctx)
+	state := election.State()
+	assert.Equal(t, 5, state.Term)
+	assert.Equal(t, "B", state.Vote)
+	election.Handle(Message{Subject: RequestVote, From: "C", To: "A", Term: 5})
+	election.Handle(Message{Subject: RequestVote, From: "B", To: "A", Term: 5})
+	deadline = time.Now().Add(time.Second)
+	for !network.sent(Vote, "B") && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.True(t, network.sent(Vote, "B"), "votes for B again")
+	assert.False(t, network.sent(Vote, "C"), "does not vote for C")
+}
+
+func TestCrashRestart(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "caskraft")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	network := newFakeNetwork(t, 3)
+	var lock sync.Mutex
+	machines := make(map[string]*recordingMachine)
+	for member, election := range network.each() {
+		machines[member] = &recordingMachine{}
+		election.Machine = machines[member]
+		election.Store = caskmemstore.New()
+		election.Persistence = &FilePersistence{Path: filepath.Join(dir, member)}
+	}
+	network.Start(ctx)
+	defer network.Stop(ctx)
+
+	restart := func(member string) {
+		machine := &recordingMachine{}
+		lock.Lock()
+		machines[member] = machine
+		lock.Unlock()
+		require.NoError(t, network.restart(ctx, member, machine))
+	}
+
+	// committed waits for a value to reach the machine of any member.
+	committed := func(value cask.Hash) bool {
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			lock.Lock()
+			for _, machine := range machines {
+				for _, applied := range machine.applied() {
+					if applied == value {
+						lock.Unlock()
+						return true
+					}
+				}
+			}
+			lock.Unlock()
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+
+	random := rand.New(rand.NewSource(0))
+	var want []cask.Hash
+	for round := 0; round < 6; round++ {
+		value := cask.Hash{byte(round + 1)}
+		for {
+			if _, _, err := network.leader(t).Propose(ctx, value); err == nil && committed(value) {
+				break
+			} else if err != nil && err != ErrNotLeader {
+				require.NoError(t, err)
+			}
+		}
+		want = append(want, value)
+
+		// Crash the leader, then crash a candidate in the ensuing election,
+		// and restart both.
+		leader := network.leader(t).member
+		require.NoError(t, network.crash(ctx, leader))
+		crashed := []string{leader}
+		deadline := time.Now().Add(time.Second)
+	Campaign:
+		for time.Now().Before(deadline) {
+			for member, election := range network.each() {
+				if election.State().Type == Candidate {
+					require.NoError(t, network.crash(ctx, member))
+					crashed = append(crashed, member)
+					break Campaign
+				}
+			}
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(time.Duration(random.Int63n(int64(maxElectionTimeout))))
+		for _, member := range crashed {
+			restart(member)
+		}
+	}
+
+	// Every member eventually applies the same committed values, in order,
+	// from the logs they recovered.
+	deadline := time.Now().Add(5 * time.Second)
+	for member := range network.each() {
+		for time.Now().Before(deadline) {
+			lock.Lock()
+			applied := machines[member].applied()
+			lock.Unlock()
+			if len(applied) >= len(want) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		lock.Lock()
+		assert.Equal(t, want, machines[member].applied(), member)
+		lock.Unlock()
+	}
+}
+
+func TestMembership(t *testing.T) {
+	ctx := context.Background()
+	network := newFakeNetwork(t, 4)
+	machines := make(map[string]*recordingMachine)
+	for member, election := range network.each() {
+		machines[member] = &recordingMachine{}
+		election.Machine = machines[member]
+		if member == "D" {
+			election.Joining = true
+			election.initial = []string{"A", "B", "C"}
+		} else {
+			election.initial = nil
+			for _, other := range []string{"A", "B", "C"} {
+				if other != member {
+					election.initial = append(election.initial, other)
+				}
+			}
+		}
+	}
+	network.Start(ctx)
+	defer network.Stop(ctx)
+
+	// retry calls a function on the leader until it is not rejected for
+	// want of leadership or a prior change.
+	retry := func(f func(*Election) error) *Election {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			leader := network.leader(t)
+			err := f(leader)
+			if err == nil {
+				return leader
+			}
+			require.True(t, err == ErrNotLeader || err == ErrMembershipChange, "%v", err)
+			require.True(t, time.Now().Before(deadline), "timed out")
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	propose := func(value cask.Hash) {
+		retry(func(leader *Election) error {
+			_, _, err := leader.Propose(ctx, value)
+			return err
+		})
+	}
+	// converge waits for the given members to apply the same values.
+	converge := func(members []string, want []cask.Hash) {
+		deadline := time.Now().Add(5 * time.Second)
+		for _, member := range members {
+			for len(machines[member].applied()) < len(want) && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			assert.Equal(t, want, machines[member].applied(), member)
+		}
+	}
+
+	propose(cask.Hash{1})
+	converge([]string{"A", "B", "C"}, []cask.Hash{{1}})
+	assert.Empty(t, machines["D"].applied(), "D is not yet a member")
+
+	// D joins, and receives the entire log.
+	retry(func(leader *Election) error {
+		_, _, err := leader.AddMember(ctx, "D")
+		return err
+	})
+	propose(cask.Hash{2})
+	converge([]string{"A", "B", "C", "D"}, []cask.Hash{{1}, {2}})
+
+	// The leader removes itself, and the others elect a new leader among
+	// themselves.
+	removed := retry(func(leader *Election) error {
+		_, _, err := leader.RemoveMember(ctx, leader.member)
+		return err
+	}).member
+	var remaining []string
+	for _, member := range []string{"A", "B", "C", "D"} {
+		if member != removed {
+			remaining = append(remaining, member)
+		}
+	}
+	propose(cask.Hash{3})
+	converge(remaining, []cask.Hash{{1}, {2}, {3}})
+	for _, member := range remaining {
+		assert.ElementsMatch(t, remaining, network.each()[member].Members(), member)
+	}
+	assert.NotEqual(t, removed, network.leader(t).member)
+}
+
+// failingStore fails to store any block.
+type failingStore struct{}
+
+func (failingStore) Store(context.Context, cask.Hash, *cask.Block) error {
+	return errors.New("disk full")
+}
+
+func (failingStore) Load(context.Context, cask.Hash, *cask.Block) error {
+	return os.ErrNotExist
+}
+
+// storeFailureLogger counts store failures rather than failing the test.
+type storeFailureLogger struct {
+	*testLogger
+	failures int32
+}
+
+func (l *storeFailureLogger) Error(err Error) {
+	if err.Class != StoreFailure {
+		l.testLogger.Error(err)
+	}
+	atomic.AddInt32(&l.failures, 1)
+}
+
+func TestLeaderStepsDownOnStoreFailure(t *testing.T) {
+	ctx := context.Background()
+	logger := &storeFailureLogger{testLogger: &testLogger{t: t, start: time.Now(), leaders: make(map[int]string)}}
+	election := NewElection("A", nil, 10, &recordingNetwork{}, logger)
+	election.Store = failingStore{}
+	require.NoError(t, election.Start(ctx))
+
+	// The lone member wins every election, but cannot append the entry that
+	// begins its term, so it never stays the leader.
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&logger.failures) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.True(t, atomic.LoadInt32(&logger.failures) >= 2, "campaigns again")
+	require.NoError(t, election.Stop(ctx))
+
+	// Once stopped, the election reports its final state.
+	state := election.State()
+	assert.Equal(t, Follower, state.Type)
+	assert.True(t, state.Term >= 2)
+	assert.Equal(t, []string{"A"}, election.Members())
+	head, index := election.Head()
+	assert.Equal(t, cask.ZeroHash, head)
+	assert.Equal(t, 0, index)
+}
@@ -0,0 +1,330 @@
+package caskraft
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"borkshop/cask"
+)
+
+// simulation runs elections on a simulated clock and network, driving every
+// member from a single goroutine, so that a run depends only on its seed.
+type simulation struct {
+	seed      int64
+	rand      *rand.Rand
+	now       time.Duration
+	events    simEvents
+	sequence  int
+	members   []string
+	elections map[string]*Election
+	machines  map[string]*recordingMachine
+	errs      []string
+
+	// loss is the probability that the network drops a message, and
+	// maxDelay bounds the delay of a message, which reorders messages that
+	// follow one another closely.
+	loss     float64
+	maxDelay time.Duration
+	// side partitions the members, dropping messages between members on
+	// different sides.
+	side map[string]int
+
+	leaders map[int]string
+	votes   map[voteKey]string
+}
+
+type voteKey struct {
+	voter string
+	term  int
+}
+
+// simEvent is either the delivery of a message or the expiry of a timer.
+type simEvent struct {
+	at       time.Duration
+	sequence int
+	message  *Message
+	timer    *simTimer
+	gen      int
+}
+
+type simEvents []simEvent
+
+func (e simEvents) Len() int { return len(e) }
+func (e simEvents) Less(i, j int) bool {
+	if e[i].at != e[j].at {
+		return e[i].at < e[j].at
+	}
+	return e[i].sequence < e[j].sequence
+}
+func (e simEvents) Swap(i, j int)       { e[i], e[j] = e[j], e[i] }
+func (e *simEvents) Push(x interface{}) { *e = append(*e, x.(simEvent)) }
+func (e *simEvents) Pop() interface{} {
+	old := *e
+	event := old[len(old)-1]
+	*e = old[:len(old)-1]
+	return event
+}
+
+// simTimer is a timer on the simulated clock.
+// Every reset or stop advances its generation, so that the events of prior
+// generations do not fire.
+type simTimer struct {
+	sim     *simulation
+	member  string
+	gen     int
+	pending bool
+}
+
+func (t *simTimer) C() <-chan time.Time {
+	return nil
+}
+
+func (t *simTimer) Stop() bool {
+	pending := t.pending
+	t.pending = false
+	t.gen++
+	return pending
+}
+
+func (t *simTimer) Reset(d time.Duration) bool {
+	pending := t.Stop()
+	t.pending = true
+	t.sim.schedule(simEvent{at: t.sim.now + d, timer: t, gen: t.gen})
+	return pending
+}
+
+func (s *simulation) NewTimer() Timer {
+	return &simTimer{sim: s}
+}
+
+// newSimulation creates a simulation of a cluster with the given number of
+// initial members, and a number of spare members that may join it.
+func newSimulation(seed int64, count, spares int) *simulation {
+	s := &simulation{
+		seed:      seed,
+		rand:      rand.New(rand.NewSource(seed)),
+		elections: make(map[string]*Election, count),
+		machines:  make(map[string]*recordingMachine, count),
+		side:      make(map[string]int, count),
+		leaders:   make(map[int]string),
+		votes:     make(map[voteKey]string),
+	}
+	for i := 0; i < count+spares; i++ {
+		s.members = append(s.members, name(i))
+	}
+	for i, member := range s.members {
+		others := make([]string, 0, count)
+		for j, other := range s.members[:count] {
+			if j != i {
+				others = append(others, other)
+			}
+		}
+		election := NewElection(member, others, 0, s, simLogger{s})
+		election.Joining = i >= count
+		election.Clock = s
+		election.Rand = rand.New(rand.NewSource(s.rand.Int63()))
+		s.machines[member] = &recordingMachine{}
+		election.Machine = s.machines[member]
+		if err := election.setup(context.Background()); err != nil {
+			panic(err)
+		}
+		election.timer.(*simTimer).member = member
+		election.resetElectionTimer()
+		s.elections[member] = election
+	}
+	return s
+}
+
+func (s *simulation) schedule(event simEvent) {
+	s.sequence++
+	event.sequence = s.sequence
+	heap.Push(&s.events, event)
+}
+
+// Send delivers a message after a random delay, unless the network loses it
+// or a partition separates its sender and recipient.
+func (s *simulation) Send(message Message) {
+	if s.side[message.From] != s.side[message.To] || s.rand.Float64() < s.loss {
+		return
+	}
+	delay := time.Duration(s.rand.Int63n(int64(s.maxDelay) + 1))
+	s.schedule(simEvent{at: s.now + delay, message: &message})
+}
+
+// run processes events until the simulated clock reaches a time.
+func (s *simulation) run(until time.Duration) {
+	for len(s.events) > 0 && s.events[0].at <= until {
+		event := heap.Pop(&s.events).(simEvent)
+		s.now = event.at
+		if event.message != nil {
+			s.elections[event.message.To].receive(*event.message)
+		} else if event.timer.pending && event.gen == event.timer.gen {
+			event.timer.pending = false
+			s.elections[event.timer.member].expire()
+		}
+	}
+	s.now = until
+}
+
+// partition randomly divides the members into two sides, or heals the
+// network.
+func (s *simulation) partition() {
+	heal := s.rand.Intn(2) == 0
+	for _, member := range s.members {
+		s.side[member] = 0
+		if !heal {
+			s.side[member] = s.rand.Intn(2)
+		}
+	}
+}
+
+// propose proposes a value to a random member, which only accepts it if it
+// leads.
+func (s *simulation) propose(value cask.Hash) {
+	member := s.members[s.rand.Intn(len(s.members))]
+	_, _, _ = s.elections[member].propose(value)
+}
+
+// change adds or removes a random member through a random member, which
+// only accepts the change if it leads and no other change is under way.
+func (s *simulation) change() {
+	election := s.elections[s.members[s.rand.Intn(len(s.members))]]
+	member := s.members[s.rand.Intn(len(s.members))]
+	if contains(election.membership, member) {
+		_, _, _ = election.removeMember(member)
+	} else {
+		_, _, _ = election.addMember(member)
+	}
+}
+
+func (s *simulation) errorf(format string, args ...interface{}) {
+	s.errs = append(s.errs, fmt.Sprintf("at %s: ", s.now)+fmt.Sprintf(format, args...))
+}
+
+// check verifies that the members that applied committed entries applied
+// the same entries in the same order.
+func (s *simulation) check() {
+	var longest []cask.Hash
+	for _, machine := range s.machines {
+		if applied := machine.applied(); len(applied) > len(longest) {
+			longest = applied
+		}
+	}
+	for member, machine := range s.machines {
+		for i, value := range machine.applied() {
+			if longest[i] != value {
+				s.errorf("%s applied %x at %d but another member applied %x", member, value[:4], i, longest[i][:4])
+				break
+			}
+		}
+	}
+}
+
+// simLogger checks the invariants of every transition and vote.
+type simLogger struct {
+	s *simulation
+}
+
+func (l simLogger) Transition(member string, next, prior State) {
+	if next.Type == Leader && prior.Type != Leader {
+		if leader, ok := l.s.leaders[next.Term]; ok && leader != member {
+			l.s.errorf("%s and %s both lead term %d", leader, member, next.Term)
+		}
+		l.s.leaders[next.Term] = member
+	}
+	if next.Term < prior.Term {
+		l.s.errorf("%s went back from term %d to %d", member, prior.Term, next.Term)
+	}
+}
+
+func (l simLogger) Send(member string, state State, message Message) {
+	if message.Subject != Vote {
+		return
+	}
+	key := voteKey{voter: member, term: message.Term}
+	if candidate, ok := l.s.votes[key]; ok && candidate != message.To {
+		l.s.errorf("%s voted for both %s and %s in term %d", member, candidate, message.To, message.Term)
+	}
+	l.s.votes[key] = message.To
+}
+
+func (l simLogger) Error(err Error) {
+	l.s.errorf("%s %s: %v", err.Member, err.State, err)
+}
+
+func (simLogger) Receive(string, State, Message)       {}
+func (simLogger) Drop(string, State, Message)          {}
+func (simLogger) Timeout(string, State, time.Duration) {}
+func (simLogger) Membership(string, State, []string)   {}
+
+func TestSimulation(t *testing.T) {
+	runs := 1000
+	if testing.Short() {
+		runs = 100
+	}
+	for seed := int64(1); seed <= int64(runs); seed++ {
+		s := newSimulation(seed, 3+int(seed%3), 2)
+		s.maxDelay = time.Duration(s.rand.Intn(50)) * time.Millisecond
+		loss := s.rand.Float64() * 0.3
+		s.loss = loss
+
+		// Turbulence: loss, delay, reordering, and partitions, with
+		// proposals throughout.
+		value := 0
+		for step := 0; step < 100; step++ {
+			if s.rand.Intn(10) == 0 {
+				s.partition()
+			}
+			if s.rand.Intn(10) == 0 {
+				s.change()
+			}
+			if s.rand.Intn(3) == 0 {
+				value++
+				s.propose(cask.Hash{byte(value), byte(value >> 8), 0xff})
+			}
+			s.run(s.now + 100*time.Millisecond)
+		}
+
+		// Calm: a healed and reliable network elects a leader that commits
+		// an entry of its own term, so every member applies the same entries.
+		for _, member := range s.members {
+			s.side[member] = 0
+		}
+		s.loss = 0
+		s.run(s.now + 5*time.Second)
+		// Members removed while partitioned may never learn of it, and so
+		// may still believe they lead an older term.
+		var leader *Election
+		for _, election := range s.elections {
+			if election.state.Type == Leader && (leader == nil || election.state.Term > leader.state.Term) {
+				leader = election
+			}
+		}
+		if leader == nil {
+			s.errorf("no leader after the network healed")
+		} else {
+			var lengths []int
+			for _, member := range leader.membership {
+				lengths = append(lengths, len(s.machines[member].applied()))
+			}
+			for _, n := range lengths {
+				if n != lengths[0] {
+					s.errorf("members %v applied different numbers of entries %v after the network healed", leader.membership, lengths)
+					break
+				}
+			}
+		}
+		s.check()
+
+		if len(s.errs) > 0 {
+			t.Errorf("seed %d with %d members, %s delay, %.2f loss:", seed, len(s.members), s.maxDelay, loss)
+			for _, err := range s.errs {
+				t.Error(err)
+			}
+		}
+	}
+}
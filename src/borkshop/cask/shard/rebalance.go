@@ -0,0 +1,114 @@
+package caskshard
+
+import (
+	"context"
+	"fmt"
+
+	"borkshop/cask"
+	"borkshop/cask/io"
+)
+
+// RebalanceConfig captures the parameters of a rebalance.
+type RebalanceConfig struct {
+	// Roots are the hashes to move to their new replicas along with their
+	// transitive links.
+	Roots []cask.Hash
+
+	// Prune removes each block from the nodes that no longer hold a replica
+	// of it, if they implement cask.Remover.
+	// Other blocks that the nodes retain may still link a pruned block, so
+	// prune only nodes that serve the sharded store alone.
+	Prune bool
+}
+
+// RebalanceReport summarizes a rebalance.
+type RebalanceReport struct {
+	// Blocks is the number of blocks reachable from the roots.
+	Blocks int
+	// Copied is the number of replicas written to nodes that lacked them.
+	Copied int
+	// Pruned is the number of replicas removed from nodes that no longer
+	// hold them.
+	Pruned int
+}
+
+// Rebalance copies every block reachable from the roots from the replicas
+// that the prior store places it on to the replicas that the next store
+// places it on, skipping replicas that already contain the block.
+//
+// Nodes that do not implement cask.Checker receive every block they hold.
+func (c RebalanceConfig) Rebalance(ctx context.Context, prior, next *Store) (*RebalanceReport, error) {
+	r := &rebalancer{
+		config: c,
+		prior:  prior,
+		next:   next,
+		seen:   make(map[cask.Hash]struct{}),
+		report: &RebalanceReport{},
+	}
+	for _, root := range c.Roots {
+		if err := r.rebalance(ctx, root); err != nil {
+			return r.report, err
+		}
+	}
+	return r.report, nil
+}
+
+type rebalancer struct {
+	config      RebalanceConfig
+	prior, next *Store
+	seen        map[cask.Hash]struct{}
+	report      *RebalanceReport
+}
+
+func (r *rebalancer) rebalance(ctx context.Context, hash cask.Hash) error {
+	if _, ok := r.seen[hash]; ok {
+		return nil
+	}
+	r.seen[hash] = struct{}{}
+	r.report.Blocks++
+
+	var block cask.Block
+	if err := r.prior.Load(ctx, hash, &block); err != nil {
+		return err
+	}
+
+	// Links move before the blocks that link them, so that the next store
+	// never holds a block without its subtree.
+	for _, link := range block.Links() {
+		if err := r.rebalance(ctx, link); err != nil {
+			return err
+		}
+	}
+
+	placed := make(map[string]struct{}, r.next.replicas)
+	for _, node := range r.next.Place(hash) {
+		placed[node.Name] = struct{}{}
+		have, err := caskio.Has(ctx, node.Store, []cask.Hash{hash})
+		if err != nil {
+			return fmt.Errorf("failed to check block %x on %s: %v", hash, node.Name, err)
+		}
+		if have[0] {
+			continue
+		}
+		if err := node.Store.Store(ctx, hash, &block); err != nil {
+			return fmt.Errorf("failed to store block %x on %s: %v", hash, node.Name, err)
+		}
+		r.report.Copied++
+	}
+
+	if !r.config.Prune {
+		return nil
+	}
+	for _, node := range r.prior.Place(hash) {
+		if _, ok := placed[node.Name]; ok {
+			continue
+		}
+		if remover, ok := node.Store.(cask.Remover); ok {
+			if err := remover.Remove(ctx, hash); err != nil {
+				return fmt.Errorf("failed to remove block %x from %s: %v", hash, node.Name, err)
+			}
+			r.report.Pruned++
+		}
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+// Package caskshard provides a content address store that spreads blocks
+// across several backing stores, such as disk directories or remote peers,
+// and keeps several replicas of every block.
+//
+// The store places blocks with consistent hashing.
+// Every node owns many points on a ring of 64 bit positions, and a block
+// belongs to the nodes that own the first points at or after the position of
+// its hash, wrapping around the ring.
+// Adding or removing a node moves only the blocks that the node gains or
+// loses, and a rebalance copies those blocks to their new replicas.
+package caskshard
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	"borkshop/cask"
+
+	"go.uber.org/multierr"
+)
+
+// pointsPerNode is the number of points each node owns on the ring, which
+// evens out the share of blocks each node receives.
+const pointsPerNode = 64
+
+// ErrNoNodes indicates that a store has no nodes to place blocks on.
+var ErrNoNodes = errors.New("sharded store requires at least one node")
+
+// Node is a backing store and the name that determines its place on the
+// ring, typically its address.
+type Node struct {
+	Name  string
+	Store cask.Store
+}
+
+// Store is a CAS block store that writes every block to several of its
+// nodes, and reads every block from whichever of them answers first.
+type Store struct {
+	nodes    []Node
+	replicas int
+	ring     []point
+}
+
+var _ cask.Store = (*Store)(nil)
+var _ cask.Checker = (*Store)(nil)
+
+// point is a position on the ring and the index of the node that owns it.
+type point struct {
+	position uint64
+	node     int
+}
+
+// New returns a store that places each block on the given number of its
+// nodes, or on every node if there are fewer.
+//
+// Two stores with nodes of the same names place blocks alike.
+func New(nodes []Node, replicas int) (*Store, error) {
+	if len(nodes) == 0 {
+		return nil, ErrNoNodes
+	}
+	if replicas < 1 {
+		replicas = 1
+	}
+	if replicas > len(nodes) {
+		replicas = len(nodes)
+	}
+
+	s := &Store{
+		nodes:    append([]Node(nil), nodes...),
+		replicas: replicas,
+		ring:     make([]point, 0, len(nodes)*pointsPerNode),
+	}
+	names := make(map[string]struct{}, len(nodes))
+	for i, node := range nodes {
+		if _, ok := names[node.Name]; ok {
+			return nil, fmt.Errorf("sharded store has two nodes named %q", node.Name)
+		}
+		names[node.Name] = struct{}{}
+		for j := 0; j < pointsPerNode; j++ {
+			sum := sha256.Sum256([]byte(node.Name + "\n" + strconv.Itoa(j)))
+			s.ring = append(s.ring, point{
+				position: binary.BigEndian.Uint64(sum[:8]),
+				node:     i,
+			})
+		}
+	}
+	sort.Slice(s.ring, func(i, j int) bool {
+		if s.ring[i].position != s.ring[j].position {
+			return s.ring[i].position < s.ring[j].position
+		}
+		return s.nodes[s.ring[i].node].Name < s.nodes[s.ring[j].node].Name
+	})
+	return s, nil
+}
+
+// Nodes returns the nodes of the store.
+func (s *Store) Nodes() []Node {
+	return append([]Node(nil), s.nodes...)
+}
+
+// Place returns the nodes that hold the replicas of a block, in order of
+// preference.
+func (s *Store) Place(h cask.Hash) []Node {
+	position := binary.BigEndian.Uint64(h[:8])
+	start := sort.Search(len(s.ring), func(i int) bool {
+		return s.ring[i].position >= position
+	})
+
+	nodes := make([]Node, 0, s.replicas)
+	placed := make(map[int]bool, s.replicas)
+	for i := 0; len(nodes) < s.replicas; i++ {
+		point := s.ring[(start+i)%len(s.ring)]
+		if !placed[point.node] {
+			placed[point.node] = true
+			nodes = append(nodes, s.nodes[point.node])
+		}
+	}
+	return nodes
+}
+
+// Store writes a block to every one of its replicas, concurrently, and fails
+// if any of them fails.
+func (s *Store) Store(ctx context.Context, h cask.Hash, b *cask.Block) error {
+	nodes := s.Place(h)
+	errs := make([]error, len(nodes))
+	var wg sync.WaitGroup
+	wg.Add(len(nodes))
+	for i, node := range nodes {
+		go func(i int, node Node) {
+			defer wg.Done()
+			if err := node.Store.Store(ctx, h, b); err != nil {
+				errs[i] = fmt.Errorf("failed to store block %x on %s: %v", h, node.Name, err)
+			}
+		}(i, node)
+	}
+	wg.Wait()
+	return multierr.Combine(errs...)
+}
+
+// Load reads a block from its replicas, concurrently, and returns the block
+// from the first replica that answers.
+//
+// Load fails only if every replica fails.
+func (s *Store) Load(ctx context.Context, h cask.Hash, b *cask.Block) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		block cask.Block
+		err   error
+	}
+	nodes := s.Place(h)
+	results := make(chan *result, len(nodes))
+	for _, node := range nodes {
+		go func(node Node) {
+			r := &result{}
+			if err := node.Store.Load(ctx, h, &r.block); err != nil {
+				r.err = fmt.Errorf("failed to load block %x from %s: %v", h, node.Name, err)
+			}
+			results <- r
+		}(node)
+	}
+
+	var err error
+	for range nodes {
+		r := <-results
+		if r.err == nil {
+			*b = r.block
+			return nil
+		}
+		err = multierr.Append(err, r.err)
+	}
+	return err
+}
+
+// Has reports, for each hash, whether any replica of the block contains it.
+//
+// Nodes that do not implement cask.Checker contain none of the blocks.
+func (s *Store) Has(ctx context.Context, hs []cask.Hash) ([]bool, error) {
+	// Ask each node at once about all of the blocks it should hold.
+	asks := make(map[int][]int, len(s.nodes))
+	index := make(map[string]int, len(s.nodes))
+	for i, node := range s.nodes {
+		index[node.Name] = i
+	}
+	for i, h := range hs {
+		for _, node := range s.Place(h) {
+			n := index[node.Name]
+			asks[n] = append(asks[n], i)
+		}
+	}
+
+	have := make([]bool, len(hs))
+	for n, indexes := range asks {
+		checker, ok := s.nodes[n].Store.(cask.Checker)
+		if !ok {
+			continue
+		}
+		batch := make([]cask.Hash, len(indexes))
+		for j, i := range indexes {
+			batch[j] = hs[i]
+		}
+		found, err := checker.Has(ctx, batch)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check blocks on %s: %v", s.nodes[n].Name, err)
+		}
+		for j, i := range indexes {
+			have[i] = have[i] || found[j]
+		}
+	}
+	return have, nil
+}
@@ -0,0 +1,170 @@
+package caskshard_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"borkshop/cask"
+	"borkshop/cask/dir"
+	"borkshop/cask/io"
+	"borkshop/cask/memstore"
+	"borkshop/cask/shard"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/osfs"
+)
+
+func newNodes(n int) []caskshard.Node {
+	nodes := make([]caskshard.Node, n)
+	for i := range nodes {
+		nodes[i] = caskshard.Node{
+			Name:  fmt.Sprintf("127.0.0.1:%d", 1024+i),
+			Store: caskmemstore.New(),
+		}
+	}
+	return nodes
+}
+
+// holders returns the names of the nodes that contain a block.
+func holders(t *testing.T, nodes []caskshard.Node, h cask.Hash) []string {
+	var names []string
+	for _, node := range nodes {
+		have, err := caskio.Has(context.Background(), node.Store, []cask.Hash{h})
+		require.NoError(t, err)
+		if have[0] {
+			names = append(names, node.Name)
+		}
+	}
+	return names
+}
+
+func names(nodes []caskshard.Node) []string {
+	names := make([]string, len(nodes))
+	for i, node := range nodes {
+		names[i] = node.Name
+	}
+	return names
+}
+
+func TestPlace(t *testing.T) {
+	nodes := newNodes(5)
+	store, err := caskshard.New(nodes, 2)
+	require.NoError(t, err)
+
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		b := cask.Block{0, 0, 0, 2, byte(i), byte(i >> 8)}
+		placed := store.Place(b.Hash())
+		require.Len(t, placed, 2)
+		assert.NotEqual(t, placed[0].Name, placed[1].Name)
+		for _, node := range placed {
+			counts[node.Name]++
+		}
+	}
+	for _, node := range nodes {
+		assert.InDelta(t, 400, counts[node.Name], 150, "share of %s", node.Name)
+	}
+
+	// Adding a node moves only the blocks that it gains.
+	grown, err := caskshard.New(append(nodes, newNodes(6)[5]), 2)
+	require.NoError(t, err)
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		b := cask.Block{0, 0, 0, 2, byte(i), byte(i >> 8)}
+		before, after := names(store.Place(b.Hash())), names(grown.Place(b.Hash()))
+		for _, name := range after {
+			if name != "127.0.0.1:1029" {
+				assert.Contains(t, before, name)
+			} else {
+				moved++
+			}
+		}
+	}
+	assert.InDelta(t, 333, moved, 150)
+}
+
+func TestNew(t *testing.T) {
+	_, err := caskshard.New(nil, 1)
+	assert.Equal(t, caskshard.ErrNoNodes, err)
+
+	nodes := newNodes(2)
+	_, err = caskshard.New(append(nodes, nodes[0]), 1)
+	assert.Error(t, err)
+
+	store, err := caskshard.New(nodes, 3)
+	require.NoError(t, err)
+	assert.Len(t, store.Place(cask.Hash{}), 2, "replicas are limited to the nodes")
+}
+
+func TestStoreAndLoad(t *testing.T) {
+	ctx := context.Background()
+	nodes := newNodes(4)
+	store, err := caskshard.New(nodes, 2)
+	require.NoError(t, err)
+
+	hash, err := caskdir.Store(ctx, store, osfs.New(".."), "testdata/nominal")
+	require.NoError(t, err)
+	bom, err := caskio.BOM(ctx, store, hash)
+	require.NoError(t, err)
+	for h := range bom {
+		assert.ElementsMatch(t, names(store.Place(h)), holders(t, nodes, h))
+	}
+
+	have, err := store.Has(ctx, []cask.Hash{hash, {1}})
+	require.NoError(t, err)
+	assert.Equal(t, []bool{true, false}, have)
+
+	// A load succeeds while any replica answers, even if another replica
+	// waits for the block forever.
+	placed := store.Place(hash)
+	lossy := make([]caskshard.Node, len(nodes))
+	for i, node := range nodes {
+		lossy[i] = node
+		if node.Name == placed[0].Name {
+			lossy[i].Store = caskmemstore.New()
+		}
+	}
+	store, err = caskshard.New(lossy, 2)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	err = caskdir.Load(ctx, store, memfs.New(), ".", hash)
+	assert.NoError(t, err)
+}
+
+func TestRebalance(t *testing.T) {
+	ctx := context.Background()
+	nodes := newNodes(4)
+	prior, err := caskshard.New(nodes[:3], 2)
+	require.NoError(t, err)
+	hash, err := caskdir.Store(ctx, prior, osfs.New(".."), "testdata/nominal")
+	require.NoError(t, err)
+	bom, err := caskio.BOM(ctx, prior, hash)
+	require.NoError(t, err)
+
+	// The next store adds a node and drops another.
+	next, err := caskshard.New(nodes[1:], 2)
+	require.NoError(t, err)
+	report, err := caskshard.RebalanceConfig{
+		Roots: []cask.Hash{hash},
+		Prune: true,
+	}.Rebalance(ctx, prior, next)
+	require.NoError(t, err)
+	assert.Equal(t, len(bom), report.Blocks)
+	assert.NotZero(t, report.Copied)
+	assert.NotZero(t, report.Pruned)
+
+	for h := range bom {
+		assert.ElementsMatch(t, names(next.Place(h)), holders(t, nodes, h))
+	}
+	err = caskdir.Load(ctx, next, memfs.New(), ".", hash)
+	assert.NoError(t, err)
+
+	// A second rebalance has nothing to do.
+	report, err = caskshard.RebalanceConfig{Roots: []cask.Hash{hash}}.Rebalance(ctx, next, next)
+	require.NoError(t, err)
+	assert.Equal(t, 0, report.Copied)
+}
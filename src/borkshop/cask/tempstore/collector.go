@@ -3,12 +3,15 @@ package casktempstore
 import (
 	"container/heap"
 	"context"
-	"fmt"
+	"errors"
 	"time"
 
 	"borkshop/cask"
 )
 
+var errNoDeadline = errors.New("temporary store requires a context deadline")
+
+// collector orders the stored blocks by deadline.
 type collector struct {
 	deadlines map[cask.Hash]deadline
 	heap      []cask.Hash
@@ -30,7 +33,7 @@ func newCollector() *collector {
 func (c *collector) Touch(ctx context.Context, hash cask.Hash) error {
 	time, ok := ctx.Deadline()
 	if !ok {
-		return fmt.Errorf("temporary store requires a context deadline")
+		return errNoDeadline
 	}
 	if other, ok := c.deadlines[hash]; ok {
 		// Update
@@ -54,27 +57,42 @@ func (c *collector) Touch(ctx context.Context, hash cask.Hash) error {
 	return nil
 }
 
-func (c *collector) Collect(cells map[cask.Hash]*cell) {
+// Collect stops tracking the blocks whose deadlines have passed, and returns
+// their hashes.
+func (c *collector) Collect() []cask.Hash {
 	now := time.Now() // TODO parameterize for tests
+	var expired []cask.Hash
 	for len(c.heap) > 0 {
 		hash := c.heap[0]
-		deadline := c.deadlines[hash]
-		if deadline.time.Before(now) {
-			last := len(c.heap) - 1
-			if last > 0 {
-				c.Swap(0, last)
-			}
+		if !c.deadlines[hash].time.Before(now) {
+			break
+		}
+		c.Remove(hash)
+		expired = append(expired, hash)
+	}
+	return expired
+}
 
-			c.heap = c.heap[:last]
-			delete(c.deadlines, hash)
-			delete(cells, hash)
+// Oldest returns the hash of the block with the nearest deadline.
+// The collector must track at least one block.
+func (c *collector) Oldest() cask.Hash {
+	return c.heap[0]
+}
 
-			if len(c.heap) > 0 {
-				heap.Fix(c, 0)
-			}
-		} else {
-			return
-		}
+// Remove stops tracking a block.
+func (c *collector) Remove(hash cask.Hash) {
+	deadline, ok := c.deadlines[hash]
+	if !ok {
+		return
+	}
+	last := len(c.heap) - 1
+	if deadline.index != last {
+		c.Swap(deadline.index, last)
+	}
+	c.heap = c.heap[:last]
+	delete(c.deadlines, hash)
+	if deadline.index < last {
+		heap.Fix(c, deadline.index)
 	}
 }
 
@@ -1,8 +1,10 @@
 // Package casktempstore provides an ephemeral in-memory content address store
 // implementation.
 //
-// This store collects cells if after the deadline expires for all load or
+// This store collects a block after the deadlines expire for all load or
 // store calls that refer to it.
+// A bounded store also collects the blocks with the nearest deadlines early
+// to stay within its capacity.
 package casktempstore
 
 import (
@@ -14,87 +16,185 @@ import (
 
 // New returns a simple, in-memory, 1KB blockwise temporary content address store.
 func New() *Store {
+	return NewBounded(0)
+}
+
+// NewBounded returns an in-memory, 1KB blockwise temporary content address
+// store that retains at most the given number of blocks, evicting the block
+// with the nearest deadline to make room for another.
+// Zero capacity retains every block until its deadline.
+func NewBounded(capacity int) *Store {
 	return &Store{
+		capacity:  capacity,
 		cells:     make(map[cask.Hash]*cell),
 		collector: newCollector(),
 	}
 }
 
 // Store is a simple, in-memory, 1KB blockwise content address store.
+//
+// Every call that stores or loads a block requires a context with a
+// deadline.
+// Loads of a block that the store lacks wait for the block to be stored,
+// until their context expires.
 type Store struct {
-	lock      sync.Mutex
-	cells     map[cask.Hash]*cell
+	lock     sync.Mutex
+	capacity int
+	cells    map[cask.Hash]*cell
+	// collector tracks the deadline of every stored block.
 	collector *collector
+	stats     Stats
 }
 
-// Store captures a block in memory.
-func (store *Store) Store(ctx context.Context, hash cask.Hash, block *cask.Block) error {
-	cell, err := store.cell(ctx, hash)
-	if err != nil {
-		return err
-	}
+var _ cask.Store = (*Store)(nil)
+var _ cask.Checker = (*Store)(nil)
+var _ cask.Remover = (*Store)(nil)
 
-	cell.store(ctx, hash, block)
-	return nil
+// Stats counts the blocks of a store and the outcomes of its loads.
+type Stats struct {
+	// Blocks is the number of blocks the store holds.
+	Blocks int
+	// Pending is the number of blocks that loads are waiting for.
+	Pending int
+	// Hits is the number of loads that found their block.
+	Hits int
+	// Misses is the number of loads that waited for their block to be
+	// stored, whether or not it arrived before their context expired.
+	Misses int
+	// Evictions is the number of blocks discarded before their deadlines to
+	// stay within capacity.
+	Evictions int
+	// Expirations is the number of blocks discarded after their deadlines.
+	Expirations int
 }
 
-// Load retrieves a block from memory.
-func (store *Store) Load(ctx context.Context, hash cask.Hash, block *cask.Block) error {
-	cell, err := store.cell(ctx, hash)
-	if err != nil {
-		return err
-	}
-	return cell.load(ctx, hash, block)
+// cell captures a block, or the loads waiting for it.
+type cell struct {
+	block  cask.Block // write-once, then close(ready)
+	stored bool
+	// waiters is the number of loads waiting for the block.
+	// The last to give up removes the cell.
+	waiters int
+	ready   chan struct{}
 }
 
-func (store *Store) cell(ctx context.Context, hash cask.Hash) (*cell, error) {
+// Store captures a block in memory until the context's deadline, or a later
+// deadline of another call for the same block.
+func (store *Store) Store(ctx context.Context, hash cask.Hash, block *cask.Block) error {
 	store.lock.Lock()
 	defer store.lock.Unlock()
 
+	store.collect()
 	if err := store.collector.Touch(ctx, hash); err != nil {
-		return nil, err
+		return err
 	}
-	store.collector.Collect(store.cells)
 
-	cell, ok := store.cells[hash]
+	c, ok := store.cells[hash]
+	if ok && c.stored {
+		return nil
+	}
 	if !ok {
-		cell = newCell()
-		store.cells[hash] = cell
+		c = &cell{}
+		store.cells[hash] = c
+	}
+	c.block = *block
+	c.stored = true
+	if c.ready != nil {
+		close(c.ready)
 	}
-	return cell, nil
-}
 
-func (cell *cell) store(ctx context.Context, hash cask.Hash, block *cask.Block) {
-	cell.lock.Lock()
-	cell.block = *block
-	if !cell.stored {
-		cell.stored = true
-		close(cell.ready)
+	for store.capacity > 0 && store.collector.Len() > store.capacity {
+		oldest := store.collector.Oldest()
+		store.collector.Remove(oldest)
+		delete(store.cells, oldest)
+		store.stats.Evictions++
 	}
-	cell.lock.Unlock()
+	return nil
 }
 
-func (cell *cell) load(ctx context.Context, hash cask.Hash, block *cask.Block) error {
+// Load retrieves a block from memory, waiting for the block to be stored if
+// necessary, and retains the block at least until the context's deadline.
+func (store *Store) Load(ctx context.Context, hash cask.Hash, block *cask.Block) error {
+	if _, ok := ctx.Deadline(); !ok {
+		return errNoDeadline
+	}
+
+	store.lock.Lock()
+	store.collect()
+	c, ok := store.cells[hash]
+	if ok && c.stored {
+		err := store.collector.Touch(ctx, hash)
+		store.stats.Hits++
+		*block = c.block
+		store.lock.Unlock()
+		return err
+	}
+	store.stats.Misses++
+	if !ok {
+		c = &cell{ready: make(chan struct{})}
+		store.cells[hash] = c
+	}
+	c.waiters++
+	ready := c.ready
+	store.lock.Unlock()
+
 	select {
+	case <-ready:
+		*block = c.block
+		return nil
 	case <-ctx.Done():
+		store.lock.Lock()
+		c.waiters--
+		if c.waiters == 0 && !c.stored && store.cells[hash] == c {
+			delete(store.cells, hash)
+		}
+		store.lock.Unlock()
 		return ctx.Err()
-	case <-cell.ready:
 	}
+}
+
+// Has reports whether each block is in memory.
+func (store *Store) Has(_ context.Context, hashes []cask.Hash) ([]bool, error) {
+	have := make([]bool, len(hashes))
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.collect()
+	for i, hash := range hashes {
+		c, ok := store.cells[hash]
+		have[i] = ok && c.stored
+	}
+	return have, nil
+}
 
-	*block = cell.block
+// Remove discards a block from memory before its deadline.
+//
+// Loads waiting for the block to be stored continue to wait.
+func (store *Store) Remove(_ context.Context, hash cask.Hash) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if c, ok := store.cells[hash]; ok && c.stored {
+		store.collector.Remove(hash)
+		delete(store.cells, hash)
+	}
 	return nil
 }
 
-// cell captures a block and synchronizes concurrent reads and writes.
-type cell struct {
-	lock   sync.RWMutex
-	block  cask.Block // write-once, then close(ready)
-	stored bool       // close(ready) only once
-	ready  chan struct{}
+// Stats returns the number of blocks the store holds and awaits, and counts
+// of the outcomes of its loads.
+func (store *Store) Stats() Stats {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.collect()
+	stats := store.stats
+	stats.Blocks = store.collector.Len()
+	stats.Pending = len(store.cells) - stats.Blocks
+	return stats
 }
 
-func newCell() *cell {
-	return &cell{
-		ready: make(chan struct{}, 0),
+// collect discards the blocks whose deadlines have passed.
+func (store *Store) collect() {
+	for _, hash := range store.collector.Collect() {
+		delete(store.cells, hash)
+		store.stats.Expirations++
 	}
 }
@@ -9,6 +9,7 @@ import (
 
 	"borkshop/cask"
 	"borkshop/cask/tempstore"
+	"borkshop/cask/test"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -73,7 +74,7 @@ func TestTempStoreLoadThenStore(t *testing.T) {
 		ctx := context.Background()
 		ctx, cancel := context.WithTimeout(ctx, time.Second)
 		defer cancel()
-		err = store.Store(ctx, h, &b)
+		err := store.Store(ctx, h, &b)
 		assert.NoError(t, err)
 
 		wg.Done()
@@ -88,3 +89,96 @@ func TestTempStoreLoadThenStore(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestTempStoreStress(t *testing.T) {
+	store := casktempstore.NewBounded(4096)
+	config := casktest.StressStoreConfig{
+		Concurrency: 50,
+		Duration:    200 * time.Millisecond,
+		Timeout:     time.Second,
+		Unique:      true,
+	}
+	report := config.Stress(store)
+	stats := store.Stats()
+	assert.Equal(t, 0, report.WriteErrors, "write errors")
+	assert.Equal(t, 0, report.DataErrors, "data integrity errors")
+	assert.NotEqual(t, 0, report.Cycles, "no cycles")
+	// A worker may lose its block to eviction between writing and reading.
+	assert.True(t, report.ReadErrors <= stats.Evictions, "%d read errors without eviction", report.ReadErrors)
+	assert.True(t, stats.Blocks <= 4096, "%d blocks exceed capacity", stats.Blocks)
+	assert.Equal(t, 0, stats.Pending)
+}
+
+func TestTempStoreEviction(t *testing.T) {
+	b1, b2, b3 := cask.Block{1}, cask.Block{2}, cask.Block{3}
+	h1, h2, h3 := b1.Hash(), b2.Hash(), b3.Hash()
+	ctx := context.Background()
+	later, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	sooner, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	store := casktempstore.NewBounded(2)
+	assert.NoError(t, store.Store(later, h1, &b1))
+	assert.NoError(t, store.Store(sooner, h2, &b2))
+	// The second block has the nearest deadline.
+	assert.NoError(t, store.Store(later, h3, &b3))
+
+	have, err := store.Has(ctx, []cask.Hash{h1, h2, h3})
+	assert.NoError(t, err)
+	assert.Equal(t, []bool{true, false, true}, have)
+	assert.Equal(t, casktempstore.Stats{Blocks: 2, Evictions: 1}, store.Stats())
+}
+
+func TestTempStoreExpiration(t *testing.T) {
+	b := cask.Block{1}
+	h := b.Hash()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	store := casktempstore.New()
+	assert.NoError(t, store.Store(ctx, h, &b))
+	<-ctx.Done()
+	time.Sleep(10 * time.Millisecond)
+
+	have, err := store.Has(context.Background(), []cask.Hash{h})
+	assert.NoError(t, err)
+	assert.Equal(t, []bool{false}, have)
+	assert.Equal(t, casktempstore.Stats{Expirations: 1}, store.Stats())
+}
+
+func TestTempStoreAbandonedLoad(t *testing.T) {
+	b := cask.Block{1}
+	h := b.Hash()
+	store := casktempstore.New()
+
+	// A load that gives up leaves nothing behind.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	assert.Error(t, store.Load(ctx, h, &cask.Block{}))
+	assert.Equal(t, casktempstore.Stats{Misses: 1}, store.Stats())
+
+	// A load that gives up does not disturb another that waits.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	impatient, cancelImpatient := context.WithTimeout(context.Background(), time.Minute)
+	patient, cancelPatient := context.WithTimeout(context.Background(), time.Minute)
+	defer cancelPatient()
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, context.Canceled, store.Load(impatient, h, &cask.Block{}))
+	}()
+	go func() {
+		defer wg.Done()
+		var got cask.Block
+		assert.NoError(t, store.Load(patient, h, &got))
+		assert.Equal(t, b, got)
+	}()
+	for store.Stats().Misses < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	cancelImpatient()
+	assert.NoError(t, store.Store(patient, h, &b))
+	wg.Wait()
+	assert.Equal(t, casktempstore.Stats{Blocks: 1, Misses: 3}, store.Stats())
+}
@@ -0,0 +1,50 @@
+package casktest
+
+import (
+	"context"
+	"sync/atomic"
+
+	"borkshop/cask"
+	"borkshop/cask/memstore"
+)
+
+// CountingStore is an in-memory store that counts the blocks loaded from and
+// stored to it, for tests of how often other code uses a store.
+type CountingStore struct {
+	*caskmemstore.MemStore
+	loads  int64
+	stores int64
+}
+
+// NewCountingStore returns an empty counting store.
+func NewCountingStore() *CountingStore {
+	return &CountingStore{MemStore: caskmemstore.New()}
+}
+
+// Load counts and loads a block.
+func (s *CountingStore) Load(ctx context.Context, h cask.Hash, b *cask.Block) error {
+	atomic.AddInt64(&s.loads, 1)
+	return s.MemStore.Load(ctx, h, b)
+}
+
+// Store counts and stores a block.
+func (s *CountingStore) Store(ctx context.Context, h cask.Hash, b *cask.Block) error {
+	atomic.AddInt64(&s.stores, 1)
+	return s.MemStore.Store(ctx, h, b)
+}
+
+// Loads returns the number of blocks loaded since the last reset.
+func (s *CountingStore) Loads() int64 {
+	return atomic.LoadInt64(&s.loads)
+}
+
+// Stores returns the number of blocks stored since the last reset.
+func (s *CountingStore) Stores() int64 {
+	return atomic.LoadInt64(&s.stores)
+}
+
+// Reset zeroes the counts.
+func (s *CountingStore) Reset() {
+	atomic.StoreInt64(&s.loads, 0)
+	atomic.StoreInt64(&s.stores, 0)
+}
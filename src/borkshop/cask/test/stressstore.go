@@ -21,12 +21,18 @@ func (r *StressStoreReport) merge(s *StressStoreReport) {
 	r.Cycles += s.Cycles
 	r.WriteErrors += s.WriteErrors
 	r.ReadErrors += s.ReadErrors
-	r.DataErrors += s.ReadErrors
+	r.DataErrors += s.DataErrors
 }
 
 type StressStoreConfig struct {
 	Concurrency int
 	Duration    time.Duration
+	// Timeout, if not zero, bounds each cycle of writing and reading, which
+	// also gives stores that require a deadline, like casktempstore, one.
+	Timeout time.Duration
+	// Unique writes a different string in every cycle, so that the store
+	// accumulates blocks, rather than writing the same block concurrently.
+	Unique bool
 }
 
 func (c StressStoreConfig) Stress(store cask.Store) *StressStoreReport {
@@ -35,7 +41,7 @@ func (c StressStoreConfig) Stress(store cask.Store) *StressStoreReport {
 	reports := make(chan *StressStoreReport, 0)
 
 	for i := 0; i < c.Concurrency; i++ {
-		go worker(done, reports, store)
+		go c.worker(i, done, reports, store)
 	}
 
 	time.Sleep(c.Duration)
@@ -47,39 +53,53 @@ func (c StressStoreConfig) Stress(store cask.Store) *StressStoreReport {
 	return report
 }
 
-func worker(done <-chan struct{}, reports chan<- *StressStoreReport, store cask.Store) {
+func (c StressStoreConfig) worker(id int, done <-chan struct{}, reports chan<- *StressStoreReport, store cask.Store) {
 	report := &StressStoreReport{}
 	defer func() {
 		reports <- report
 	}()
 
-	ctx := context.Background()
-	for {
+	for cycle := 0; ; cycle++ {
 		select {
 		case <-done:
 			return
 		default:
 		}
 
-		hash, err := caskblob.WriteString(ctx, store, str)
-		if err != nil {
-			fmt.Printf("%v\n", err)
-			report.WriteErrors++
-			continue
+		want := str
+		if c.Unique {
+			want = fmt.Sprintf("%s %d %d", str, id, cycle)
 		}
+		c.cycle(want, store, report)
+	}
+}
 
-		rst, err := caskblob.ReadString(ctx, store, hash)
-		if err != nil {
-			fmt.Printf("%v\n", err)
-			report.ReadErrors++
-			continue
-		}
+func (c StressStoreConfig) cycle(want string, store cask.Store, report *StressStoreReport) {
+	ctx := context.Background()
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
 
-		if rst != str {
-			report.DataErrors++
-			continue
-		}
+	hash, err := caskblob.WriteString(ctx, store, want)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		report.WriteErrors++
+		return
+	}
 
-		report.Cycles++
+	got, err := caskblob.ReadString(ctx, store, hash)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		report.ReadErrors++
+		return
 	}
+
+	if got != want {
+		report.DataErrors++
+		return
+	}
+
+	report.Cycles++
 }